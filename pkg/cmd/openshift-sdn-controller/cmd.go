@@ -1,16 +1,28 @@
 package openshift_sdn_controller
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/spf13/cobra"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 
 	"github.com/openshift/library-go/pkg/serviceability"
+	sdnmaster "github.com/openshift/sdn/pkg/network/master"
 )
 
 type OpenShiftNetworkController struct {
 	platformType string
 	nodeName     string
+
+	masterOptions sdnmaster.Options
+	// Flags that are converted into masterOptions by Validate
+	nodeIPProbePort             int
+	hostSubnetAnnotations       map[string]string
+	hostSubnetDeletePropagation string
+	tracingEndpoint             string
 }
 
 func NewOpenShiftNetworkControllerCommand(name string) *cobra.Command {
@@ -36,16 +48,60 @@ func NewOpenShiftNetworkControllerCommand(name string) *cobra.Command {
 	flags := cmd.Flags()
 	flags.StringVar(&options.nodeName, "node-name", "", "The node name that openshift-sdn controller resides on")
 	flags.StringVar(&options.platformType, "platform-type", "", "The cloud provider platform type openshift-sdn is deployed on")
+
+	mo := &options.masterOptions
+	flags.StringVar(&mo.EventComponent, "event-component", "", "The source component of the controller's events (default \"openshift-network-controller\")")
+	flags.Uint32Var(&mo.SubnetAllocationOffset, "subnet-allocation-offset", 0, "The number of subnets at the start of each cluster network range to reserve for external use")
+	flags.StringToIntVar(&mo.SubnetRangePriorities, "subnet-range-priorities", nil, "Allocation priorities of cluster network ranges, as CIDR=priority; higher-priority ranges are used up first")
+	flags.StringVar(&mo.SubnetRangeLabel, "subnet-range-label", "", "A node label whose value selects the cluster network range the node's subnet is allocated from")
+	flags.StringToStringVar(&mo.SubnetRangesByLabel, "subnet-ranges-by-label", nil, "The cluster network range for each value of --subnet-range-label, as value=CIDR")
+	flags.BoolVar(&mo.SubnetRangeFallback, "subnet-range-fallback", false, "Allocate from any range when a node's range is full")
+	flags.IntVar(&options.nodeIPProbePort, "node-ip-probe-port", 0, "If set, check that nodes are reachable on this TCP port before assigning them subnets")
+	flags.BoolVar(&mo.BlockUnreachableNodeIPs, "block-unreachable-node-ips", false, "Don't assign subnets to nodes that fail the --node-ip-probe-port check")
+	flags.BoolVar(&mo.CheckNodeIPsAreLocal, "check-node-ips-local", false, "Report node IPs that are not IPs of the local host")
+	flags.BoolVar(&mo.CheckHostNetworksOnStart, "check-host-networks-on-start", false, "Warn at startup about local host networks that conflict with the cluster network")
+	flags.BoolVar(&mo.CheckEgressIPsOnNodeSubnets, "check-egress-ips-on-node-subnets", false, "Warn about egress IPs that are not on their node's egress interface subnet")
+	flags.BoolVar(&mo.DisableNetworkUnavailableClear, "keep-network-unavailable-condition", false, "Don't clear the NetworkUnavailable node condition")
+	flags.StringSliceVar(&mo.NetworkUnavailableReasons, "network-unavailable-reasons", nil, "Additional NetworkUnavailable condition reasons to clear")
+	flags.Uint64Var(&mo.SubnetLowThreshold, "subnet-low-threshold", 0, "Report ranges with fewer than this many free subnets")
+	flags.Uint64Var(&mo.SubnetLowThresholdPercent, "subnet-low-threshold-percent", 0, "Report ranges with less than this percentage of their subnets free")
+	flags.IntVar(&mo.MaxHostSubnets, "max-hostsubnets", 0, "The maximum number of HostSubnets to allocate (0 for no limit)")
+	flags.StringToStringVar(&options.hostSubnetAnnotations, "hostsubnet-annotations", nil, "Annotations to add to every new HostSubnet, as key=value")
+	flags.StringVar(&options.hostSubnetDeletePropagation, "hostsubnet-delete-propagation", "", "The propagation policy for HostSubnet deletions (Orphan, Background, or Foreground)")
+	flags.StringVar(&options.tracingEndpoint, "tracing-endpoint", "", "If set, the OTLP gRPC endpoint to send subnet operation traces to")
+	flags.DurationVar(&mo.DeferSubnetDeleteTimeout, "defer-subnet-delete-timeout", 0, "If set, defer deleting a deleted node's HostSubnet while pods remain on it, for at most this long")
+	flags.BoolVar(&mo.FixHostSubnetHostMismatch, "fix-hostsubnet-host-mismatch", false, "Correct node-backed HostSubnets whose host doesn't match their name")
+	flags.BoolVar(&mo.RequireDrainForNodeIPChange, "require-drain-for-node-ip-change", false, "Don't update a node's HostSubnet for a new node IP while it has running pods")
+	flags.BoolVar(&mo.AnnotateNodeSubnet, "annotate-node-subnet", false, "Record each node's subnet in an annotation on the node")
+	flags.DurationVar(&mo.SubnetStatsReportInterval, "subnet-stats-report-interval", 0, "If set, write the subnet allocator state to a ConfigMap on changes and at least this often")
+	flags.StringVar(&mo.SubnetStatsNamespace, "subnet-stats-namespace", "", "The namespace of the subnet allocator state ConfigMap")
+	flags.StringVar(&mo.SubnetStatsName, "subnet-stats-name", "", "The name of the subnet allocator state ConfigMap")
+	flags.DurationVar(&mo.SubnetSelfHealInterval, "subnet-self-heal-interval", 0, "If set, look for nodes without HostSubnets this often")
 	return cmd
 }
 
 func (o *OpenShiftNetworkController) Validate() error {
+	if o.nodeIPProbePort != 0 {
+		o.masterOptions.NodeIPProber = sdnmaster.NewTCPNodeIPProber(o.nodeIPProbePort, 5*time.Second)
+	} else if o.masterOptions.BlockUnreachableNodeIPs {
+		return fmt.Errorf("--block-unreachable-node-ips requires --node-ip-probe-port")
+	}
+	if len(o.hostSubnetAnnotations) > 0 {
+		o.masterOptions.AnnotationDecorator = sdnmaster.StaticAnnotationDecorator(o.hostSubnetAnnotations)
+	}
+	switch policy := metav1.DeletionPropagation(o.hostSubnetDeletePropagation); policy {
+	case "":
+	case metav1.DeletePropagationOrphan, metav1.DeletePropagationBackground, metav1.DeletePropagationForeground:
+		o.masterOptions.HostSubnetDeletePropagation = &policy
+	default:
+		return fmt.Errorf("invalid --hostsubnet-delete-propagation %q", o.hostSubnetDeletePropagation)
+	}
 	return nil
 }
 
 // StartNetworkController calls RunOpenShiftNetworkController and then waits forever
 func (o *OpenShiftNetworkController) StartNetworkController() error {
-	if err := RunOpenShiftNetworkController(o.platformType, o.nodeName); err != nil {
+	if err := RunOpenShiftNetworkController(o.platformType, o.nodeName, o.tracingEndpoint, o.masterOptions); err != nil {
 		return err
 	}
 
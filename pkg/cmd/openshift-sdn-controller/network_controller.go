@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -26,9 +28,17 @@ import (
 	_ "k8s.io/component-base/metrics/prometheus/version"
 )
 
-func RunOpenShiftNetworkController(platformType, nodeName string) error {
+func RunOpenShiftNetworkController(platformType, nodeName, tracingEndpoint string, masterOptions sdnmaster.Options) error {
 	serviceability.InitLogrusFromKlog()
 
+	if tracingEndpoint != "" {
+		exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(tracingEndpoint), otlptracegrpc.WithInsecure())
+		if err != nil {
+			return fmt.Errorf("failed to create trace exporter: %v", err)
+		}
+		masterOptions.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	}
+
 	clientConfig, err := rest.InClusterConfig()
 	if err != nil {
 		return err
@@ -51,6 +61,7 @@ func RunOpenShiftNetworkController(platformType, nodeName string) error {
 			controllerContext.osdnInformers,
 			controllerContext.cloudNetworkClient,
 			controllerContext.cloudNetworkInformer,
+			masterOptions,
 		); err != nil {
 			klog.Fatalf("Error starting OpenShift Network Controller: %v", err)
 		}
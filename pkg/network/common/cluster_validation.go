@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
+)
+
+// ClusterConfigReport is the result of ValidateClusterConfig. Each field holds the
+// problems found by one group of checks, or nil if the checks passed.
+type ClusterConfigReport struct {
+	// ClusterNetwork reports problems with the default ClusterNetwork itself. If it
+	// can't be parsed, the checks that depend on it are skipped and report that.
+	ClusterNetwork error
+	// HostNetworks reports node addresses that overlap the cluster or service network
+	HostNetworks error
+	// ClusterObjects reports HostSubnets, pods, and services outside of the cluster or
+	// service network
+	ClusterObjects error
+	// Egress reports HostSubnets with invalid egress IPs or CIDRs
+	Egress error
+	// NodeIPs reports invalid or duplicate node IPs
+	NodeIPs error
+}
+
+// Failed returns whether any section of r reported a problem
+func (r *ClusterConfigReport) Failed() bool {
+	return r.ClusterNetwork != nil || r.HostNetworks != nil || r.ClusterObjects != nil || r.Egress != nil || r.NodeIPs != nil
+}
+
+func (r *ClusterConfigReport) String() string {
+	var b strings.Builder
+	for _, section := range []struct {
+		name string
+		err  error
+	}{
+		{"ClusterNetwork", r.ClusterNetwork},
+		{"Host networks", r.HostNetworks},
+		{"Cluster objects", r.ClusterObjects},
+		{"Egress", r.Egress},
+		{"Node IPs", r.NodeIPs},
+	} {
+		if section.err == nil {
+			fmt.Fprintf(&b, "%s: OK\n", section.name)
+		} else {
+			fmt.Fprintf(&b, "%s: %v\n", section.name, section.err)
+		}
+	}
+	return b.String()
+}
+
+// ValidateClusterConfig runs all of the cluster-wide network configuration checks against
+// a live cluster and returns a report of the results. It only returns an error if the
+// cluster objects can't be fetched.
+func ValidateClusterConfig(ctx context.Context, osdnClient osdnclient.Interface, kClient kubernetes.Interface) (*ClusterConfigReport, error) {
+	nodes, err := kClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list nodes: %v", err)
+	}
+	subnets, err := ListAllHostSubnets(ctx, osdnClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not list HostSubnets: %v", err)
+	}
+	pods, err := ListAllPods(ctx, kClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods: %v", err)
+	}
+	services, err := ListAllServices(ctx, kClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not list services: %v", err)
+	}
+
+	report := &ClusterConfigReport{}
+
+	var egressErrs []error
+	for _, hs := range subnets {
+		if err := ValidateHostSubnetEgress(hs); err != nil {
+			egressErrs = append(egressErrs, fmt.Errorf("HostSubnet %s: %v", hs.Name, err))
+		}
+	}
+	report.Egress = kerrors.NewAggregate(egressErrs)
+
+	var pcn *ParsedClusterNetwork
+	cn, err := osdnClient.NetworkV1().ClusterNetworks().Get(ctx, osdnv1.ClusterNetworkDefault, metav1.GetOptions{})
+	if err == nil {
+		err = ValidateClusterNetwork(cn)
+		if err == nil {
+			pcn, err = ParseClusterNetwork(cn)
+		}
+	}
+	if err != nil {
+		report.ClusterNetwork = err
+		skipped := fmt.Errorf("skipped: no valid ClusterNetwork")
+		report.HostNetworks = skipped
+		report.ClusterObjects = skipped
+		report.NodeIPs = skipped
+		return report, nil
+	}
+
+	var hostIPNets []*net.IPNet
+	for i := range nodes.Items {
+		for _, addr := range nodes.Items[i].Status.Addresses {
+			if addr.Type != corev1.NodeInternalIP && addr.Type != corev1.NodeExternalIP {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			hostIPNets = append(hostIPNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	report.HostNetworks = pcn.CheckHostNetworks(hostIPNets)
+
+	report.ClusterObjects = pcn.CheckClusterObjects(subnets, pods, services)
+
+	var nodeIPErrs []error
+	nodeIPOwners := make(map[string]string, len(nodes.Items))
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		nodeIP := GetNodeInternalIP(node)
+		if err := pcn.ValidateNodeIP(nodeIP); err != nil {
+			nodeIPErrs = append(nodeIPErrs, fmt.Errorf("node %s: %v", node.Name, err))
+			continue
+		}
+		if owner, ok := nodeIPOwners[nodeIP]; ok {
+			nodeIPErrs = append(nodeIPErrs, fmt.Errorf("node %s: node IP %s is also used by node %s", node.Name, nodeIP, owner))
+			continue
+		}
+		nodeIPOwners[nodeIP] = node.Name
+	}
+	report.NodeIPs = kerrors.NewAggregate(nodeIPErrs)
+
+	return report, nil
+}
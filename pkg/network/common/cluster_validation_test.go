@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekubeclient "k8s.io/client-go/kubernetes/fake"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+)
+
+func makeValidationNode(name string, addrs ...corev1.NodeAddress) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Addresses: addrs},
+	}
+}
+
+func makeValidationHostSubnet(name, hostIP, subnet string, egressIPs ...osdnv1.HostSubnetEgressIP) *osdnv1.HostSubnet {
+	return &osdnv1.HostSubnet{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Host:       name,
+		HostIP:     hostIP,
+		Subnet:     subnet,
+		EgressIPs:  egressIPs,
+	}
+}
+
+func checkReportSection(t *testing.T, section string, err error, expected []string) {
+	if len(expected) == 0 {
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", section, err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("%s: expected errors matching %v, got none", section, expected)
+	}
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Fatalf("%s: expected error matching %q, got %v", section, e, err)
+		}
+	}
+}
+
+func TestValidateClusterConfig(t *testing.T) {
+	clusterNetwork := &osdnv1.ClusterNetwork{
+		ObjectMeta:       metav1.ObjectMeta{Name: osdnv1.ClusterNetworkDefault},
+		ClusterNetworks:  []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+		ServiceNetwork:   "172.30.0.0/16",
+		HostSubnetLength: 9,
+		Network:          "10.128.0.0/14",
+	}
+	kubeObjs := []runtime.Object{
+		makeValidationNode("node1",
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "192.168.1.1"}),
+		makeValidationNode("node2",
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "192.168.1.2"},
+			corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "172.30.0.5"}),
+		makeValidationNode("node3",
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "192.168.1.1"}),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "svc"},
+			Spec:       corev1.ServiceSpec{ClusterIP: "10.0.0.1"},
+		},
+	}
+	osdnObjs := []runtime.Object{
+		makeValidationHostSubnet("node1", "192.168.1.1", "10.128.0.0/23"),
+		makeValidationHostSubnet("node2", "192.168.1.2", "10.200.0.0/23", "bad-ip"),
+	}
+
+	for _, tc := range []struct {
+		name           string
+		clusterNetwork *osdnv1.ClusterNetwork
+		clusterNetErr  []string
+		hostNetErr     []string
+		objectsErr     []string
+		egressErr      []string
+		nodeIPErr      []string
+	}{
+		{
+			name:           "valid ClusterNetwork",
+			clusterNetwork: clusterNetwork,
+			hostNetErr:     []string{"172.30.0.5/32"},
+			objectsErr:     []string{"10.200.0.0/23", "ns:svc"},
+			egressErr:      []string{"HostSubnet node2", "bad-ip"},
+			nodeIPErr:      []string{"node node3: node IP 192.168.1.1 is also used by node node1"},
+		},
+		{
+			name:          "missing ClusterNetwork",
+			clusterNetErr: []string{"not found"},
+			hostNetErr:    []string{"skipped"},
+			objectsErr:    []string{"skipped"},
+			egressErr:     []string{"HostSubnet node2", "bad-ip"},
+			nodeIPErr:     []string{"skipped"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := osdnObjs
+			if tc.clusterNetwork != nil {
+				objs = append([]runtime.Object{tc.clusterNetwork}, objs...)
+			}
+			kClient := fakekubeclient.NewSimpleClientset(kubeObjs...)
+			osdnClient := osdnfake.NewSimpleClientset(objs...)
+
+			report, err := ValidateClusterConfig(context.TODO(), osdnClient, kClient)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !report.Failed() {
+				t.Fatalf("expected report to show failures")
+			}
+			checkReportSection(t, "ClusterNetwork", report.ClusterNetwork, tc.clusterNetErr)
+			checkReportSection(t, "HostNetworks", report.HostNetworks, tc.hostNetErr)
+			checkReportSection(t, "ClusterObjects", report.ClusterObjects, tc.objectsErr)
+			checkReportSection(t, "Egress", report.Egress, tc.egressErr)
+			checkReportSection(t, "NodeIPs", report.NodeIPs, tc.nodeIPErr)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/watch"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions/network/v1"
+)
+
+// ClusterNetworkCache serves the parsed default ClusterNetwork from an informer, for
+// callers that would otherwise call GetParsedClusterNetwork repeatedly. The parsed result
+// is cached until the ClusterNetwork changes.
+type ClusterNetworkCache struct {
+	informer osdninformers.ClusterNetworkInformer
+
+	lock sync.Mutex
+	pcn  *ParsedClusterNetwork
+	err  error
+}
+
+// NewClusterNetworkCache returns a ClusterNetworkCache using informer. The informer must
+// be started (and synced) before Get is called.
+func NewClusterNetworkCache(informer osdninformers.ClusterNetworkInformer) (*ClusterNetworkCache, error) {
+	cnc := &ClusterNetworkCache{informer: informer}
+	funcs := InformerFuncs(&osdnv1.ClusterNetwork{}, cnc.handleAddOrUpdate, cnc.handleDelete)
+	if _, err := informer.Informer().AddEventHandler(funcs); err != nil {
+		return nil, fmt.Errorf("could not watch ClusterNetworks: %v", err)
+	}
+	return cnc, nil
+}
+
+// Get returns the parsed default ClusterNetwork, or an error if it doesn't exist or is
+// invalid
+func (cnc *ClusterNetworkCache) Get() (*ParsedClusterNetwork, error) {
+	cnc.lock.Lock()
+	defer cnc.lock.Unlock()
+
+	if cnc.pcn == nil && cnc.err == nil {
+		cnc.pcn, cnc.err = cnc.parse()
+	}
+	return cnc.pcn, cnc.err
+}
+
+func (cnc *ClusterNetworkCache) parse() (*ParsedClusterNetwork, error) {
+	cn, err := cnc.informer.Lister().Get(osdnv1.ClusterNetworkDefault)
+	if err != nil {
+		return nil, err
+	}
+	if err = ValidateClusterNetwork(cn); err != nil {
+		return nil, fmt.Errorf("ClusterNetwork is invalid (%v)", err)
+	}
+	return ParseClusterNetwork(cn)
+}
+
+func (cnc *ClusterNetworkCache) invalidate(obj interface{}) {
+	if obj.(*osdnv1.ClusterNetwork).Name != osdnv1.ClusterNetworkDefault {
+		return
+	}
+	cnc.lock.Lock()
+	defer cnc.lock.Unlock()
+	cnc.pcn, cnc.err = nil, nil
+}
+
+func (cnc *ClusterNetworkCache) handleAddOrUpdate(obj, _ interface{}, _ watch.EventType) {
+	cnc.invalidate(obj)
+}
+
+func (cnc *ClusterNetworkCache) handleDelete(obj interface{}) {
+	cnc.invalidate(obj)
+}
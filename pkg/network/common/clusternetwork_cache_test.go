@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+)
+
+func TestClusterNetworkCache(t *testing.T) {
+	cn := &osdnv1.ClusterNetwork{
+		ObjectMeta:       metav1.ObjectMeta{Name: osdnv1.ClusterNetworkDefault},
+		ClusterNetworks:  []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+		ServiceNetwork:   "172.30.0.0/16",
+		HostSubnetLength: 9,
+		Network:          "10.128.0.0/14",
+	}
+	osdnClient := osdnfake.NewSimpleClientset(cn)
+	osdnInformers := osdninformers.NewSharedInformerFactory(osdnClient, 0)
+	cnc, err := NewClusterNetworkCache(osdnInformers.Network().V1().ClusterNetworks())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	osdnInformers.Start(stopCh)
+	osdnInformers.WaitForCacheSync(stopCh)
+
+	osdnClient.ClearActions()
+	pcn, err := cnc.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pcn.ServiceNetwork.String() != "172.30.0.0/16" {
+		t.Fatalf("unexpected service network %s", pcn.ServiceNetwork.String())
+	}
+	if again, _ := cnc.Get(); again != pcn {
+		t.Fatalf("expected second Get to return the cached result")
+	}
+	if actions := osdnClient.Actions(); len(actions) != 0 {
+		t.Fatalf("expected no API calls, got %v", actions)
+	}
+
+	// Updates invalidate the cache
+	cn = cn.DeepCopy()
+	cn.ServiceNetwork = "172.31.0.0/16"
+	if _, err := osdnClient.NetworkV1().ClusterNetworks().Update(context.TODO(), cn, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating ClusterNetwork: %v", err)
+	}
+	err = utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		pcn, err := cnc.Get()
+		return err == nil && pcn.ServiceNetwork.String() == "172.31.0.0/16", nil
+	})
+	if err != nil {
+		t.Fatalf("cache was not updated after ClusterNetwork change")
+	}
+
+	// As do deletions
+	if err := osdnClient.NetworkV1().ClusterNetworks().Delete(context.TODO(), cn.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error deleting ClusterNetwork: %v", err)
+	}
+	err = utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, err := cnc.Get()
+		return err != nil, nil
+	})
+	if err != nil {
+		t.Fatalf("cache was not invalidated after ClusterNetwork deletion")
+	}
+}
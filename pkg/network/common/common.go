@@ -2,23 +2,57 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"net"
+	"sort"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	osdnclient "github.com/openshift/client-go/network/clientset/versioned"
 	"github.com/openshift/library-go/pkg/network/networkutils"
 )
 
+// HostSubnetFormatter formats a HostSubnet for logging
+type HostSubnetFormatter func(subnet *osdnv1.HostSubnet) string
+
+var hostSubnetFormatter HostSubnetFormatter = hostSubnetToHumanString
+
+// SetHostSubnetFormatter makes HostSubnetToString use formatter (such as HostSubnetToKV,
+// for logs that are parsed by tools), or the default human-readable format if formatter is
+// nil. It should be called at startup, before anything is logged.
+func SetHostSubnetFormatter(formatter HostSubnetFormatter) {
+	if formatter == nil {
+		formatter = hostSubnetToHumanString
+	}
+	hostSubnetFormatter = formatter
+}
+
+// HostSubnetToString formats subnet for logging, with the formatter set by
+// SetHostSubnetFormatter
 func HostSubnetToString(subnet *osdnv1.HostSubnet) string {
+	return hostSubnetFormatter(subnet)
+}
+
+func hostSubnetToHumanString(subnet *osdnv1.HostSubnet) string {
 	return fmt.Sprintf("%s (host: %q, ip: %q, subnet: %q)", subnet.Name, subnet.Host, subnet.HostIP, subnet.Subnet)
 }
 
+// HostSubnetToKV formats subnet as space-separated key=value pairs, with quoted values, in
+// a fixed order
+func HostSubnetToKV(subnet *osdnv1.HostSubnet) string {
+	return fmt.Sprintf("name=%q host=%q hostIP=%q subnet=%q", subnet.Name, subnet.Host, subnet.HostIP, subnet.Subnet)
+}
+
 func ClusterNetworkToString(n *osdnv1.ClusterNetwork) string {
 	return fmt.Sprintf("%s (network: %q, hostSubnetBits: %d, serviceNetwork: %q, pluginName: %q)", n.Name, n.Network, n.HostSubnetLength, n.ServiceNetwork, n.PluginName)
 }
@@ -38,6 +72,10 @@ type ParsedClusterNetwork struct {
 	ServiceNetwork  *net.IPNet
 	VXLANPort       uint32
 	OverlayMTU      uint32
+
+	// ForbiddenNodeNetworks are additional networks (eg, management networks) that
+	// ValidateNodeIP rejects node IPs in
+	ForbiddenNodeNetworks []*net.IPNet
 }
 
 type ParsedClusterNetworkEntry struct {
@@ -45,13 +83,48 @@ type ParsedClusterNetworkEntry struct {
 	HostSubnetLength uint32
 }
 
+// ClusterNetworkDefaults holds the values used for optional ClusterNetwork fields that
+// are unset
+type ClusterNetworkDefaults struct {
+	VXLANPort  uint32
+	OverlayMTU uint32
+}
+
+const (
+	DefaultVXLANPort  = 4789
+	DefaultOverlayMTU = 1450
+)
+
+// Defaults are the ClusterNetworkDefaults used by ParseClusterNetwork
+var Defaults = ClusterNetworkDefaults{
+	VXLANPort:  DefaultVXLANPort,
+	OverlayMTU: DefaultOverlayMTU,
+}
+
+// ParseClusterNetwork parses cn. If cn has no clusterNetworks, its legacy network and
+// hostsubnetlength fields are used instead; otherwise the legacy fields are ignored (with
+// a warning if they are inconsistent with clusterNetworks[0]).
 func ParseClusterNetwork(cn *osdnv1.ClusterNetwork) (*ParsedClusterNetwork, error) {
+	return ParseClusterNetworkWithDefaults(cn, Defaults)
+}
+
+// ParseClusterNetworkWithDefaults parses cn like ParseClusterNetwork, but using defaults
+// for unset optional fields, for deployments that use non-standard values.
+func ParseClusterNetworkWithDefaults(cn *osdnv1.ClusterNetwork, defaults ClusterNetworkDefaults) (*ParsedClusterNetwork, error) {
+	entries := cn.ClusterNetworks
+	if len(entries) == 0 && cn.Network != "" {
+		klog.Warningf("ClusterNetwork %q only sets the legacy network and hostsubnetlength fields; using them as its clusterNetworks", cn.Name)
+		entries = []osdnv1.ClusterNetworkEntry{{CIDR: cn.Network, HostSubnetLength: cn.HostSubnetLength}}
+	} else if err := CheckLegacyClusterNetworkFields(cn); err != nil {
+		klog.Warningf("ClusterNetwork %q: %v; ignoring the legacy fields in favor of clusterNetworks", cn.Name, err)
+	}
+
 	pcn := &ParsedClusterNetwork{
 		PluginName:      cn.PluginName,
-		ClusterNetworks: make([]ParsedClusterNetworkEntry, 0, len(cn.ClusterNetworks)),
+		ClusterNetworks: make([]ParsedClusterNetworkEntry, 0, len(entries)),
 	}
 
-	for _, entry := range cn.ClusterNetworks {
+	for _, entry := range entries {
 		cidr, err := networkutils.ParseCIDRMask(entry.CIDR)
 		if err != nil {
 			_, cidr, err = net.ParseCIDR(entry.CIDR)
@@ -76,18 +149,43 @@ func ParseClusterNetwork(cn *osdnv1.ClusterNetwork) (*ParsedClusterNetwork, erro
 	if cn.VXLANPort != nil {
 		pcn.VXLANPort = *cn.VXLANPort
 	} else {
-		pcn.VXLANPort = 4789
+		pcn.VXLANPort = defaults.VXLANPort
 	}
 
 	if cn.MTU != nil {
 		pcn.OverlayMTU = *cn.MTU
 	} else {
-		pcn.OverlayMTU = 1450
+		pcn.OverlayMTU = defaults.OverlayMTU
 	}
 
 	return pcn, nil
 }
 
+// FormatClusterNetworkEnv returns pcn as KEY=VALUE lines, suitable for sourcing into a
+// shell script. Every key is always present, in a fixed order; lists (the cluster
+// networks, in order, and their host subnet lengths) are comma-separated.
+func FormatClusterNetworkEnv(pcn *ParsedClusterNetwork) string {
+	cidrs := make([]string, 0, len(pcn.ClusterNetworks))
+	lengths := make([]string, 0, len(pcn.ClusterNetworks))
+	for _, cn := range pcn.ClusterNetworks {
+		cidrs = append(cidrs, cn.ClusterCIDR.String())
+		lengths = append(lengths, fmt.Sprint(cn.HostSubnetLength))
+	}
+	serviceNetwork := ""
+	if pcn.ServiceNetwork != nil {
+		serviceNetwork = pcn.ServiceNetwork.String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "PLUGIN_NAME=%s\n", pcn.PluginName)
+	fmt.Fprintf(&b, "CLUSTER_NETWORK_CIDRS=%s\n", strings.Join(cidrs, ","))
+	fmt.Fprintf(&b, "CLUSTER_NETWORK_HOST_SUBNET_LENGTHS=%s\n", strings.Join(lengths, ","))
+	fmt.Fprintf(&b, "SERVICE_NETWORK_CIDR=%s\n", serviceNetwork)
+	fmt.Fprintf(&b, "OVERLAY_MTU=%d\n", pcn.OverlayMTU)
+	fmt.Fprintf(&b, "VXLAN_PORT=%d\n", pcn.VXLANPort)
+	return b.String()
+}
+
 // PodNetworkContains determines whether pcn's pod network contains ip
 func (pcn *ParsedClusterNetwork) PodNetworkContains(ip net.IP) bool {
 	for _, cn := range pcn.ClusterNetworks {
@@ -108,6 +206,220 @@ func (pcn *ParsedClusterNetwork) ServiceNetworkContains(ip net.IP) bool {
 	return false
 }
 
+// ServiceNetworkCapacity returns the number of service IPs available in serviceNetwork.
+// This excludes the network address and, for IPv4, the broadcast address, which are never
+// assigned to services. Very large IPv6 networks are reported as math.MaxUint64.
+func ServiceNetworkCapacity(serviceNetwork *net.IPNet) uint64 {
+	ones, bits := serviceNetwork.Mask.Size()
+	hostBits := bits - ones
+	if hostBits >= 64 {
+		return math.MaxUint64
+	}
+	size := uint64(1) << hostBits
+	reserved := uint64(1)
+	if bits == 32 {
+		reserved = 2
+	}
+	if size <= reserved {
+		return 0
+	}
+	return size - reserved
+}
+
+// CheckServiceNetworkCapacity returns an error if pcn's service network is too small to
+// hold serviceCount services.
+func (pcn *ParsedClusterNetwork) CheckServiceNetworkCapacity(serviceCount uint64) error {
+	if pcn.ServiceNetwork == nil {
+		return fmt.Errorf("no service network")
+	}
+	if capacity := ServiceNetworkCapacity(pcn.ServiceNetwork); capacity < serviceCount {
+		return fmt.Errorf("service network %s has room for only %d services, not %d", pcn.ServiceNetwork.String(), capacity, serviceCount)
+	}
+	return nil
+}
+
+// ServicesOutsideServiceNetwork returns the services whose cluster IPs would not be in
+// serviceNetwork, for checking whether the ClusterNetwork's ServiceNetwork can be changed
+// to serviceNetwork without breaking existing services. Headless services are ignored.
+func ServicesOutsideServiceNetwork(serviceNetwork *net.IPNet, services []*corev1.Service) []*corev1.Service {
+	proposed := &ParsedClusterNetwork{ServiceNetwork: serviceNetwork}
+	var outside []*corev1.Service
+	for _, svc := range services {
+		clusterIPs := svc.Spec.ClusterIPs
+		if len(clusterIPs) == 0 && svc.Spec.ClusterIP != "" {
+			clusterIPs = []string{svc.Spec.ClusterIP}
+		}
+		for _, clusterIP := range clusterIPs {
+			ip := net.ParseIP(clusterIP)
+			if ip == nil {
+				// eg, corev1.ClusterIPNone
+				continue
+			}
+			if !proposed.ServiceNetworkContains(ip) {
+				outside = append(outside, svc)
+				break
+			}
+		}
+	}
+	return outside
+}
+
+// maxPodsPerNode caps the value returned by PodsPerNode, since IPv6 host subnets have far
+// more addresses than any node could use
+const maxPodsPerNode = uint64(1) << 32
+
+// PodsPerNode returns the number of pod IPs available on each node when rangeCIDR is
+// divided into subnets with hostSubnetLength host bits. This excludes the network address
+// and the gateway address, plus the broadcast address for IPv4, and is capped at 2^32.
+func PodsPerNode(rangeCIDR *net.IPNet, hostSubnetLength uint32) (uint64, error) {
+	if err := ValidateHostSubnetLength(rangeCIDR, hostSubnetLength); err != nil && !errors.Is(err, ErrNonStandardIPv6HostSubnetLength) {
+		return 0, err
+	}
+	if hostSubnetLength >= 33 {
+		return maxPodsPerNode, nil
+	}
+	reserved, _ := reservedSubnetAddresses(rangeCIDR)
+	size := uint64(1) << hostSubnetLength
+	if size <= reserved {
+		return 0, nil
+	}
+	if size-reserved > maxPodsPerNode {
+		return maxPodsPerNode, nil
+	}
+	return size - reserved, nil
+}
+
+// AggregateRoute returns the smallest CIDR covering all of subnets, which can be used as a
+// single underlay route to them. It returns an error if subnets mix IP families (each
+// family needs its own route), or if the covering CIDR would include addresses outside of
+// subnets, meaning that they can't be aggregated cleanly.
+func AggregateRoute(subnets []string) (string, error) {
+	if len(subnets) == 0 {
+		return "", fmt.Errorf("no subnets to aggregate")
+	}
+	ipnets := make([]*net.IPNet, 0, len(subnets))
+	for _, subnet := range subnets {
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return "", err
+		}
+		if len(ipnets) > 0 && cidrIPFamily(ipnet) != cidrIPFamily(ipnets[0]) {
+			return "", fmt.Errorf("cannot aggregate %s subnet %s with %s subnet %s", cidrIPFamily(ipnet), subnet, cidrIPFamily(ipnets[0]), ipnets[0].String())
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+
+	// Drop subnets that are duplicates of, or contained in, other subnets
+	sort.SliceStable(ipnets, func(i, j int) bool {
+		onesI, _ := ipnets[i].Mask.Size()
+		onesJ, _ := ipnets[j].Mask.Size()
+		return onesI < onesJ
+	})
+	var distinct []*net.IPNet
+	for _, ipnet := range ipnets {
+		contained := false
+		for _, other := range distinct {
+			if isSubnet(other, ipnet) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			distinct = append(distinct, ipnet)
+		}
+	}
+
+	ones, bits := distinct[0].Mask.Size()
+	aggregate := distinct[0]
+	for {
+		coversAll := true
+		for _, ipnet := range distinct {
+			if !isSubnet(aggregate, ipnet) {
+				coversAll = false
+				break
+			}
+		}
+		if coversAll {
+			break
+		}
+		ones--
+		mask := net.CIDRMask(ones, bits)
+		aggregate = &net.IPNet{IP: distinct[0].IP.Mask(mask), Mask: mask}
+	}
+
+	// The subnets don't overlap, so they cover aggregate entirely iff their sizes add
+	// up to its size
+	covered := new(big.Int)
+	for _, ipnet := range distinct {
+		subnetOnes, _ := ipnet.Mask.Size()
+		covered.Add(covered, new(big.Int).Lsh(big.NewInt(1), uint(bits-subnetOnes)))
+	}
+	if size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)); covered.Cmp(size) != 0 {
+		return "", fmt.Errorf("subnets can't be aggregated: the smallest CIDR covering them, %s, includes addresses outside of them", aggregate.String())
+	}
+	return aggregate.String(), nil
+}
+
+// VXLAN encapsulation overhead: the outer IP header, UDP header, VXLAN header, and the
+// inner Ethernet header
+const (
+	vxlanOverheadIPv4 = 20 + 8 + 8 + 14
+	vxlanOverheadIPv6 = 40 + 8 + 8 + 14
+)
+
+// RecommendMTU returns the largest pod network MTU that fits in a VXLAN packet on an
+// underlay network with the given MTU and IP family, and warns if pcn's configured
+// OverlayMTU exceeds it. It returns an error if underlayMTU is too small to carry any
+// VXLAN traffic.
+func (pcn *ParsedClusterNetwork) RecommendMTU(underlayMTU uint32, underlayFamily corev1.IPFamily) (uint32, error) {
+	overhead := uint32(vxlanOverheadIPv4)
+	if underlayFamily == corev1.IPv6Protocol {
+		overhead = vxlanOverheadIPv6
+	}
+	if underlayMTU <= overhead {
+		return 0, fmt.Errorf("underlay MTU %d is too small for %d bytes of VXLAN overhead", underlayMTU, overhead)
+	}
+	recommended := underlayMTU - overhead
+	if pcn.OverlayMTU > recommended {
+		klog.Warningf("Configured MTU %d exceeds the recommended MTU %d for a %s underlay with MTU %d; large packets will be fragmented or dropped",
+			pcn.OverlayMTU, recommended, underlayFamily, underlayMTU)
+	}
+	return recommended, nil
+}
+
+func cidrIPFamily(cidr *net.IPNet) corev1.IPFamily {
+	return ipFamily(cidr.IP)
+}
+
+func ipFamily(ip net.IP) corev1.IPFamily {
+	if ip.To4() != nil {
+		return corev1.IPv4Protocol
+	}
+	return corev1.IPv6Protocol
+}
+
+// PrimaryIPFamily returns the IP family of pcn's first cluster network
+func (pcn *ParsedClusterNetwork) PrimaryIPFamily() corev1.IPFamily {
+	return cidrIPFamily(pcn.ClusterNetworks[0].ClusterCIDR)
+}
+
+// ValidateIPFamilyRequirement checks that pcn's cluster networks and service network are
+// all of the given family, as required for a single-stack cluster.
+func ValidateIPFamilyRequirement(pcn *ParsedClusterNetwork, family corev1.IPFamily) error {
+	var errList []error
+	for _, cn := range pcn.ClusterNetworks {
+		if f := cidrIPFamily(cn.ClusterCIDR); f != family {
+			errList = append(errList, fmt.Errorf("cluster network %s is %s, not %s", cn.ClusterCIDR.String(), f, family))
+		}
+	}
+	if pcn.ServiceNetwork != nil {
+		if f := cidrIPFamily(pcn.ServiceNetwork); f != family {
+			errList = append(errList, fmt.Errorf("service network %s is %s, not %s", pcn.ServiceNetwork.String(), f, family))
+		}
+	}
+	return kerrors.NewAggregate(errList)
+}
+
 func (pcn *ParsedClusterNetwork) ValidateNodeIP(nodeIP string) error {
 	if nodeIP == "" || nodeIP == "127.0.0.1" {
 		return fmt.Errorf("invalid node IP %q", nodeIP)
@@ -126,20 +438,114 @@ func (pcn *ParsedClusterNetwork) ValidateNodeIP(nodeIP string) error {
 	if pcn.ServiceNetwork.Contains(ipaddr) {
 		return fmt.Errorf("node IP %s conflicts with service network %s", nodeIP, pcn.ServiceNetwork.String())
 	}
+	for _, forbidden := range pcn.ForbiddenNodeNetworks {
+		if forbidden.Contains(ipaddr) {
+			return fmt.Errorf("node IP %s is in forbidden network %s", nodeIP, forbidden.String())
+		}
+	}
 
 	return nil
 }
 
+// HostNetworkConflict describes a host network that overlaps the cluster or service
+// network. CheckHostNetworks returns an aggregate of these.
+type HostNetworkConflict struct {
+	// HostNetwork is the network of the host interface
+	HostNetwork *net.IPNet
+	// ConflictingNetwork is the cluster network CIDR or service network it overlaps
+	ConflictingNetwork *net.IPNet
+	// IsServiceNetwork is true if ConflictingNetwork is the service network
+	IsServiceNetwork bool
+}
+
+func (c *HostNetworkConflict) Error() string {
+	if c.IsServiceNetwork {
+		return fmt.Sprintf("service IP: %s conflicts with host network: %s", c.ConflictingNetwork.String(), c.HostNetwork.String())
+	}
+	return fmt.Sprintf("cluster IP: %s conflicts with host network: %s", c.ConflictingNetwork.IP.String(), c.HostNetwork.String())
+}
+
+// RoutingCompatible checks whether the cluster network configuration can be changed from
+// oldNet to newNet without recycling nodes: every old cluster network must be inside a new
+// cluster network with the same HostSubnetLength (so existing HostSubnets and pod IPs
+// stay valid), and the old service network must be inside the new one. It returns an
+// error describing the first incompatibility, or nil. (Whether existing node IPs are
+// allowed by newNet can be checked with newNet.ValidateNodeIP.)
+func RoutingCompatible(oldNet, newNet *ParsedClusterNetwork) error {
+	for _, oldCN := range oldNet.ClusterNetworks {
+		var container *ParsedClusterNetworkEntry
+		for i := range newNet.ClusterNetworks {
+			if isSubnet(newNet.ClusterNetworks[i].ClusterCIDR, oldCN.ClusterCIDR) {
+				container = &newNet.ClusterNetworks[i]
+				break
+			}
+		}
+		if container == nil {
+			return fmt.Errorf("cluster network %s is not contained in any new cluster network", oldCN.ClusterCIDR.String())
+		}
+		if container.HostSubnetLength != oldCN.HostSubnetLength {
+			return fmt.Errorf("cluster network %s has hostSubnetLength %d, but new cluster network %s has hostSubnetLength %d",
+				oldCN.ClusterCIDR.String(), oldCN.HostSubnetLength, container.ClusterCIDR.String(), container.HostSubnetLength)
+		}
+	}
+	if oldNet.ServiceNetwork != nil && (newNet.ServiceNetwork == nil || !isSubnet(newNet.ServiceNetwork, oldNet.ServiceNetwork)) {
+		return fmt.Errorf("service network %s is not contained in the new service network", oldNet.ServiceNetwork.String())
+	}
+	return nil
+}
+
+// HostSubnetHostNetworkOverlaps returns the networks in hostIPNets (the networks of a
+// node's interfaces) that overlap subnet (the node's HostSubnet subnet), which would break
+// local routing on the node
+func HostSubnetHostNetworkOverlaps(subnet string, hostIPNets []*net.IPNet) ([]*net.IPNet, error) {
+	_, subnetCIDR, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %v", subnet, err)
+	}
+	var overlaps []*net.IPNet
+	for _, ipNet := range hostIPNets {
+		if cidrsOverlap(ipNet, subnetCIDR) {
+			overlaps = append(overlaps, ipNet)
+		}
+	}
+	return overlaps, nil
+}
+
+// EgressIPsOffLocalSubnets returns the egress IPs of hs that are not inside any of
+// localIPNets (the networks of the node's interfaces), and so can't be hosted on the node
+// in modes that require egress IPs to be on the node's local subnet. Unparseable egress
+// IPs are ignored.
+func EgressIPsOffLocalSubnets(hs *osdnv1.HostSubnet, localIPNets []*net.IPNet) []string {
+	var offSubnet []string
+	for _, egressIP := range hs.EgressIPs {
+		ip := net.ParseIP(strings.TrimSpace(string(egressIP)))
+		if ip == nil {
+			continue
+		}
+		local := false
+		for _, ipNet := range localIPNets {
+			if ipNet.Contains(ip) {
+				local = true
+				break
+			}
+		}
+		if !local {
+			offSubnet = append(offSubnet, string(egressIP))
+		}
+	}
+	return offSubnet
+}
+
 func (pcn *ParsedClusterNetwork) CheckHostNetworks(hostIPNets []*net.IPNet) error {
 	errList := []error{}
 	for _, ipNet := range hostIPNets {
 		for _, clusterNetwork := range pcn.ClusterNetworks {
 			if cidrsOverlap(ipNet, clusterNetwork.ClusterCIDR) {
-				errList = append(errList, fmt.Errorf("cluster IP: %s conflicts with host network: %s", clusterNetwork.ClusterCIDR.IP.String(), ipNet.String()))
+				errList = append(errList, &HostNetworkConflict{HostNetwork: ipNet, ConflictingNetwork: clusterNetwork.ClusterCIDR})
 			}
 		}
 		if cidrsOverlap(ipNet, pcn.ServiceNetwork) {
-			errList = append(errList, fmt.Errorf("service IP: %s conflicts with host network: %s", pcn.ServiceNetwork.String(), ipNet.String()))
+			errList = append(errList, &HostNetworkConflict{HostNetwork: ipNet, ConflictingNetwork: pcn.ServiceNetwork, IsServiceNetwork: true})
 		}
 	}
 	return kerrors.NewAggregate(errList)
@@ -193,6 +599,52 @@ func (pcn *ParsedClusterNetwork) CheckClusterObjects(subnets []*osdnv1.HostSubne
 	return kerrors.NewAggregate(errList)
 }
 
+// endpointSliceControllerName is the discoveryv1.LabelManagedBy value of EndpointSlices
+// created by the kube-controller-manager from Services' selectors
+const endpointSliceControllerName = "endpointslice-controller.k8s.io"
+
+// CheckEndpointSlices checks that the addresses of slices are all in the pod or service
+// network. Addresses matching the HostIP of one of subnets are assumed to belong to
+// host-network endpoints and are accepted. Slices not managed by the EndpointSlice
+// controller (e.g. those of selectorless Services, which may legitimately point outside
+// the cluster) are ignored.
+func (pcn *ParsedClusterNetwork) CheckEndpointSlices(subnets []*osdnv1.HostSubnet, slices []*discoveryv1.EndpointSlice) error {
+	var errList []error
+
+	hostIPs := make(map[string]bool, len(subnets))
+	for _, subnet := range subnets {
+		hostIPs[subnet.HostIP] = true
+	}
+
+	for _, slice := range slices {
+		if slice.Labels[discoveryv1.LabelManagedBy] != endpointSliceControllerName {
+			continue
+		}
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			for _, addr := range endpoint.Addresses {
+				ip := net.ParseIP(addr)
+				if ip == nil || hostIPs[addr] {
+					continue
+				}
+				if !pcn.PodNetworkContains(ip) && !pcn.ServiceNetworkContains(ip) {
+					errList = append(errList, fmt.Errorf("existing endpointslice %s:%s with address %s is not part of cluster network or service network", slice.Namespace, slice.Name, addr))
+				}
+			}
+		}
+		if len(errList) >= 10 {
+			break
+		}
+	}
+
+	if len(errList) >= 10 {
+		errList = append(errList[:10], fmt.Errorf("too many errors... truncating"))
+	}
+	return kerrors.NewAggregate(errList)
+}
+
 func GetParsedClusterNetwork(osdnClient osdnclient.Interface) (*ParsedClusterNetwork, error) {
 	cn, err := osdnClient.NetworkV1().ClusterNetworks().Get(context.TODO(), osdnv1.ClusterNetworkDefault, metav1.GetOptions{})
 	if err != nil {
@@ -204,12 +656,62 @@ func GetParsedClusterNetwork(osdnClient osdnclient.Interface) (*ParsedClusterNet
 	return ParseClusterNetwork(cn)
 }
 
+// ParseClusterNetworkBytes unmarshals a ClusterNetwork from a YAML or JSON document,
+// validates it, and parses it, for checking network configuration without a live
+// cluster. Unknown fields in the document are treated as errors.
+func ParseClusterNetworkBytes(data []byte) (*ParsedClusterNetwork, error) {
+	cn := &osdnv1.ClusterNetwork{}
+	if err := yaml.UnmarshalStrict(data, cn); err != nil {
+		return nil, fmt.Errorf("could not decode ClusterNetwork: %v", err)
+	}
+	if err := ValidateClusterNetwork(cn); err != nil {
+		return nil, fmt.Errorf("ClusterNetwork is invalid (%v)", err)
+	}
+	return ParseClusterNetwork(cn)
+}
+
 // Generate the default gateway IP Address for a subnet
 func GenerateDefaultGateway(sna *net.IPNet) net.IP {
 	ip := sna.IP.To4()
 	return net.IPv4(ip[0], ip[1], ip[2], ip[3]|0x1)
 }
 
+// GatewayMismatch describes a HostSubnet whose subnet is written with a gateway address
+// (eg, "10.128.0.254/23") other than the one GenerateDefaultGateway assigns
+type GatewayMismatch struct {
+	HostSubnet string
+	Subnet     string
+	// The gateway implied by the subnet, and the gateway nodes actually use
+	Implied  string
+	Expected string
+}
+
+// FindGatewayMismatches returns the IPv4 HostSubnets in subnets that imply a different
+// gateway than GenerateDefaultGateway, as can happen with HostSubnets imported from
+// another cluster. Nodes ignore the implied gateway, so anything that depends on it will
+// be broken; this is only for reporting, since changing a subnet's gateway disrupts its
+// pods. Subnets written with their network address, or that can't be parsed, are skipped.
+func FindGatewayMismatches(subnets []*osdnv1.HostSubnet) []GatewayMismatch {
+	var mismatches []GatewayMismatch
+	for _, hs := range subnets {
+		ip, ipnet, err := net.ParseCIDR(hs.Subnet)
+		if err != nil || ip.To4() == nil || ip.Equal(ipnet.IP) {
+			continue
+		}
+		expected := GenerateDefaultGateway(ipnet)
+		if ip.Equal(expected) {
+			continue
+		}
+		mismatches = append(mismatches, GatewayMismatch{
+			HostSubnet: hs.Name,
+			Subnet:     hs.Subnet,
+			Implied:    ip.String(),
+			Expected:   expected.String(),
+		})
+	}
+	return mismatches
+}
+
 // Return Host IP Networks
 // Ignores provided interfaces and filters loopback and non IPv4 addrs.
 func GetHostIPNetworks(skipInterfaces []string) ([]*net.IPNet, []net.IP, error) {
@@ -253,6 +755,21 @@ func GetHostIPNetworks(skipInterfaces []string) ([]*net.IPNet, []net.IP, error)
 	return hostIPNets, hostIPs, kerrors.NewAggregate(errList)
 }
 
+// CheckNodeIPIsLocal returns an error if nodeIP is not one of hostIPs (the IPs of the
+// local host's interfaces, as returned by GetHostIPNetworks)
+func CheckNodeIPIsLocal(nodeIP string, hostIPs []net.IP) error {
+	ip := net.ParseIP(nodeIP)
+	if ip == nil {
+		return fmt.Errorf("invalid node IP %q", nodeIP)
+	}
+	for _, hostIP := range hostIPs {
+		if hostIP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("node IP %s is not present on any local interface", nodeIP)
+}
+
 func HSEgressIPsToStrings(ips []osdnv1.HostSubnetEgressIP) []string {
 	out := make([]string, 0, len(ips))
 	for _, ip := range ips {
@@ -269,6 +786,45 @@ func StringsToHSEgressIPs(ips []string) []osdnv1.HostSubnetEgressIP {
 	return out
 }
 
+// ParseEgressIPs parses and canonicalizes ips (trimming whitespace and normalizing the
+// IPv6 representation) so that equal addresses compare equal as strings. Invalid
+// entries are left out of the returned IPs and reported in the returned errors.
+func ParseEgressIPs(ips []string) ([]net.IP, []error) {
+	out := make([]net.IP, 0, len(ips))
+	var errs []error
+	for _, ip := range ips {
+		parsed := net.ParseIP(strings.TrimSpace(ip))
+		if parsed == nil {
+			errs = append(errs, fmt.Errorf("invalid egress IP %q", ip))
+			continue
+		}
+		if parsed.To4() != nil {
+			parsed = parsed.To4()
+		}
+		out = append(out, parsed)
+	}
+	return out, errs
+}
+
+// MismatchedEgressIPFamilies returns the egress IPs of hs that are not of the same IP
+// family as hs.HostIP (or of defaultFamily, if hs.HostIP is not a valid IP), which can't
+// be routed to the node. Invalid egress IPs are not included.
+func MismatchedEgressIPFamilies(hs *osdnv1.HostSubnet, defaultFamily corev1.IPFamily) []osdnv1.HostSubnetEgressIP {
+	family := defaultFamily
+	if hostIP := net.ParseIP(hs.HostIP); hostIP != nil {
+		family = ipFamily(hostIP)
+	}
+
+	var mismatched []osdnv1.HostSubnetEgressIP
+	for _, egressIP := range hs.EgressIPs {
+		ips, _ := ParseEgressIPs([]string{string(egressIP)})
+		if len(ips) == 1 && ipFamily(ips[0]) != family {
+			mismatched = append(mismatched, egressIP)
+		}
+	}
+	return mismatched
+}
+
 func GetNodeInternalIP(node *corev1.Node) string {
 	var nodeIP string
 	for _, addr := range node.Status.Addresses {
@@ -280,6 +836,53 @@ func GetNodeInternalIP(node *corev1.Node) string {
 	return nodeIP
 }
 
+// FindNodesMissingSubnet returns the nodes that have a usable internal IP but no HostSubnet
+// in subnets, which means that a node event was missed or that allocating a subnet for
+// the node failed. (Nodes with no usable internal IP can't be assigned a HostSubnet.)
+func FindNodesMissingSubnet(nodes []*corev1.Node, subnets []*osdnv1.HostSubnet) []*corev1.Node {
+	hasSubnet := make(map[string]bool, len(subnets))
+	for _, hs := range subnets {
+		hasSubnet[hs.Name] = true
+	}
+
+	var missing []*corev1.Node
+	for _, node := range nodes {
+		if hasSubnet[node.Name] || net.ParseIP(GetNodeInternalIP(node)) == nil {
+			continue
+		}
+		missing = append(missing, node)
+	}
+	return missing
+}
+
+// HostSubnetNodeUID returns the osdnv1.NodeUIDAnnotation of hs, with any surrounding
+// whitespace trimmed, or "" if it is unset or blank
+func HostSubnetNodeUID(hs *osdnv1.HostSubnet) string {
+	return strings.TrimSpace(hs.Annotations[osdnv1.NodeUIDAnnotation])
+}
+
+// FindDuplicateNodeSubnets groups subnets by their node UID (see HostSubnetNodeUID) and returns
+// the node UIDs that have more than one HostSubnet, mapped to the (sorted) names of those
+// HostSubnets. Each node should have a single HostSubnet, so this is normally empty;
+// otherwise the node's pods could be split across several subnets.
+func FindDuplicateNodeSubnets(subnets []*osdnv1.HostSubnet) map[string][]string {
+	byUID := make(map[string][]string)
+	for _, hs := range subnets {
+		if uid := HostSubnetNodeUID(hs); uid != "" {
+			byUID[uid] = append(byUID[uid], hs.Name)
+		}
+	}
+
+	duplicates := make(map[string][]string)
+	for uid, names := range byUID {
+		if len(names) > 1 {
+			sort.Strings(names)
+			duplicates[uid] = names
+		}
+	}
+	return duplicates
+}
+
 func NetnsIsMulticastEnabled(netns *osdnv1.NetNamespace) bool {
 	enabled, ok := netns.Annotations[osdnv1.MulticastEnabledAnnotation]
 	return enabled == "true" && ok
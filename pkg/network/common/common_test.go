@@ -1,24 +1,19 @@
 package common
 
 import (
+	"math"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
-func mustParseCIDR(cidr string) *net.IPNet {
-	_, net, err := net.ParseCIDR(cidr)
-	if err != nil {
-		panic("bad CIDR string constant " + cidr)
-	}
-	return net
-}
-
 func TestGenerateGateway(t *testing.T) {
 	_, ipNet, err := net.ParseCIDR("10.1.0.0/24")
 	if err != nil {
@@ -118,6 +113,226 @@ func TestCheckHostNetworks(t *testing.T) {
 	}
 }
 
+func TestHostSubnetHostNetworkOverlaps(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		hostNetworks []string
+		expected     []string
+	}{
+		{
+			name:         "no overlap",
+			hostNetworks: []string{"192.168.1.0/24", "fd00::/64"},
+		},
+		{
+			name:         "overlap",
+			hostNetworks: []string{"192.168.1.0/24", "10.128.2.0/24", "10.0.0.0/8"},
+			expected:     []string{"10.128.2.0/24", "10.0.0.0/8"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hostIPNets []*net.IPNet
+			for _, cidr := range tc.hostNetworks {
+				hostIPNets = append(hostIPNets, mustParseCIDR(cidr))
+			}
+			overlaps, err := HostSubnetHostNetworkOverlaps("10.128.2.0/23", hostIPNets)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, ipNet := range overlaps {
+				got = append(got, ipNet.String())
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected overlaps %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	if _, err := HostSubnetHostNetworkOverlaps("bad", nil); err == nil {
+		t.Fatalf("expected error for invalid subnet")
+	}
+}
+
+func TestEgressIPsOffLocalSubnets(t *testing.T) {
+	localIPNets := []*net.IPNet{mustParseCIDR("192.168.1.0/24"), mustParseCIDR("fd00::/64")}
+	for _, tc := range []struct {
+		name      string
+		egressIPs []string
+		expected  []string
+	}{
+		{
+			name:      "all local",
+			egressIPs: []string{"192.168.1.100", " 192.168.1.101", "fd00::100"},
+		},
+		{
+			name:      "some off the local subnets",
+			egressIPs: []string{"192.168.1.100", "192.168.2.100", "fd01::100"},
+			expected:  []string{"192.168.2.100", "fd01::100"},
+		},
+		{
+			name:      "unparseable IPs are ignored",
+			egressIPs: []string{"192.168.2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := &osdnv1.HostSubnet{EgressIPs: StringsToHSEgressIPs(tc.egressIPs)}
+			got := EgressIPsOffLocalSubnets(hs, localIPNets)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCheckHostNetworksConflicts(t *testing.T) {
+	hostIPNets := []*net.IPNet{
+		mustParseCIDR("10.0.0.0/9"),
+		mustParseCIDR("172.20.0.0/16"),
+	}
+	networkInfo := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.1.0.0/16"), HostSubnetLength: 8},
+		},
+		ServiceNetwork: mustParseCIDR("172.20.30.0/24"),
+	}
+
+	err := networkInfo.CheckHostNetworks(hostIPNets)
+	if err == nil {
+		t.Fatalf("unexpected lack of error")
+	}
+	errs := err.(kerrors.Aggregate).Errors()
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	expected := []HostNetworkConflict{
+		{HostNetwork: hostIPNets[0], ConflictingNetwork: networkInfo.ClusterNetworks[0].ClusterCIDR},
+		{HostNetwork: hostIPNets[1], ConflictingNetwork: networkInfo.ServiceNetwork, IsServiceNetwork: true},
+	}
+	for i, e := range errs {
+		conflict, ok := e.(*HostNetworkConflict)
+		if !ok {
+			t.Fatalf("error %d is not a HostNetworkConflict: %v", i, e)
+		}
+		if conflict.HostNetwork.String() != expected[i].HostNetwork.String() ||
+			conflict.ConflictingNetwork.String() != expected[i].ConflictingNetwork.String() ||
+			conflict.IsServiceNetwork != expected[i].IsServiceNetwork {
+			t.Fatalf("error %d: expected %#v, got %#v", i, expected[i], *conflict)
+		}
+	}
+	if !strings.Contains(errs[0].Error(), "cluster IP: 10.1.0.0 conflicts with host network: 10.0.0.0/9") {
+		t.Fatalf("unexpected error string %q", errs[0].Error())
+	}
+	if !strings.Contains(errs[1].Error(), "service IP: 172.20.30.0/24 conflicts with host network: 172.20.0.0/16") {
+		t.Fatalf("unexpected error string %q", errs[1].Error())
+	}
+}
+
+func TestValidateNodeIP(t *testing.T) {
+	networkInfo := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 8},
+		},
+		ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+		ForbiddenNodeNetworks: []*net.IPNet{
+			mustParseCIDR("192.168.100.0/24"),
+		},
+	}
+
+	tests := []struct {
+		nodeIP string
+		err    string
+	}{
+		{nodeIP: "192.168.1.2"},
+		{nodeIP: "", err: "invalid node IP"},
+		{nodeIP: "127.0.0.1", err: "invalid node IP"},
+		{nodeIP: "10.128.0.2", err: "conflicts with cluster network"},
+		{nodeIP: "172.30.0.2", err: "conflicts with service network"},
+		{nodeIP: "192.168.100.2", err: "forbidden network 192.168.100.0/24"},
+	}
+	for _, test := range tests {
+		err := networkInfo.ValidateNodeIP(test.nodeIP)
+		if test.err == "" {
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %v", test.nodeIP, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%q: expected error matching %q, got %v", test.nodeIP, test.err, err)
+		}
+	}
+}
+
+func TestValidateIPFamilyRequirement(t *testing.T) {
+	ipv4 := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 9},
+		},
+		ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+	}
+	ipv6 := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("fd01::/48"), HostSubnetLength: 64},
+		},
+		ServiceNetwork: mustParseCIDR("fd02::/112"),
+	}
+	dualStack := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 9},
+			{ClusterCIDR: mustParseCIDR("fd01::/48"), HostSubnetLength: 64},
+		},
+		ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+	}
+
+	tests := []struct {
+		name   string
+		pcn    *ParsedClusterNetwork
+		family corev1.IPFamily
+		errs   []string
+	}{
+		{
+			name:   "single-stack IPv4",
+			pcn:    ipv4,
+			family: corev1.IPv4Protocol,
+		},
+		{
+			name:   "single-stack IPv6",
+			pcn:    ipv6,
+			family: corev1.IPv6Protocol,
+		},
+		{
+			name:   "IPv4 with IPv6 requirement",
+			pcn:    ipv4,
+			family: corev1.IPv6Protocol,
+			errs:   []string{"cluster network 10.128.0.0/14 is IPv4", "service network 172.30.0.0/16 is IPv4"},
+		},
+		{
+			name:   "dual-stack with IPv4 requirement",
+			pcn:    dualStack,
+			family: corev1.IPv4Protocol,
+			errs:   []string{"cluster network fd01::/48 is IPv6"},
+		},
+	}
+
+	for _, test := range tests {
+		err := ValidateIPFamilyRequirement(test.pcn, test.family)
+		if err == nil {
+			if len(test.errs) > 0 {
+				t.Fatalf("test %q unexpectedly did not get an error", test.name)
+			}
+			continue
+		}
+		errs := err.(kerrors.Aggregate).Errors()
+		if len(errs) != len(test.errs) {
+			t.Fatalf("test %q expected %d errors, got %v", test.name, len(test.errs), err)
+		}
+		for i, match := range test.errs {
+			if !strings.Contains(errs[i].Error(), match) {
+				t.Fatalf("test %q: error %d did not match %q: %v", test.name, i, match, errs[i])
+			}
+		}
+	}
+}
+
 func dummySubnet(hostip string, subnet string) *osdnv1.HostSubnet {
 	return &osdnv1.HostSubnet{HostIP: hostip, Subnet: subnet}
 }
@@ -130,6 +345,143 @@ func dummyPod(ip string) *corev1.Pod {
 	return &corev1.Pod{Status: corev1.PodStatus{PodIP: ip}}
 }
 
+func TestCheckServiceNetworkCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		serviceNetwork string
+		serviceCount   uint64
+		capacity       uint64
+		expectErr      bool
+	}{
+		{"172.30.0.0/16", 1000, 65534, false},
+		{"172.30.0.0/16", 65534, 65534, false},
+		{"172.30.0.0/16", 65535, 65534, true},
+		{"172.30.0.0/24", 500, 254, true},
+		{"172.30.0.0/31", 1, 0, true},
+		{"172.30.0.1/32", 1, 0, true},
+		{"fd02::/112", 65535, 65535, false},
+		{"fd02::/112", 65536, 65535, true},
+		{"fd02::/120", 500, 255, true},
+		{"fd02::/64", 1000000, math.MaxUint64, false},
+		{"fd02::/48", math.MaxUint64, math.MaxUint64, false},
+	} {
+		pcn := &ParsedClusterNetwork{ServiceNetwork: mustParseCIDR(tc.serviceNetwork)}
+		if capacity := ServiceNetworkCapacity(pcn.ServiceNetwork); capacity != tc.capacity {
+			t.Fatalf("expected capacity %d for %s, got %d", tc.capacity, tc.serviceNetwork, capacity)
+		}
+		err := pcn.CheckServiceNetworkCapacity(tc.serviceCount)
+		if tc.expectErr && err == nil {
+			t.Fatalf("expected error for %d services in %s, got none", tc.serviceCount, tc.serviceNetwork)
+		} else if !tc.expectErr && err != nil {
+			t.Fatalf("unexpected error for %d services in %s: %v", tc.serviceCount, tc.serviceNetwork, err)
+		}
+	}
+
+	if err := (&ParsedClusterNetwork{}).CheckServiceNetworkCapacity(1); err == nil {
+		t.Fatalf("expected error with no service network, got none")
+	}
+}
+
+func TestRecommendMTU(t *testing.T) {
+	pcn := &ParsedClusterNetwork{OverlayMTU: DefaultOverlayMTU}
+	for _, tc := range []struct {
+		underlayMTU uint32
+		family      corev1.IPFamily
+		expected    uint32
+		expectErr   bool
+	}{
+		{1500, corev1.IPv4Protocol, 1450, false},
+		{9000, corev1.IPv4Protocol, 8950, false},
+		{1500, corev1.IPv6Protocol, 1430, false},
+		{9000, corev1.IPv6Protocol, 8930, false},
+		{50, corev1.IPv4Protocol, 0, true},
+		{60, corev1.IPv6Protocol, 0, true},
+	} {
+		mtu, err := pcn.RecommendMTU(tc.underlayMTU, tc.family)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("expected error for %s underlay MTU %d, got %d", tc.family, tc.underlayMTU, mtu)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %s underlay MTU %d: %v", tc.family, tc.underlayMTU, err)
+		}
+		if mtu != tc.expected {
+			t.Fatalf("expected MTU %d for %s underlay MTU %d, got %d", tc.expected, tc.family, tc.underlayMTU, mtu)
+		}
+	}
+}
+
+func TestServicesOutsideServiceNetwork(t *testing.T) {
+	makeService := func(name string, clusterIPs ...string) *corev1.Service {
+		svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		if len(clusterIPs) > 0 {
+			svc.Spec.ClusterIP = clusterIPs[0]
+			svc.Spec.ClusterIPs = clusterIPs
+		}
+		return svc
+	}
+	legacy := makeService("legacy")
+	legacy.Spec.ClusterIP = "172.30.200.1"
+
+	services := []*corev1.Service{
+		makeService("inside", "172.30.0.10"),
+		makeService("outside", "172.30.128.10"),
+		makeService("headless", corev1.ClusterIPNone),
+		makeService("external"),
+		makeService("dual", "172.30.0.11", "fd02::11"),
+		legacy,
+	}
+
+	outside := ServicesOutsideServiceNetwork(mustParseCIDR("172.30.0.0/17"), services)
+	names := []string{}
+	for _, svc := range outside {
+		names = append(names, svc.Name)
+	}
+	if strings.Join(names, ",") != "outside,dual,legacy" {
+		t.Fatalf("unexpected services outside of proposed network: %v", names)
+	}
+
+	if outside := ServicesOutsideServiceNetwork(mustParseCIDR("172.30.0.0/16"), services[:4]); len(outside) != 0 {
+		t.Fatalf("expected no services outside of proposed network, got %d", len(outside))
+	}
+}
+
+func TestPodsPerNode(t *testing.T) {
+	for _, tc := range []struct {
+		rangeCIDR        string
+		hostSubnetLength uint32
+		expected         uint64
+		expectErr        bool
+	}{
+		{"10.128.0.0/14", 9, 509, false},
+		{"10.128.0.0/14", 8, 253, false},
+		{"10.128.0.0/14", 10, 1021, false},
+		{"10.128.0.0/14", 2, 1, false},
+		{"10.128.0.0/14", 1, 0, true},
+		{"10.128.0.0/14", 19, 0, true},
+		{"10.0.0.0/8", 24, 16777213, false},
+		{"fd01::/48", 64, 1 << 32, false},
+		{"fd01::/48", 8, 254, false},
+		{"fd01::/48", 32, 1<<32 - 2, false},
+		{"fd01::/48", 81, 0, true},
+	} {
+		pods, err := PodsPerNode(mustParseCIDR(tc.rangeCIDR), tc.hostSubnetLength)
+		if tc.expectErr {
+			if err == nil {
+				t.Fatalf("expected error for %s with hostSubnetLength %d, got %d", tc.rangeCIDR, tc.hostSubnetLength, pods)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %s with hostSubnetLength %d: %v", tc.rangeCIDR, tc.hostSubnetLength, err)
+		}
+		if pods != tc.expected {
+			t.Fatalf("expected %d pods per node for %s with hostSubnetLength %d, got %d", tc.expected, tc.rangeCIDR, tc.hostSubnetLength, pods)
+		}
+	}
+}
+
 func Test_checkClusterObjects(t *testing.T) {
 	subnets := []*osdnv1.HostSubnet{
 		dummySubnet("192.168.1.2", "10.128.0.0/23"),
@@ -221,6 +573,107 @@ func Test_checkClusterObjects(t *testing.T) {
 	}
 }
 
+func dummyEndpointSlice(name string, addrs ...string) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{discoveryv1.LabelManagedBy: endpointSliceControllerName},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for _, addr := range addrs {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{Addresses: []string{addr}})
+	}
+	return slice
+}
+
+func TestCheckEndpointSlices(t *testing.T) {
+	ni := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 8},
+		},
+		ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+	}
+	subnets := []*osdnv1.HostSubnet{
+		dummySubnet("192.168.1.2", "10.128.0.0/23"),
+	}
+
+	tests := []struct {
+		name   string
+		slices []*discoveryv1.EndpointSlice
+		errs   []string
+	}{
+		{
+			name: "valid",
+			slices: []*discoveryv1.EndpointSlice{
+				dummyEndpointSlice("pods", "10.128.0.2", "10.129.0.5"),
+				dummyEndpointSlice("services", "172.30.0.10"),
+				dummyEndpointSlice("host-network", "192.168.1.2"),
+			},
+			errs: []string{},
+		},
+		{
+			name: "addresses outside of cluster and service network",
+			slices: []*discoveryv1.EndpointSlice{
+				dummyEndpointSlice("pods", "10.128.0.2", "10.132.0.5"),
+				dummyEndpointSlice("stale", "192.168.1.3"),
+			},
+			errs: []string{"default:pods with address 10.132.0.5", "default:stale with address 192.168.1.3"},
+		},
+		{
+			name: "slices not managed by the EndpointSlice controller are ignored",
+			slices: []*discoveryv1.EndpointSlice{
+				func() *discoveryv1.EndpointSlice {
+					slice := dummyEndpointSlice("external", "192.168.1.3")
+					slice.Labels[discoveryv1.LabelManagedBy] = "example.com/external-endpoints"
+					return slice
+				}(),
+				func() *discoveryv1.EndpointSlice {
+					slice := dummyEndpointSlice("unlabeled", "192.168.1.4")
+					slice.Labels = nil
+					return slice
+				}(),
+			},
+			errs: []string{},
+		},
+		{
+			name: "non-IP address types are ignored",
+			slices: []*discoveryv1.EndpointSlice{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "default",
+						Name:      "fqdn",
+						Labels:    map[string]string{discoveryv1.LabelManagedBy: endpointSliceControllerName},
+					},
+					AddressType: discoveryv1.AddressTypeFQDN,
+					Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"example.com"}}},
+				},
+			},
+			errs: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		err := ni.CheckEndpointSlices(subnets, test.slices)
+		if err == nil {
+			if len(test.errs) > 0 {
+				t.Fatalf("test %q unexpectedly did not get an error", test.name)
+			}
+			continue
+		}
+		errs := err.(kerrors.Aggregate).Errors()
+		if len(errs) != len(test.errs) {
+			t.Fatalf("test %q expected %d errors, got %v", test.name, len(test.errs), err)
+		}
+		for i, match := range test.errs {
+			if !strings.Contains(errs[i].Error(), match) {
+				t.Fatalf("test %q: error %d did not match %q: %v", test.name, i, match, errs[i])
+			}
+		}
+	}
+}
+
 func TestParseClusterNetwork(t *testing.T) {
 	tests := []struct {
 		name string
@@ -274,6 +727,216 @@ func TestParseClusterNetwork(t *testing.T) {
 	}
 }
 
+func TestParseClusterNetworkBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "valid YAML",
+			data: `
+apiVersion: network.openshift.io/v1
+kind: ClusterNetwork
+metadata:
+  name: default
+network: 10.128.0.0/14
+hostsubnetlength: 9
+clusterNetworks:
+- CIDR: 10.128.0.0/14
+  hostSubnetLength: 9
+serviceNetwork: 172.30.0.0/16
+vxlanPort: 4790
+mtu: 1400
+`,
+		},
+		{
+			name: "valid JSON",
+			data: `{"metadata": {"name": "example"}, "clusterNetworks": [{"CIDR": "10.128.0.0/14", "hostSubnetLength": 9}], "serviceNetwork": "172.30.0.0/16"}`,
+		},
+		{
+			name: "malformed YAML",
+			data: "metadata: [name: default",
+			err:  "could not decode ClusterNetwork",
+		},
+		{
+			name: "unknown field",
+			data: `{"metadata": {"name": "example"}, "clusterNetworks": [{"CIDR": "10.128.0.0/14", "hostSubnetLength": 9}], "serviceNetwork": "172.30.0.0/16", "serviceNetworks": "foo"}`,
+			err:  "could not decode ClusterNetwork",
+		},
+		{
+			name: "wrong field type",
+			data: `{"metadata": {"name": "example"}, "clusterNetworks": "10.128.0.0/14", "serviceNetwork": "172.30.0.0/16"}`,
+			err:  "could not decode ClusterNetwork",
+		},
+		{
+			name: "invalid network",
+			data: `{"metadata": {"name": "example"}, "clusterNetworks": [{"CIDR": "10.128.0.0/14", "hostSubnetLength": 9}], "serviceNetwork": "10.128.0.0/16"}`,
+			err:  "ClusterNetwork is invalid",
+		},
+		{
+			name: "empty document",
+			data: "",
+			err:  "ClusterNetwork is invalid",
+		},
+	}
+	for _, test := range tests {
+		pcn, err := ParseClusterNetworkBytes([]byte(test.data))
+		if err == nil {
+			if len(test.err) > 0 {
+				t.Fatalf("test %q unexpectedly did not get an error", test.name)
+			}
+			if len(pcn.ClusterNetworks) != 1 || pcn.ClusterNetworks[0].ClusterCIDR.String() != "10.128.0.0/14" || pcn.ServiceNetwork.String() != "172.30.0.0/16" {
+				t.Fatalf("test %q: unexpected result %#v", test.name, pcn)
+			}
+		} else if len(test.err) == 0 {
+			t.Fatalf("test %q: unexpected error: %v", test.name, err)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("test %q: error did not match %q: %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestParseClusterNetworkDefaults(t *testing.T) {
+	port := uint32(8472)
+	mtu := uint32(8950)
+
+	tests := []struct {
+		name         string
+		cn           osdnv1.ClusterNetwork
+		defaults     *ClusterNetworkDefaults
+		expectedPort uint32
+		expectedMTU  uint32
+	}{
+		{
+			name:         "standard defaults",
+			expectedPort: DefaultVXLANPort,
+			expectedMTU:  DefaultOverlayMTU,
+		},
+		{
+			name:         "overridden defaults",
+			defaults:     &ClusterNetworkDefaults{VXLANPort: 4790, OverlayMTU: 1400},
+			expectedPort: 4790,
+			expectedMTU:  1400,
+		},
+		{
+			name:         "explicit values take precedence over defaults",
+			cn:           osdnv1.ClusterNetwork{VXLANPort: &port, MTU: &mtu},
+			defaults:     &ClusterNetworkDefaults{VXLANPort: 4790, OverlayMTU: 1400},
+			expectedPort: port,
+			expectedMTU:  mtu,
+		},
+	}
+
+	for _, test := range tests {
+		test.cn.ClusterNetworks = []osdnv1.ClusterNetworkEntry{{CIDR: "10.0.0.0/16", HostSubnetLength: 8}}
+		test.cn.ServiceNetwork = "172.30.0.0/16"
+
+		var pcn *ParsedClusterNetwork
+		var err error
+		if test.defaults == nil {
+			pcn, err = ParseClusterNetwork(&test.cn)
+		} else {
+			pcn, err = ParseClusterNetworkWithDefaults(&test.cn, *test.defaults)
+		}
+		if err != nil {
+			t.Fatalf("test %q: unexpected error: %v", test.name, err)
+		}
+		if pcn.VXLANPort != test.expectedPort {
+			t.Fatalf("test %q: expected VXLAN port %d, got %d", test.name, test.expectedPort, pcn.VXLANPort)
+		}
+		if pcn.OverlayMTU != test.expectedMTU {
+			t.Fatalf("test %q: expected MTU %d, got %d", test.name, test.expectedMTU, pcn.OverlayMTU)
+		}
+	}
+}
+
+func TestFormatClusterNetworkEnv(t *testing.T) {
+	pcn, err := ParseClusterNetwork(&osdnv1.ClusterNetwork{
+		PluginName: "redhat/openshift-ovs-networkpolicy",
+		ClusterNetworks: []osdnv1.ClusterNetworkEntry{
+			{CIDR: "10.128.0.0/14", HostSubnetLength: 9},
+			{CIDR: "fd01::/48", HostSubnetLength: 64},
+		},
+		ServiceNetwork: "172.30.0.0/16",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing ClusterNetwork: %v", err)
+	}
+	expected := `PLUGIN_NAME=redhat/openshift-ovs-networkpolicy
+CLUSTER_NETWORK_CIDRS=10.128.0.0/14,fd01::/48
+CLUSTER_NETWORK_HOST_SUBNET_LENGTHS=9,64
+SERVICE_NETWORK_CIDR=172.30.0.0/16
+OVERLAY_MTU=1450
+VXLAN_PORT=4789
+`
+	if env := FormatClusterNetworkEnv(pcn); env != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, env)
+	}
+}
+
+func TestRoutingCompatible(t *testing.T) {
+	makePCN := func(serviceNetwork string, clusterNetworks ...string) *ParsedClusterNetwork {
+		pcn := &ParsedClusterNetwork{ServiceNetwork: mustParseCIDR(serviceNetwork)}
+		for _, cidr := range clusterNetworks {
+			pcn.ClusterNetworks = append(pcn.ClusterNetworks, ParsedClusterNetworkEntry{ClusterCIDR: mustParseCIDR(cidr), HostSubnetLength: 9})
+		}
+		return pcn
+	}
+	old := makePCN("172.30.0.0/16", "10.128.0.0/14")
+
+	for _, tc := range []struct {
+		name string
+		new  *ParsedClusterNetwork
+		err  string
+	}{
+		{
+			name: "unchanged",
+			new:  makePCN("172.30.0.0/16", "10.128.0.0/14"),
+		},
+		{
+			name: "superset",
+			new:  makePCN("172.30.0.0/15", "10.128.0.0/12"),
+		},
+		{
+			name: "added range",
+			new:  makePCN("172.30.0.0/16", "10.128.0.0/14", "10.132.0.0/14"),
+		},
+		{
+			name: "disjoint",
+			new:  makePCN("172.30.0.0/16", "10.0.0.0/14"),
+			err:  "cluster network 10.128.0.0/14 is not contained",
+		},
+		{
+			name: "shrunk",
+			new:  makePCN("172.30.0.0/16", "10.128.0.0/15"),
+			err:  "cluster network 10.128.0.0/14 is not contained",
+		},
+		{
+			name: "different host subnet length",
+			new: &ParsedClusterNetwork{
+				ServiceNetwork:  mustParseCIDR("172.30.0.0/16"),
+				ClusterNetworks: []ParsedClusterNetworkEntry{{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 8}},
+			},
+			err: "hostSubnetLength 9",
+		},
+		{
+			name: "disjoint service network",
+			new:  makePCN("172.31.0.0/16", "10.128.0.0/14"),
+			err:  "service network 172.30.0.0/16 is not contained",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := RoutingCompatible(old, tc.new)
+			if tc.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
 func TestValidateHostSubnetEgress(t *testing.T) {
 	tests := []struct {
 		name string
@@ -356,3 +1019,305 @@ func TestValidateHostSubnetEgress(t *testing.T) {
 		}
 	}
 }
+
+func TestParseEgressIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		expected []string
+		errs     int
+	}{
+		{
+			name:     "valid IPv4",
+			ips:      []string{"10.0.0.1", " 10.0.0.2 "},
+			expected: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:     "malformed",
+			ips:      []string{"10.0.0.1", "10.0.0.256", "bob"},
+			expected: []string{"10.0.0.1"},
+			errs:     2,
+		},
+		{
+			name:     "differently-formatted IPv6",
+			ips:      []string{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:DB8::1"},
+			expected: []string{"2001:db8::1", "2001:db8::1"},
+		},
+	}
+
+	for _, test := range tests {
+		ips, errs := ParseEgressIPs(test.ips)
+		if len(errs) != test.errs {
+			t.Fatalf("%s: expected %d errors, got %v", test.name, test.errs, errs)
+		}
+		if len(ips) != len(test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, ips)
+		}
+		for i := range ips {
+			if ips[i].String() != test.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", test.name, test.expected, ips)
+			}
+		}
+	}
+}
+
+func TestFindNodesMissingSubnet(t *testing.T) {
+	makeNode := func(name, ip string) *corev1.Node {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if ip != "" {
+			node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+		}
+		return node
+	}
+	nodes := []*corev1.Node{
+		makeNode("has-subnet", "192.168.1.1"),
+		makeNode("missing-subnet", "192.168.1.2"),
+		makeNode("no-ip", ""),
+		makeNode("bad-ip", "bob"),
+		makeNode("missing-subnet-ipv6", "fd00::2"),
+	}
+	subnets := []*osdnv1.HostSubnet{
+		{ObjectMeta: metav1.ObjectMeta{Name: "has-subnet"}, Host: "has-subnet", HostIP: "192.168.1.1", Subnet: "10.128.0.0/23"},
+		{ObjectMeta: metav1.ObjectMeta{Name: "f5"}, Host: "f5", HostIP: "192.168.1.100", Subnet: "10.128.2.0/23"},
+	}
+
+	missing := FindNodesMissingSubnet(nodes, subnets)
+	var names []string
+	for _, node := range missing {
+		names = append(names, node.Name)
+	}
+	expected := []string{"missing-subnet", "missing-subnet-ipv6"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestFindDuplicateNodeSubnets(t *testing.T) {
+	makeHostSubnet := func(name, subnet, uid string) *osdnv1.HostSubnet {
+		hs := &osdnv1.HostSubnet{ObjectMeta: metav1.ObjectMeta{Name: name}, Host: name, HostIP: "192.168.1.1", Subnet: subnet}
+		if uid != "" {
+			hs.Annotations = map[string]string{osdnv1.NodeUIDAnnotation: uid}
+		}
+		return hs
+	}
+	subnets := []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "10.128.0.0/23", "uid1"),
+		makeHostSubnet("node2", "10.128.2.0/23", "uid2"),
+		makeHostSubnet("f5", "10.128.4.0/23", ""),
+		makeHostSubnet("f5-2", "10.128.6.0/23", ""),
+		makeHostSubnet("f5-3", "10.128.10.0/23", " "),
+	}
+	if duplicates := FindDuplicateNodeSubnets(subnets); len(duplicates) != 0 {
+		t.Fatalf("expected no duplicates, got %v", duplicates)
+	}
+
+	// UIDs are compared after trimming whitespace
+	subnets = append(subnets, makeHostSubnet("node1-old", "10.128.8.0/23", " uid1\n"))
+	expected := map[string][]string{"uid1": {"node1", "node1-old"}}
+	if duplicates := FindDuplicateNodeSubnets(subnets); !reflect.DeepEqual(duplicates, expected) {
+		t.Fatalf("expected %v, got %v", expected, duplicates)
+	}
+}
+
+func TestMismatchedEgressIPFamilies(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		hostIP        string
+		egressIPs     []string
+		defaultFamily corev1.IPFamily
+		expected      []string
+	}{
+		{
+			name:      "IPv4 matching",
+			hostIP:    "192.168.1.1",
+			egressIPs: []string{"192.168.1.100", "192.168.1.101"},
+		},
+		{
+			name:      "IPv4 mismatched",
+			hostIP:    "192.168.1.1",
+			egressIPs: []string{"192.168.1.100", "fd00::100", "bob"},
+			expected:  []string{"fd00::100"},
+		},
+		{
+			name:      "IPv6 matching",
+			hostIP:    "fd00::1",
+			egressIPs: []string{"fd00::100", "FD00::0101"},
+		},
+		{
+			name:      "IPv6 mismatched",
+			hostIP:    "fd00::1",
+			egressIPs: []string{"fd00::100", "192.168.1.100", "::ffff:192.168.1.101"},
+			expected:  []string{"192.168.1.100", "::ffff:192.168.1.101"},
+		},
+		{
+			name:          "no host IP",
+			egressIPs:     []string{"192.168.1.100", "fd00::100"},
+			defaultFamily: corev1.IPv6Protocol,
+			expected:      []string{"192.168.1.100"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := &osdnv1.HostSubnet{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Host:       "node1",
+				HostIP:     tc.hostIP,
+				EgressIPs:  StringsToHSEgressIPs(tc.egressIPs),
+			}
+			family := tc.defaultFamily
+			if family == "" {
+				family = corev1.IPv4Protocol
+			}
+			mismatched := HSEgressIPsToStrings(MismatchedEgressIPFamilies(hs, family))
+			if strings.Join(mismatched, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("expected %v, got %v", tc.expected, mismatched)
+			}
+		})
+	}
+}
+
+func TestAggregateRoute(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		subnets  []string
+		expected string
+		err      string
+	}{
+		{
+			name:     "single subnet",
+			subnets:  []string{"10.128.0.0/23"},
+			expected: "10.128.0.0/23",
+		},
+		{
+			name:     "contiguous IPv4",
+			subnets:  []string{"10.128.2.0/23", "10.128.0.0/23", "10.128.4.0/22"},
+			expected: "10.128.0.0/21",
+		},
+		{
+			name:     "duplicate and nested subnets",
+			subnets:  []string{"10.128.0.0/23", "10.128.0.0/24", "10.128.2.0/23", "10.128.0.0/23"},
+			expected: "10.128.0.0/22",
+		},
+		{
+			name:     "contiguous IPv6",
+			subnets:  []string{"fd01:0:0:1::/64", "fd01::/64"},
+			expected: "fd01::/63",
+		},
+		{
+			name:    "disjoint IPv4",
+			subnets: []string{"10.128.0.0/23", "10.128.4.0/23"},
+			err:     "10.128.0.0/21",
+		},
+		{
+			name:    "adjacent but unaligned IPv4",
+			subnets: []string{"10.128.2.0/23", "10.128.4.0/23"},
+			err:     "10.128.0.0/21",
+		},
+		{
+			name:    "disjoint IPv6",
+			subnets: []string{"fd01::/64", "fd02::/64"},
+			err:     "fd00::/14",
+		},
+		{
+			name:    "mixed families",
+			subnets: []string{"10.128.0.0/23", "fd01::/64"},
+			err:     "cannot aggregate",
+		},
+		{
+			name: "no subnets",
+			err:  "no subnets",
+		},
+		{
+			name:    "invalid subnet",
+			subnets: []string{"10.128.0.0"},
+			err:     "invalid CIDR",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			route, err := AggregateRoute(tc.subnets)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error matching %q, got %q, %v", tc.err, route, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if route != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, route)
+			}
+		})
+	}
+}
+
+func TestHostSubnetFormatters(t *testing.T) {
+	hs := &osdnv1.HostSubnet{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Host:       "node1",
+		HostIP:     "192.168.1.1",
+		Subnet:     "10.128.0.0/23",
+	}
+	human := `node1 (host: "node1", ip: "192.168.1.1", subnet: "10.128.0.0/23")`
+	kv := `name="node1" host="node1" hostIP="192.168.1.1" subnet="10.128.0.0/23"`
+
+	if s := HostSubnetToString(hs); s != human {
+		t.Fatalf("expected default format %s, got %s", human, s)
+	}
+	if s := HostSubnetToKV(hs); s != kv {
+		t.Fatalf("expected key=value format %s, got %s", kv, s)
+	}
+
+	SetHostSubnetFormatter(HostSubnetToKV)
+	defer SetHostSubnetFormatter(nil)
+	if s := HostSubnetToString(hs); s != kv {
+		t.Fatalf("expected configured format %s, got %s", kv, s)
+	}
+	SetHostSubnetFormatter(nil)
+	if s := HostSubnetToString(hs); s != human {
+		t.Fatalf("expected restored default format %s, got %s", human, s)
+	}
+}
+
+func TestCheckNodeIPIsLocal(t *testing.T) {
+	hostIPs := []net.IP{net.ParseIP("10.0.0.5").To4(), net.ParseIP("192.168.1.1").To4(), net.ParseIP("fd00::1")}
+	for _, tc := range []struct {
+		nodeIP string
+		err    string
+	}{
+		{nodeIP: "192.168.1.1"},
+		{nodeIP: "fd00::1"},
+		{nodeIP: "192.168.1.2", err: "not present"},
+		{nodeIP: "bob", err: "invalid node IP"},
+	} {
+		err := CheckNodeIPIsLocal(tc.nodeIP, hostIPs)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.nodeIP, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: expected error matching %q, got %v", tc.nodeIP, tc.err, err)
+		}
+	}
+}
+
+func TestFindGatewayMismatches(t *testing.T) {
+	makeHostSubnet := func(name, subnet string) *osdnv1.HostSubnet {
+		return &osdnv1.HostSubnet{ObjectMeta: metav1.ObjectMeta{Name: name}, Host: name, HostIP: "192.168.1.1", Subnet: subnet}
+	}
+	subnets := []*osdnv1.HostSubnet{
+		makeHostSubnet("network-address", "10.128.0.0/23"),
+		makeHostSubnet("default-gateway", "10.128.2.1/23"),
+		makeHostSubnet("other-gateway", "10.128.5.254/23"),
+		makeHostSubnet("ipv6", "fd01::fe/64"),
+		makeHostSubnet("invalid", "10.128.6.0"),
+	}
+
+	mismatches := FindGatewayMismatches(subnets)
+	expected := []GatewayMismatch{{
+		HostSubnet: "other-gateway",
+		Subnet:     "10.128.5.254/23",
+		Implied:    "10.128.5.254",
+		Expected:   "10.128.4.1",
+	}}
+	if !reflect.DeepEqual(mismatches, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, mismatches)
+	}
+}
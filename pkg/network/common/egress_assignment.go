@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// EgressIPRejectionReason is the reason CanAssignEgressIP rejects an egress IP
+type EgressIPRejectionReason string
+
+const (
+	// EgressIPInvalid means the egress IP can't be parsed
+	EgressIPInvalid EgressIPRejectionReason = "InvalidIP"
+	// EgressIPUnknownNode means there is no HostSubnet for the target node
+	EgressIPUnknownNode EgressIPRejectionReason = "UnknownNode"
+	// EgressIPFamilyMismatch means the egress IP is not of the target node's IP family
+	EgressIPFamilyMismatch EgressIPRejectionReason = "FamilyMismatch"
+	// EgressIPInClusterNetwork means the egress IP is inside a cluster network
+	EgressIPInClusterNetwork EgressIPRejectionReason = "InClusterNetwork"
+	// EgressIPInServiceNetwork means the egress IP is inside the service network
+	EgressIPInServiceNetwork EgressIPRejectionReason = "InServiceNetwork"
+	// EgressIPInPodSubnet means the egress IP is inside a HostSubnet's subnet (that is
+	// not part of a cluster network)
+	EgressIPInPodSubnet EgressIPRejectionReason = "InPodSubnet"
+	// EgressIPAssignedElsewhere means the egress IP is already assigned to another node
+	EgressIPAssignedElsewhere EgressIPRejectionReason = "AssignedElsewhere"
+)
+
+// EgressIPAssignmentError is returned by CanAssignEgressIP when an egress IP can't be
+// assigned to a node
+type EgressIPAssignmentError struct {
+	IP     string
+	Node   string
+	Reason EgressIPRejectionReason
+	Detail string
+}
+
+func (e *EgressIPAssignmentError) Error() string {
+	return fmt.Sprintf("cannot assign egress IP %s to node %s: %s", e.IP, e.Node, e.Detail)
+}
+
+// CanAssignEgressIP checks whether ip can be added to the egress IPs of targetNode's
+// HostSubnet, given allSubnets (which must include targetNode's HostSubnet). It returns
+// an *EgressIPAssignmentError describing the first problem found, or nil if the IP can be
+// assigned. An IP already assigned to targetNode can be assigned again.
+func (pcn *ParsedClusterNetwork) CanAssignEgressIP(ip, targetNode string, allSubnets []*osdnv1.HostSubnet) error {
+	reject := func(reason EgressIPRejectionReason, format string, args ...interface{}) error {
+		return &EgressIPAssignmentError{IP: ip, Node: targetNode, Reason: reason, Detail: fmt.Sprintf(format, args...)}
+	}
+
+	ips, errs := ParseEgressIPs([]string{ip})
+	if len(errs) > 0 {
+		return reject(EgressIPInvalid, "%v", errs[0])
+	}
+	egressIP := ips[0]
+
+	var target *osdnv1.HostSubnet
+	for _, hs := range allSubnets {
+		if hs.Name == targetNode {
+			target = hs
+			break
+		}
+	}
+	if target == nil {
+		return reject(EgressIPUnknownNode, "node has no HostSubnet")
+	}
+	probe := &osdnv1.HostSubnet{HostIP: target.HostIP, EgressIPs: []osdnv1.HostSubnetEgressIP{osdnv1.HostSubnetEgressIP(egressIP.String())}}
+	if len(MismatchedEgressIPFamilies(probe, pcn.PrimaryIPFamily())) > 0 {
+		return reject(EgressIPFamilyMismatch, "IP family does not match node IP %s", target.HostIP)
+	}
+
+	for _, cn := range pcn.ClusterNetworks {
+		if cn.ClusterCIDR.Contains(egressIP) {
+			return reject(EgressIPInClusterNetwork, "IP is inside cluster network %s", cn.ClusterCIDR.String())
+		}
+	}
+	if pcn.ServiceNetwork != nil && pcn.ServiceNetwork.Contains(egressIP) {
+		return reject(EgressIPInServiceNetwork, "IP is inside service network %s", pcn.ServiceNetwork.String())
+	}
+	if hs := NewSubnetIndex(allSubnets).LookupByIP(egressIP); hs != nil {
+		return reject(EgressIPInPodSubnet, "IP is inside subnet %s of HostSubnet %s", hs.Subnet, hs.Name)
+	}
+
+	for _, hs := range allSubnets {
+		if hs.Name == targetNode {
+			continue
+		}
+		assigned, _ := ParseEgressIPs(HSEgressIPsToStrings(hs.EgressIPs))
+		for _, other := range assigned {
+			if other.Equal(egressIP) {
+				return reject(EgressIPAssignedElsewhere, "IP is already assigned to node %s", hs.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestCanAssignEgressIP(t *testing.T) {
+	pcn := &ParsedClusterNetwork{
+		ClusterNetworks: []ParsedClusterNetworkEntry{
+			{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 9},
+		},
+		ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+	}
+	makeHostSubnet := func(name, hostIP, subnet string, egressIPs ...string) *osdnv1.HostSubnet {
+		return &osdnv1.HostSubnet{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Host:       name,
+			HostIP:     hostIP,
+			Subnet:     subnet,
+			EgressIPs:  StringsToHSEgressIPs(egressIPs),
+		}
+	}
+	subnets := []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "192.168.1.1", "10.128.0.0/23", "192.168.1.100"),
+		makeHostSubnet("node2", "192.168.1.2", "10.128.2.0/23", "192.168.1.101"),
+		makeHostSubnet("node6", "fd00::1", "fd01::/64"),
+		makeHostSubnet("legacy", "192.168.1.3", "10.0.0.0/23"),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ip       string
+		node     string
+		expected EgressIPRejectionReason
+	}{
+		{
+			name: "assignable",
+			ip:   "192.168.1.102",
+			node: "node1",
+		},
+		{
+			name: "already assigned to the same node",
+			ip:   "192.168.1.100",
+			node: "node1",
+		},
+		{
+			name:     "invalid",
+			ip:       "192.168.1",
+			node:     "node1",
+			expected: EgressIPInvalid,
+		},
+		{
+			name:     "unknown node",
+			ip:       "192.168.1.102",
+			node:     "node3",
+			expected: EgressIPUnknownNode,
+		},
+		{
+			name:     "wrong family",
+			ip:       "fd00::100",
+			node:     "node1",
+			expected: EgressIPFamilyMismatch,
+		},
+		{
+			name:     "wrong family for IPv6 node",
+			ip:       "192.168.1.102",
+			node:     "node6",
+			expected: EgressIPFamilyMismatch,
+		},
+		{
+			name:     "in cluster network",
+			ip:       "10.129.0.5",
+			node:     "node1",
+			expected: EgressIPInClusterNetwork,
+		},
+		{
+			name:     "in service network",
+			ip:       "172.30.0.5",
+			node:     "node1",
+			expected: EgressIPInServiceNetwork,
+		},
+		{
+			name:     "in pod subnet outside cluster network",
+			ip:       "10.0.0.5",
+			node:     "node1",
+			expected: EgressIPInPodSubnet,
+		},
+		{
+			name:     "assigned elsewhere",
+			ip:       " 192.168.1.101",
+			node:     "node1",
+			expected: EgressIPAssignedElsewhere,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := pcn.CanAssignEgressIP(tc.ip, tc.node, subnets)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var assignErr *EgressIPAssignmentError
+			if !errors.As(err, &assignErr) {
+				t.Fatalf("expected EgressIPAssignmentError, got %v", err)
+			}
+			if assignErr.Reason != tc.expected {
+				t.Fatalf("expected reason %s, got %s (%v)", tc.expected, assignErr.Reason, err)
+			}
+		})
+	}
+}
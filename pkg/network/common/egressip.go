@@ -485,7 +485,33 @@ func (eit *EgressIPTracker) GetNodeCloudEgressIPConfig(nodeName string) (*nodeCl
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving node %q, err: %v", nodeName, err)
 	}
+	return parseNodeCloudEgressIPConfig(node)
+}
+
+// NodeCloudEgressIPNetworks returns the networks of node's egress interface, according to
+// its cloud egress IP config annotation, or nil if it has none
+func NodeCloudEgressIPNetworks(node *corev1.Node) ([]*net.IPNet, error) {
+	cloudEgressIPConfig, err := parseNodeCloudEgressIPConfig(node)
+	if err != nil || cloudEgressIPConfig == nil {
+		return nil, err
+	}
+	var networks []*net.IPNet
+	for _, cidr := range []string{cloudEgressIPConfig.IFAddr.IPv4, cloudEgressIPConfig.IFAddr.IPv6} {
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface address %q in annotation %q: %v", cidr, nodeEgressIPConfigAnnotationKey, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
 
+// parseNodeCloudEgressIPConfig returns the cloud egress IP config in node's annotation,
+// or nil if it has none
+func parseNodeCloudEgressIPConfig(node *corev1.Node) (*nodeCloudEgressIPConfiguration, error) {
 	nodeCloudEgressIPAnnotation, exists := node.Annotations[nodeEgressIPConfigAnnotationKey]
 	if !exists {
 		return nil, nil
@@ -2175,6 +2175,66 @@ func TestValidEgressCIDRsForCloudNodes(t *testing.T) {
 	}
 }
 
+func TestNodeCloudEgressIPNetworks(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		annotation *string
+		expected   []string
+		expectErr  bool
+	}{
+		{
+			name:     "no annotation",
+			expected: nil,
+		},
+		{
+			name:       "IPv4 only",
+			annotation: stringPtr(`[{"interface":"eni-1","ifaddr":{"ipv4":"172.17.0.2/23"},"capacity":{"ipv4":2}}]`),
+			expected:   []string{"172.17.0.0/23"},
+		},
+		{
+			name:       "dual stack",
+			annotation: stringPtr(`[{"interface":"eni-1","ifaddr":{"ipv4":"172.17.0.2/23","ipv6":"fd00::2/64"},"capacity":{"ip":4}}]`),
+			expected:   []string{"172.17.0.0/23", "fd00::/64"},
+		},
+		{
+			name:       "bad CIDR",
+			annotation: stringPtr(`[{"interface":"eni-1","ifaddr":{"ipv4":"172.17.0.2"},"capacity":{"ipv4":2}}]`),
+			expectErr:  true,
+		},
+		{
+			name:       "bad JSON",
+			annotation: stringPtr(`{`),
+			expectErr:  true,
+		},
+	} {
+		node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node1"}}
+		if tc.annotation != nil {
+			node.Annotations = map[string]string{nodeEgressIPConfigAnnotationKey: *tc.annotation}
+		}
+		networks, err := NodeCloudEgressIPNetworks(node)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tc.name, networks)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, network := range networks {
+			got = append(got, network.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
 func getAllAssignedEgressIPs(allocation map[string][]string) sets.String {
 	assignedEgressIPs := sets.NewString()
 	for _, nodeAllocations := range allocation {
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
@@ -86,6 +87,20 @@ func ListAllServices(ctx context.Context, client kubernetes.Interface) ([]*corev
 	return list, err
 }
 
+func ListAllEndpointSlices(ctx context.Context, client kubernetes.Interface) ([]*discoveryv1.EndpointSlice, error) {
+	list := []*discoveryv1.EndpointSlice{}
+	opts := metav1.ListOptions{
+		ResourceVersion: "0",
+	}
+	err := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return client.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, opts)
+	}).EachListItem(ctx, opts, func(obj runtime.Object) error {
+		list = append(list, obj.(*discoveryv1.EndpointSlice))
+		return nil
+	})
+	return list, err
+}
+
 func ListServicesInNamespace(ctx context.Context, client kubernetes.Interface, namespace string) ([]*corev1.Service, error) {
 	list := []*corev1.Service{}
 	opts := metav1.ListOptions{
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// PodIPOptions controls which addresses of a HostSubnet can be assigned to pods
+type PodIPOptions struct {
+	// ReservedOffsets are offsets within every subnet (where the network address is
+	// offset 0) that are never assigned to pods, in addition to the network address,
+	// the gateway address (offset 1), and, for IPv4, the broadcast address. Offsets
+	// outside of a subnet are ignored.
+	ReservedOffsets []uint64
+}
+
+// usableOffsets returns the first and last offsets within subnet that could be assigned
+// to pods, ignoring opts.ReservedOffsets
+func usableOffsets(subnet *net.IPNet) (*big.Int, *big.Int) {
+	ones, bits := subnet.Mask.Size()
+	last := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last.Sub(last, big.NewInt(1))
+	if bits == 32 {
+		// broadcast address
+		last.Sub(last, big.NewInt(1))
+	}
+	return big.NewInt(2), last
+}
+
+func (opts PodIPOptions) reserved() map[uint64]bool {
+	reserved := make(map[uint64]bool, len(opts.ReservedOffsets))
+	for _, offset := range opts.ReservedOffsets {
+		reserved[offset] = true
+	}
+	return reserved
+}
+
+func isReservedOffset(offset *big.Int, reserved map[uint64]bool) bool {
+	return offset.IsUint64() && reserved[offset.Uint64()]
+}
+
+// ipAtOffset returns the IP at offset within subnet
+func ipAtOffset(subnet *net.IPNet, offset *big.Int) net.IP {
+	base := subnet.IP.To4()
+	if base == nil {
+		base = subnet.IP.To16()
+	}
+	sum := new(big.Int).Add(new(big.Int).SetBytes(base), offset)
+	ip := make(net.IP, len(base))
+	return sum.FillBytes(ip)
+}
+
+// UsableHostRange returns the first and last IPs in subnet that can be assigned to pods.
+// (Reserved offsets between the two may also be unassignable; use IteratePodIPs to skip
+// them.) It returns an error if subnet has no assignable IPs.
+func UsableHostRange(subnet *net.IPNet, opts PodIPOptions) (net.IP, net.IP, error) {
+	first, last := usableOffsets(subnet)
+	reserved := opts.reserved()
+	for first.Cmp(last) <= 0 && isReservedOffset(first, reserved) {
+		first.Add(first, big.NewInt(1))
+	}
+	for last.Cmp(first) >= 0 && isReservedOffset(last, reserved) {
+		last.Sub(last, big.NewInt(1))
+	}
+	if first.Cmp(last) > 0 {
+		return nil, nil, fmt.Errorf("subnet %s has no IPs that can be assigned to pods", subnet.String())
+	}
+	return ipAtOffset(subnet, first), ipAtOffset(subnet, last), nil
+}
+
+// IteratePodIPs calls fn with each IP in subnet that can be assigned to pods, in order,
+// until fn returns false
+func IteratePodIPs(subnet *net.IPNet, opts PodIPOptions, fn func(ip net.IP) bool) {
+	offset, last := usableOffsets(subnet)
+	reserved := opts.reserved()
+	for ; offset.Cmp(last) <= 0; offset.Add(offset, big.NewInt(1)) {
+		if isReservedOffset(offset, reserved) {
+			continue
+		}
+		if !fn(ipAtOffset(subnet, offset)) {
+			return
+		}
+	}
+}
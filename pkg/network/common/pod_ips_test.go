@@ -0,0 +1,120 @@
+package common
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPodIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		reserved []uint64
+		first    string
+		last     string
+		count    int
+		excluded []string
+		err      bool
+	}{
+		{
+			name:   "/24 with no reservations",
+			subnet: "10.128.0.0/24",
+			first:  "10.128.0.2",
+			last:   "10.128.0.254",
+			count:  253,
+		},
+		{
+			name:     "/24 with reservations",
+			subnet:   "10.128.0.0/24",
+			reserved: []uint64{2, 3, 10, 254},
+			first:    "10.128.0.4",
+			last:     "10.128.0.253",
+			count:    249,
+			excluded: []string{"10.128.0.2", "10.128.0.3", "10.128.0.10", "10.128.0.254"},
+		},
+		{
+			name:     "/23 with reservations",
+			subnet:   "10.128.2.0/23",
+			reserved: []uint64{2, 256, 1000},
+			first:    "10.128.2.3",
+			last:     "10.128.3.254",
+			count:    507,
+			excluded: []string{"10.128.2.2", "10.128.3.0"},
+		},
+		{
+			name:     "/29 with reservations",
+			subnet:   "10.128.0.8/29",
+			reserved: []uint64{2, 6},
+			first:    "10.128.0.11",
+			last:     "10.128.0.13",
+			count:    3,
+			excluded: []string{"10.128.0.10", "10.128.0.14"},
+		},
+		{
+			name:     "fully reserved",
+			subnet:   "10.128.0.8/30",
+			reserved: []uint64{2},
+			err:      true,
+		},
+		{
+			name:     "IPv6",
+			subnet:   "fd01:0:0:1::/120",
+			reserved: []uint64{2, 255},
+			first:    "fd01:0:0:1::3",
+			last:     "fd01:0:0:1::fe",
+			count:    252,
+			excluded: []string{"fd01:0:0:1::2", "fd01:0:0:1::ff"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subnet := mustParseCIDR(tc.subnet)
+			opts := PodIPOptions{ReservedOffsets: tc.reserved}
+
+			first, last, err := UsableHostRange(subnet, opts)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s-%s", first, last)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !first.Equal(net.ParseIP(tc.first)) || !last.Equal(net.ParseIP(tc.last)) {
+				t.Fatalf("expected %s-%s, got %s-%s", tc.first, tc.last, first, last)
+			}
+
+			var ips []net.IP
+			IteratePodIPs(subnet, opts, func(ip net.IP) bool {
+				ips = append(ips, ip)
+				return true
+			})
+			if len(ips) != tc.count {
+				t.Fatalf("expected %d pod IPs, got %d", tc.count, len(ips))
+			}
+			if !reflect.DeepEqual(ips[0], first) || !reflect.DeepEqual(ips[len(ips)-1], last) {
+				t.Fatalf("expected IPs from %s to %s, got %s to %s", first, last, ips[0], ips[len(ips)-1])
+			}
+			for _, ip := range ips {
+				for _, excluded := range tc.excluded {
+					if ip.Equal(net.ParseIP(excluded)) {
+						t.Fatalf("reserved IP %s was not excluded", excluded)
+					}
+				}
+			}
+		})
+	}
+
+	// Iteration stops when fn returns false
+	count := 0
+	IteratePodIPs(mustParseCIDR("10.128.0.0/24"), PodIPOptions{}, func(ip net.IP) bool {
+		count++
+		return count < 5
+	})
+	if count != 5 {
+		t.Fatalf("expected iteration to stop after 5 IPs, got %d", count)
+	}
+}
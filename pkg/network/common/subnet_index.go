@@ -0,0 +1,241 @@
+package common
+
+import (
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+// SubnetIndex answers containment queries ("which HostSubnet contains this IP / CIDR?")
+// over a set of HostSubnets. It is a binary radix trie keyed on the subnet prefix, so
+// lookups take time proportional to the address length rather than to the number of
+// subnets. It can be kept up to date with Add and Remove as HostSubnets change; it is
+// safe for concurrent lookups, but callers must synchronize modifications with lookups.
+type SubnetIndex struct {
+	v4  *subnetIndexNode
+	v6  *subnetIndexNode
+	len int
+	// The indexed HostSubnets, by name
+	byName map[string]*osdnv1.HostSubnet
+}
+
+type subnetIndexNode struct {
+	children [2]*subnetIndexNode
+	// The HostSubnets with this node's subnet, in the order they were added
+	subnets []*osdnv1.HostSubnet
+}
+
+// NewSubnetIndex builds a SubnetIndex from subnets (see Add).
+func NewSubnetIndex(subnets []*osdnv1.HostSubnet) *SubnetIndex {
+	idx := &SubnetIndex{
+		v4:     &subnetIndexNode{},
+		v6:     &subnetIndexNode{},
+		byName: make(map[string]*osdnv1.HostSubnet),
+	}
+	for _, hs := range subnets {
+		idx.Add(hs)
+	}
+	return idx
+}
+
+// Add adds hs to the index, replacing any HostSubnet of the same name. HostSubnets with no
+// subnet or with an unparseable subnet are not indexed. If two HostSubnets have the same
+// subnet, lookups return the later one.
+func (idx *SubnetIndex) Add(hs *osdnv1.HostSubnet) {
+	idx.Remove(hs.Name)
+	if hs.Subnet == "" {
+		return
+	}
+	_, cidr, err := net.ParseCIDR(hs.Subnet)
+	if err != nil {
+		klog.Warningf("Ignoring HostSubnet %q with invalid subnet %q in subnet index: %v", hs.Name, hs.Subnet, err)
+		return
+	}
+	node := idx.nodeFor(cidr, true)
+	if len(node.subnets) == 0 {
+		idx.len++
+	}
+	node.subnets = append(node.subnets, hs)
+	idx.byName[hs.Name] = hs
+}
+
+// Remove removes the HostSubnet called name from the index, if it is there
+func (idx *SubnetIndex) Remove(name string) {
+	hs, ok := idx.byName[name]
+	if !ok {
+		return
+	}
+	delete(idx.byName, name)
+	_, cidr, _ := net.ParseCIDR(hs.Subnet)
+	node := idx.nodeFor(cidr, false)
+	for i, other := range node.subnets {
+		if other.Name == name {
+			node.subnets = append(node.subnets[:i:i], node.subnets[i+1:]...)
+			break
+		}
+	}
+	if len(node.subnets) == 0 {
+		idx.len--
+	}
+}
+
+// nodeFor returns the trie node for cidr, creating it (and the nodes on the way to it) if
+// create is set, or else returning nil if it doesn't exist
+func (idx *SubnetIndex) nodeFor(cidr *net.IPNet, create bool) *subnetIndexNode {
+	ones, _ := cidr.Mask.Size()
+	root, addr := idx.rootFor(cidr.IP)
+	node := root
+	for i := 0; i < ones; i++ {
+		bit := addrBit(addr, i)
+		if node.children[bit] == nil {
+			if !create {
+				return nil
+			}
+			node.children[bit] = &subnetIndexNode{}
+		}
+		node = node.children[bit]
+	}
+	return node
+}
+
+// Len returns the number of distinct subnets in the index
+func (idx *SubnetIndex) Len() int {
+	return idx.len
+}
+
+// LookupByIP returns the HostSubnet whose subnet contains ip, or nil if there is none. If
+// more than one subnet contains ip, the most specific one is returned.
+func (idx *SubnetIndex) LookupByIP(ip net.IP) *osdnv1.HostSubnet {
+	if ip == nil {
+		return nil
+	}
+	root, addr := idx.rootFor(ip)
+	return idx.lookup(root, addr, len(addr)*8)
+}
+
+// LookupByCIDR returns the HostSubnet whose subnet contains all of cidr (including a
+// subnet equal to cidr), or nil if there is none. If more than one subnet contains cidr,
+// the most specific one is returned.
+func (idx *SubnetIndex) LookupByCIDR(cidr *net.IPNet) *osdnv1.HostSubnet {
+	if cidr == nil {
+		return nil
+	}
+	ones, bits := cidr.Mask.Size()
+	root, addr := idx.rootFor(cidr.IP)
+	if bits != len(addr)*8 {
+		return nil
+	}
+	return idx.lookup(root, addr, ones)
+}
+
+// Overlapping returns the HostSubnets whose subnets overlap cidr: those containing it
+// (including a subnet equal to it), from least to most specific, followed by those inside
+// it.
+func (idx *SubnetIndex) Overlapping(cidr *net.IPNet) []*osdnv1.HostSubnet {
+	if cidr == nil {
+		return nil
+	}
+	ones, bits := cidr.Mask.Size()
+	root, addr := idx.rootFor(cidr.IP)
+	if bits != len(addr)*8 {
+		return nil
+	}
+	var found []*osdnv1.HostSubnet
+	node := root
+	for i := 0; node != nil; i++ {
+		found = append(found, node.subnets...)
+		if i == ones {
+			for _, child := range node.children {
+				found = appendSubtree(found, child)
+			}
+			break
+		}
+		node = node.children[addrBit(addr, i)]
+	}
+	return found
+}
+
+// appendSubtree appends the subnets of node and its descendants to found
+func appendSubtree(found []*osdnv1.HostSubnet, node *subnetIndexNode) []*osdnv1.HostSubnet {
+	if node == nil {
+		return found
+	}
+	found = append(found, node.subnets...)
+	for _, child := range node.children {
+		found = appendSubtree(found, child)
+	}
+	return found
+}
+
+// rootFor returns the trie for ip's address family and ip in that family's byte form
+func (idx *SubnetIndex) rootFor(ip net.IP) (*subnetIndexNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return idx.v4, ip4
+	}
+	return idx.v6, ip.To16()
+}
+
+// lookup returns the latest-added subnet of the deepest node on addr's path within the first maxBits
+// bits
+func (idx *SubnetIndex) lookup(root *subnetIndexNode, addr net.IP, maxBits int) *osdnv1.HostSubnet {
+	var found *osdnv1.HostSubnet
+	node := root
+	for i := 0; node != nil; i++ {
+		if len(node.subnets) > 0 {
+			found = node.subnets[len(node.subnets)-1]
+		}
+		if i == maxBits {
+			break
+		}
+		node = node.children[addrBit(addr, i)]
+	}
+	return found
+}
+
+func addrBit(addr net.IP, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// MisplacedPod describes a pod whose IP belongs to a HostSubnet other than that of the
+// node the pod is scheduled on
+type MisplacedPod struct {
+	Pod *corev1.Pod
+	IP  string
+	// ExpectedNode is the node the pod is scheduled on
+	ExpectedNode string
+	// ActualNode is the node owning the HostSubnet that contains IP
+	ActualNode string
+}
+
+// FindMisplacedPods returns the pods in pods that have an IP in a HostSubnet (according
+// to idx) belonging to a different node than the one they are scheduled on, which
+// indicates IPAM corruption or misrouted traffic. Host-network pods, unscheduled pods, and
+// IPs not in any HostSubnet are ignored.
+func FindMisplacedPods(idx *SubnetIndex, pods []*corev1.Pod) []MisplacedPod {
+	var misplaced []MisplacedPod
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Spec.NodeName == "" {
+			continue
+		}
+		podIPs := pod.Status.PodIPs
+		if len(podIPs) == 0 && pod.Status.PodIP != "" {
+			podIPs = []corev1.PodIP{{IP: pod.Status.PodIP}}
+		}
+		for _, podIP := range podIPs {
+			hs := idx.LookupByIP(net.ParseIP(podIP.IP))
+			if hs == nil || hs.Host == pod.Spec.NodeName {
+				continue
+			}
+			misplaced = append(misplaced, MisplacedPod{
+				Pod:          pod,
+				IP:           podIP.IP,
+				ExpectedNode: pod.Spec.NodeName,
+				ActualNode:   hs.Host,
+			})
+		}
+	}
+	return misplaced
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func makeIndexedHostSubnet(name, subnet string) *osdnv1.HostSubnet {
+	return &osdnv1.HostSubnet{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Host:       name,
+		Subnet:     subnet,
+	}
+}
+
+func TestSubnetIndex(t *testing.T) {
+	idx := NewSubnetIndex([]*osdnv1.HostSubnet{
+		makeIndexedHostSubnet("node1", "10.128.0.0/23"),
+		makeIndexedHostSubnet("node2", "10.128.2.0/23"),
+		makeIndexedHostSubnet("node3", "10.129.0.0/23"),
+		makeIndexedHostSubnet("wide", "10.130.0.0/16"),
+		makeIndexedHostSubnet("narrow", "10.130.4.0/24"),
+		makeIndexedHostSubnet("node6", "fd01:0:0:1::/64"),
+		makeIndexedHostSubnet("empty", ""),
+		makeIndexedHostSubnet("bad", "not-a-cidr"),
+	})
+	if idx.Len() != 6 {
+		t.Fatalf("expected 6 subnets in index, got %d", idx.Len())
+	}
+
+	for _, tc := range []struct {
+		ip       string
+		expected string
+	}{
+		{"10.128.0.1", "node1"},
+		{"10.128.1.255", "node1"},
+		{"10.128.2.0", "node2"},
+		{"10.128.4.1", ""},
+		{"10.129.1.10", "node3"},
+		{"10.130.9.9", "wide"},
+		{"10.130.4.9", "narrow"},
+		{"::ffff:10.128.0.5", "node1"},
+		{"fd01:0:0:1::5", "node6"},
+		{"fd01:0:0:2::5", ""},
+		{"192.168.0.1", ""},
+	} {
+		hs := idx.LookupByIP(net.ParseIP(tc.ip))
+		if name := subnetIndexResultName(hs); name != tc.expected {
+			t.Fatalf("LookupByIP(%s): expected %q, got %q", tc.ip, tc.expected, name)
+		}
+	}
+
+	for _, tc := range []struct {
+		cidr     string
+		expected string
+	}{
+		{"10.128.0.0/23", "node1"},
+		{"10.128.0.0/24", "node1"},
+		{"10.128.1.128/25", "node1"},
+		{"10.128.0.0/22", ""},
+		{"10.130.4.0/24", "narrow"},
+		{"10.130.4.0/23", "wide"},
+		{"10.130.0.0/15", ""},
+		{"fd01:0:0:1::/80", "node6"},
+		{"fd01::/48", ""},
+	} {
+		_, cidr, err := net.ParseCIDR(tc.cidr)
+		if err != nil {
+			t.Fatalf("bad CIDR %q: %v", tc.cidr, err)
+		}
+		hs := idx.LookupByCIDR(cidr)
+		if name := subnetIndexResultName(hs); name != tc.expected {
+			t.Fatalf("LookupByCIDR(%s): expected %q, got %q", tc.cidr, tc.expected, name)
+		}
+	}
+
+	if hs := idx.LookupByIP(nil); hs != nil {
+		t.Fatalf("expected no result for nil IP, got %q", hs.Name)
+	}
+}
+
+func TestSubnetIndexOverlapping(t *testing.T) {
+	idx := NewSubnetIndex([]*osdnv1.HostSubnet{
+		makeIndexedHostSubnet("node1", "10.128.0.0/23"),
+		makeIndexedHostSubnet("node2", "10.128.2.0/23"),
+		makeIndexedHostSubnet("wide", "10.130.0.0/16"),
+		makeIndexedHostSubnet("narrow1", "10.130.4.0/24"),
+		makeIndexedHostSubnet("narrow2", "10.130.6.0/24"),
+	})
+
+	for _, tc := range []struct {
+		cidr     string
+		expected []string
+	}{
+		{"10.128.0.0/23", []string{"node1"}},
+		{"10.128.0.0/22", []string{"node1", "node2"}},
+		{"10.128.4.0/23", nil},
+		{"10.130.4.0/23", []string{"wide", "narrow1"}},
+		{"10.130.0.0/21", []string{"wide", "narrow1", "narrow2"}},
+		{"10.0.0.0/8", []string{"node1", "node2", "wide", "narrow1", "narrow2"}},
+		{"fd01::/64", nil},
+	} {
+		_, cidr, err := net.ParseCIDR(tc.cidr)
+		if err != nil {
+			t.Fatalf("bad CIDR %q: %v", tc.cidr, err)
+		}
+		var names []string
+		for _, hs := range idx.Overlapping(cidr) {
+			names = append(names, hs.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.expected) {
+			t.Fatalf("Overlapping(%s): expected %v, got %v", tc.cidr, tc.expected, names)
+		}
+	}
+}
+
+func TestSubnetIndexAddRemove(t *testing.T) {
+	idx := NewSubnetIndex(nil)
+	idx.Add(makeIndexedHostSubnet("node1", "10.128.0.0/23"))
+	idx.Add(makeIndexedHostSubnet("node2", "10.128.2.0/23"))
+	idx.Add(makeIndexedHostSubnet("dup", "10.128.2.0/23"))
+	if idx.Len() != 2 {
+		t.Fatalf("expected 2 subnets in index, got %d", idx.Len())
+	}
+	if name := subnetIndexResultName(idx.LookupByIP(net.ParseIP("10.128.2.1"))); name != "dup" {
+		t.Fatalf("expected later HostSubnet dup to win, got %q", name)
+	}
+	_, cidr, _ := net.ParseCIDR("10.128.2.0/23")
+	if overlapping := idx.Overlapping(cidr); len(overlapping) != 2 {
+		t.Fatalf("expected both HostSubnets with the same subnet to overlap, got %d", len(overlapping))
+	}
+
+	// Re-adding a HostSubnet moves it
+	idx.Add(makeIndexedHostSubnet("node1", "10.128.4.0/23"))
+	if hs := idx.LookupByIP(net.ParseIP("10.128.0.1")); hs != nil {
+		t.Fatalf("expected old subnet of node1 to be gone, got %q", hs.Name)
+	}
+	if name := subnetIndexResultName(idx.LookupByIP(net.ParseIP("10.128.4.1"))); name != "node1" {
+		t.Fatalf("expected node1 at its new subnet, got %q", name)
+	}
+
+	idx.Remove("dup")
+	if name := subnetIndexResultName(idx.LookupByIP(net.ParseIP("10.128.2.1"))); name != "node2" {
+		t.Fatalf("expected node2 after removing dup, got %q", name)
+	}
+	idx.Remove("node2")
+	idx.Remove("node2")
+	idx.Remove("unknown")
+	if hs := idx.LookupByIP(net.ParseIP("10.128.2.1")); hs != nil {
+		t.Fatalf("expected no HostSubnet after removing node2, got %q", hs.Name)
+	}
+	if idx.Len() != 1 {
+		t.Fatalf("expected 1 subnet in index, got %d", idx.Len())
+	}
+}
+
+func subnetIndexResultName(hs *osdnv1.HostSubnet) string {
+	if hs == nil {
+		return ""
+	}
+	return hs.Name
+}
+
+func makeIndexedPod(name, nodeName string, hostNetwork bool, ips ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name},
+		Spec: corev1.PodSpec{
+			NodeName:    nodeName,
+			HostNetwork: hostNetwork,
+		},
+	}
+	for _, ip := range ips {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	return pod
+}
+
+func TestFindMisplacedPods(t *testing.T) {
+	idx := NewSubnetIndex([]*osdnv1.HostSubnet{
+		makeIndexedHostSubnet("node1", "10.128.0.0/23"),
+		makeIndexedHostSubnet("node2", "10.128.2.0/23"),
+	})
+	legacy := makeIndexedPod("legacy", "node2", false)
+	legacy.Status.PodIP = "10.128.0.7"
+
+	misplaced := FindMisplacedPods(idx, []*corev1.Pod{
+		makeIndexedPod("good", "node1", false, "10.128.0.5"),
+		makeIndexedPod("bad", "node1", false, "10.128.2.5"),
+		makeIndexedPod("host", "node1", true, "10.128.2.6"),
+		makeIndexedPod("unscheduled", "", false, "10.128.2.7"),
+		makeIndexedPod("unknown", "node1", false, "192.168.0.1"),
+		makeIndexedPod("noip", "node1", false),
+		legacy,
+	})
+
+	expected := []struct {
+		pod, ip, expectedNode, actualNode string
+	}{
+		{"bad", "10.128.2.5", "node1", "node2"},
+		{"legacy", "10.128.0.7", "node2", "node1"},
+	}
+	if len(misplaced) != len(expected) {
+		t.Fatalf("expected %d misplaced pods, got %#v", len(expected), misplaced)
+	}
+	for i, mp := range misplaced {
+		e := expected[i]
+		if mp.Pod.Name != e.pod || mp.IP != e.ip || mp.ExpectedNode != e.expectedNode || mp.ActualNode != e.actualNode {
+			t.Fatalf("expected misplaced pod %s/%s on %s (owned by %s), got %s/%s on %s (owned by %s)",
+				e.pod, e.ip, e.expectedNode, e.actualNode, mp.Pod.Name, mp.IP, mp.ExpectedNode, mp.ActualNode)
+		}
+	}
+}
+
+func BenchmarkSubnetIndexLookupByIP(b *testing.B) {
+	// Every /23 in 10.0.0.0/8
+	subnets := make([]*osdnv1.HostSubnet, 0, 32768)
+	for i := 0; i < 32768; i++ {
+		subnets = append(subnets, makeIndexedHostSubnet(fmt.Sprintf("node%d", i), fmt.Sprintf("10.%d.%d.0/23", i/128, (i%128)*2)))
+	}
+	idx := NewSubnetIndex(subnets)
+
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = net.IPv4(10, byte(i*7%256), byte(i*13%256), byte(i%256))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if idx.LookupByIP(ips[i%len(ips)]) == nil {
+			b.Fatalf("expected a match for %s", ips[i%len(ips)])
+		}
+	}
+}
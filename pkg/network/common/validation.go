@@ -1,12 +1,15 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/validation/path"
 	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/apis/core/validation"
 
 	osdnv1 "github.com/openshift/api/network/v1"
@@ -35,14 +38,126 @@ func validateIPv4(ip string) (net.IP, error) {
 	return bytes, nil
 }
 
+// minNetworkPrefixLength is the shortest prefix accepted for a cluster or service network;
+// anything broader covers (nearly) the entire address space, which is never intended.
+const minNetworkPrefixLength = 2
+
+func validateNetworkPrefixLength(ipnet *net.IPNet) error {
+	ones, _ := ipnet.Mask.Size()
+	if ones == 0 {
+		return fmt.Errorf("must not be a default route")
+	} else if ones < minNetworkPrefixLength {
+		return fmt.Errorf("prefix length /%d is too broad; must be at least /%d", ones, minNetworkPrefixLength)
+	}
+	return nil
+}
+
+// privateNetworks are the RFC1918 IPv4 ranges and the IPv6 unique local address range
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic("bad CIDR string constant " + cidr)
+	}
+	return ipnet
+}
+
+// isPrivateNetwork returns whether ipnet lies entirely within private address space
+func isPrivateNetwork(ipnet *net.IPNet) bool {
+	for _, private := range privateNetworks {
+		if isSubnet(private, ipnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrivateNetwork reports if ipnet (the value of fldPath) uses publicly-routable
+// addresses; this is usually a mistake, since the overlay would shadow those addresses
+// for pods. It's an error if strict is set, and a warning otherwise.
+func checkPrivateNetwork(clusterNet *osdnv1.ClusterNetwork, fldPath *field.Path, value string, ipnet *net.IPNet, strict bool) *field.Error {
+	if isPrivateNetwork(ipnet) {
+		return nil
+	}
+	const msg = "uses publicly-routable address space"
+	if strict {
+		return field.Invalid(fldPath, value, msg)
+	}
+	klog.Warningf("ClusterNetwork %q: %s %s %s", clusterNet.Name, fldPath.String(), value, msg)
+	return nil
+}
+
+// ErrNonStandardIPv6HostSubnetLength is wrapped by the error ValidateHostSubnetLength
+// returns for IPv6 ranges that would not be divided into /64s, which works, but is unusual
+var ErrNonStandardIPv6HostSubnetLength = errors.New("IPv6 host subnets should be /64s")
+
+// reservedSubnetAddresses returns the number of addresses in each host subnet of cidr
+// that can't be assigned to pods, and a description of them
+func reservedSubnetAddresses(cidr *net.IPNet) (uint64, string) {
+	if cidr.IP.To4() != nil {
+		return 3, "network, gateway, and broadcast"
+	}
+	return 2, "network and gateway"
+}
+
+// ValidateHostSubnetLength checks that hostSubnetLength (the number of host bits in each
+// subnet) is within the bounds that make sense for cidr's address family.
+func ValidateHostSubnetLength(cidr *net.IPNet, hostSubnetLength uint32) error {
+	maskLen, addrLen := cidr.Mask.Size()
+	if hostSubnetLength > uint32(addrLen-maskLen) {
+		return fmt.Errorf("subnet length is too large for cidr %s", cidr.String())
+	}
+	// Each subnet must have at least one address for pods besides the reserved ones
+	reserved, names := reservedSubnetAddresses(cidr)
+	minLength := uint32(0)
+	for uint64(1)<<minLength <= reserved {
+		minLength++
+	}
+	if hostSubnetLength < minLength {
+		return fmt.Errorf("subnet length must be at least %d, to leave room for pod IPs besides the %s addresses", minLength, names)
+	}
+	if addrLen == 128 && hostSubnetLength != 64 {
+		return fmt.Errorf("%w, not /%d", ErrNonStandardIPv6HostSubnetLength, 128-hostSubnetLength)
+	}
+	return nil
+}
+
+// ClusterNetworkValidationOptions enables optional checks in ValidateClusterNetworkWithOptions
+type ClusterNetworkValidationOptions struct {
+	// StrictHostSubnetLength makes it an error, rather than just a warning, for
+	// clusterNetworks entries of the same address family to have different
+	// hostSubnetLengths
+	StrictHostSubnetLength bool
+	// StrictPrivateAddressSpace makes it an error, rather than just a warning, for the
+	// cluster or service network to use publicly-routable addresses
+	StrictPrivateAddressSpace bool
+}
+
 // ValidateClusterNetwork tests if required fields in the ClusterNetwork are set, and ensures that the "default" ClusterNetwork can only be set to the correct values
 func ValidateClusterNetwork(clusterNet *osdnv1.ClusterNetwork) error {
+	return ValidateClusterNetworkWithOptions(clusterNet, ClusterNetworkValidationOptions{})
+}
+
+// ValidateClusterNetworkWithOptions validates clusterNet like ValidateClusterNetwork, with
+// the additional checks enabled in opts
+func ValidateClusterNetworkWithOptions(clusterNet *osdnv1.ClusterNetwork, opts ClusterNetworkValidationOptions) error {
 	allErrs := validation.ValidateObjectMeta(&clusterNet.ObjectMeta, false, path.ValidatePathSegmentName, field.NewPath("metadata"))
 	var testedCIDRS []*net.IPNet
 
 	serviceIPNet, err := validateCIDRv4(clusterNet.ServiceNetwork)
 	if err != nil {
 		allErrs = append(allErrs, field.Invalid(field.NewPath("serviceNetwork"), clusterNet.ServiceNetwork, err.Error()))
+	} else if err := validateNetworkPrefixLength(serviceIPNet); err != nil {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("serviceNetwork"), clusterNet.ServiceNetwork, err.Error()))
+		serviceIPNet = nil
+	} else if err := checkPrivateNetwork(clusterNet, field.NewPath("serviceNetwork"), clusterNet.ServiceNetwork, serviceIPNet, opts.StrictPrivateAddressSpace); err != nil {
+		allErrs = append(allErrs, err)
 	}
 
 	if len(clusterNet.ClusterNetworks) == 0 {
@@ -55,12 +170,16 @@ func ValidateClusterNetwork(clusterNet *osdnv1.ClusterNetwork) error {
 			clusterIPNet, err := validateCIDRv4(clusterNet.Network)
 			if err != nil {
 				allErrs = append(allErrs, field.Invalid(field.NewPath("network"), clusterNet.Network, err.Error()))
+			} else if err := validateNetworkPrefixLength(clusterIPNet); err != nil {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("network"), clusterNet.Network, err.Error()))
+				clusterIPNet = nil
+			} else if err := checkPrivateNetwork(clusterNet, field.NewPath("network"), clusterNet.Network, clusterIPNet, opts.StrictPrivateAddressSpace); err != nil {
+				allErrs = append(allErrs, err)
 			}
-			maskLen, addrLen := clusterIPNet.Mask.Size()
-			if clusterNet.HostSubnetLength > uint32(addrLen-maskLen) {
-				allErrs = append(allErrs, field.Invalid(field.NewPath("hostsubnetlength"), clusterNet.HostSubnetLength, "subnet length is too large for cidr"))
-			} else if clusterNet.HostSubnetLength < 2 {
-				allErrs = append(allErrs, field.Invalid(field.NewPath("hostsubnetlength"), clusterNet.HostSubnetLength, "subnet length must be at least 2"))
+			if clusterIPNet != nil {
+				if err := ValidateHostSubnetLength(clusterIPNet, clusterNet.HostSubnetLength); err != nil {
+					allErrs = append(allErrs, field.Invalid(field.NewPath("hostsubnetlength"), clusterNet.HostSubnetLength, err.Error()))
+				}
 			}
 
 			if (clusterIPNet != nil) && (serviceIPNet != nil) && cidrsOverlap(clusterIPNet, serviceIPNet) {
@@ -83,17 +202,35 @@ func ValidateClusterNetwork(clusterNet *osdnv1.ClusterNetwork) error {
 		}
 	}
 
+	// index of the first clusterNetworks entry of each address family
+	firstOfFamily := map[corev1.IPFamily]int{}
 	for i, cn := range clusterNet.ClusterNetworks {
 		clusterIPNet, err := validateCIDRv4(cn.CIDR)
 		if err != nil {
 			allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("cidr"), cn.CIDR, err.Error()))
 			continue
 		}
-		maskLen, addrLen := clusterIPNet.Mask.Size()
-		if cn.HostSubnetLength > uint32(addrLen-maskLen) {
-			allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("hostSubnetLength"), cn.HostSubnetLength, "subnet length is too large for clusterNetwork "))
-		} else if cn.HostSubnetLength < 2 {
-			allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("hostSubnetLength"), cn.HostSubnetLength, "subnet length must be at least 2"))
+		if err := validateNetworkPrefixLength(clusterIPNet); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("cidr"), cn.CIDR, err.Error()))
+			continue
+		}
+		if err := ValidateHostSubnetLength(clusterIPNet, cn.HostSubnetLength); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("hostSubnetLength"), cn.HostSubnetLength, err.Error()))
+		}
+		if err := checkPrivateNetwork(clusterNet, field.NewPath("clusterNetworks").Index(i).Child("cidr"), cn.CIDR, clusterIPNet, opts.StrictPrivateAddressSpace); err != nil {
+			allErrs = append(allErrs, err)
+		}
+
+		family := cidrIPFamily(clusterIPNet)
+		if first, ok := firstOfFamily[family]; !ok {
+			firstOfFamily[family] = i
+		} else if firstLength := clusterNet.ClusterNetworks[first].HostSubnetLength; cn.HostSubnetLength != firstLength {
+			msg := fmt.Sprintf("hostSubnetLength %d differs from hostSubnetLength %d of clusterNetworks[%d]", cn.HostSubnetLength, firstLength, first)
+			if opts.StrictHostSubnetLength {
+				allErrs = append(allErrs, field.Invalid(field.NewPath("clusterNetworks").Index(i).Child("hostSubnetLength"), cn.HostSubnetLength, msg))
+			} else {
+				klog.Warningf("ClusterNetwork %q: clusterNetworks[%d]: %s", clusterNet.Name, i, msg)
+			}
 		}
 
 		for _, cidr := range testedCIDRS {
@@ -121,6 +258,27 @@ func ValidateClusterNetwork(clusterNet *osdnv1.ClusterNetwork) error {
 	}
 }
 
+// CheckLegacyClusterNetworkFields checks that the legacy Network and HostSubnetLength
+// fields of clusterNet, if set alongside ClusterNetworks, describe the same network as
+// clusterNetworks[0]. (Only ClusterNetworks is used in that case.)
+func CheckLegacyClusterNetworkFields(clusterNet *osdnv1.ClusterNetwork) error {
+	if len(clusterNet.ClusterNetworks) == 0 || (clusterNet.Network == "" && clusterNet.HostSubnetLength == 0) {
+		return nil
+	}
+	first := clusterNet.ClusterNetworks[0]
+	if clusterNet.HostSubnetLength != first.HostSubnetLength {
+		return fmt.Errorf("legacy hostsubnetlength %d differs from clusterNetworks[0].hostSubnetLength %d", clusterNet.HostSubnetLength, first.HostSubnetLength)
+	}
+	_, legacyNet, err := net.ParseCIDR(clusterNet.Network)
+	if err != nil {
+		return fmt.Errorf("legacy network %q is invalid: %v", clusterNet.Network, err)
+	}
+	if _, firstNet, err := net.ParseCIDR(first.CIDR); err != nil || legacyNet.String() != firstNet.String() {
+		return fmt.Errorf("legacy network %s differs from clusterNetworks[0].cidr %s", clusterNet.Network, first.CIDR)
+	}
+	return nil
+}
+
 // ValidateHostSubnet checks if the system-maintained fields of hostsubnet are valid.
 func ValidateHostSubnet(hs *osdnv1.HostSubnet) error {
 	allErrs := validation.ValidateObjectMeta(&hs.ObjectMeta, false, path.ValidatePathSegmentName, field.NewPath("metadata"))
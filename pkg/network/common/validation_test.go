@@ -1,9 +1,13 @@
 package common
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"testing"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 )
@@ -205,6 +209,249 @@ func TestValidateClusterNetwork(t *testing.T) {
 	}
 }
 
+func TestValidateClusterNetworkBroadPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		cn             *osdnv1.ClusterNetwork
+		expectedErrors []string
+	}{
+		{
+			name: "default route cluster network",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "0.0.0.0/0", HostSubnetLength: 8}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			expectedErrors: []string{"clusterNetworks[0].cidr: Invalid value: \"0.0.0.0/0\": must not be a default route"},
+		},
+		{
+			name: "/1 cluster network",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "0.0.0.0/1", HostSubnetLength: 8}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			expectedErrors: []string{"clusterNetworks[0].cidr: Invalid value: \"0.0.0.0/1\": prefix length /1 is too broad; must be at least /2"},
+		},
+		{
+			name: "legacy default route network",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:       metav1.ObjectMeta{Name: "any"},
+				Network:          "0.0.0.0/0",
+				HostSubnetLength: 8,
+				ServiceNetwork:   "172.30.0.0/16",
+			},
+			expectedErrors: []string{"network: Invalid value: \"0.0.0.0/0\": must not be a default route"},
+		},
+		{
+			name: "default route service network",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.20.0.0/16", HostSubnetLength: 8}},
+				ServiceNetwork:  "0.0.0.0/0",
+			},
+			expectedErrors: []string{"serviceNetwork: Invalid value: \"0.0.0.0/0\": must not be a default route"},
+		},
+		{
+			name: "/1 service network",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.20.0.0/16", HostSubnetLength: 8}},
+				ServiceNetwork:  "128.0.0.0/1",
+			},
+			expectedErrors: []string{"serviceNetwork: Invalid value: \"128.0.0.0/1\": prefix length /1 is too broad; must be at least /2"},
+		},
+		{
+			name: "/2 cluster network is allowed",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "0.0.0.0/2", HostSubnetLength: 8}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+		},
+		{
+			name: "IPv6 default route",
+			cn: &osdnv1.ClusterNetwork{
+				ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "::/0", HostSubnetLength: 64}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			expectedErrors: []string{"clusterNetworks[0].cidr: Invalid value: \"::/0\": must be an IPv4 network"},
+		},
+	} {
+		err := ValidateClusterNetwork(tc.cn)
+		if len(tc.expectedErrors) == 0 {
+			if err != nil {
+				t.Errorf("Test case %s expected no error, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Test case %s expected errors, but passed", tc.name)
+			continue
+		}
+		errs := err.(utilerrors.Aggregate).Errors()
+		if len(errs) != len(tc.expectedErrors) {
+			t.Errorf("Test case %s expected %d errors, got %v", tc.name, len(tc.expectedErrors), err)
+			continue
+		}
+		for i := range errs {
+			if errs[i].Error() != tc.expectedErrors[i] {
+				t.Errorf("Test case %s expected error %q, got %q", tc.name, tc.expectedErrors[i], errs[i].Error())
+			}
+		}
+	}
+}
+
+func TestValidateClusterNetworkHostSubnetLengthConsistency(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		clusterNets  []osdnv1.ClusterNetworkEntry
+		strictErrors int
+	}{
+		{
+			name: "single entry",
+			clusterNets: []osdnv1.ClusterNetworkEntry{
+				{CIDR: "10.20.0.0/16", HostSubnetLength: 8},
+			},
+		},
+		{
+			name: "consistent entries",
+			clusterNets: []osdnv1.ClusterNetworkEntry{
+				{CIDR: "10.20.0.0/16", HostSubnetLength: 8},
+				{CIDR: "10.21.0.0/16", HostSubnetLength: 8},
+				{CIDR: "10.22.0.0/16", HostSubnetLength: 8},
+			},
+		},
+		{
+			name: "mixed entries",
+			clusterNets: []osdnv1.ClusterNetworkEntry{
+				{CIDR: "10.20.0.0/16", HostSubnetLength: 8},
+				{CIDR: "10.21.0.0/16", HostSubnetLength: 9},
+				{CIDR: "10.22.0.0/16", HostSubnetLength: 10},
+			},
+			strictErrors: 2,
+		},
+	} {
+		cn := &osdnv1.ClusterNetwork{
+			ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+			ClusterNetworks: tc.clusterNets,
+			ServiceNetwork:  "172.30.0.0/16",
+		}
+
+		if err := ValidateClusterNetwork(cn); err != nil {
+			t.Errorf("Test case %s expected no error by default, got %v", tc.name, err)
+		}
+
+		err := ValidateClusterNetworkWithOptions(cn, ClusterNetworkValidationOptions{StrictHostSubnetLength: true})
+		if tc.strictErrors == 0 {
+			if err != nil {
+				t.Errorf("Test case %s expected no error in strict mode, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Test case %s expected errors in strict mode, but passed", tc.name)
+			continue
+		}
+		errs := err.(utilerrors.Aggregate).Errors()
+		if len(errs) != tc.strictErrors {
+			t.Errorf("Test case %s expected %d errors in strict mode, got %v", tc.name, tc.strictErrors, err)
+		}
+		for _, e := range errs {
+			if !strings.Contains(e.Error(), "differs from hostSubnetLength 8 of clusterNetworks[0]") {
+				t.Errorf("Test case %s got unexpected error %q", tc.name, e.Error())
+			}
+		}
+	}
+}
+
+func TestValidateClusterNetworkPrivateAddressSpace(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		network        string
+		serviceNetwork string
+		strictErrors   []string
+	}{
+		{
+			name:           "RFC1918",
+			network:        "10.128.0.0/14",
+			serviceNetwork: "172.30.0.0/16",
+		},
+		{
+			name:           "public cluster network",
+			network:        "11.128.0.0/14",
+			serviceNetwork: "192.168.0.0/16",
+			strictErrors:   []string{"clusterNetworks[0].cidr"},
+		},
+		{
+			name:           "public service network",
+			network:        "10.128.0.0/14",
+			serviceNetwork: "172.32.0.0/16",
+			strictErrors:   []string{"serviceNetwork"},
+		},
+		{
+			name:           "partly public",
+			network:        "10.0.0.0/7",
+			serviceNetwork: "172.30.0.0/16",
+			strictErrors:   []string{"clusterNetworks[0].cidr"},
+		},
+	} {
+		cn := &osdnv1.ClusterNetwork{
+			ObjectMeta:      metav1.ObjectMeta{Name: "any"},
+			ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: tc.network, HostSubnetLength: 8}},
+			ServiceNetwork:  tc.serviceNetwork,
+		}
+
+		if err := ValidateClusterNetwork(cn); err != nil {
+			t.Errorf("Test case %s expected no error by default, got %v", tc.name, err)
+		}
+
+		err := ValidateClusterNetworkWithOptions(cn, ClusterNetworkValidationOptions{StrictPrivateAddressSpace: true})
+		if len(tc.strictErrors) == 0 {
+			if err != nil {
+				t.Errorf("Test case %s expected no error in strict mode, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Test case %s expected errors in strict mode, but passed", tc.name)
+			continue
+		}
+		errs := err.(utilerrors.Aggregate).Errors()
+		if len(errs) != len(tc.strictErrors) {
+			t.Errorf("Test case %s expected %d errors in strict mode, got %v", tc.name, len(tc.strictErrors), err)
+			continue
+		}
+		for i, e := range errs {
+			if !strings.Contains(e.Error(), tc.strictErrors[i]) || !strings.Contains(e.Error(), "publicly-routable") {
+				t.Errorf("Test case %s got unexpected error %q", tc.name, e.Error())
+			}
+		}
+	}
+}
+
+func TestIsPrivateNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		cidr    string
+		private bool
+	}{
+		{"10.128.0.0/14", true},
+		{"172.16.0.0/12", true},
+		{"192.168.10.0/24", true},
+		{"fd01::/48", true},
+		{"fc00::/7", true},
+		{"8.8.8.0/24", false},
+		{"172.32.0.0/16", false},
+		{"2001:db8::/32", false},
+		{"fe80::/10", false},
+	} {
+		if private := isPrivateNetwork(mustParseCIDR(tc.cidr)); private != tc.private {
+			t.Errorf("expected isPrivateNetwork(%s) to be %v, got %v", tc.cidr, tc.private, private)
+		}
+	}
+}
+
 func TestValidateHostSubnet(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -260,3 +507,164 @@ func TestValidateHostSubnet(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateHostSubnetLength(t *testing.T) {
+	tests := []struct {
+		name             string
+		cidr             string
+		hostSubnetLength uint32
+		err              string
+		nonStandard      bool
+	}{
+		{
+			name:             "IPv4 sensible",
+			cidr:             "10.128.0.0/14",
+			hostSubnetLength: 9,
+		},
+		{
+			name:             "IPv4 too large",
+			cidr:             "10.128.0.0/24",
+			hostSubnetLength: 9,
+			err:              "too large",
+		},
+		{
+			name:             "IPv4 /30",
+			cidr:             "10.128.0.0/14",
+			hostSubnetLength: 2,
+		},
+		{
+			name:             "IPv4 too small",
+			cidr:             "10.128.0.0/14",
+			hostSubnetLength: 1,
+			err:              "at least 2",
+		},
+		{
+			name:             "IPv4 /32",
+			cidr:             "10.128.0.0/14",
+			hostSubnetLength: 0,
+			err:              "network, gateway, and broadcast",
+		},
+		{
+			name:             "IPv6 /64",
+			cidr:             "fd01::/48",
+			hostSubnetLength: 64,
+		},
+		{
+			name:             "IPv6 non-/64",
+			cidr:             "fd01::/48",
+			hostSubnetLength: 68,
+			err:              "not /60",
+			nonStandard:      true,
+		},
+		{
+			name:             "IPv6 /127",
+			cidr:             "fd01::/48",
+			hostSubnetLength: 1,
+			err:              "network and gateway",
+		},
+		{
+			name:             "IPv6 too large",
+			cidr:             "fd01::/64",
+			hostSubnetLength: 66,
+			err:              "too large",
+		},
+	}
+
+	for _, tc := range tests {
+		_, cidr, _ := net.ParseCIDR(tc.cidr)
+		err := ValidateHostSubnetLength(cidr, tc.hostSubnetLength)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("Test case %s expected no error, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Test case %s expected error matching %q, got %v", tc.name, tc.err, err)
+		} else if errors.Is(err, ErrNonStandardIPv6HostSubnetLength) != tc.nonStandard {
+			t.Errorf("Test case %s: unexpected error type %v", tc.name, err)
+		}
+	}
+}
+
+func TestLegacyClusterNetworkFields(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		cn            *osdnv1.ClusterNetwork
+		expectedErr   string
+		expectedCIDR  string
+		expectedHSLen uint32
+	}{
+		{
+			name: "consistent",
+			cn: &osdnv1.ClusterNetwork{
+				Network:          "10.128.0.0/14",
+				HostSubnetLength: 9,
+				ClusterNetworks:  []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+				ServiceNetwork:   "172.30.0.0/16",
+			},
+			expectedCIDR:  "10.128.0.0/14",
+			expectedHSLen: 9,
+		},
+		{
+			name: "divergent network",
+			cn: &osdnv1.ClusterNetwork{
+				Network:          "10.0.0.0/14",
+				HostSubnetLength: 9,
+				ClusterNetworks:  []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+				ServiceNetwork:   "172.30.0.0/16",
+			},
+			expectedErr:   "legacy network 10.0.0.0/14 differs",
+			expectedCIDR:  "10.128.0.0/14",
+			expectedHSLen: 9,
+		},
+		{
+			name: "divergent hostsubnetlength",
+			cn: &osdnv1.ClusterNetwork{
+				Network:          "10.128.0.0/14",
+				HostSubnetLength: 8,
+				ClusterNetworks:  []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+				ServiceNetwork:   "172.30.0.0/16",
+			},
+			expectedErr:   "legacy hostsubnetlength 8 differs",
+			expectedCIDR:  "10.128.0.0/14",
+			expectedHSLen: 9,
+		},
+		{
+			name: "legacy only",
+			cn: &osdnv1.ClusterNetwork{
+				Network:          "10.128.0.0/14",
+				HostSubnetLength: 9,
+				ServiceNetwork:   "172.30.0.0/16",
+			},
+			expectedCIDR:  "10.128.0.0/14",
+			expectedHSLen: 9,
+		},
+		{
+			name: "clusterNetworks only",
+			cn: &osdnv1.ClusterNetwork{
+				ClusterNetworks: []osdnv1.ClusterNetworkEntry{{CIDR: "10.128.0.0/14", HostSubnetLength: 9}},
+				ServiceNetwork:  "172.30.0.0/16",
+			},
+			expectedCIDR:  "10.128.0.0/14",
+			expectedHSLen: 9,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckLegacyClusterNetworkFields(tc.cn)
+			if tc.expectedErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectedErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+
+			pcn, err := ParseClusterNetwork(tc.cn)
+			if err != nil {
+				t.Fatalf("unexpected error parsing ClusterNetwork: %v", err)
+			}
+			if len(pcn.ClusterNetworks) != 1 || pcn.ClusterNetworks[0].ClusterCIDR.String() != tc.expectedCIDR || pcn.ClusterNetworks[0].HostSubnetLength != tc.expectedHSLen {
+				t.Fatalf("expected cluster network %s with hostSubnetLength %d, got %#v", tc.expectedCIDR, tc.expectedHSLen, pcn.ClusterNetworks)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"k8s.io/klog/v2"
 
 	osdcnv1 "github.com/openshift/api/cloudnetwork/v1"
+	osdnv1 "github.com/openshift/api/network/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -153,6 +154,8 @@ func (eim *egressIPManager) maybeDoUpdateEgressCIDRs() (bool, error) {
 	allocation := eim.tracker.ReallocateEgressIPs()
 	monitorNodes := make(map[string]*egressNode, len(allocation))
 	for nodeName, egressIPs := range allocation {
+		egressIPs = validEgressIPs(nodeName, egressIPs)
+
 		resultErr := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 			hs, err := eim.hostSubnetInformer.Lister().Get(nodeName)
 			if err != nil {
@@ -167,9 +170,7 @@ func (eim *egressIPManager) maybeDoUpdateEgressCIDRs() (bool, error) {
 				monitorNodes[hs.HostIP] = &egressNode{ip: hs.HostIP, sdnIP: sdnIP, name: nodeName}
 			}
 
-			oldIPs := sets.NewString(common.HSEgressIPsToStrings(hs.EgressIPs)...)
-			newIPs := sets.NewString(egressIPs...)
-			if !oldIPs.Equal(newIPs) {
+			if !sameEgressIPs(hs.EgressIPs, egressIPs) {
 				hs.EgressIPs = common.StringsToHSEgressIPs(egressIPs)
 				_, err = eim.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), hs, metav1.UpdateOptions{})
 			}
@@ -351,3 +352,32 @@ func (eim *egressIPManager) SetNamespaceEgressDropped(vnid uint32) {
 
 func (eim *egressIPManager) SetNamespaceEgressViaEgressIPs(vnid uint32, activeEgressIPs []common.EgressIPAssignment) {
 }
+
+// validEgressIPs returns the egress IPs in ips that are valid IPs, logging a warning about
+// the rest. The IPs are returned as written, not canonicalized, so that they still match
+// the NetNamespace egress IPs they were allocated from.
+func validEgressIPs(nodeName string, ips []string) []string {
+	valid := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if _, errs := common.ParseEgressIPs([]string{ip}); len(errs) > 0 {
+			klog.Warningf("Ignoring egress IP for node %s: %v", nodeName, errs[0])
+			continue
+		}
+		valid = append(valid, ip)
+	}
+	return valid
+}
+
+// sameEgressIPs returns whether current and ips contain the same egress IPs, comparing
+// them in canonical form
+func sameEgressIPs(current []osdnv1.HostSubnetEgressIP, ips []string) bool {
+	currentIPs := sets.NewString()
+	for _, ip := range current {
+		currentIPs.Insert(canonicalEgressIP(ip))
+	}
+	newIPs := sets.NewString()
+	for _, ip := range ips {
+		newIPs.Insert(canonicalEgressIP(osdnv1.HostSubnetEgressIP(ip)))
+	}
+	return currentIPs.Equal(newIPs)
+}
@@ -0,0 +1,51 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestValidEgressIPs(t *testing.T) {
+	// Valid IPs are kept as written, so they still match their NetNamespace
+	ips := validEgressIPs("node1", []string{"192.168.1.100", "bob", "FD00:0:0::100"})
+	expected := []string{"192.168.1.100", "FD00:0:0::100"}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Fatalf("expected %v, got %v", expected, ips)
+	}
+}
+
+func TestSameEgressIPs(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		current  []osdnv1.HostSubnetEgressIP
+		ips      []string
+		expected bool
+	}{
+		{
+			name:     "identical",
+			current:  []osdnv1.HostSubnetEgressIP{"192.168.1.100", "192.168.1.101"},
+			ips:      []string{"192.168.1.101", "192.168.1.100"},
+			expected: true,
+		},
+		{
+			name:     "differently written",
+			current:  []osdnv1.HostSubnetEgressIP{"fd00::100"},
+			ips:      []string{"FD00:0:0::100"},
+			expected: true,
+		},
+		{
+			name:     "different",
+			current:  []osdnv1.HostSubnetEgressIP{"192.168.1.100"},
+			ips:      []string{"192.168.1.100", "192.168.1.101"},
+			expected: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if same := sameEgressIPs(tc.current, tc.ips); same != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, same)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package master
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// HostSubnetState describes how a HostSubnet relates to the node it belongs to, as seen
+// by the master's reconcile logic
+type HostSubnetState int
+
+const (
+	// HostSubnetHealthy is a valid HostSubnet backed by an existing node. (If the
+	// HostSubnet has no node UID annotation yet, reconcile will add it.)
+	HostSubnetHealthy HostSubnetState = iota
+	// HostSubnetOrphaned is a node-backed HostSubnet whose node no longer exists;
+	// reconcile deletes it
+	HostSubnetOrphaned
+	// HostSubnetUIDMismatch is a node-backed HostSubnet whose node has been replaced by
+	// a different node with the same name; reconcile deletes it
+	HostSubnetUIDMismatch
+	// HostSubnetF5Reserved is a valid HostSubnet that is not backed by a node, created
+	// to reserve a subnet (e.g. for F5)
+	HostSubnetF5Reserved
+	// HostSubnetAssignPending is a HostSubnet with osdnv1.AssignHostSubnetAnnotation
+	// that is waiting for the master to assign it a subnet
+	HostSubnetAssignPending
+	// HostSubnetInvalid is a HostSubnet that fails validation
+	HostSubnetInvalid
+)
+
+func (s HostSubnetState) String() string {
+	switch s {
+	case HostSubnetHealthy:
+		return "Healthy"
+	case HostSubnetOrphaned:
+		return "Orphaned"
+	case HostSubnetUIDMismatch:
+		return "UIDMismatch"
+	case HostSubnetF5Reserved:
+		return "F5Reserved"
+	case HostSubnetAssignPending:
+		return "AssignPending"
+	case HostSubnetInvalid:
+		return "Invalid"
+	default:
+		return "Unknown"
+	}
+}
+
+// ClassifyHostSubnet returns the state of hs, given the node with the same name (or nil
+// if there is no such node). States that reconcileHostSubnet resolves by deleting hs
+// take precedence over HostSubnetInvalid.
+func ClassifyHostSubnet(hs *osdnv1.HostSubnet, node *corev1.Node) HostSubnetState {
+	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
+		return HostSubnetAssignPending
+	}
+
+	nodeUID := common.HostSubnetNodeUID(hs)
+	if nodeUID != "" {
+		if node == nil {
+			return HostSubnetOrphaned
+		} else if string(node.UID) != nodeUID {
+			return HostSubnetUIDMismatch
+		}
+	}
+
+	if err := common.ValidateHostSubnet(hs); err != nil {
+		return HostSubnetInvalid
+	}
+	if node == nil {
+		return HostSubnetF5Reserved
+	}
+	return HostSubnetHealthy
+}
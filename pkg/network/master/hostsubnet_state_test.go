@@ -0,0 +1,84 @@
+package master
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestClassifyHostSubnet(t *testing.T) {
+	assignPending := makeHostSubnet("f5-pending", "f5-pending", "192.168.1.100", "", "")
+	assignPending.Annotations = map[string]string{osdnv1.AssignHostSubnetAnnotation: "true"}
+
+	for _, tc := range []struct {
+		name     string
+		hs       *osdnv1.HostSubnet
+		node     *corev1.Node
+		expected HostSubnetState
+	}{
+		{
+			name:     "node-backed",
+			hs:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			node:     makeNode("node1", "uid1", "192.168.1.1"),
+			expected: HostSubnetHealthy,
+		},
+		{
+			name:     "node-backed without UID annotation",
+			hs:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", ""),
+			node:     makeNode("node1", "uid1", "192.168.1.1"),
+			expected: HostSubnetHealthy,
+		},
+		{
+			name:     "node deleted",
+			hs:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			expected: HostSubnetOrphaned,
+		},
+		{
+			name:     "node replaced",
+			hs:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			node:     makeNode("node1", "uid2", "192.168.1.1"),
+			expected: HostSubnetUIDMismatch,
+		},
+		{
+			name:     "node replaced and invalid",
+			hs:       makeHostSubnet("node1", "node1", "", "10.128.0.0/23", "uid1"),
+			node:     makeNode("node1", "uid2", "192.168.1.1"),
+			expected: HostSubnetUIDMismatch,
+		},
+		{
+			name:     "F5",
+			hs:       makeHostSubnet("f5", "f5", "192.168.1.100", "10.128.2.0/23", ""),
+			expected: HostSubnetF5Reserved,
+		},
+		{
+			name:     "F5 assign pending",
+			hs:       assignPending,
+			expected: HostSubnetAssignPending,
+		},
+		{
+			name:     "F5 with no host IP",
+			hs:       makeHostSubnet("f5", "f5", "", "10.128.2.0/23", ""),
+			expected: HostSubnetInvalid,
+		},
+		{
+			name:     "host mismatch",
+			hs:       makeHostSubnet("node1", "node2", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			node:     makeNode("node1", "uid1", "192.168.1.1"),
+			expected: HostSubnetInvalid,
+		},
+		{
+			name:     "bad subnet",
+			hs:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0", "uid1"),
+			node:     makeNode("node1", "uid1", "192.168.1.1"),
+			expected: HostSubnetInvalid,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if state := ClassifyHostSubnet(tc.hs, tc.node); state != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, state)
+			}
+		})
+	}
+}
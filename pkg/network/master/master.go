@@ -2,15 +2,28 @@ package master
 
 import (
 	"context"
+	"net"
+	"sync"
+	"time"
 
+	oteltrace "go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	kcoreinformers "k8s.io/client-go/informers/core/v1"
 	kclientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	kcorev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/keymutex"
 
+	osdnv1 "github.com/openshift/api/network/v1"
 	cloudnetworkclient "github.com/openshift/client-go/cloudnetwork/clientset/versioned"
 	cloudnetworkinformer "github.com/openshift/client-go/cloudnetwork/informers/externalversions"
 	cloudnetworkinformerv1 "github.com/openshift/client-go/cloudnetwork/informers/externalversions/cloudnetwork/v1"
@@ -26,25 +39,179 @@ const (
 	tun0 = "tun0"
 )
 
+// AnnotationDecorator can add custom annotations to a HostSubnet that the master is about
+// to create. node is the HostSubnet's node, or nil if it is not backed by a node. The
+// NodeUID annotation is owned by the master and any changes to it are ignored.
+type AnnotationDecorator func(node *corev1.Node, annotations map[string]string)
+
+// PreDeleteHook is called before the master deletes a HostSubnet, to clean up external
+// state associated with it. If it returns an error, the HostSubnet is not deleted.
+type PreDeleteHook func(hs *osdnv1.HostSubnet) error
+
+// ExternalIPAM assigns subnets to nodes on behalf of the master, for integration with
+// external IPAM systems. AllocateForNode returns the subnet CIDR for node's HostSubnet,
+// which must be an unallocated subnet of the cluster network.
+type ExternalIPAM interface {
+	AllocateForNode(node *corev1.Node) (string, error)
+}
+
+// defaultEventComponent is the source component of the master's events, if
+// OsdnMaster.eventComponent is unset
+const defaultEventComponent = "openshift-network-controller"
+
 type OsdnMaster struct {
 	kClient            kclientset.Interface
 	osdnClient         osdnclient.Interface
 	cloudNetworkClient cloudnetworkclient.Interface
 	networkInfo        *common.ParsedClusterNetwork
 	vnids              *masterVNIDMap
+	recorder           record.EventRecorder
+	// The source component of the master's events, if not defaultEventComponent, so
+	// that they can be told apart from other controllers' events
+	eventComponent string
 
 	nodeInformer                 kcoreinformers.NodeInformer
 	namespaceInformer            kcoreinformers.NamespaceInformer
 	hostSubnetInformer           osdninformersv1.HostSubnetInformer
+	clusterNetworkInformer       osdninformersv1.ClusterNetworkInformer
 	netNamespaceInformer         osdninformersv1.NetNamespaceInformer
 	cloudPrivateIPConfigInformer cloudnetworkinformerv1.CloudPrivateIPConfigInformer
 	egressNetPolInformer         osdninformersv1.EgressNetworkPolicyInformer
 
+	// Event handler registrations of the subnet master, for removing them on Stop
+	nodeHandlerRegistration       cache.ResourceEventHandlerRegistration
+	hostSubnetHandlerRegistration cache.ResourceEventHandlerRegistration
+
 	// Used for allocating subnets in order
 	subnetAllocator *masterutil.SubnetAllocator
+	// The number of subnets at the start of each cluster network range that are
+	// reserved for external use and never allocated to nodes
+	subnetAllocationOffset uint32
+	// Allocation priorities of cluster network ranges, by CIDR; ranges with higher
+	// priority are used up first
+	subnetRangePriorities map[string]int
+	// If set, nodes with this label get their subnet from the cluster network range
+	// that subnetRangesByLabel maps the label's value to
+	subnetRangeLabel    string
+	subnetRangesByLabel map[string]string
+	// If set, nodes whose range is full get a subnet from any range, rather than none
+	subnetRangeFallback bool
+	// If set, called to check that a node's IP is reachable before assigning a subnet
+	// to it. Unreachable IPs are reported, and are also refused if
+	// blockUnreachableNodeIPs is set.
+	nodeIPProber            func(nodeIP string) error
+	blockUnreachableNodeIPs bool
+	// If set, returns the IPs of the local host's interfaces, and node IPs that are not
+	// among them are reported. Only useful when the master runs on the node it is
+	// assigning a subnet to.
+	localHostIPs func() ([]net.IP, error)
+	// If set, startSubnetMaster checks the cluster and service networks against the
+	// networks of the local host's interfaces, and warns (rather than failing) about any
+	// conflicts. hostIPNetworks returns those networks; it defaults to
+	// localHostIPNetworks.
+	checkHostNetworksOnStart bool
+	hostIPNetworks           func() ([]*net.IPNet, error)
+	// If set, HostSubnet egress IPs are checked against the networks of the node's
+	// interfaces (as returned by this), with a warning for any that aren't on a local
+	// subnet. (Off by default, since the master generally can't see node interfaces.)
+	nodeInterfaceNetworks func(nodeName string) ([]*net.IPNet, error)
+	// If set, the NetworkUnavailable node condition (set by kubelet on GCE) is left
+	// alone rather than cleared, for providers that never set it
+	disableNetworkUnavailableClear bool
+	// Additional NetworkUnavailable condition reasons, set by other providers, to clear
+	// as well as GCE's "NoRouteCreated"
+	networkUnavailableReasons []string
+	// If either is non-zero, a range is considered low on subnets when it has fewer than
+	// subnetLowThreshold free subnets, or fewer than subnetLowThresholdPercent percent of
+	// its subnets free. Each allocation from a low range is logged as a warning, and an
+	// event is emitted each time a range becomes low.
+	subnetLowThreshold        uint64
+	subnetLowThresholdPercent uint64
+	// The ranges that are currently low on subnets
+	subnetLowLock   sync.Mutex
+	subnetLowRanges map[string]bool
+	// An index of the HostSubnets, kept up to date by the HostSubnet event handlers,
+	// and the HostSubnet overlaps (see checkHostSubnetOverlap) and node IP conflicts
+	// (see checkNodeIPInHostSubnet, by node name) that have been reported, so that each
+	// is reported once rather than on every event
+	subnetIndexLock         sync.Mutex
+	subnetIndex             *common.SubnetIndex
+	reportedOverlaps        map[string]bool
+	reportedNodeIPConflicts map[string]string
+	// The subnets of HostSubnets (by name) whose HostSubnetLength mismatch has been
+	// reported, so that it is reported once rather than on every event
+	lengthMismatchLock     sync.Mutex
+	lengthMismatchReported map[string]string
+	// If non-zero, the maximum number of HostSubnets that may be allocated
+	maxHostSubnets int
+	// If set, called to add custom annotations to new HostSubnets
+	annotationDecorator AnnotationDecorator
+	// If set, called before deleting HostSubnets
+	preDeleteHook PreDeleteHook
+	// If set, node-backed HostSubnets get their subnets from this rather than from the
+	// subnet allocator (which still records them, to keep track of what is in use)
+	externalIPAM ExternalIPAM
+	// If set, the propagation policy used when deleting HostSubnets (e.g. when they
+	// have dependents via owner references); the API server default otherwise
+	hostSubnetDeletePropagation *metav1.DeletionPropagation
+	// If set, used to trace subnet operations
+	tracerProvider oteltrace.TracerProvider
+	// Used by all time-dependent subnet master logic, including the subnet allocator;
+	// the real clock if unset
+	clock clock.WithTicker
+	// Serializes addNode calls for the same node
+	nodeLocks keymutex.KeyMutex
 
+	// Protects hostSubnetNodeIPs, nodeIPOwners, maintenanceNodes,
+	// deferredSubnetDeletes, and requeuedSubnetDeletes, which the subnet self-heal
+	// loop and HostSubnet reconciliation use concurrently with the node event handlers
+	nodeIPLock sync.Mutex
 	// Holds Node IP used in creating host subnet for a node
 	hostSubnetNodeIPs map[ktypes.UID]string
+	// Reverse of hostSubnetNodeIPs; holds the UID of the node owning each Node IP
+	nodeIPOwners map[string]ktypes.UID
+	// Names of the nodes last seen with nodeMaintenanceAnnotation, whose HostSubnets
+	// are frozen
+	maintenanceNodes map[string]bool
+	// When deletion of each deleted node's HostSubnet was first deferred (see
+	// deferSubnetDeleteTimeout)
+	deferredSubnetDeletes map[string]time.Time
+	// Nodes whose deferred HostSubnet deletion has a retry pending
+	requeuedSubnetDeletes map[string]bool
+
+	// If non-zero, deleting a deleted node's HostSubnet is deferred (and retried) while
+	// pod-network pods remain on the node, so that terminating pods keep their
+	// networking, but for no longer than this
+	deferSubnetDeleteTimeout time.Duration
+
+	// If set, node-backed HostSubnets whose Host doesn't match their name are
+	// corrected rather than only reported
+	fixHostSubnetHostMismatch bool
+
+	// If set, a node's HostSubnet is not updated for a change of node IP until the
+	// node has no running pods
+	requireDrainForNodeIPChange bool
+
+	// If set, each node's assigned subnet is also recorded in nodeSubnetAnnotation on
+	// the node, for tools that read node annotations rather than HostSubnets
+	annotateNodeSubnet bool
+
+	// If non-zero, the subnet allocator state is written to a ConfigMap whenever it
+	// changes, and at least this often
+	subnetStatsReportInterval time.Duration
+	// The ConfigMap to write the subnet allocator state to, if not the default
+	subnetStatsNamespace string
+	subnetStatsName      string
+	// Set if subnetStatsReportInterval is non-zero
+	subnetStatsReporter *subnetStatsReporter
+	// Stops subnetStatsReporter; set if subnetStatsReportInterval is non-zero
+	stopSubnetStats chan struct{}
+
+	// If non-zero, nodes that have no HostSubnet (because a node event was missed or
+	// allocation failed) are looked for this often, and assigned one
+	subnetSelfHealInterval time.Duration
+	// Stops the self-heal loop; set if subnetSelfHealInterval is non-zero
+	cancelSubnetSelfHeal context.CancelFunc
 }
 
 func Start(kClient kclientset.Interface,
@@ -52,7 +219,8 @@ func Start(kClient kclientset.Interface,
 	osdnClient osdnclient.Interface,
 	osdnInformers osdninformers.SharedInformerFactory,
 	cloudNetworkClient cloudnetworkclient.Interface,
-	cloudNetworkInformer cloudnetworkinformer.SharedInformerFactory) error {
+	cloudNetworkInformer cloudnetworkinformer.SharedInformerFactory,
+	opts Options) error {
 	klog.Infof("Initializing SDN master")
 
 	networkInfo, err := common.GetParsedClusterNetwork(osdnClient)
@@ -60,19 +228,28 @@ func Start(kClient kclientset.Interface,
 		return err
 	}
 
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&kcorev1client.EventSinkImpl{Interface: kClient.CoreV1().Events("")})
+
 	master := &OsdnMaster{
 		kClient:     kClient,
 		osdnClient:  osdnClient,
 		networkInfo: networkInfo,
 
-		nodeInformer:         kubeInformers.Core().V1().Nodes(),
-		namespaceInformer:    kubeInformers.Core().V1().Namespaces(),
-		hostSubnetInformer:   osdnInformers.Network().V1().HostSubnets(),
-		netNamespaceInformer: osdnInformers.Network().V1().NetNamespaces(),
-		egressNetPolInformer: osdnInformers.Network().V1().EgressNetworkPolicies(),
+		nodeInformer:           kubeInformers.Core().V1().Nodes(),
+		namespaceInformer:      kubeInformers.Core().V1().Namespaces(),
+		hostSubnetInformer:     osdnInformers.Network().V1().HostSubnets(),
+		clusterNetworkInformer: osdnInformers.Network().V1().ClusterNetworks(),
+		netNamespaceInformer:   osdnInformers.Network().V1().NetNamespaces(),
+		egressNetPolInformer:   osdnInformers.Network().V1().EgressNetworkPolicies(),
 
-		hostSubnetNodeIPs: map[ktypes.UID]string{},
+		nodeLocks:              keymutex.NewHashed(0),
+		hostSubnetNodeIPs:      map[ktypes.UID]string{},
+		nodeIPOwners:           map[string]ktypes.UID{},
+		lengthMismatchReported: map[string]string{},
 	}
+	opts.apply(master)
+	master.recorder = master.newEventRecorder(eventBroadcaster)
 
 	if cloudNetworkClient != nil {
 		master.cloudNetworkClient = cloudNetworkClient
@@ -92,6 +269,7 @@ func Start(kClient kclientset.Interface,
 	master.nodeInformer.Informer().GetController()
 	master.namespaceInformer.Informer().GetController()
 	master.hostSubnetInformer.Informer().GetController()
+	master.clusterNetworkInformer.Informer().GetController()
 	master.netNamespaceInformer.Informer().GetController()
 	master.egressNetPolInformer.Informer().GetController()
 
@@ -100,12 +278,29 @@ func Start(kClient kclientset.Interface,
 	return nil
 }
 
+// newEventRecorder returns a recorder for the master's events, attributed to
+// master.eventComponent
+func (master *OsdnMaster) newEventRecorder(eventBroadcaster record.EventBroadcaster) record.EventRecorder {
+	component := master.eventComponent
+	if component == "" {
+		component = defaultEventComponent
+	}
+	return eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+}
+
+// Stop removes the master's node and HostSubnet event handlers, so that it stops acting
+// on changes. (The informers themselves are stopped by their owner.)
+func (master *OsdnMaster) Stop() error {
+	return master.stopSubnetMaster()
+}
+
 func (master *OsdnMaster) startSubSystems(pluginName string) {
 	// Wait for informer sync
 	if !cache.WaitForCacheSync(wait.NeverStop,
 		master.nodeInformer.Informer().GetController().HasSynced,
 		master.namespaceInformer.Informer().GetController().HasSynced,
 		master.hostSubnetInformer.Informer().GetController().HasSynced,
+		master.clusterNetworkInformer.Informer().GetController().HasSynced,
 		master.netNamespaceInformer.Informer().GetController().HasSynced,
 		master.egressNetPolInformer.Informer().GetController().HasSynced) {
 		klog.Fatalf("failed to sync SDN master informers")
@@ -137,14 +332,28 @@ func (master *OsdnMaster) startSubSystems(pluginName string) {
 }
 
 func (master *OsdnMaster) checkClusterNetworkAgainstLocalNetworks() error {
-	// During live migration, ignore ovn-k8s-mp0 when it run on a node using ovnkube as CNI.
-	hostIPNets, _, err := common.GetHostIPNetworks([]string{tun0, "ovn-k8s-mp0"})
+	hostIPNets, err := localHostIPNetworks()
 	if err != nil {
 		return err
 	}
 	return master.networkInfo.CheckHostNetworks(hostIPNets)
 }
 
+// localHostIPNetworks returns the networks of the local host's interfaces, other than
+// those created by the SDN itself
+func localHostIPNetworks() ([]*net.IPNet, error) {
+	// During live migration, ignore ovn-k8s-mp0 when it run on a node using ovnkube as CNI.
+	hostIPNets, _, err := common.GetHostIPNetworks([]string{tun0, "ovn-k8s-mp0"})
+	return hostIPNets, err
+}
+
+// LocalHostIPs returns the IPs of the local host's interfaces, other than those created
+// by the SDN itself
+func LocalHostIPs() ([]net.IP, error) {
+	_, hostIPs, err := common.GetHostIPNetworks([]string{tun0, "ovn-k8s-mp0"})
+	return hostIPs, err
+}
+
 func (master *OsdnMaster) checkClusterNetworkAgainstClusterObjects() error {
 	subnets, err := common.ListAllHostSubnets(context.TODO(), master.osdnClient)
 	if err != nil {
@@ -161,5 +370,13 @@ func (master *OsdnMaster) checkClusterNetworkAgainstClusterObjects() error {
 		klog.Warningf("Failed to list services: %v", err)
 	}
 
-	return master.networkInfo.CheckClusterObjects(subnets, pods, services)
+	slices, err := common.ListAllEndpointSlices(context.TODO(), master.kClient)
+	if err != nil {
+		klog.Warningf("Failed to list endpointslices: %v", err)
+	}
+
+	return kerrors.NewAggregate([]error{
+		master.networkInfo.CheckClusterObjects(subnets, pods, services),
+		master.networkInfo.CheckEndpointSlices(subnets, slices),
+	})
 }
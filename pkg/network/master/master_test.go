@@ -0,0 +1,51 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestEventComponent(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		component string
+		expected  string
+	}{
+		{
+			name:     "default",
+			expected: defaultEventComponent,
+		},
+		{
+			name:      "configured",
+			component: "openshift-sdn-master",
+			expected:  "openshift-sdn-master",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			eventBroadcaster := record.NewBroadcaster()
+			defer eventBroadcaster.Shutdown()
+			events := make(chan *corev1.Event, 1)
+			eventBroadcaster.StartEventWatcher(func(event *corev1.Event) {
+				events <- event
+			})
+
+			master := &OsdnMaster{}
+			opts := Options{EventComponent: tc.component}
+			opts.apply(master)
+			master.recorder = master.newEventRecorder(eventBroadcaster)
+			master.recorder.Eventf(nodeRef("node1", "uid1"), corev1.EventTypeNormal, "Test", "test event")
+
+			select {
+			case event := <-events:
+				if event.Source.Component != tc.expected {
+					t.Fatalf("expected event from %q, got %q", tc.expected, event.Source.Component)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for event")
+			}
+		})
+	}
+}
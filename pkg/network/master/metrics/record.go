@@ -2,6 +2,8 @@ package metrics
 
 // contains all controller/master metric data updates
 
+import "time"
+
 // RecordEgressFirewallCount records the number of kind EgressNetworkPolicy
 func RecordEgressFirewallCount(count float64) {
 	metricEgressFirewallCount.Set(count)
@@ -23,3 +25,15 @@ func RecordEgressIPCount(count float64) {
 func RecordMulticastEnabledNamespaceCount(count float64) {
 	metricMulticastEnabledNamespaceCount.Set(count)
 }
+
+// RecordSubnetSelfHeal records that the self-heal loop created a missing HostSubnet
+func RecordSubnetSelfHeal() {
+	metricSubnetSelfHeals.Inc()
+}
+
+// RecordSubnetAllocatorLockWait records a contended acquisition of the subnet allocator
+// lock that waited for wait.
+func RecordSubnetAllocatorLockWait(wait time.Duration) {
+	metricSubnetAllocatorLockContended.Inc()
+	metricSubnetAllocatorLockWaitSeconds.Observe(wait.Seconds())
+}
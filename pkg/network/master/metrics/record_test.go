@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRecordSubnetSelfHeal(t *testing.T) {
+	selfHeals := testutil.ToFloat64(metricSubnetSelfHeals)
+	RecordSubnetSelfHeal()
+	if c := testutil.ToFloat64(metricSubnetSelfHeals); c != selfHeals+1 {
+		t.Fatalf("Expected %v self-heals, got %v", selfHeals+1, c)
+	}
+}
+
+func TestRecordSubnetAllocatorLockWait(t *testing.T) {
+	histogram := func() (uint64, float64) {
+		t.Helper()
+		m := &dto.Metric{}
+		if err := metricSubnetAllocatorLockWaitSeconds.Write(m); err != nil {
+			t.Fatalf("Failed to read histogram: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	contended := testutil.ToFloat64(metricSubnetAllocatorLockContended)
+	count, sum := histogram()
+
+	RecordSubnetAllocatorLockWait(3 * time.Second)
+
+	if c := testutil.ToFloat64(metricSubnetAllocatorLockContended); c != contended+1 {
+		t.Fatalf("Expected contention counter %v, got %v", contended+1, c)
+	}
+	newCount, newSum := histogram()
+	if newCount != count+1 || newSum-sum != 3 {
+		t.Fatalf("Expected one 3s wait observation, got %d observations totalling %vs", newCount-count, newSum-sum)
+	}
+}
@@ -40,6 +40,32 @@ var metricMulticastEnabledNamespaceCount = prometheus.NewGauge(prometheus.GaugeO
 	Help:      "The number of multicast enabled namespaces",
 })
 
+// counts acquisitions of the subnet allocator lock that had to wait for another holder
+var metricSubnetAllocatorLockContended = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricSDNNamespace,
+	Subsystem: metricSDNSubsystemController,
+	Name:      "subnet_allocator_lock_contended_total",
+	Help:      "The number of contended acquisitions of the subnet allocator lock",
+})
+
+// represents the time spent waiting for the subnet allocator lock, for contended
+// acquisitions only
+var metricSubnetAllocatorLockWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metricSDNNamespace,
+	Subsystem: metricSDNSubsystemController,
+	Name:      "subnet_allocator_lock_wait_seconds",
+	Help:      "Time spent waiting for the subnet allocator lock, when it was contended",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+})
+
+// counts HostSubnets created by the self-heal loop for nodes that had none
+var metricSubnetSelfHeals = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: metricSDNNamespace,
+	Subsystem: metricSDNSubsystemController,
+	Name:      "subnet_self_heals_total",
+	Help:      "The number of HostSubnets created for nodes found without one by the self-heal loop",
+})
+
 var registry = prometheus.NewRegistry()
 
 func Register() {
@@ -47,4 +73,7 @@ func Register() {
 	registry.MustRegister(metricEgressFirewallRuleCount)
 	registry.MustRegister(metricEgressFirewallCount)
 	registry.MustRegister(metricMulticastEnabledNamespaceCount)
+	registry.MustRegister(metricSubnetAllocatorLockContended)
+	registry.MustRegister(metricSubnetAllocatorLockWaitSeconds)
+	registry.MustRegister(metricSubnetSelfHeals)
 }
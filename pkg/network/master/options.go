@@ -0,0 +1,182 @@
+package master
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// Options configures the optional behavior of the master. The zero value gives the
+// default behavior.
+type Options struct {
+	// The source component of the master's events, if not the default
+	// ("openshift-network-controller"), so that they can be told apart from other
+	// controllers' events
+	EventComponent string
+
+	// The number of subnets at the start of each cluster network range that are
+	// reserved for external use and never allocated to nodes
+	SubnetAllocationOffset uint32
+	// Allocation priorities of cluster network ranges, by CIDR; ranges with higher
+	// priority are used up first
+	SubnetRangePriorities map[string]int
+	// If set, nodes with the label SubnetRangeLabel get their subnet from the cluster
+	// network range that SubnetRangesByLabel maps the label's value to
+	SubnetRangeLabel    string
+	SubnetRangesByLabel map[string]string
+	// If set, nodes whose range is full get a subnet from any range, rather than none
+	SubnetRangeFallback bool
+
+	// If set, called to check that a node's IP is reachable before assigning a subnet
+	// to it (see NewTCPNodeIPProber). Unreachable IPs are reported, and are also
+	// refused if BlockUnreachableNodeIPs is set.
+	NodeIPProber            func(nodeIP string) error
+	BlockUnreachableNodeIPs bool
+	// If set, node IPs that are not among the local host's IPs (as returned by
+	// LocalHostIPs) are reported. Only useful when the master runs on the nodes it
+	// assigns subnets to.
+	CheckNodeIPsAreLocal bool
+	// If set, the cluster and service networks are checked against the local host's
+	// networks when the subnet master starts, with a warning about any conflicts
+	CheckHostNetworksOnStart bool
+	// If set, HostSubnet egress IPs are checked against the networks of their node's
+	// interfaces, with a warning for any that aren't on a local subnet. The networks
+	// come from NodeInterfaceNetworks if set, or else from the node's cloud egress IP
+	// config annotation.
+	CheckEgressIPsOnNodeSubnets bool
+	NodeInterfaceNetworks       func(nodeName string) ([]*net.IPNet, error)
+
+	// If set, the NetworkUnavailable node condition is left alone rather than cleared
+	DisableNetworkUnavailableClear bool
+	// Additional NetworkUnavailable condition reasons to clear, beyond GCE's
+	NetworkUnavailableReasons []string
+
+	// If either is non-zero, the threshold (in free subnets, or percent of subnets
+	// free) below which a range is reported as low on subnets
+	SubnetLowThreshold        uint64
+	SubnetLowThresholdPercent uint64
+	// If non-zero, the maximum number of HostSubnets that may be allocated
+	MaxHostSubnets int
+
+	// If set, called to add custom annotations to new HostSubnets
+	AnnotationDecorator AnnotationDecorator
+	// If set, called before deleting HostSubnets
+	PreDeleteHook PreDeleteHook
+	// If set, node-backed HostSubnets get their subnets from this rather than from the
+	// subnet allocator
+	ExternalIPAM ExternalIPAM
+	// If set, the propagation policy used when deleting HostSubnets
+	HostSubnetDeletePropagation *metav1.DeletionPropagation
+	// If set, used to trace subnet operations
+	TracerProvider oteltrace.TracerProvider
+
+	// If non-zero, deleting a deleted node's HostSubnet is deferred while pod-network
+	// pods remain on the node, for no longer than this
+	DeferSubnetDeleteTimeout time.Duration
+	// If set, node-backed HostSubnets whose Host doesn't match their name are
+	// corrected rather than only reported
+	FixHostSubnetHostMismatch bool
+	// If set, a node's HostSubnet is not updated for a change of node IP until the
+	// node has no running pods
+	RequireDrainForNodeIPChange bool
+	// If set, each node's subnet is also recorded in an annotation on the node
+	AnnotateNodeSubnet bool
+
+	// If non-zero, the subnet allocator state is written to a ConfigMap whenever it
+	// changes, and at least this often. The ConfigMap's namespace and name default
+	// if unset.
+	SubnetStatsReportInterval time.Duration
+	SubnetStatsNamespace      string
+	SubnetStatsName           string
+	// If non-zero, nodes without HostSubnets are looked for this often
+	SubnetSelfHealInterval time.Duration
+}
+
+// apply configures master according to opts
+func (opts *Options) apply(master *OsdnMaster) {
+	master.eventComponent = opts.EventComponent
+
+	master.subnetAllocationOffset = opts.SubnetAllocationOffset
+	master.subnetRangePriorities = opts.SubnetRangePriorities
+	master.subnetRangeLabel = opts.SubnetRangeLabel
+	master.subnetRangesByLabel = opts.SubnetRangesByLabel
+	master.subnetRangeFallback = opts.SubnetRangeFallback
+
+	master.nodeIPProber = opts.NodeIPProber
+	master.blockUnreachableNodeIPs = opts.BlockUnreachableNodeIPs
+	if opts.CheckNodeIPsAreLocal {
+		master.localHostIPs = LocalHostIPs
+	}
+	master.checkHostNetworksOnStart = opts.CheckHostNetworksOnStart
+	if opts.CheckEgressIPsOnNodeSubnets {
+		master.nodeInterfaceNetworks = opts.NodeInterfaceNetworks
+		if master.nodeInterfaceNetworks == nil {
+			master.nodeInterfaceNetworks = master.nodeCloudEgressIPNetworks
+		}
+	}
+
+	master.disableNetworkUnavailableClear = opts.DisableNetworkUnavailableClear
+	master.networkUnavailableReasons = opts.NetworkUnavailableReasons
+
+	master.subnetLowThreshold = opts.SubnetLowThreshold
+	master.subnetLowThresholdPercent = opts.SubnetLowThresholdPercent
+	master.maxHostSubnets = opts.MaxHostSubnets
+
+	master.annotationDecorator = opts.AnnotationDecorator
+	master.preDeleteHook = opts.PreDeleteHook
+	master.externalIPAM = opts.ExternalIPAM
+	master.hostSubnetDeletePropagation = opts.HostSubnetDeletePropagation
+	master.tracerProvider = opts.TracerProvider
+
+	master.deferSubnetDeleteTimeout = opts.DeferSubnetDeleteTimeout
+	master.fixHostSubnetHostMismatch = opts.FixHostSubnetHostMismatch
+	master.requireDrainForNodeIPChange = opts.RequireDrainForNodeIPChange
+	master.annotateNodeSubnet = opts.AnnotateNodeSubnet
+
+	master.subnetStatsReportInterval = opts.SubnetStatsReportInterval
+	master.subnetStatsNamespace = opts.SubnetStatsNamespace
+	master.subnetStatsName = opts.SubnetStatsName
+	master.subnetSelfHealInterval = opts.SubnetSelfHealInterval
+}
+
+// NewTCPNodeIPProber returns a node IP prober (see Options.NodeIPProber) that considers a
+// node IP reachable if a TCP connection to port on it succeeds within timeout
+func NewTCPNodeIPProber(port int, timeout time.Duration) func(nodeIP string) error {
+	return func(nodeIP string) error {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(nodeIP, fmt.Sprint(port)), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// nodeCloudEgressIPNetworks returns the networks of nodeName's egress interface according
+// to its cloud egress IP config annotation
+func (master *OsdnMaster) nodeCloudEgressIPNetworks(nodeName string) ([]*net.IPNet, error) {
+	node, err := master.nodeInformer.Lister().Get(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := common.NodeCloudEgressIPNetworks(node)
+	if err == nil && len(networks) == 0 {
+		return nil, fmt.Errorf("node %s has no cloud egress IP config", nodeName)
+	}
+	return networks, err
+}
+
+// StaticAnnotationDecorator returns an AnnotationDecorator that adds annotations to every
+// new HostSubnet
+func StaticAnnotationDecorator(annotations map[string]string) AnnotationDecorator {
+	return func(_ *corev1.Node, hsAnnotations map[string]string) {
+		for k, v := range annotations {
+			hsAnnotations[k] = v
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/openshift/sdn/pkg/network/common"
+)
+
+// ReconcileAction is what reconciling a HostSubnet did to it
+type ReconcileAction int
+
+const (
+	// ReconcileNone means the HostSubnet needed no changes (or couldn't be reconciled)
+	ReconcileNone ReconcileAction = iota
+	// ReconcileSkipped means the HostSubnet needed changes, but they were skipped because
+	// reconciliation is paused or the node is in maintenance
+	ReconcileSkipped
+	// ReconcileStampedNodeUID means the node's UID annotation was added
+	ReconcileStampedNodeUID
+	// ReconcileFilledFields means the missing Host or HostIP was filled in
+	ReconcileFilledFields
+	// ReconcileDeletedOrphan means the HostSubnet was deleted because its node is gone
+	ReconcileDeletedOrphan
+	// ReconcileDeletedReplaced means the HostSubnet was deleted because its node was
+	// replaced by a different node with the same name
+	ReconcileDeletedReplaced
+)
+
+func (a ReconcileAction) String() string {
+	switch a {
+	case ReconcileNone:
+		return "None"
+	case ReconcileSkipped:
+		return "Skipped"
+	case ReconcileStampedNodeUID:
+		return "StampedNodeUID"
+	case ReconcileFilledFields:
+		return "FilledFields"
+	case ReconcileDeletedOrphan:
+		return "DeletedOrphan"
+	case ReconcileDeletedReplaced:
+		return "DeletedReplaced"
+	default:
+		return "Unknown"
+	}
+}
+
+// ReconcileSummary describes what a ReconcileOnce run did
+type ReconcileSummary struct {
+	// Counts is the number of HostSubnets reconciled with each action
+	Counts map[ReconcileAction]int
+	// Subnets lists the (sorted) names of the HostSubnets reconciled with each action
+	// other than ReconcileNone
+	Subnets map[ReconcileAction][]string
+	// Failed lists the (sorted) names of the HostSubnets that could not be reconciled
+	Failed []string
+}
+
+// ReconcileOnce reconciles every HostSubnet once, and returns a summary of what was done.
+// If some HostSubnets can't be reconciled, the rest still are, and the errors are
+// returned together with the summary.
+func (master *OsdnMaster) ReconcileOnce() (*ReconcileSummary, error) {
+	subnets, err := common.ListAllHostSubnets(context.TODO(), master.osdnClient)
+	if err != nil {
+		return nil, fmt.Errorf("could not list HostSubnets: %v", err)
+	}
+
+	summary := &ReconcileSummary{
+		Counts:  make(map[ReconcileAction]int),
+		Subnets: make(map[ReconcileAction][]string),
+	}
+	var errs []error
+	for _, hs := range subnets {
+		action, err := master.reconcileHostSubnetAction(hs)
+		if err != nil {
+			errs = append(errs, err)
+			summary.Failed = append(summary.Failed, hs.Name)
+			continue
+		}
+		summary.Counts[action]++
+		if action != ReconcileNone {
+			summary.Subnets[action] = append(summary.Subnets[action], hs.Name)
+		}
+	}
+	for _, names := range summary.Subnets {
+		sort.Strings(names)
+	}
+	sort.Strings(summary.Failed)
+	master.recordReconcile()
+	return summary, kerrors.NewAggregate(errs)
+}
+
+// recordReconcile records the completion of a full reconcile pass (ReconcileOnce, or a
+// pass of the subnet self-heal loop) in the subnet stats, if they are being reported
+func (master *OsdnMaster) recordReconcile() {
+	if master.subnetStatsReporter != nil {
+		master.subnetStatsReporter.recordReconcile(master.clock.Now())
+	}
+}
@@ -0,0 +1,65 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestReconcileOnce(t *testing.T) {
+	nodes := []*corev1.Node{
+		makeNode("healthy", "uid1", "192.168.1.1"),
+		makeNode("unstamped", "uid2", "192.168.1.2"),
+		makeNode("replaced", "uid4-new", "192.168.1.4"),
+		makeNode("no-host-ip", "uid5", "192.168.1.5"),
+	}
+	subnets := []*osdnv1.HostSubnet{
+		makeHostSubnet("healthy", "healthy", "192.168.1.1", "10.128.0.0/23", "uid1"),
+		makeHostSubnet("unstamped", "unstamped", "192.168.1.2", "10.128.2.0/23", ""),
+		makeHostSubnet("orphan", "orphan", "192.168.1.3", "10.128.4.0/23", "uid3"),
+		makeHostSubnet("orphan2", "orphan2", "192.168.1.6", "10.128.6.0/23", "uid6"),
+		makeHostSubnet("replaced", "replaced", "192.168.1.4", "10.128.8.0/23", "uid4"),
+		makeHostSubnet("no-host-ip", "no-host-ip", "", "10.128.10.0/23", "uid5"),
+		makeHostSubnet("f5", "f5", "192.168.1.100", "10.128.12.0/23", ""),
+	}
+	master, _ := newTestSubnetMaster(t, nodes, subnets)
+
+	summary, err := master.ReconcileOnce()
+	if err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	expected := &ReconcileSummary{
+		Counts: map[ReconcileAction]int{
+			ReconcileNone:            2,
+			ReconcileStampedNodeUID:  1,
+			ReconcileDeletedOrphan:   2,
+			ReconcileDeletedReplaced: 1,
+			ReconcileFilledFields:    1,
+		},
+		Subnets: map[ReconcileAction][]string{
+			ReconcileStampedNodeUID:  {"unstamped"},
+			ReconcileDeletedOrphan:   {"orphan", "orphan2"},
+			ReconcileDeletedReplaced: {"replaced"},
+			ReconcileFilledFields:    {"no-host-ip"},
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+
+	// A second pass finds nothing left to do
+	summary, err = master.ReconcileOnce()
+	if err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	expected = &ReconcileSummary{
+		Counts:  map[ReconcileAction]int{ReconcileNone: 4},
+		Subnets: map[ReconcileAction][]string{},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+}
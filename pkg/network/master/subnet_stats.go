@@ -0,0 +1,137 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	masterutil "github.com/openshift/sdn/pkg/network/master/util"
+)
+
+const (
+	subnetStatsConfigMapNamespace = "openshift-sdn"
+	subnetStatsConfigMapName      = "sdn-subnet-allocation"
+)
+
+// subnetStatsReporter writes a summary of the subnet allocator's state to a ConfigMap,
+// for consumers that can't scrape metrics. The ConfigMap is updated whenever the
+// reporter is notified of a change, and also periodically.
+type subnetStatsReporter struct {
+	kClient   kclientset.Interface
+	allocator *masterutil.SubnetAllocator
+	namespace string
+	name      string
+	interval  time.Duration
+	clock     clock.WithTicker
+
+	changed chan struct{}
+
+	lock          sync.Mutex
+	lastReconcile time.Time
+}
+
+// newSubnetStatsReporter creates a reporter writing to the ConfigMap namespace/name (or
+// the default ConfigMap, if those are empty), using clk for its periodic updates
+func newSubnetStatsReporter(kClient kclientset.Interface, allocator *masterutil.SubnetAllocator, namespace, name string, interval time.Duration, clk clock.WithTicker) *subnetStatsReporter {
+	if namespace == "" {
+		namespace = subnetStatsConfigMapNamespace
+	}
+	if name == "" {
+		name = subnetStatsConfigMapName
+	}
+	return &subnetStatsReporter{
+		kClient:   kClient,
+		allocator: allocator,
+		namespace: namespace,
+		name:      name,
+		interval:  interval,
+		clock:     clk,
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+func (r *subnetStatsReporter) run(stopCh <-chan struct{}) {
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.report(); err != nil {
+			klog.Warningf("Failed to report subnet allocation state: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+		case <-r.changed:
+		}
+	}
+}
+
+// notifyChange causes the ConfigMap to be updated soon, without blocking
+func (r *subnetStatsReporter) notifyChange() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// recordReconcile records that a full pass reconciling HostSubnets completed at time t
+func (r *subnetStatsReporter) recordReconcile(t time.Time) {
+	r.lock.Lock()
+	r.lastReconcile = t
+	r.lock.Unlock()
+	r.notifyChange()
+}
+
+// report writes the allocator's current state to the ConfigMap, creating it if needed
+func (r *subnetStatsReporter) report() error {
+	data := subnetStatsConfigMapData(r.allocator.Stats())
+	r.lock.Lock()
+	if !r.lastReconcile.IsZero() {
+		data["lastReconcile"] = r.lastReconcile.UTC().Format(time.RFC3339)
+	}
+	r.lock.Unlock()
+
+	cm, err := r.kClient.CoreV1().ConfigMaps(r.namespace).Get(context.TODO(), r.name, metav1.GetOptions{})
+	if kerrs.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace, Name: r.name},
+			Data:       data,
+		}
+		_, err = r.kClient.CoreV1().ConfigMaps(r.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(cm.Data, data) {
+		return nil
+	}
+	cm = cm.DeepCopy()
+	cm.Data = data
+	_, err = r.kClient.CoreV1().ConfigMaps(r.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+func subnetStatsConfigMapData(stats masterutil.SubnetAllocatorStats) map[string]string {
+	ranges := make([]string, 0, len(stats.Ranges))
+	for _, rs := range stats.Ranges {
+		ranges = append(ranges, fmt.Sprintf("%s hostBits=%d total=%d allocated=%d free=%d", rs.Network, rs.HostBits, rs.Total, rs.Allocated, rs.Free))
+	}
+	return map[string]string{
+		"total":     strconv.FormatUint(stats.Total, 10),
+		"allocated": strconv.FormatUint(stats.Allocated, 10),
+		"free":      strconv.FormatUint(stats.Free, 10),
+		"ranges":    strings.Join(ranges, "\n"),
+	}
+}
@@ -0,0 +1,144 @@
+package master
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	testingclock "k8s.io/utils/clock/testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+)
+
+func TestSubnetStatsReporter(t *testing.T) {
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+	})
+	reporter := newSubnetStatsReporter(master.kClient, master.subnetAllocator, "", "", time.Minute, master.clock)
+
+	checkData := func(allocated, free string) {
+		t.Helper()
+		cm, err := master.kClient.CoreV1().ConfigMaps(subnetStatsConfigMapNamespace).Get(context.TODO(), subnetStatsConfigMapName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error getting ConfigMap: %v", err)
+		}
+		expected := map[string]string{
+			"total":     "512",
+			"allocated": allocated,
+			"free":      free,
+			"ranges":    "10.128.0.0/14 hostBits=9 total=512 allocated=" + allocated + " free=" + free,
+		}
+		for key, value := range expected {
+			if cm.Data[key] != value {
+				t.Fatalf("expected %s=%q, got %q", key, value, cm.Data[key])
+			}
+		}
+	}
+
+	if err := reporter.report(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkData("1", "511")
+
+	if _, err := master.subnetAllocator.AllocateNetwork(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := reporter.report(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkData("2", "510")
+}
+
+func TestSubnetStatsReporterOnChange(t *testing.T) {
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+	})
+	reporter := newSubnetStatsReporter(master.kClient, master.subnetAllocator, "custom-ns", "custom-name", time.Hour, master.clock)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go reporter.run(stopCh)
+
+	waitForData := func(key, value string) {
+		t.Helper()
+		err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			cm, err := master.kClient.CoreV1().ConfigMaps("custom-ns").Get(context.TODO(), "custom-name", metav1.GetOptions{})
+			if err != nil {
+				return false, nil
+			}
+			return cm.Data[key] == value, nil
+		})
+		if err != nil {
+			t.Fatalf("ConfigMap never got %s=%q", key, value)
+		}
+	}
+
+	// Initial report
+	waitForData("allocated", "1")
+
+	// Changes are reported without waiting for the interval
+	if _, err := master.subnetAllocator.AllocateNetwork(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reporter.notifyChange()
+	waitForData("allocated", "2")
+
+	reconciled := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	reporter.recordReconcile(reconciled)
+	waitForData("lastReconcile", "2023-01-02T03:04:05Z")
+}
+
+func TestSubnetStatsReporterStop(t *testing.T) {
+	master, _ := newTestSubnetMaster(t, nil, nil)
+	master.subnetStatsReportInterval = time.Hour
+
+	if err := master.startSubnetMaster(); err != nil {
+		t.Fatalf("unexpected error starting subnet master: %v", err)
+	}
+	stopCh := master.stopSubnetStats
+	if stopCh == nil {
+		t.Fatalf("expected subnet stats reporter to be started")
+	}
+	if err := master.Stop(); err != nil {
+		t.Fatalf("unexpected error stopping subnet master: %v", err)
+	}
+	select {
+	case <-stopCh:
+	default:
+		t.Fatalf("expected subnet stats reporter to be stopped")
+	}
+	if master.stopSubnetStats != nil {
+		t.Fatalf("expected subnet stats reporter stop channel to be cleared")
+	}
+}
+
+func TestSubnetStatsLastReconcile(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+	fakeClock := testingclock.NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	master.clock = fakeClock
+	master.subnetStatsReporter = newSubnetStatsReporter(master.kClient, master.subnetAllocator, "", "", time.Hour, master.clock)
+	lastReconcile := func() time.Time {
+		master.subnetStatsReporter.lock.Lock()
+		defer master.subnetStatsReporter.lock.Unlock()
+		return master.subnetStatsReporter.lastReconcile
+	}
+
+	// HostSubnet events aren't full reconciles
+	master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+	if last := lastReconcile(); !last.IsZero() {
+		t.Fatalf("expected no reconcile to be recorded, got %v", last)
+	}
+
+	if _, err := master.ReconcileOnce(); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	if last := lastReconcile(); !last.Equal(fakeClock.Now()) {
+		t.Fatalf("expected reconcile at %v to be recorded, got %v", fakeClock.Now(), last)
+	}
+}
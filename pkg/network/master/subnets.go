@@ -2,29 +2,91 @@ package master
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	corev1 "k8s.io/api/core/v1"
 	kerrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
 
 	osdnv1 "github.com/openshift/api/network/v1"
 	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
 	masterutil "github.com/openshift/sdn/pkg/network/master/util"
 )
 
+// reconcilePausedAnnotation can be set on the default ClusterNetwork to stop the master
+// from updating or deleting existing HostSubnets during reconciliation, e.g. while an
+// administrator is repairing them by hand
+const reconcilePausedAnnotation = "network.openshift.io/pause-hostsubnet-reconcile"
+
+// deferredSubnetDeleteRetryInterval is how often a deferred HostSubnet deletion (see
+// deferHostSubnetDelete) is retried
+const deferredSubnetDeleteRetryInterval = 10 * time.Second
+
+// HostSubnetLimitError is returned when a HostSubnet can't be created because the
+// configured maximum number of HostSubnets has been reached
+type HostSubnetLimitError struct {
+	Limit int
+}
+
+func (e *HostSubnetLimitError) Error() string {
+	return fmt.Sprintf("cluster has reached the maximum of %d HostSubnets", e.Limit)
+}
+
+// hostSubnetLengthAnnotation can be set on a node to request a HostSubnet with that many
+// host bits, rather than the HostSubnetLength of the cluster network. It must be at least
+// the cluster network's HostSubnetLength. The master records the length on the
+// HostSubnet with the same annotation.
+const hostSubnetLengthAnnotation = "network.openshift.io/host-subnet-length"
+
+// requestedSubnetAnnotation can be set along with osdnv1.AssignHostSubnetAnnotation to
+// request a specific subnet for a HostSubnet that is not backed by a node
+const requestedSubnetAnnotation = "pod.network.openshift.io/requested-subnet"
+
+// nodeMaintenanceAnnotation can be set on a node to freeze its HostSubnet: while it is
+// set, the master does not delete or otherwise reconcile the HostSubnet, even if the node
+// is deleted or seems to have disappeared. Removing the annotation (or recreating the
+// node without it) resumes normal handling. Nodes that are deleted while in maintenance
+// are only remembered until the master restarts.
+const nodeMaintenanceAnnotation = "network.openshift.io/subnet-maintenance"
+
+// nodeSubnetAnnotation is set by the master on each node to the subnet of its HostSubnet,
+// if OsdnMaster.annotateNodeSubnet is set
+const nodeSubnetAnnotation = "network.openshift.io/node-subnet"
+
 func (master *OsdnMaster) startSubnetMaster() error {
-	master.subnetAllocator = masterutil.NewSubnetAllocator()
+	if master.clock == nil {
+		master.clock = clock.RealClock{}
+	}
+	master.subnetAllocator = masterutil.NewSubnetAllocator(masterutil.WithClock(master.clock))
 	for _, cn := range master.networkInfo.ClusterNetworks {
-		err := master.subnetAllocator.AddNetworkRange(cn.ClusterCIDR.String(), cn.HostSubnetLength)
+		err := master.subnetAllocator.AddNetworkRangeWithOffset(cn.ClusterCIDR.String(), cn.HostSubnetLength, master.subnetAllocationOffset)
 		if err != nil {
 			return err
 		}
+		if priority, ok := master.subnetRangePriorities[cn.ClusterCIDR.String()]; ok {
+			if err := master.subnetAllocator.SetRangePriority(cn.ClusterCIDR.String(), priority); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Populate subnet allocator
@@ -32,21 +94,117 @@ func (master *OsdnMaster) startSubnetMaster() error {
 	if err != nil {
 		return err
 	}
+	orphaned, foreign := 0, 0
 	for _, sn := range subnets {
-		if err := master.subnetAllocator.MarkAllocatedNetwork(sn.Subnet); err != nil {
+		subnet, err := master.subnetAllocator.NormalizeSubnet(sn.Subnet)
+		if err != nil {
+			// Length mismatches are reported by warnHostSubnetLengthMismatches below
+			if rng, _, _ := master.hostSubnetLengthMismatch(sn); rng != nil || !hostSubnetLengthOverridden(sn) {
+				klog.Errorf("HostSubnet %s does not match the cluster network configuration: %v", common.HostSubnetToString(sn), err)
+			}
+			subnet = sn.Subnet
+		}
+		if err := master.subnetAllocator.MarkAllocatedNetwork(subnet); err != nil {
 			klog.Errorf("Error marking allocated subnet: %v", err)
+			foreign++
+		} else if nodeUID := common.HostSubnetNodeUID(sn); nodeUID != "" {
+			master.setSubnetOwner(subnet, nodeUID)
+		}
+		if common.HostSubnetNodeUID(sn) != "" {
+			if _, err := master.nodeInformer.Lister().Get(sn.Name); err != nil {
+				orphaned++
+			}
 		}
 	}
 
-	master.watchNodes()
-	master.watchSubnets()
+	master.subnetIndexLock.Lock()
+	master.subnetIndex = common.NewSubnetIndex(subnets)
+	master.subnetIndexLock.Unlock()
+
+	// (Before watching HostSubnets, so that the event handlers don't report these
+	// mismatches again individually.)
+	master.warnHostSubnetLengthMismatches(subnets)
+
+	if err := master.watchNodes(); err != nil {
+		return err
+	}
+	if err := master.watchSubnets(); err != nil {
+		return err
+	}
+
+	klog.Info(subnetMasterSummary(master.subnetAllocator.Stats(), orphaned, foreign))
+	for _, mismatch := range common.FindGatewayMismatches(subnets) {
+		klog.Warningf("HostSubnet %s has subnet %s, implying gateway %s, but nodes use gateway %s; check anything that depends on the gateway",
+			mismatch.HostSubnet, mismatch.Subnet, mismatch.Implied, mismatch.Expected)
+	}
+	for uid, names := range common.FindDuplicateNodeSubnets(subnets) {
+		klog.Warningf("Node with UID %s has multiple HostSubnets: %s; its pods may be split across their subnets",
+			uid, strings.Join(names, ", "))
+	}
+
+	if master.checkHostNetworksOnStart {
+		master.warnHostNetworkConflicts()
+	}
+
+	if master.subnetStatsReportInterval > 0 {
+		master.subnetStatsReporter = newSubnetStatsReporter(master.kClient, master.subnetAllocator,
+			master.subnetStatsNamespace, master.subnetStatsName, master.subnetStatsReportInterval, master.clock)
+		master.stopSubnetStats = make(chan struct{})
+		go master.subnetStatsReporter.run(master.stopSubnetStats)
+	}
+
+	if master.subnetSelfHealInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		master.cancelSubnetSelfHeal = cancel
+		go master.runSubnetSelfHeal(ctx, master.subnetSelfHealInterval)
+	}
 
 	return nil
 }
 
-func (master *OsdnMaster) watchNodes() {
+// warnHostNetworkConflicts logs a warning and emits an event for each network of the
+// local host's interfaces that overlaps the cluster or service network
+func (master *OsdnMaster) warnHostNetworkConflicts() {
+	hostIPNetworks := master.hostIPNetworks
+	if hostIPNetworks == nil {
+		hostIPNetworks = localHostIPNetworks
+	}
+	hostIPNets, err := hostIPNetworks()
+	if err != nil {
+		klog.Warningf("Could not check the cluster network against the host's networks: %v", err)
+		return
+	}
+	err = master.networkInfo.CheckHostNetworks(hostIPNets)
+	if err == nil {
+		return
+	}
+	for _, conflict := range err.(kerrors.Aggregate).Errors() {
+		klog.Warningf("Host network conflict: %v", conflict)
+		master.recorder.Eventf(clusterNetworkRef(), corev1.EventTypeWarning, "HostNetworkConflict",
+			"The master's host has a network that conflicts with the cluster network configuration: %v", conflict)
+	}
+}
+
+// subnetMasterSummary returns a one-line summary of the subnet master's state, given
+// the allocator stats and the number of orphaned (node-backed, but with no node) and
+// foreign (not in any cluster network range) HostSubnets.
+func subnetMasterSummary(stats masterutil.SubnetAllocatorStats, orphaned, foreign int) string {
+	ranges := make([]string, 0, len(stats.Ranges))
+	for _, rs := range stats.Ranges {
+		ranges = append(ranges, fmt.Sprintf("%s (host bits %d, %d/%d allocated)", rs.Network, rs.HostBits, rs.Allocated, rs.Total))
+	}
+	return fmt.Sprintf("Started subnet master: ranges [%s]; %d subnets total, %d allocated, %d free; %d orphaned HostSubnets, %d foreign HostSubnets",
+		strings.Join(ranges, ", "), stats.Total, stats.Allocated, stats.Free, orphaned, foreign)
+}
+
+func (master *OsdnMaster) watchNodes() error {
 	funcs := common.InformerFuncs(&corev1.Node{}, master.handleAddOrUpdateNode, master.handleDeleteNode)
-	master.nodeInformer.Informer().AddEventHandler(funcs)
+	registration, err := master.nodeInformer.Informer().AddEventHandler(funcs)
+	if err != nil {
+		return fmt.Errorf("could not watch nodes: %v", err)
+	}
+	master.nodeHandlerRegistration = registration
+	return nil
 }
 
 func (master *OsdnMaster) handleAddOrUpdateNode(obj, _ interface{}, eventType watch.EventType) {
@@ -59,30 +217,103 @@ func (master *OsdnMaster) handleAddOrUpdateNode(obj, _ interface{}, eventType wa
 	}
 
 	master.clearInitialNodeNetworkUnavailableCondition(node)
+	master.recordNodeMaintenance(node)
 
-	if oldNodeIP, ok := master.hostSubnetNodeIPs[node.UID]; ok && (nodeIP == oldNodeIP) {
+	master.nodeIPLock.Lock()
+	oldNodeIP, hasOldNodeIP := master.hostSubnetNodeIPs[node.UID]
+	owner, hasOwner := master.nodeIPOwners[nodeIP]
+	master.nodeIPLock.Unlock()
+	if hasOldNodeIP && (nodeIP == oldNodeIP) {
 		return
 	}
 	// Node status is frequently updated by kubelet, so log only if the above condition is not met
 	klog.V(5).Infof("Watch %s event for Node %q", eventType, node.Name)
 
-	err := master.addNode(node.Name, string(node.UID), nodeIP, nil)
+	if hasOwner && owner != node.UID {
+		// Most likely a node was deleted and a new node reused its IP before we
+		// processed the deletion, but it may also be a real conflict.
+		klog.Warningf("Node %s claims IP %s which is still held by the node with UID %s", node.Name, nodeIP, owner)
+		master.recorder.Eventf(nodeRef(node.Name, string(node.UID)), corev1.EventTypeWarning, "NodeIPReused",
+			"Node IP %s is still held by the node with UID %s", nodeIP, owner)
+	}
+
+	err := master.addNode(node.Name, string(node.UID), nodeIP, nil, "")
 	if err != nil {
 		klog.Errorf("Error creating subnet for node %s, ip %s: %v", node.Name, nodeIP, err)
 		return
 	}
-	master.hostSubnetNodeIPs[node.UID] = nodeIP
+	master.recordNodeIP(node.UID, nodeIP)
+}
+
+// recordNodeIP records that the HostSubnet of the node with UID nodeUID has host IP nodeIP
+func (master *OsdnMaster) recordNodeIP(nodeUID ktypes.UID, nodeIP string) {
+	master.nodeIPLock.Lock()
+	defer master.nodeIPLock.Unlock()
+
+	if oldNodeIP, ok := master.hostSubnetNodeIPs[nodeUID]; ok && master.nodeIPOwners[oldNodeIP] == nodeUID {
+		delete(master.nodeIPOwners, oldNodeIP)
+	}
+	master.hostSubnetNodeIPs[nodeUID] = nodeIP
+	master.nodeIPOwners[nodeIP] = nodeUID
+}
+
+// recordNodeMaintenance records whether node has nodeMaintenanceAnnotation
+func (master *OsdnMaster) recordNodeMaintenance(node *corev1.Node) {
+	_, inMaintenance := node.Annotations[nodeMaintenanceAnnotation]
+
+	master.nodeIPLock.Lock()
+	defer master.nodeIPLock.Unlock()
+
+	if inMaintenance == master.maintenanceNodes[node.Name] {
+		return
+	}
+	if inMaintenance {
+		klog.Infof("Node %s is in maintenance; freezing its HostSubnet", node.Name)
+		if master.maintenanceNodes == nil {
+			master.maintenanceNodes = make(map[string]bool)
+		}
+		master.maintenanceNodes[node.Name] = true
+	} else {
+		klog.Infof("Node %s is no longer in maintenance; unfreezing its HostSubnet", node.Name)
+		delete(master.maintenanceNodes, node.Name)
+	}
+}
+
+// nodeInMaintenance returns whether the HostSubnet of the node named nodeName is frozen
+// by nodeMaintenanceAnnotation, logging the skipped action if so
+func (master *OsdnMaster) nodeInMaintenance(nodeName, action string) bool {
+	master.nodeIPLock.Lock()
+	inMaintenance := master.maintenanceNodes[nodeName]
+	master.nodeIPLock.Unlock()
+	if inMaintenance {
+		klog.Infof("Node %s is in maintenance; not acting on its HostSubnet (would %s)", nodeName, action)
+	}
+	return inMaintenance
 }
 
 func (master *OsdnMaster) handleDeleteNode(obj interface{}) {
 	node := obj.(*corev1.Node)
 	klog.V(5).Infof("Watch %s event for Node %q", watch.Deleted, node.Name)
 
-	if _, exists := master.hostSubnetNodeIPs[node.UID]; !exists {
+	if _, ok := node.Annotations[nodeMaintenanceAnnotation]; ok {
+		master.recordNodeMaintenance(node)
+	}
+	if master.nodeInMaintenance(node.Name, "delete it") {
+		return
+	}
+
+	master.nodeIPLock.Lock()
+	nodeIP, exists := master.hostSubnetNodeIPs[node.UID]
+	if !exists {
+		master.nodeIPLock.Unlock()
 		return
 	}
 
 	delete(master.hostSubnetNodeIPs, node.UID)
+	if master.nodeIPOwners[nodeIP] == node.UID {
+		delete(master.nodeIPOwners, nodeIP)
+	}
+	master.nodeIPLock.Unlock()
 
 	if err := master.deleteNode(node.Name); err != nil {
 		klog.Errorf("Error deleting node %s: %v", node.Name, err)
@@ -90,43 +321,127 @@ func (master *OsdnMaster) handleDeleteNode(obj interface{}) {
 	}
 }
 
-// addNode takes the nodeName, a preferred nodeIP and the node's annotations
+// addNode takes the nodeName, a preferred nodeIP, the node's annotations, and optionally
+// a requested subnet
 // Creates or updates a HostSubnet if needed
-func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string, hsAnnotations map[string]string) error {
+func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string, hsAnnotations map[string]string, requestedSubnet string) (err error) {
+	ctx, span := master.startSpan(context.TODO(), "addNode", nodeNameAttr(nodeName))
+	defer func() { endSpan(span, err) }()
+
+	// Ensure concurrent calls for the same node can't both allocate a subnet
+	master.nodeLocks.LockKey(nodeName)
+	defer master.nodeLocks.UnlockKey(nodeName)
+
 	// Validate node IP before proceeding
 	if err := master.networkInfo.ValidateNodeIP(nodeIP); err != nil {
 		return err
 	}
+	if err := master.checkNodeIPConflict(nodeName, nodeUID, nodeIP); err != nil {
+		return err
+	}
+	if err := master.checkNodeIPInHostSubnet(nodeName, nodeUID, nodeIP); err != nil {
+		return err
+	}
 
 	// Check if subnet needs to be created or updated
 	sub, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), nodeName, metav1.GetOptions{})
 	if err == nil {
 		if err = common.ValidateHostSubnet(sub); err != nil {
 			klog.Errorf("Deleting invalid HostSubnet %q: %v", nodeName, err)
-			_ = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), nodeName, metav1.DeleteOptions{})
+			if err := master.runPreDeleteHook(sub); err != nil {
+				return err
+			}
+			_ = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), nodeName, master.hostSubnetDeleteOptions())
 			// fall through to create new subnet below
 		} else if sub.HostIP == nodeIP {
+			span.SetAttributes(subnetKey.String(sub.Subnet))
+			master.syncNodeSubnetAnnotation(nodeName, nodeUID, sub.Subnet)
 			return nil
 		} else {
 			// Node IP changed, update old subnet
+			if err := master.checkNodeIPChange(nodeName, nodeUID, sub.HostIP, nodeIP); err != nil {
+				return err
+			}
+			master.checkNodeIPIsLocal(nodeName, nodeUID, nodeIP)
+			if err := master.probeNodeIP(nodeName, nodeUID, nodeIP); err != nil {
+				return err
+			}
 			sub.HostIP = nodeIP
 			sub, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sub, metav1.UpdateOptions{})
 			if err != nil {
 				return fmt.Errorf("error updating subnet %s for node %s: %v", sub.Subnet, nodeName, err)
 			}
 			klog.Infof("Updated HostSubnet %s", common.HostSubnetToString(sub))
+			span.SetAttributes(subnetKey.String(sub.Subnet))
+			master.syncNodeSubnetAnnotation(nodeName, nodeUID, sub.Subnet)
 			return nil
 		}
 	}
 
 	// Create new subnet
-	if len(nodeUID) != 0 {
-		if hsAnnotations == nil {
-			hsAnnotations = make(map[string]string)
+	master.checkNodeIPIsLocal(nodeName, nodeUID, nodeIP)
+	if err := master.probeNodeIP(nodeName, nodeUID, nodeIP); err != nil {
+		return err
+	}
+	if master.maxHostSubnets > 0 {
+		if allocated := master.subnetAllocator.Stats().Allocated; allocated >= uint64(master.maxHostSubnets) {
+			err = &HostSubnetLimitError{Limit: master.maxHostSubnets}
+			if len(nodeUID) != 0 {
+				master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "HostSubnetLimitReached",
+					"Not assigning a subnet to node %s: %v", nodeName, err)
+			}
+			return err
 		}
+	}
+	if hsAnnotations == nil && (master.annotationDecorator != nil || len(nodeUID) != 0) {
+		hsAnnotations = make(map[string]string)
+	}
+	if master.annotationDecorator != nil {
+		master.decorateHostSubnetAnnotations(nodeName, nodeUID, hsAnnotations)
+	}
+	if len(nodeUID) != 0 {
 		hsAnnotations[osdnv1.NodeUIDAnnotation] = nodeUID
 	}
-	network, err := master.subnetAllocator.AllocateNetwork()
+	hostSubnetLength, err := master.hostSubnetLengthForNode(nodeName, nodeUID)
+	if err != nil {
+		return err
+	}
+	var network string
+	_, allocSpan := master.startSpan(ctx, "AllocateNetwork", nodeNameAttr(nodeName))
+	if master.externalIPAM != nil && len(nodeUID) != 0 {
+		network, err = master.allocateFromExternalIPAM(nodeName, nodeUID)
+	} else if requestedSubnet != "" {
+		network, err = master.subnetAllocator.AllocateNetworkPreferring(requestedSubnet)
+		if err == nil && network != requestedSubnet {
+			klog.Warningf("Requested subnet %s for node %s is not available; allocated %s instead", requestedSubnet, nodeName, network)
+		} else if err != nil && err != masterutil.ErrSubnetAllocatorFull {
+			klog.Errorf("Ignoring invalid requested subnet for node %s: %v", nodeName, err)
+			network, err = master.subnetAllocator.AllocateNetwork()
+		}
+	} else if hostSubnetLength != 0 {
+		network, err = master.subnetAllocator.AllocateNetworkWithLength(hostSubnetLength)
+		if err == nil {
+			hsAnnotations[hostSubnetLengthAnnotation] = strconv.Itoa(int(hostSubnetLength))
+		} else if err != masterutil.ErrSubnetAllocatorFull {
+			master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "InvalidHostSubnetLength",
+				"Not assigning a subnet to node %s: invalid %s annotation: %v", nodeName, hostSubnetLengthAnnotation, err)
+		}
+	} else if rangeCIDR := master.subnetRangeForNode(nodeName, nodeUID); rangeCIDR != "" {
+		network, err = master.subnetAllocator.AllocateNetworkFromRange(rangeCIDR)
+		if err == masterutil.ErrSubnetAllocatorFull && master.subnetRangeFallback {
+			klog.Warningf("Range %s for node %s is full; allocating from any range", rangeCIDR, nodeName)
+			network, err = master.subnetAllocator.AllocateNetwork()
+		} else if err != nil && err != masterutil.ErrSubnetAllocatorFull {
+			klog.Errorf("Ignoring invalid range for node %s: %v", nodeName, err)
+			network, err = master.subnetAllocator.AllocateNetwork()
+		}
+	} else {
+		network, err = master.subnetAllocator.AllocateNetwork()
+	}
+	if err == nil {
+		allocSpan.SetAttributes(subnetKey.String(network))
+	}
+	endSpan(allocSpan, err)
 	if err != nil {
 		return fmt.Errorf("error allocating network for node %s: %v", nodeName, err)
 	}
@@ -145,170 +460,1519 @@ func (master *OsdnMaster) addNode(nodeName string, nodeUID string, nodeIP string
 		return fmt.Errorf("error allocating subnet for node %q: %v", nodeName, err)
 	}
 	klog.Infof("Created HostSubnet %s", common.HostSubnetToString(sub))
+	if len(nodeUID) != 0 {
+		master.setSubnetOwner(network, nodeUID)
+	}
+	span.SetAttributes(subnetKey.String(sub.Subnet))
+	master.checkSubnetsLow()
+	master.syncNodeSubnetAnnotation(nodeName, nodeUID, sub.Subnet)
+	if len(nodeUID) != 0 {
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeNormal, "SubnetAssigned",
+			"Assigned subnet %s to node %s (host IP %s)", sub.Subnet, nodeName, nodeIP)
+	} else {
+		master.recorder.Eventf(hostSubnetRef(sub), corev1.EventTypeNormal, "SubnetAssigned",
+			"Assigned subnet %s to HostSubnet %s (host IP %s) as requested by %s annotation", sub.Subnet, nodeName, nodeIP, osdnv1.AssignHostSubnetAnnotation)
+	}
 	return nil
 }
 
-func (master *OsdnMaster) deleteNode(nodeName string) error {
-	subInfo := nodeName
-	// If create and delete events for the same node are called in quick succession,
-	// hostsubnet informer cache may not have corresponding item. We fetch the object just for logging.
-	// So if we get the object we will log in detail otherwise will log in brief.
-	if sub, err := master.hostSubnetInformer.Lister().Get(nodeName); err == nil {
-		subInfo = common.HostSubnetToString(sub)
+// syncNodeSubnetAnnotation sets nodeSubnetAnnotation on the node to subnet (or removes it
+// if subnet is ""), if master.annotateNodeSubnet is set. Only that annotation is patched,
+// and only if it doesn't already have the right value, so other writers of the node's
+// annotations are unaffected. Errors are logged but otherwise ignored, since the
+// annotation is informational.
+func (master *OsdnMaster) syncNodeSubnetAnnotation(nodeName, nodeUID, subnet string) {
+	if !master.annotateNodeSubnet || len(nodeUID) == 0 {
+		return
 	}
-	if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), nodeName, metav1.DeleteOptions{}); err != nil {
-		return fmt.Errorf("error deleting subnet for node %q: %v", nodeName, err)
+	if node := master.getHostSubnetNode(nodeName, nodeUID); node != nil {
+		if current, ok := node.Annotations[nodeSubnetAnnotation]; ok == (subnet != "") && current == subnet {
+			return
+		}
+	} else if subnet == "" {
+		// Node is gone (or replaced), so there's nothing to remove
+		return
 	}
 
-	klog.Infof("Deleted HostSubnet %s", subInfo)
-	return nil
+	var value interface{}
+	if subnet != "" {
+		value = subnet
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{nodeSubnetAnnotation: value},
+		},
+	})
+	if err != nil {
+		klog.Errorf("Could not build %s patch for node %s: %v", nodeSubnetAnnotation, nodeName, err)
+		return
+	}
+	if _, err := master.kClient.CoreV1().Nodes().Patch(context.TODO(), nodeName, ktypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil && !kerrs.IsNotFound(err) {
+		klog.Warningf("Could not update %s annotation on node %s: %v", nodeSubnetAnnotation, nodeName, err)
+	}
 }
 
-// Because openshift-sdn uses an overlay and doesn't need GCE Routes, we need to
-// clear the NetworkUnavailable condition that kubelet adds to initial node
-// status when using GCE.
-// TODO: make upstream kubelet more flexible with overlays and GCE so this
-// condition doesn't get added for network plugins that don't want it, and then
-// we can remove this function.
-func (master *OsdnMaster) clearInitialNodeNetworkUnavailableCondition(origNode *corev1.Node) {
-	// Informer cache should not be mutated, so get a copy of the object
-	node := origNode.DeepCopy()
-	knode := node
-	cleared := false
-	resultErr := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+// allocateFromExternalIPAM gets a subnet for the node from master.externalIPAM, checks
+// that it is an unallocated subnet of the cluster network that does not overlap another
+// node's HostSubnet, and marks it allocated in the subnet allocator
+func (master *OsdnMaster) allocateFromExternalIPAM(nodeName, nodeUID string) (string, error) {
+	node := master.getHostSubnetNode(nodeName, nodeUID)
+	if node == nil {
 		var err error
-
-		if knode != node {
-			knode, err = master.nodeInformer.Lister().Get(node.Name)
-			if err != nil {
-				return err
-			}
+		node, err = master.kClient.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("could not get node %s for external IPAM: %v", nodeName, err)
 		}
-
-		for i := range knode.Status.Conditions {
-			if knode.Status.Conditions[i].Type == corev1.NodeNetworkUnavailable {
-				condition := &knode.Status.Conditions[i]
-				if condition.Status != corev1.ConditionFalse && condition.Reason == "NoRouteCreated" {
-					condition.Status = corev1.ConditionFalse
-					condition.Reason = "RouteCreated"
-					condition.Message = "openshift-sdn cleared kubelet-set NoRouteCreated"
-					condition.LastTransitionTime = metav1.Now()
-
-					if knode, err = master.kClient.CoreV1().Nodes().UpdateStatus(context.TODO(), knode, metav1.UpdateOptions{}); err == nil {
-						cleared = true
-					}
-				}
-				break
-			}
+	}
+	subnet, err := master.externalIPAM.AllocateForNode(node)
+	if err != nil {
+		return "", fmt.Errorf("external IPAM failed to allocate a subnet: %v", err)
+	}
+	network, err := master.subnetAllocator.NormalizeSubnet(subnet)
+	if err != nil {
+		return "", fmt.Errorf("external IPAM returned invalid subnet %q: %v", subnet, err)
+	}
+	if owner := master.otherHostSubnetOverlapping(network, nodeName); owner != nil {
+		return "", fmt.Errorf("external IPAM returned subnet %s, which overlaps HostSubnet %s", network, common.HostSubnetToString(owner))
+	}
+	allocated, err := master.subnetAllocator.AllocateNetworkPreferring(network)
+	if err != nil {
+		return "", fmt.Errorf("external IPAM returned unusable subnet %s: %v", network, err)
+	}
+	if allocated != network {
+		if err := master.subnetAllocator.ReleaseNetwork(allocated); err != nil {
+			klog.Errorf("Failed to release subnet %s after rejecting external IPAM subnet %s: %v", allocated, network, err)
 		}
-		return err
-	})
-	if resultErr != nil {
-		klog.Errorf("Status update failed for local node: %v", resultErr)
-	} else if cleared {
-		klog.Infof("Cleared node NetworkUnavailable/NoRouteCreated condition for %s", node.Name)
+		return "", fmt.Errorf("external IPAM returned subnet %s, which is already allocated", network)
 	}
+	return network, nil
 }
 
-func (master *OsdnMaster) watchSubnets() {
-	funcs := common.InformerFuncs(&osdnv1.HostSubnet{}, master.handleAddOrUpdateSubnet, master.handleDeleteSubnet)
-	master.hostSubnetInformer.Informer().AddEventHandler(funcs)
+// otherHostSubnetOverlapping returns a HostSubnet, other than nodeName's, whose subnet
+// overlaps subnet, or nil if there is none
+func (master *OsdnMaster) otherHostSubnetOverlapping(subnet, nodeName string) *osdnv1.HostSubnet {
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil
+	}
+	master.subnetIndexLock.Lock()
+	defer master.subnetIndexLock.Unlock()
+	for _, hs := range master.hostSubnetIndex().Overlapping(ipnet) {
+		if hs.Name != nodeName {
+			return hs
+		}
+	}
+	return nil
 }
 
-func (master *OsdnMaster) handleAddOrUpdateSubnet(obj, _ interface{}, eventType watch.EventType) {
-	hs := obj.(*osdnv1.HostSubnet)
-	klog.V(5).Infof("Watch %s event for HostSubnet %q", eventType, hs.Name)
+// setSubnetOwner records in the subnet allocator that subnet belongs to the node with
+// UID nodeUID
+func (master *OsdnMaster) setSubnetOwner(subnet, nodeUID string) {
+	if err := master.subnetAllocator.SetNetworkOwner(subnet, nodeUID); err != nil {
+		klog.Warningf("Could not record node %s as the owner of subnet %s: %v", nodeUID, subnet, err)
+	}
+}
 
-	if err := common.ValidateHostSubnet(hs); err != nil {
-		klog.Errorf("Ignoring invalid HostSubnet %s: %v", common.HostSubnetToString(hs), err)
+// checkSubnetsLow checks whether any cluster network range is low on free subnets (see
+// OsdnMaster.subnetLowThreshold), logging a warning for each range that is, and emitting
+// an event for each range that wasn't low the last time it was checked.
+func (master *OsdnMaster) checkSubnetsLow() {
+	if master.subnetLowThreshold == 0 && master.subnetLowThresholdPercent == 0 {
 		return
 	}
 
-	if err := master.reconcileHostSubnet(hs); err != nil {
-		klog.Errorf("Error reconciling HostSubnet: %v", err)
+	master.subnetLowLock.Lock()
+	defer master.subnetLowLock.Unlock()
+	if master.subnetLowRanges == nil {
+		master.subnetLowRanges = make(map[string]bool)
 	}
-	if err := master.networkInfo.ValidateNodeIP(hs.HostIP); err != nil {
-		// Don't error out; just warn so the error can be corrected with 'oc'
-		klog.Errorf("Failed to validate HostSubnet %s: %v", common.HostSubnetToString(hs), err)
+	for _, rs := range master.subnetAllocator.Stats().Ranges {
+		low := rs.Free < master.subnetLowThreshold ||
+			rs.Free*100 < rs.Total*master.subnetLowThresholdPercent
+		if !low {
+			delete(master.subnetLowRanges, rs.Network)
+			continue
+		}
+		klog.Warningf("Cluster network range %s is running out of subnets: %d of %d free", rs.Network, rs.Free, rs.Total)
+		if !master.subnetLowRanges[rs.Network] {
+			master.subnetLowRanges[rs.Network] = true
+			master.recorder.Eventf(clusterNetworkRef(), corev1.EventTypeWarning, "SubnetsLow",
+				"Cluster network range %s is running out of subnets: %d of %d free", rs.Network, rs.Free, rs.Total)
+		}
 	}
+}
 
-	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
-		if err := master.handleAssignHostSubnetAnnotation(hs); err != nil {
-			klog.Errorf("Error handling AssignHostSubnetAnnotation: %v", err)
-			return
+// checkNodeIPIsLocal checks nodeIP against master.localHostIPs, if set, and emits an
+// event if it isn't one of the local host's IPs
+func (master *OsdnMaster) checkNodeIPIsLocal(nodeName, nodeUID, nodeIP string) {
+	if master.localHostIPs == nil {
+		return
+	}
+	hostIPs, err := master.localHostIPs()
+	if err != nil {
+		klog.Warningf("Could not get local host IPs to check IP %s of node %s: %v", nodeIP, nodeName, err)
+		return
+	}
+	if err := common.CheckNodeIPIsLocal(nodeIP, hostIPs); err != nil {
+		klog.Warningf("Node %s: %v", nodeName, err)
+		if len(nodeUID) != 0 {
+			master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "NodeIPNotLocal",
+				"Node IP %s is not present on any local interface", nodeIP)
 		}
 	}
 }
 
-func (master *OsdnMaster) handleDeleteSubnet(obj interface{}) {
-	hs := obj.(*osdnv1.HostSubnet)
-	klog.V(5).Infof("Watch %s event for HostSubnet %q", watch.Deleted, hs.Name)
-
-	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
-		return
+// probeNodeIP checks nodeIP with master.nodeIPProber, if one is configured, and emits an
+// event if it is unreachable. It only returns an error if the node IP is unreachable and
+// master.blockUnreachableNodeIPs is set.
+func (master *OsdnMaster) probeNodeIP(nodeName, nodeUID, nodeIP string) error {
+	if master.nodeIPProber == nil {
+		return nil
+	}
+	err := master.nodeIPProber(nodeIP)
+	if err == nil {
+		return nil
 	}
 
-	if err := master.subnetAllocator.ReleaseNetwork(hs.Subnet); err != nil {
-		klog.Errorf("Error releasing allocated subnet: %v", err)
+	klog.Warningf("IP %s of node %s appears to be unreachable: %v", nodeIP, nodeName, err)
+	if len(nodeUID) != 0 {
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "NodeIPUnreachable",
+			"Node IP %s appears to be unreachable: %v", nodeIP, err)
 	}
+	if master.blockUnreachableNodeIPs {
+		return fmt.Errorf("not assigning subnet to node %s: IP %s is unreachable: %v", nodeName, nodeIP, err)
+	}
+	return nil
 }
 
-// reconcileHostSubnet verifies and corrects the state of the hostsubnet.
-// Because openshift watches on events to keep hostsubnets and nodes in the correct state, missing an event
-// can cause orphaned or unusable hostsubnets to stick around.
-func (master *OsdnMaster) reconcileHostSubnet(subnet *osdnv1.HostSubnet) error {
-	var node *corev1.Node
-	var err error
-	node, err = master.nodeInformer.Lister().Get(subnet.Name)
+// checkNodeIPConflict returns an error if nodeIP is already owned by a different node
+// that still exists and still has that IP (eg, because of a cloud provider bug), since
+// both nodes would then try to own the overlay traffic for that IP. An event is emitted
+// on both nodes.
+func (master *OsdnMaster) checkNodeIPConflict(nodeName, nodeUID, nodeIP string) error {
+	master.nodeIPLock.Lock()
+	owner, ok := master.nodeIPOwners[nodeIP]
+	master.nodeIPLock.Unlock()
+	if !ok || len(nodeUID) == 0 || owner == ktypes.UID(nodeUID) {
+		return nil
+	}
+	nodes, err := master.nodeInformer.Lister().List(labels.Everything())
 	if err != nil {
-		node, err = master.kClient.CoreV1().Nodes().Get(context.TODO(), subnet.Name, metav1.GetOptions{})
-		if err != nil {
-			if kerrs.IsNotFound(err) {
-				node = nil
-			} else {
-				return fmt.Errorf("error fetching node for subnet %q: %v", subnet.Name, err)
-			}
+		klog.Warningf("Could not list nodes to check whether IP %s of node %s is in use: %v", nodeIP, nodeName, err)
+		return nil
+	}
+	for _, node := range nodes {
+		if node.UID != owner || common.GetNodeInternalIP(node) != nodeIP {
+			continue
 		}
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "NodeIPConflict",
+			"Node IP %s is also in use by node %s", nodeIP, node.Name)
+		master.recorder.Eventf(nodeRef(node.Name, string(node.UID)), corev1.EventTypeWarning, "NodeIPConflict",
+			"Node IP %s is also in use by node %s", nodeIP, nodeName)
+		return fmt.Errorf("not assigning subnet to node %s: IP %s is already in use by node %s", nodeName, nodeIP, node.Name)
 	}
+	return nil
+}
 
-	if node == nil && len(subnet.Annotations[osdnv1.NodeUIDAnnotation]) == 0 {
-		// Subnet belongs to F5, Ignore.
+// checkNodeIPInHostSubnet returns an error, and emits an event, if nodeIP is inside the
+// subnet of another node's HostSubnet, which would create a routing loop. (ValidateNodeIP
+// already rejects node IPs inside the cluster network; this also catches HostSubnets
+// outside of it.)
+func (master *OsdnMaster) checkNodeIPInHostSubnet(nodeName, nodeUID, nodeIP string) error {
+	master.subnetIndexLock.Lock()
+	defer master.subnetIndexLock.Unlock()
+
+	hs := master.hostSubnetIndex().LookupByIP(net.ParseIP(nodeIP))
+	if hs == nil || hs.Name == nodeName {
+		delete(master.reportedNodeIPConflicts, nodeName)
 		return nil
-	} else if node != nil && len(subnet.Annotations[osdnv1.NodeUIDAnnotation]) == 0 {
-		// Update path, stamp UID annotation on subnet.
-		sn := subnet.DeepCopy()
-		if sn.Annotations == nil {
-			sn.Annotations = make(map[string]string)
-		}
-		sn.Annotations[osdnv1.NodeUIDAnnotation] = string(node.UID)
-		if _, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{}); err != nil {
-			return fmt.Errorf("error updating subnet %v for node %s: %v", sn, sn.Name, err)
+	}
+	conflict := nodeIP + " " + hs.Name + " " + hs.Subnet
+	if len(nodeUID) != 0 && master.reportedNodeIPConflicts[nodeName] != conflict {
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "NodeIPInHostSubnet",
+			"Node IP %s is inside subnet %s of HostSubnet %s", nodeIP, hs.Subnet, hs.Name)
+		if master.reportedNodeIPConflicts == nil {
+			master.reportedNodeIPConflicts = make(map[string]string)
 		}
-	} else if node == nil && len(subnet.Annotations[osdnv1.NodeUIDAnnotation]) > 0 {
-		// Missed Node event, delete stale subnet.
-		klog.Infof("Setup found no node associated with hostsubnet %s, deleting the hostsubnet", subnet.Name)
-		if err = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), subnet.Name, metav1.DeleteOptions{}); err != nil {
-			return fmt.Errorf("error deleting subnet %v: %v", subnet, err)
+		master.reportedNodeIPConflicts[nodeName] = conflict
+	}
+	return fmt.Errorf("not assigning subnet to node %s: IP %s is inside subnet %s of HostSubnet %s", nodeName, nodeIP, hs.Subnet, hs.Name)
+}
+
+// podNetworkPodsOnNode returns the pods scheduled on nodeName that use the pod network
+// (that is, that are not host-network)
+func (master *OsdnMaster) podNetworkPodsOnNode(nodeName string) ([]corev1.Pod, error) {
+	pods, err := master.kClient.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var podNetworkPods []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == nodeName && !pod.Spec.HostNetwork {
+			podNetworkPods = append(podNetworkPods, pod)
 		}
-	} else if string(node.UID) != subnet.Annotations[osdnv1.NodeUIDAnnotation] {
-		// Missed Node event, node with the same name exists delete stale subnet.
-		klog.Infof("Missed node event, hostsubnet %s has the UID of an incorrect object, deleting the hostsubnet", subnet.Name)
-		if err = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), subnet.Name, metav1.DeleteOptions{}); err != nil {
-			return fmt.Errorf("error deleting subnet %v: %v", subnet, err)
+	}
+	return podNetworkPods, nil
+}
+
+// checkNodeIPChange warns about a pending change of a node's IP if the node has running
+// pod-network pods, since those pods will lose connectivity until the other nodes pick up
+// the new IP. If requireDrainForNodeIPChange is set, it returns an error (causing the
+// change to be retried later) rather than allowing the change while pods are running.
+func (master *OsdnMaster) checkNodeIPChange(nodeName, nodeUID, oldIP, newIP string) error {
+	pods, err := master.podNetworkPodsOnNode(nodeName)
+	if err != nil {
+		klog.Warningf("Could not list pods on node %s to check the impact of its IP change: %v", nodeName, err)
+		return nil
+	}
+	running := 0
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning {
+			running++
 		}
 	}
+	if running == 0 {
+		return nil
+	}
+
+	if master.requireDrainForNodeIPChange {
+		return fmt.Errorf("not changing IP of node %s from %s to %s while it has %d running pods; drain the node first", nodeName, oldIP, newIP, running)
+	}
+	klog.Warningf("IP of node %s changed from %s to %s while it has %d running pods; pod traffic will be briefly disrupted", nodeName, oldIP, newIP, running)
+	if len(nodeUID) != 0 {
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "NodeIPChanged",
+			"IP of node %s changed from %s to %s while it has %d running pods; pod traffic will be briefly disrupted", nodeName, oldIP, newIP, running)
+	}
 	return nil
 }
 
+// getHostSubnetNode returns the node (from the informer cache) that a HostSubnet being
+// created for nodeName/nodeUID belongs to, or nil if it is not backed by a (known) node
+func (master *OsdnMaster) getHostSubnetNode(nodeName, nodeUID string) *corev1.Node {
+	if len(nodeUID) == 0 {
+		return nil
+	}
+	node, err := master.nodeInformer.Lister().Get(nodeName)
+	if err != nil || string(node.UID) != nodeUID {
+		return nil
+	}
+	return node
+}
+
+// hostSubnetLengthForNode returns the subnet length requested by the node's
+// hostSubnetLengthAnnotation, or 0 if none. It emits an event and returns an error if the
+// annotation is not a valid length.
+func (master *OsdnMaster) hostSubnetLengthForNode(nodeName, nodeUID string) (uint32, error) {
+	node := master.getHostSubnetNode(nodeName, nodeUID)
+	if node == nil {
+		return 0, nil
+	}
+	value, ok := node.Annotations[hostSubnetLengthAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	length, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || length == 0 {
+		master.recorder.Eventf(nodeRef(nodeName, nodeUID), corev1.EventTypeWarning, "InvalidHostSubnetLength",
+			"Not assigning a subnet to node %s: invalid %s annotation %q", nodeName, hostSubnetLengthAnnotation, value)
+		return 0, fmt.Errorf("node %s has invalid %s annotation %q", nodeName, hostSubnetLengthAnnotation, value)
+	}
+	return uint32(length), nil
+}
+
+// hostSubnetLengthOverridden returns whether hs's subnet length was set by a node's
+// hostSubnetLengthAnnotation
+func hostSubnetLengthOverridden(hs *osdnv1.HostSubnet) bool {
+	value, ok := hs.Annotations[hostSubnetLengthAnnotation]
+	if !ok {
+		return false
+	}
+	_, ipnet, err := net.ParseCIDR(hs.Subnet)
+	if err != nil {
+		return false
+	}
+	ones, addrLen := ipnet.Mask.Size()
+	return value == strconv.Itoa(addrLen-ones)
+}
+
+// subnetRangeForNode returns the cluster network range that the node's
+// subnetRangeLabel directs it to allocate from, or "" if none
+func (master *OsdnMaster) subnetRangeForNode(nodeName, nodeUID string) string {
+	if master.subnetRangeLabel == "" {
+		return ""
+	}
+	node := master.getHostSubnetNode(nodeName, nodeUID)
+	if node == nil {
+		return ""
+	}
+	value, ok := node.Labels[master.subnetRangeLabel]
+	if !ok {
+		return ""
+	}
+	rangeCIDR, ok := master.subnetRangesByLabel[value]
+	if !ok {
+		klog.Warningf("Node %s has unknown %s label value %q", nodeName, master.subnetRangeLabel, value)
+	}
+	return rangeCIDR
+}
+
+// decorateHostSubnetAnnotations calls master.annotationDecorator to add custom annotations
+// to hsAnnotations for a new HostSubnet, without letting it change the NodeUID annotation,
+// which the master owns.
+func (master *OsdnMaster) decorateHostSubnetAnnotations(nodeName, nodeUID string, hsAnnotations map[string]string) {
+	var node *corev1.Node
+	if n := master.getHostSubnetNode(nodeName, nodeUID); n != nil {
+		node = n.DeepCopy()
+	}
+
+	origUID, hadUID := hsAnnotations[osdnv1.NodeUIDAnnotation]
+	master.annotationDecorator(node, hsAnnotations)
+	if hadUID {
+		hsAnnotations[osdnv1.NodeUIDAnnotation] = origUID
+	} else {
+		delete(hsAnnotations, osdnv1.NodeUIDAnnotation)
+	}
+}
+
+// ReallocateNode moves nodeName's HostSubnet to a newly-allocated subnet in the cluster
+// network range targetRange, and releases its old subnet. If the HostSubnet can't be
+// updated, the new subnet is released and the HostSubnet is left unchanged. Nothing is
+// done if the node's subnet is already in targetRange.
+func (master *OsdnMaster) ReallocateNode(nodeName, targetRange string) error {
+	return master.moveNodeSubnet(nodeName,
+		func(subnet string) bool {
+			cn, err := master.subnetAllocator.RangeForSubnet(subnet)
+			return err == nil && cn.ClusterCIDR.String() == targetRange
+		},
+		func() (string, error) {
+			network, err := master.subnetAllocator.AllocateNetworkFromRange(targetRange)
+			if err != nil {
+				return "", fmt.Errorf("error allocating subnet in %s for node %q: %w", targetRange, nodeName, err)
+			}
+			return network, nil
+		})
+}
+
+// restoreNodeSubnet moves nodeName's HostSubnet back to exactly subnet, which must be
+// free, e.g. to undo a ReallocateNode.
+func (master *OsdnMaster) restoreNodeSubnet(nodeName, subnet string) error {
+	return master.moveNodeSubnet(nodeName,
+		func(current string) bool { return current == subnet },
+		func() (string, error) {
+			network, err := master.subnetAllocator.AllocateNetworkPreferring(subnet)
+			if err != nil {
+				return "", fmt.Errorf("error allocating subnet %s for node %q: %w", subnet, nodeName, err)
+			}
+			if network != subnet {
+				if err := master.subnetAllocator.ReleaseNetwork(network); err != nil {
+					klog.Errorf("Failed to release subnet %s after failing to restore node %s: %v", network, nodeName, err)
+				}
+				return "", fmt.Errorf("subnet %s of node %q is no longer free", subnet, nodeName)
+			}
+			return network, nil
+		})
+}
+
+// moveNodeSubnet moves nodeName's HostSubnet to a subnet returned by allocate, unless done
+// reports that its current subnet is already acceptable; see ReallocateNode.
+func (master *OsdnMaster) moveNodeSubnet(nodeName string, done func(subnet string) bool, allocate func() (string, error)) error {
+	master.nodeLocks.LockKey(nodeName)
+	defer master.nodeLocks.UnlockKey(nodeName)
+
+	sub, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting subnet for node %q: %v", nodeName, err)
+	}
+	if done(sub.Subnet) {
+		return nil
+	}
+
+	oldSubnet := sub.Subnet
+	network, err := allocate()
+	if err != nil {
+		return err
+	}
+
+	sub.Subnet = network
+	sub, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sub, metav1.UpdateOptions{})
+	if err != nil {
+		if releaseErr := master.subnetAllocator.ReleaseNetwork(network); releaseErr != nil {
+			klog.Errorf("Failed to release subnet %s after failing to reallocate node %s: %v", network, nodeName, releaseErr)
+		}
+		return fmt.Errorf("error updating subnet for node %q to %s: %v", nodeName, network, err)
+	}
+
+	if err := master.subnetAllocator.ReleaseNetwork(oldSubnet); err != nil {
+		klog.Errorf("Failed to release old subnet %s of node %s: %v", oldSubnet, nodeName, err)
+	}
+	if nodeUID := common.HostSubnetNodeUID(sub); nodeUID != "" {
+		master.setSubnetOwner(network, nodeUID)
+		master.syncNodeSubnetAnnotation(nodeName, nodeUID, network)
+	}
+	klog.Infof("Reallocated HostSubnet %s (was %s)", common.HostSubnetToString(sub), oldSubnet)
+	master.recorder.Eventf(hostSubnetRef(sub), corev1.EventTypeNormal, "SubnetReallocated",
+		"Moved node %s from subnet %s to %s", nodeName, oldSubnet, network)
+	return nil
+}
+
+// RangeMigrationResult describes the outcome of MigrateRange
+type RangeMigrationResult struct {
+	// Nodes whose HostSubnets were moved to the new range
+	Migrated []string
+	// Nodes whose HostSubnets could not be moved (or, when the migration was aborted,
+	// moved back), and why
+	Failed map[string]error
+	// Nodes that were moved to the new range and then back when the migration was
+	// aborted
+	RolledBack []string
+	// Nodes that were not attempted because there was not enough room in the new range
+	Skipped []string
+}
+
+// MigrateRange moves every HostSubnet whose subnet is in the cluster network range
+// oldRange to a new subnet in newRange (see ReallocateNode), e.g. before oldRange is
+// removed from the cluster network. Nodes that fail to move are reported in the result,
+// and the rest are still moved. If newRange runs out of subnets partway through, the
+// migration is aborted, the nodes already moved are moved back to their original
+// subnets, and an error is returned; if newRange doesn't have room for every node to
+// begin with, nothing is moved.
+func (master *OsdnMaster) MigrateRange(oldRange, newRange string) (*RangeMigrationResult, error) {
+	var oldFound, newFound bool
+	for _, cn := range master.subnetAllocator.Ranges() {
+		oldFound = oldFound || cn.ClusterCIDR.String() == oldRange
+		newFound = newFound || cn.ClusterCIDR.String() == newRange
+	}
+	if !oldFound || !newFound || oldRange == newRange {
+		return nil, fmt.Errorf("cannot migrate from %s to %s: both must be distinct known ranges", oldRange, newRange)
+	}
+
+	subnets, err := common.ListAllHostSubnets(context.TODO(), master.osdnClient)
+	if err != nil {
+		return nil, fmt.Errorf("error listing subnets: %v", err)
+	}
+	var nodes []string
+	origSubnets := map[string]string{}
+	for _, hs := range subnets {
+		if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
+			continue
+		}
+		if cn, err := master.subnetAllocator.RangeForSubnet(hs.Subnet); err == nil && cn.ClusterCIDR.String() == oldRange {
+			nodes = append(nodes, hs.Name)
+			origSubnets[hs.Name] = hs.Subnet
+		}
+	}
+	sort.Strings(nodes)
+
+	result := &RangeMigrationResult{Failed: map[string]error{}}
+	for _, rs := range master.subnetAllocator.Stats().Ranges {
+		if rs.Network == newRange && rs.Free < uint64(len(nodes)) {
+			result.Skipped = nodes
+			return result, fmt.Errorf("range %s has only %d free subnets, but %d nodes need to move", newRange, rs.Free, len(nodes))
+		}
+	}
+
+	for i, nodeName := range nodes {
+		err := master.ReallocateNode(nodeName, newRange)
+		if err == nil {
+			result.Migrated = append(result.Migrated, nodeName)
+			continue
+		} else if !errors.Is(err, masterutil.ErrSubnetAllocatorFull) {
+			klog.Errorf("Failed to migrate node %s from %s to %s: %v", nodeName, oldRange, newRange, err)
+			result.Failed[nodeName] = err
+			continue
+		}
+
+		klog.Errorf("Range %s is full; aborting migration from %s and moving %d nodes back", newRange, oldRange, len(result.Migrated))
+		result.Skipped = nodes[i:]
+		for _, migrated := range result.Migrated {
+			if err := master.restoreNodeSubnet(migrated, origSubnets[migrated]); err != nil {
+				result.Failed[migrated] = fmt.Errorf("could not move back to %s: %v", origSubnets[migrated], err)
+			} else {
+				result.RolledBack = append(result.RolledBack, migrated)
+			}
+		}
+		result.Migrated = nil
+		return result, fmt.Errorf("migration from %s to %s aborted: %v", oldRange, newRange, err)
+	}
+	return result, nil
+}
+
+// ReleaseNode releases every subnet allocated to nodeName: that of its own HostSubnet, and
+// those of any other HostSubnets recording the same node UID. Each HostSubnet is deleted
+// (after the pre-delete hook, if any, allows it), and its subnet is returned to the
+// subnet allocator when the deletion is observed, so that a subnet is never free while a
+// HostSubnet still holds it. It returns the subnets of the deleted HostSubnets; if some
+// can't be deleted, the rest still are, and the errors are returned together. HostSubnets
+// that are already gone (including nodeName's own) are not an error.
+func (master *OsdnMaster) ReleaseNode(nodeName string) ([]string, error) {
+	master.nodeLocks.LockKey(nodeName)
+	defer master.nodeLocks.UnlockKey(nodeName)
+
+	subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("error listing subnets for node %q: %v", nodeName, err)
+	}
+	var own *osdnv1.HostSubnet
+	for _, hs := range subnets {
+		if hs.Name == nodeName {
+			own = hs
+			break
+		}
+	}
+	if own == nil {
+		// If the node was created and deleted in quick succession, the informer cache
+		// may not have its HostSubnet yet
+		own, err = master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), nodeName, metav1.GetOptions{})
+		if kerrs.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error fetching subnet for node %q: %v", nodeName, err)
+		}
+		subnets = append(subnets, own)
+	}
+	nodeUID := common.HostSubnetNodeUID(own)
+
+	var released []string
+	var errs []error
+	for _, hs := range subnets {
+		if hs.Name != nodeName && (nodeUID == "" || common.HostSubnetNodeUID(hs) != nodeUID) {
+			continue
+		}
+		if err := master.runPreDeleteHook(hs); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), hs.Name, master.hostSubnetDeleteOptions()); kerrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("error deleting subnet for node %q: %v", hs.Name, err))
+			continue
+		}
+		klog.Infof("Deleted HostSubnet %s", common.HostSubnetToString(hs))
+		if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; !ok {
+			released = append(released, hs.Subnet)
+		}
+	}
+	master.syncNodeSubnetAnnotation(nodeName, nodeUID, "")
+	return released, kerrors.NewAggregate(errs)
+}
+
+func (master *OsdnMaster) deleteNode(nodeName string) (err error) {
+	_, span := master.startSpan(context.TODO(), "deleteNode", nodeNameAttr(nodeName))
+	defer func() { endSpan(span, err) }()
+
+	if master.deferHostSubnetDelete(nodeName) {
+		master.requeueHostSubnetDelete(nodeName)
+		return nil
+	}
+
+	released, err := master.ReleaseNode(nodeName)
+	if len(released) > 0 {
+		span.SetAttributes(subnetKey.String(strings.Join(released, ",")))
+	}
+	return err
+}
+
+// deferHostSubnetDelete returns whether deleting the HostSubnet of the deleted node
+// nodeName should wait, because deferSubnetDeleteTimeout is set and pod-network pods that
+// haven't finished yet remain on the node. Deletion is deferred for at most
+// deferSubnetDeleteTimeout after it was first deferred.
+func (master *OsdnMaster) deferHostSubnetDelete(nodeName string) bool {
+	if master.deferSubnetDeleteTimeout == 0 {
+		return false
+	}
+
+	remaining := 0
+	pods, err := master.podNetworkPodsOnNode(nodeName)
+	if err != nil {
+		// Assume the pods are still there until the timeout
+		klog.Warningf("Could not list pods on deleted node %s: %v", nodeName, err)
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			remaining++
+		}
+	}
+
+	now := master.clock.Now()
+	master.nodeIPLock.Lock()
+	defer master.nodeIPLock.Unlock()
+	if err == nil && remaining == 0 {
+		delete(master.deferredSubnetDeletes, nodeName)
+		return false
+	}
+	since, ok := master.deferredSubnetDeletes[nodeName]
+	if !ok {
+		if master.deferredSubnetDeletes == nil {
+			master.deferredSubnetDeletes = make(map[string]time.Time)
+		}
+		master.deferredSubnetDeletes[nodeName] = now
+		since = now
+	}
+	if now.Sub(since) >= master.deferSubnetDeleteTimeout {
+		klog.Warningf("Deleting HostSubnet of deleted node %s although %d pods remain on it after %v", nodeName, remaining, master.deferSubnetDeleteTimeout)
+		delete(master.deferredSubnetDeletes, nodeName)
+		return false
+	}
+	klog.Infof("Deferring deletion of HostSubnet of deleted node %s while %d pods remain on it", nodeName, remaining)
+	return true
+}
+
+// requeueHostSubnetDelete retries deleting the HostSubnet of the deleted node nodeName
+// after deferredSubnetDeleteRetryInterval, unless a node of that name has been created
+// again in the meantime. Nothing is done if a retry is already pending.
+func (master *OsdnMaster) requeueHostSubnetDelete(nodeName string) {
+	master.nodeIPLock.Lock()
+	defer master.nodeIPLock.Unlock()
+	if master.requeuedSubnetDeletes[nodeName] {
+		return
+	}
+	if master.requeuedSubnetDeletes == nil {
+		master.requeuedSubnetDeletes = make(map[string]bool)
+	}
+	master.requeuedSubnetDeletes[nodeName] = true
+
+	after := master.clock.After(deferredSubnetDeleteRetryInterval)
+	go func() {
+		<-after
+		master.nodeIPLock.Lock()
+		delete(master.requeuedSubnetDeletes, nodeName)
+		master.nodeIPLock.Unlock()
+		if _, err := master.nodeInformer.Lister().Get(nodeName); err == nil {
+			klog.Infof("Node %s was recreated; no longer deleting its HostSubnet", nodeName)
+			master.nodeIPLock.Lock()
+			delete(master.deferredSubnetDeletes, nodeName)
+			master.nodeIPLock.Unlock()
+			return
+		}
+		if err := master.deleteNode(nodeName); err != nil {
+			klog.Errorf("Error deleting node %s: %v", nodeName, err)
+		}
+	}()
+}
+
+// hostSubnetDeleteOptions returns the options for deleting a HostSubnet
+func (master *OsdnMaster) hostSubnetDeleteOptions() metav1.DeleteOptions {
+	return metav1.DeleteOptions{PropagationPolicy: master.hostSubnetDeletePropagation}
+}
+
+// runPreDeleteHook calls master.preDeleteHook, if set, before hs is deleted; every path
+// that deletes a HostSubnet must call it. If it returns an error, hs must not be deleted,
+// and the error should be returned so that the delete is attempted again (calling the
+// hook again) the next time the HostSubnet or its node is handled.
+func (master *OsdnMaster) runPreDeleteHook(hs *osdnv1.HostSubnet) error {
+	if master.preDeleteHook == nil {
+		return nil
+	}
+	if err := master.preDeleteHook(hs.DeepCopy()); err != nil {
+		master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "HostSubnetDeleteBlocked",
+			"Not deleting HostSubnet %s: pre-delete cleanup failed: %v", hs.Name, err)
+		return fmt.Errorf("pre-delete hook for HostSubnet %s failed: %v", hs.Name, err)
+	}
+	return nil
+}
+
+// Because openshift-sdn uses an overlay and doesn't need GCE Routes, we need to
+// clear the NetworkUnavailable condition that kubelet adds to initial node
+// status when using GCE.
+// TODO: make upstream kubelet more flexible with overlays and GCE so this
+// condition doesn't get added for network plugins that don't want it, and then
+// we can remove this function.
+//
+// If disableNetworkUnavailableClear is set this does nothing; if
+// networkUnavailableReasons is set, conditions with those reasons are cleared as well.
+func (master *OsdnMaster) clearInitialNodeNetworkUnavailableCondition(origNode *corev1.Node) {
+	if master.disableNetworkUnavailableClear {
+		return
+	}
+
+	// Informer cache should not be mutated, so get a copy of the object
+	node := origNode.DeepCopy()
+	knode := node
+	cleared := ""
+	resultErr := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		var err error
+
+		if knode != node {
+			knode, err = master.nodeInformer.Lister().Get(node.Name)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range knode.Status.Conditions {
+			if knode.Status.Conditions[i].Type == corev1.NodeNetworkUnavailable {
+				condition := &knode.Status.Conditions[i]
+				if condition.Status != corev1.ConditionFalse && master.clearableNetworkUnavailableReason(condition.Reason) {
+					reason := condition.Reason
+					condition.Status = corev1.ConditionFalse
+					condition.Reason = "RouteCreated"
+					condition.Message = fmt.Sprintf("openshift-sdn cleared kubelet-set %s", reason)
+					condition.LastTransitionTime = metav1.Now()
+
+					if knode, err = master.kClient.CoreV1().Nodes().UpdateStatus(context.TODO(), knode, metav1.UpdateOptions{}); err == nil {
+						cleared = reason
+					}
+				}
+				break
+			}
+		}
+		return err
+	})
+	if resultErr != nil {
+		klog.Errorf("Status update failed for local node: %v", resultErr)
+	} else if cleared != "" {
+		klog.Infof("Cleared node NetworkUnavailable/%s condition for %s", cleared, node.Name)
+	}
+}
+
+// clearableNetworkUnavailableReason returns whether a NetworkUnavailable condition with
+// the given reason should be cleared
+func (master *OsdnMaster) clearableNetworkUnavailableReason(reason string) bool {
+	if reason == "NoRouteCreated" {
+		return true
+	}
+	for _, r := range master.networkUnavailableReasons {
+		if reason == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (master *OsdnMaster) watchSubnets() error {
+	funcs := common.InformerFuncs(&osdnv1.HostSubnet{}, master.handleAddOrUpdateSubnet, master.handleDeleteSubnet)
+	registration, err := master.hostSubnetInformer.Informer().AddEventHandler(funcs)
+	if err != nil {
+		return fmt.Errorf("could not watch HostSubnets: %v", err)
+	}
+	master.hostSubnetHandlerRegistration = registration
+	return nil
+}
+
+// stopSubnetMaster stops the subnet self-heal loop and removes the subnet master's node
+// and HostSubnet event handlers
+func (master *OsdnMaster) stopSubnetMaster() error {
+	if master.cancelSubnetSelfHeal != nil {
+		master.cancelSubnetSelfHeal()
+		master.cancelSubnetSelfHeal = nil
+	}
+	if master.stopSubnetStats != nil {
+		close(master.stopSubnetStats)
+		master.stopSubnetStats = nil
+	}
+	var errList []error
+	if master.nodeHandlerRegistration != nil {
+		if err := master.nodeInformer.Informer().RemoveEventHandler(master.nodeHandlerRegistration); err != nil {
+			errList = append(errList, fmt.Errorf("could not stop watching nodes: %v", err))
+		}
+		master.nodeHandlerRegistration = nil
+	}
+	if master.hostSubnetHandlerRegistration != nil {
+		if err := master.hostSubnetInformer.Informer().RemoveEventHandler(master.hostSubnetHandlerRegistration); err != nil {
+			errList = append(errList, fmt.Errorf("could not stop watching HostSubnets: %v", err))
+		}
+		master.hostSubnetHandlerRegistration = nil
+	}
+	return kerrors.NewAggregate(errList)
+}
+
+// runSubnetSelfHeal calls selfHealSubnets every interval until ctx is canceled
+func (master *OsdnMaster) runSubnetSelfHeal(ctx context.Context, interval time.Duration) {
+	selfHeal := func() {
+		if err := master.selfHealSubnets(ctx); err != nil {
+			klog.Warningf("Failed to check for nodes without HostSubnets: %v", err)
+		} else {
+			master.recordReconcile()
+		}
+	}
+	selfHeal()
+	ticker := master.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			selfHeal()
+		}
+	}
+}
+
+// selfHealSubnets creates HostSubnets for any nodes that should have one but don't,
+// because a node event was missed or allocating the subnet failed
+func (master *OsdnMaster) selfHealSubnets(ctx context.Context) error {
+	nodes, err := master.nodeInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("could not list nodes: %v", err)
+	}
+	// The informer cache may lag behind HostSubnet deletions, so check the API
+	subnets, err := common.ListAllHostSubnets(ctx, master.osdnClient)
+	if err != nil {
+		return fmt.Errorf("could not list HostSubnets: %v", err)
+	}
+
+	for _, node := range common.FindNodesMissingSubnet(nodes, subnets) {
+		nodeIP := common.GetNodeInternalIP(node)
+		klog.Infof("Node %s has no HostSubnet; creating one", node.Name)
+		if err := master.addNode(node.Name, string(node.UID), nodeIP, nil, ""); err != nil {
+			klog.Errorf("Error creating missing subnet for node %s, ip %s: %v", node.Name, nodeIP, err)
+			continue
+		}
+		master.recordNodeIP(node.UID, nodeIP)
+		metrics.RecordSubnetSelfHeal()
+	}
+	return nil
+}
+
+func (master *OsdnMaster) handleAddOrUpdateSubnet(obj, old interface{}, eventType watch.EventType) {
+	hs := obj.(*osdnv1.HostSubnet)
+	klog.V(5).Infof("Watch %s event for HostSubnet %q", eventType, hs.Name)
+	master.indexHostSubnet(hs)
+
+	if hs.Host == "" || hs.HostIP == "" {
+		// reconcileHostSubnet fills in Host and HostIP for node-backed subnets, after
+		// which we'll get another event for the updated object
+		if err := master.reconcileHostSubnet(hs); err != nil {
+			klog.Errorf("Error reconciling HostSubnet: %v", err)
+		}
+		return
+	} else if hs.Host != hs.Name {
+		if fixed, err := master.reconcileHostSubnetHost(hs); err != nil {
+			klog.Errorf("Error reconciling HostSubnet host: %v", err)
+		} else if fixed {
+			// We'll get another event for the updated object
+			return
+		}
+	}
+
+	if err := common.ValidateHostSubnet(hs); err != nil {
+		klog.Errorf("Ignoring invalid HostSubnet %s: %v", common.HostSubnetToString(hs), err)
+		return
+	}
+
+	if deduped, err := master.dedupeEgressIPs(hs); err != nil {
+		klog.Errorf("Error removing repeated egress IPs: %v", err)
+	} else if deduped {
+		// We'll get another event for the updated object
+		return
+	}
+	oldHS, _ := old.(*osdnv1.HostSubnet)
+	if rejected, err := master.rejectDuplicateEgressIPs(hs, oldHS); err != nil {
+		klog.Errorf("Error removing duplicate egress IPs: %v", err)
+	} else if rejected {
+		// We'll get another event for the updated object
+		return
+	}
+
+	if err := master.reconcileHostSubnet(hs); err != nil {
+		klog.Errorf("Error reconciling HostSubnet: %v", err)
+	}
+	if hs.Subnet != "" && (oldHS == nil || oldHS.Subnet != hs.Subnet) && !master.lengthMismatchAlreadyReported(hs) {
+		if _, err := master.subnetAllocator.NormalizeSubnet(hs.Subnet); err != nil && !master.checkHostSubnetLength(hs) {
+			master.setLengthMismatchReported(hs)
+		}
+	}
+	if err := master.networkInfo.ValidateNodeIP(hs.HostIP); err != nil {
+		// Don't error out; just warn so the error can be corrected with 'oc'
+		klog.Errorf("Failed to validate HostSubnet %s: %v", common.HostSubnetToString(hs), err)
+	}
+
+	if master.nodeInterfaceNetworks != nil && len(hs.EgressIPs) > 0 {
+		master.checkEgressIPsOnLocalSubnets(hs)
+	}
+
+	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
+		if err := master.handleAssignHostSubnetAnnotation(hs); err != nil {
+			klog.Errorf("Error handling AssignHostSubnetAnnotation: %v", err)
+			return
+		}
+	}
+}
+
+// checkEgressIPsOnLocalSubnets warns about egress IPs of hs that are not on any subnet
+// of the node's interfaces, as reported by master.nodeInterfaceNetworks
+func (master *OsdnMaster) checkEgressIPsOnLocalSubnets(hs *osdnv1.HostSubnet) {
+	localIPNets, err := master.nodeInterfaceNetworks(hs.Host)
+	if err != nil {
+		klog.Warningf("Could not check the egress IPs of HostSubnet %s against node interfaces: %v", hs.Name, err)
+		return
+	}
+	for _, egressIP := range common.EgressIPsOffLocalSubnets(hs, localIPNets) {
+		klog.Warningf("Egress IP %s of HostSubnet %s is not on any local subnet of node %s", egressIP, hs.Name, hs.Host)
+		master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "EgressIPNotOnLocalSubnet",
+			"Egress IP %s is not on any subnet of node %s's interfaces", egressIP, hs.Host)
+	}
+}
+
+// dedupeEgressIPs removes any egress IPs that hs lists more than once (comparing them
+// in canonical form, so that e.g. differently-written IPv6 addresses match), keeping the
+// first of each. It returns whether hs was updated.
+func (master *OsdnMaster) dedupeEgressIPs(hs *osdnv1.HostSubnet) (bool, error) {
+	seen := sets.NewString()
+	kept := make([]osdnv1.HostSubnetEgressIP, 0, len(hs.EgressIPs))
+	for _, ip := range hs.EgressIPs {
+		key := string(ip)
+		if parsed, _ := common.ParseEgressIPs([]string{key}); len(parsed) == 1 {
+			key = parsed[0].String()
+		}
+		if seen.Has(key) {
+			klog.Infof("Removing repeated egress IP %s from HostSubnet %s", ip, hs.Name)
+			continue
+		}
+		seen.Insert(key)
+		kept = append(kept, ip)
+	}
+	return master.updateEgressIPs(hs, kept)
+}
+
+// rejectDuplicateEgressIPs removes any egress IPs that were added to hs (by an update from
+// old, or by its creation if old is nil) but that are already assigned to another
+// HostSubnet, and emits an event for each. Egress IPs are compared in canonical form, so
+// differently-written forms of the same IP are duplicates. When hs is new, only
+// HostSubnets older than it count as already having the IP, so that whichever of two
+// pre-existing duplicates is seen first at startup isn't stripped; pre-existing
+// duplicates are left for the egress IP tracker to resolve. It returns whether hs was
+// updated.
+func (master *OsdnMaster) rejectDuplicateEgressIPs(hs, old *osdnv1.HostSubnet) (bool, error) {
+	oldIPs := sets.NewString()
+	if old != nil {
+		for _, ip := range old.EgressIPs {
+			oldIPs.Insert(canonicalEgressIP(ip))
+		}
+	}
+	added := false
+	for _, ip := range hs.EgressIPs {
+		if !oldIPs.Has(canonicalEgressIP(ip)) {
+			added = true
+			break
+		}
+	}
+	if !added {
+		return false, nil
+	}
+
+	subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return false, fmt.Errorf("could not list HostSubnets: %v", err)
+	}
+	owners := make(map[string]string)
+	for _, other := range subnets {
+		if other.Name == hs.Name || (old == nil && !hostSubnetNewer(hs, other)) {
+			continue
+		}
+		for _, ip := range other.EgressIPs {
+			owners[canonicalEgressIP(ip)] = other.Name
+		}
+	}
+
+	kept := make([]osdnv1.HostSubnetEgressIP, 0, len(hs.EgressIPs))
+	for _, ip := range hs.EgressIPs {
+		canonical := canonicalEgressIP(ip)
+		if owner, ok := owners[canonical]; ok && !oldIPs.Has(canonical) {
+			klog.Warningf("Rejecting egress IP %s on HostSubnet %s: already assigned to HostSubnet %s", ip, hs.Name, owner)
+			master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "EgressIPConflict",
+				"Egress IP %s is already assigned to HostSubnet %s", ip, owner)
+			continue
+		}
+		kept = append(kept, ip)
+	}
+	return master.updateEgressIPs(hs, kept)
+}
+
+// canonicalEgressIP returns the canonical form of ip (as parsed by
+// common.ParseEgressIPs), or ip itself if it is not a valid IP
+func canonicalEgressIP(ip osdnv1.HostSubnetEgressIP) string {
+	parsed, errs := common.ParseEgressIPs([]string{string(ip)})
+	if len(errs) > 0 {
+		return string(ip)
+	}
+	return parsed[0].String()
+}
+
+// updateEgressIPs updates hs to have only the egress IPs in kept, if that is a change. It
+// returns whether hs was updated.
+func (master *OsdnMaster) updateEgressIPs(hs *osdnv1.HostSubnet, kept []osdnv1.HostSubnetEgressIP) (bool, error) {
+	if len(kept) == len(hs.EgressIPs) {
+		return false, nil
+	}
+	if master.hostSubnetReconcilePaused(hs, "remove some of its egress IPs") {
+		return false, nil
+	}
+
+	sn := hs.DeepCopy()
+	sn.EgressIPs = kept
+	if _, err := master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("error updating egress IPs of HostSubnet %s: %v", hs.Name, err)
+	}
+	return true, nil
+}
+
+// SetEgressIPs sets the egress IPs of nodeName's HostSubnet to ips, after checking that
+// each can be assigned to the node (see common.ParsedClusterNetwork.CanAssignEgressIP)
+// and that none is repeated. The IPs are stored in canonical form. If any IP is rejected,
+// the HostSubnet is left unchanged and the error describes the first rejected IP.
+func (master *OsdnMaster) SetEgressIPs(nodeName string, ips []string) error {
+	master.nodeLocks.LockKey(nodeName)
+	defer master.nodeLocks.UnlockKey(nodeName)
+
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		subnets, err := common.ListAllHostSubnets(context.TODO(), master.osdnClient)
+		if err != nil {
+			return fmt.Errorf("error listing subnets: %v", err)
+		}
+		var hs *osdnv1.HostSubnet
+		for _, sn := range subnets {
+			if sn.Name == nodeName {
+				hs = sn
+				break
+			}
+		}
+		if hs == nil {
+			return fmt.Errorf("node %q has no HostSubnet", nodeName)
+		}
+
+		seen := sets.NewString()
+		egressIPs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			if err := master.networkInfo.CanAssignEgressIP(ip, nodeName, subnets); err != nil {
+				return err
+			}
+			parsed, _ := common.ParseEgressIPs([]string{ip})
+			canonical := parsed[0].String()
+			if seen.Has(canonical) {
+				return fmt.Errorf("egress IP %s is repeated", ip)
+			}
+			seen.Insert(canonical)
+			egressIPs = append(egressIPs, canonical)
+		}
+
+		if reflect.DeepEqual(common.HSEgressIPsToStrings(hs.EgressIPs), egressIPs) {
+			return nil
+		}
+		sn := hs.DeepCopy()
+		sn.EgressIPs = common.StringsToHSEgressIPs(egressIPs)
+		_, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (master *OsdnMaster) handleDeleteSubnet(obj interface{}) {
+	hs := obj.(*osdnv1.HostSubnet)
+	klog.V(5).Infof("Watch %s event for HostSubnet %q", watch.Deleted, hs.Name)
+
+	master.forgetLengthMismatch(hs.Name)
+	master.unindexHostSubnet(hs)
+	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok {
+		return
+	}
+
+	if err := master.subnetAllocator.ReleaseNetwork(hs.Subnet); err != nil {
+		klog.Errorf("Error releasing allocated subnet: %v", err)
+		return
+	}
+	if master.subnetStatsReporter != nil {
+		master.subnetStatsReporter.notifyChange()
+	}
+	master.checkSubnetsLow()
+}
+
+// reconcileHostSubnet verifies and corrects the state of the hostsubnet.
+// Because openshift watches on events to keep hostsubnets and nodes in the correct state, missing an event
+// can cause orphaned or unusable hostsubnets to stick around.
+func (master *OsdnMaster) reconcileHostSubnet(subnet *osdnv1.HostSubnet) error {
+	_, err := master.reconcileHostSubnetAction(subnet)
+	return err
+}
+
+// reconcileHostSubnetAction reconciles subnet like reconcileHostSubnet, and returns what
+// it did
+func (master *OsdnMaster) reconcileHostSubnetAction(subnet *osdnv1.HostSubnet) (action ReconcileAction, err error) {
+	_, span := master.startSpan(context.TODO(), "reconcileHostSubnet", nodeNameAttr(subnet.Name), subnetKey.String(subnet.Subnet))
+	defer func() { endSpan(span, err) }()
+
+	master.checkHostSubnetOverlap(subnet)
+
+	var node *corev1.Node
+	node, err = master.nodeInformer.Lister().Get(subnet.Name)
+	if err != nil {
+		node, err = master.kClient.CoreV1().Nodes().Get(context.TODO(), subnet.Name, metav1.GetOptions{})
+		if err != nil {
+			if kerrs.IsNotFound(err) {
+				node = nil
+			} else {
+				return ReconcileNone, fmt.Errorf("error fetching node for subnet %q: %v", subnet.Name, err)
+			}
+		}
+	}
+
+	nodeUID := common.HostSubnetNodeUID(subnet)
+	if node == nil && nodeUID == "" {
+		// Subnet belongs to F5, Ignore.
+		if subnet.Host == "" || subnet.HostIP == "" {
+			klog.Warningf("Ignoring HostSubnet %s with no host or host IP that is not backed by a node", subnet.Name)
+		}
+		return ReconcileNone, nil
+	} else if node != nil && nodeUID == "" {
+		// Update path, stamp UID annotation on subnet.
+		if master.hostSubnetReconcilePaused(subnet, "stamp its node UID") {
+			return ReconcileSkipped, nil
+		}
+		sn := subnet.DeepCopy()
+		if sn.Annotations == nil {
+			sn.Annotations = make(map[string]string)
+		}
+		sn.Annotations[osdnv1.NodeUIDAnnotation] = string(node.UID)
+		master.fillMissingHostSubnetFields(sn, node)
+		if _, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{}); err != nil {
+			return ReconcileNone, fmt.Errorf("error updating subnet %v for node %s: %v", sn, sn.Name, err)
+		}
+		return ReconcileStampedNodeUID, nil
+	} else if node == nil && nodeUID != "" {
+		// Missed Node event, delete stale subnet.
+		if master.nodeInMaintenance(subnet.Name, "delete it (no node)") || master.hostSubnetReconcilePaused(subnet, "delete it (no node)") {
+			return ReconcileSkipped, nil
+		}
+		if master.deferHostSubnetDelete(subnet.Name) {
+			master.requeueHostSubnetDelete(subnet.Name)
+			return ReconcileSkipped, nil
+		}
+		klog.Infof("Setup found no node associated with hostsubnet %s, deleting the hostsubnet", subnet.Name)
+		if err = master.runPreDeleteHook(subnet); err != nil {
+			return ReconcileNone, err
+		}
+		if err = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), subnet.Name, master.hostSubnetDeleteOptions()); err != nil {
+			return ReconcileNone, fmt.Errorf("error deleting subnet %v: %v", subnet, err)
+		}
+		return ReconcileDeletedOrphan, nil
+	} else if string(node.UID) != nodeUID {
+		// Missed Node event, node with the same name exists delete stale subnet.
+		// But the lister may not have caught up with the node being recreated yet,
+		// so confirm the mismatch against the live node first.
+		liveNode, liveErr := master.kClient.CoreV1().Nodes().Get(context.TODO(), subnet.Name, metav1.GetOptions{})
+		if liveErr != nil && !kerrs.IsNotFound(liveErr) {
+			return ReconcileNone, fmt.Errorf("error fetching node for subnet %q: %v", subnet.Name, liveErr)
+		} else if liveErr == nil && string(liveNode.UID) == nodeUID {
+			klog.V(5).Infof("Node cache is stale for hostsubnet %s; its node UID %s matches the live node", subnet.Name, nodeUID)
+			return ReconcileNone, nil
+		}
+		if master.nodeInMaintenance(subnet.Name, "delete it (node UID mismatch)") || master.hostSubnetReconcilePaused(subnet, "delete it (node UID mismatch)") {
+			return ReconcileSkipped, nil
+		}
+		klog.Infof("Missed node event, hostsubnet %s has the UID of an incorrect object, deleting the hostsubnet", subnet.Name)
+		if err = master.runPreDeleteHook(subnet); err != nil {
+			return ReconcileNone, err
+		}
+		if err = master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), subnet.Name, master.hostSubnetDeleteOptions()); err != nil {
+			return ReconcileNone, fmt.Errorf("error deleting subnet %v: %v", subnet, err)
+		}
+		return ReconcileDeletedReplaced, nil
+	} else if subnet.Host == "" || subnet.HostIP == "" {
+		// Externally-created subnet with missing fields; fill them in from the node
+		if master.hostSubnetReconcilePaused(subnet, "fill in its host and host IP") {
+			return ReconcileSkipped, nil
+		}
+		sn := subnet.DeepCopy()
+		if !master.fillMissingHostSubnetFields(sn, node) {
+			return ReconcileNone, nil
+		}
+		if _, err = master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{}); err != nil {
+			return ReconcileNone, fmt.Errorf("error updating subnet %v for node %s: %v", sn, sn.Name, err)
+		}
+		return ReconcileFilledFields, nil
+	}
+	return ReconcileNone, nil
+}
+
+// checkHostSubnetOverlap warns about any other HostSubnets whose subnets overlap hs's,
+// which MarkAllocatedNetwork catches at startup but not for HostSubnets created while the
+// master is running. The event is recorded against the newer of each overlapping pair,
+// since that is the one that needs fixing, and only once for each pair of subnets.
+func (master *OsdnMaster) checkHostSubnetOverlap(hs *osdnv1.HostSubnet) {
+	if hs.Subnet == "" {
+		return
+	}
+	_, cidr, err := net.ParseCIDR(hs.Subnet)
+	if err != nil {
+		return
+	}
+
+	master.subnetIndexLock.Lock()
+	defer master.subnetIndexLock.Unlock()
+	for _, other := range master.hostSubnetIndex().Overlapping(cidr) {
+		if other.Name == hs.Name {
+			continue
+		}
+		newer, older := hs, other
+		if hostSubnetNewer(other, hs) {
+			newer, older = other, hs
+		}
+		overlap := overlapKey(newer, older)
+		if master.reportedOverlaps[overlap] {
+			continue
+		}
+		if master.reportedOverlaps == nil {
+			master.reportedOverlaps = make(map[string]bool)
+		}
+		master.reportedOverlaps[overlap] = true
+		klog.Errorf("Subnet %s of HostSubnet %s overlaps subnet %s of older HostSubnet %s", newer.Subnet, newer.Name, older.Subnet, older.Name)
+		master.recorder.Eventf(hostSubnetRef(newer), corev1.EventTypeWarning, "HostSubnetOverlap",
+			"Subnet %s overlaps subnet %s of older HostSubnet %s", newer.Subnet, older.Subnet, older.Name)
+	}
+}
+
+// overlapKey returns the key in master.reportedOverlaps for an overlap between the
+// subnets of newer and older
+func overlapKey(newer, older *osdnv1.HostSubnet) string {
+	return newer.Name + " " + newer.Subnet + " " + older.Name + " " + older.Subnet
+}
+
+// hostSubnetIndex returns master.subnetIndex, building it from the informer's HostSubnets
+// if it hasn't been built yet. master.subnetIndexLock must be held.
+func (master *OsdnMaster) hostSubnetIndex() *common.SubnetIndex {
+	if master.subnetIndex == nil {
+		subnets, err := master.hostSubnetInformer.Lister().List(labels.Everything())
+		if err != nil {
+			klog.Warningf("Could not list HostSubnets to index them: %v", err)
+		}
+		master.subnetIndex = common.NewSubnetIndex(subnets)
+	}
+	return master.subnetIndex
+}
+
+// indexHostSubnet adds (or updates) hs in master.subnetIndex
+func (master *OsdnMaster) indexHostSubnet(hs *osdnv1.HostSubnet) {
+	master.subnetIndexLock.Lock()
+	defer master.subnetIndexLock.Unlock()
+	master.hostSubnetIndex().Add(hs)
+}
+
+// unindexHostSubnet removes hs from master.subnetIndex, and forgets the overlaps reported
+// for it
+func (master *OsdnMaster) unindexHostSubnet(hs *osdnv1.HostSubnet) {
+	master.subnetIndexLock.Lock()
+	defer master.subnetIndexLock.Unlock()
+	master.hostSubnetIndex().Remove(hs.Name)
+	for overlap := range master.reportedOverlaps {
+		if names := strings.Fields(overlap); names[0] == hs.Name || names[2] == hs.Name {
+			delete(master.reportedOverlaps, overlap)
+		}
+	}
+}
+
+// hostSubnetNewer returns whether a was created after b (comparing names if they were
+// created at the same time)
+func hostSubnetNewer(a, b *osdnv1.HostSubnet) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return b.CreationTimestamp.Before(&a.CreationTimestamp)
+	}
+	return a.Name > b.Name
+}
+
+// fillMissingHostSubnetFields fills in an empty Host or HostIP in the node-backed
+// HostSubnet hs from node, emitting an event if the HostIP can't be determined. It
+// returns whether hs was changed.
+func (master *OsdnMaster) fillMissingHostSubnetFields(hs *osdnv1.HostSubnet, node *corev1.Node) bool {
+	changed := false
+	if hs.Host == "" {
+		klog.Infof("HostSubnet %s has no host, setting it to %q", hs.Name, hs.Name)
+		hs.Host = hs.Name
+		changed = true
+	}
+	if hs.HostIP == "" {
+		if nodeIP := common.GetNodeInternalIP(node); nodeIP != "" {
+			klog.Infof("HostSubnet %s has no host IP, setting it to %s", hs.Name, nodeIP)
+			hs.HostIP = nodeIP
+			changed = true
+		} else {
+			klog.Warningf("HostSubnet %s has no host IP, and node %s has no internal IP", hs.Name, node.Name)
+			master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "HostSubnetHostIPUnresolved",
+				"HostSubnet has no host IP, and node %s has no internal IP to use", node.Name)
+		}
+	}
+	return changed
+}
+
+// hostSubnetReconcilePaused returns whether HostSubnet reconciliation is paused by
+// reconcilePausedAnnotation on the default ClusterNetwork, logging the skipped action
+// if so. Errors fetching the ClusterNetwork are treated as not paused.
+func (master *OsdnMaster) hostSubnetReconcilePaused(subnet *osdnv1.HostSubnet, action string) bool {
+	cn, err := master.clusterNetworkInformer.Lister().Get(osdnv1.ClusterNetworkDefault)
+	if err != nil {
+		klog.V(4).Infof("Could not check whether HostSubnet reconciliation is paused: %v", err)
+		return false
+	}
+	if _, paused := cn.Annotations[reconcilePausedAnnotation]; !paused {
+		return false
+	}
+	klog.Infof("HostSubnet reconciliation is paused; not acting on HostSubnet %s (would %s)", common.HostSubnetToString(subnet), action)
+	return true
+}
+
+// checkHostSubnetLength checks that hs's subnet has the prefix length implied by the
+// HostSubnetLength of the cluster network containing it, and emits an event if it does not.
+// (HostSubnets outside of the cluster network are not reported here.) It returns false if
+// there is a mismatch.
+func (master *OsdnMaster) checkHostSubnetLength(hs *osdnv1.HostSubnet) bool {
+	rng, ones, expected := master.hostSubnetLengthMismatch(hs)
+	if rng == nil {
+		return true
+	}
+	klog.Warningf("HostSubnet %s has a /%d subnet but cluster network %s uses /%d subnets", common.HostSubnetToString(hs), ones, rng.ClusterCIDR.String(), expected)
+	master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "HostSubnetLengthMismatch",
+		"Subnet %s is a /%d, but cluster network %s uses /%d subnets", hs.Subnet, ones, rng.ClusterCIDR.String(), expected)
+	return false
+}
+
+// hostSubnetLengthMismatch returns the cluster network containing hs's subnet, the
+// subnet's prefix length, and the prefix length implied by the cluster network's
+// HostSubnetLength, if the two prefix lengths differ (and hs doesn't have an allowed
+// override). It returns nil if they match or hs is not in the cluster network.
+func (master *OsdnMaster) hostSubnetLengthMismatch(hs *osdnv1.HostSubnet) (*common.ParsedClusterNetworkEntry, int, int) {
+	rng, err := master.subnetAllocator.RangeForSubnet(hs.Subnet)
+	if err != nil {
+		return nil, 0, 0
+	}
+	_, ipnet, _ := net.ParseCIDR(hs.Subnet)
+	ones, addrLen := ipnet.Mask.Size()
+	if hostSubnetLengthOverridden(hs) && addrLen-ones >= int(rng.HostSubnetLength) {
+		return nil, 0, 0
+	}
+	if expected := addrLen - int(rng.HostSubnetLength); ones != expected {
+		return rng, ones, expected
+	}
+	return nil, 0, 0
+}
+
+// warnHostSubnetLengthMismatches warns, for each cluster network, about the HostSubnets
+// in subnets whose prefix length doesn't match the cluster network's HostSubnetLength,
+// which happens if HostSubnetLength is changed after subnets were allocated, and means
+// those HostSubnets need to be migrated. The HostSubnet event handler then doesn't report
+// them again individually.
+func (master *OsdnMaster) warnHostSubnetLengthMismatches(subnets []*osdnv1.HostSubnet) {
+	mismatched := map[string][]string{}
+	for _, hs := range subnets {
+		if rng, _, _ := master.hostSubnetLengthMismatch(hs); rng != nil {
+			cidr := rng.ClusterCIDR.String()
+			mismatched[cidr] = append(mismatched[cidr], fmt.Sprintf("%s (%s)", hs.Name, hs.Subnet))
+			master.setLengthMismatchReported(hs)
+		}
+	}
+	for _, cn := range master.networkInfo.ClusterNetworks {
+		names := mismatched[cn.ClusterCIDR.String()]
+		if len(names) == 0 {
+			continue
+		}
+		sort.Strings(names)
+		klog.Warningf("%d HostSubnets in cluster network %s do not match its HostSubnetLength %d and need to be migrated: %s",
+			len(names), cn.ClusterCIDR.String(), cn.HostSubnetLength, strings.Join(names, ", "))
+		master.recorder.Eventf(clusterNetworkRef(), corev1.EventTypeWarning, "HostSubnetLengthMigrationNeeded",
+			"%d HostSubnets in cluster network %s do not match its HostSubnetLength %d: %s",
+			len(names), cn.ClusterCIDR.String(), cn.HostSubnetLength, strings.Join(names, ", "))
+	}
+}
+
+// setLengthMismatchReported records that hs's HostSubnetLength mismatch has been reported
+func (master *OsdnMaster) setLengthMismatchReported(hs *osdnv1.HostSubnet) {
+	master.lengthMismatchLock.Lock()
+	defer master.lengthMismatchLock.Unlock()
+	master.lengthMismatchReported[hs.Name] = hs.Subnet
+}
+
+// lengthMismatchAlreadyReported returns whether a HostSubnetLength mismatch has already
+// been reported for hs's current subnet
+func (master *OsdnMaster) lengthMismatchAlreadyReported(hs *osdnv1.HostSubnet) bool {
+	master.lengthMismatchLock.Lock()
+	defer master.lengthMismatchLock.Unlock()
+	return master.lengthMismatchReported[hs.Name] == hs.Subnet
+}
+
+// forgetLengthMismatch forgets any HostSubnetLength mismatch reported for the HostSubnet
+// named name
+func (master *OsdnMaster) forgetLengthMismatch(name string) {
+	master.lengthMismatchLock.Lock()
+	defer master.lengthMismatchLock.Unlock()
+	delete(master.lengthMismatchReported, name)
+}
+
+// reconcileHostSubnetHost checks that a node-backed HostSubnet's Host field matches its
+// name, which addNode (and much else) assumes. Mismatches are reported with an event, and
+// corrected if master.fixHostSubnetHostMismatch is set. It returns whether the HostSubnet
+// was updated.
+func (master *OsdnMaster) reconcileHostSubnetHost(hs *osdnv1.HostSubnet) (bool, error) {
+	if hs.Host == hs.Name || common.HostSubnetNodeUID(hs) == "" {
+		return false, nil
+	}
+
+	master.recorder.Eventf(hostSubnetRef(hs), corev1.EventTypeWarning, "HostSubnetHostMismatch",
+		"HostSubnet %s has host %q, which does not match its name", hs.Name, hs.Host)
+	if !master.fixHostSubnetHostMismatch || master.hostSubnetReconcilePaused(hs, "correct its host") {
+		return false, nil
+	}
+
+	sn := hs.DeepCopy()
+	sn.Host = sn.Name
+	if _, err := master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), sn, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("error updating host of subnet %s: %v", common.HostSubnetToString(hs), err)
+	}
+	klog.Infof("Corrected host of HostSubnet %s from %q to %q", sn.Name, hs.Host, sn.Host)
+	return true, nil
+}
+
+func nodeRef(nodeName, nodeUID string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind: "Node",
+		Name: nodeName,
+		UID:  ktypes.UID(nodeUID),
+	}
+}
+
+func clusterNetworkRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: osdnv1.GroupVersion.String(),
+		Kind:       "ClusterNetwork",
+		Name:       osdnv1.ClusterNetworkDefault,
+	}
+}
+
+func hostSubnetRef(hs *osdnv1.HostSubnet) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: osdnv1.GroupVersion.String(),
+		Kind:       "HostSubnet",
+		Name:       hs.Name,
+		UID:        hs.UID,
+	}
+}
+
 // Handle F5 use case: Admin manually creates HostSubnet with 'AssignHostSubnetAnnotation'
 // to allocate a subnet with no real node in the cluster.
 func (master *OsdnMaster) handleAssignHostSubnetAnnotation(hs *osdnv1.HostSubnet) error {
+	// The informer may redeliver an annotated HostSubnet that we have already handled,
+	// in which case the live object will have been replaced by one without the
+	// annotation, which we must not delete again.
+	cur, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), hs.Name, metav1.GetOptions{})
+	if err != nil {
+		if kerrs.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("error fetching annotated subnet: %s, %v", hs.Name, err)
+	}
+	if _, ok := cur.Annotations[osdnv1.AssignHostSubnetAnnotation]; !ok || cur.UID != hs.UID {
+		klog.V(5).Infof("Ignoring already-handled annotated HostSubnet %s", hs.Name)
+		return nil
+	}
+
 	// Delete the annotated hostsubnet and create a new one with an assigned subnet
 	// We do not update (instead of delete+create) because the watchSubnets on the nodes
 	// will skip the event if it finds that the hostsubnet has the same host
 	// And we cannot fix the watchSubnets code for node because it will break migration if
 	// nodes are upgraded after the master
-	if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), hs.Name, metav1.DeleteOptions{}); err != nil {
+	if err := master.runPreDeleteHook(cur); err != nil {
+		return err
+	}
+	if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), hs.Name, master.hostSubnetDeleteOptions()); err != nil {
 		return fmt.Errorf("error in deleting annotated subnet: %s, %v", hs.Name, err)
 	}
 	klog.Infof("Deleted HostSubnet not backed by node: %s", common.HostSubnetToString(hs))
@@ -324,7 +1988,15 @@ func (master *OsdnMaster) handleAssignHostSubnetAnnotation(hs *osdnv1.HostSubnet
 		}
 	}
 
-	if err := master.addNode(hs.Name, "", hs.HostIP, hsAnnotations); err != nil {
+	var requestedSubnet string
+	if subnet, ok := hs.Annotations[requestedSubnetAnnotation]; ok {
+		requestedSubnet, err = master.subnetAllocator.NormalizeSubnet(subnet)
+		if err != nil {
+			klog.Errorf("Subnet %s is an invalid value for annotation %s. Annotation will be ignored: %v", subnet, requestedSubnetAnnotation, err)
+		}
+	}
+
+	if err := master.addNode(hs.Name, "", hs.HostIP, hsAnnotations, requestedSubnet); err != nil {
 		return fmt.Errorf("error creating subnet: %s, %v", hs.Name, err)
 	}
 	klog.Infof("Created HostSubnet not backed by node: %s", common.HostSubnetToString(hs))
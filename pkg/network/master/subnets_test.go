@@ -0,0 +1,2660 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ktypes "k8s.io/apimachinery/pkg/types"
+	utilwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+	"k8s.io/utils/keymutex"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+	osdninformers "github.com/openshift/client-go/network/informers/externalversions"
+	"github.com/openshift/sdn/pkg/network/common"
+	masterutil "github.com/openshift/sdn/pkg/network/master/util"
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic("bad CIDR string constant " + cidr)
+	}
+	return ipnet
+}
+
+func makeNode(name, uid, ip string) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			UID:  ktypes.UID(uid),
+		},
+	}
+	if ip != "" {
+		node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+	}
+	return node
+}
+
+func makeHostSubnet(name, host, hostIP, subnet, nodeUID string) *osdnv1.HostSubnet {
+	hs := &osdnv1.HostSubnet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Host:   host,
+		HostIP: hostIP,
+		Subnet: subnet,
+	}
+	if nodeUID != "" {
+		hs.Annotations = map[string]string{osdnv1.NodeUIDAnnotation: nodeUID}
+	}
+	return hs
+}
+
+// newTestSubnetMaster returns an OsdnMaster with fake clients, and with its informer
+// caches and subnet allocator populated from nodes and subnets
+func newTestSubnetMaster(t *testing.T, nodes []*corev1.Node, subnets []*osdnv1.HostSubnet) (*OsdnMaster, *record.FakeRecorder) {
+	kubeObjs := []runtime.Object{}
+	for _, node := range nodes {
+		kubeObjs = append(kubeObjs, node)
+	}
+	osdnObjs := []runtime.Object{}
+	for _, hs := range subnets {
+		osdnObjs = append(osdnObjs, hs)
+	}
+
+	kClient := kfake.NewSimpleClientset(kubeObjs...)
+	osdnClient := osdnfake.NewSimpleClientset(osdnObjs...)
+	kubeInformers := informers.NewSharedInformerFactory(kClient, 0)
+	osdnInformers := osdninformers.NewSharedInformerFactory(osdnClient, 0)
+	recorder := record.NewFakeRecorder(100)
+
+	master := &OsdnMaster{
+		kClient:    kClient,
+		osdnClient: osdnClient,
+		networkInfo: &common.ParsedClusterNetwork{
+			ClusterNetworks: []common.ParsedClusterNetworkEntry{
+				{ClusterCIDR: mustParseCIDR("10.128.0.0/14"), HostSubnetLength: 9},
+			},
+			ServiceNetwork: mustParseCIDR("172.30.0.0/16"),
+			VXLANPort:      4789,
+			OverlayMTU:     1450,
+		},
+		recorder:               recorder,
+		nodeInformer:           kubeInformers.Core().V1().Nodes(),
+		hostSubnetInformer:     osdnInformers.Network().V1().HostSubnets(),
+		clusterNetworkInformer: osdnInformers.Network().V1().ClusterNetworks(),
+		subnetAllocator:        masterutil.NewSubnetAllocator(),
+		clock:                  clock.RealClock{},
+		nodeLocks:              keymutex.NewHashed(0),
+		hostSubnetNodeIPs:      map[ktypes.UID]string{},
+		nodeIPOwners:           map[string]ktypes.UID{},
+		lengthMismatchReported: map[string]string{},
+	}
+
+	for _, cn := range master.networkInfo.ClusterNetworks {
+		if err := master.subnetAllocator.AddNetworkRange(cn.ClusterCIDR.String(), cn.HostSubnetLength); err != nil {
+			t.Fatalf("unexpected error adding network range: %v", err)
+		}
+	}
+	for _, node := range nodes {
+		if err := master.nodeInformer.Informer().GetIndexer().Add(node); err != nil {
+			t.Fatalf("unexpected error adding node to informer: %v", err)
+		}
+	}
+	for _, hs := range subnets {
+		if err := master.hostSubnetInformer.Informer().GetIndexer().Add(hs); err != nil {
+			t.Fatalf("unexpected error adding subnet to informer: %v", err)
+		}
+		if hs.Subnet != "" {
+			if err := master.subnetAllocator.MarkAllocatedNetwork(hs.Subnet); err != nil {
+				t.Fatalf("unexpected error marking subnet allocated: %v", err)
+			}
+		}
+	}
+
+	return master, recorder
+}
+
+// drainEvents returns the events that have been recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func getHostSubnet(t *testing.T, master *OsdnMaster, name string) *osdnv1.HostSubnet {
+	hs, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting HostSubnet %q: %v", name, err)
+	}
+	return hs
+}
+
+func TestReconcileHostSubnetHost(t *testing.T) {
+	tests := []struct {
+		name          string
+		subnet        *osdnv1.HostSubnet
+		fix           bool
+		expectEvent   bool
+		expectedHost  string
+		expectUpdated bool
+	}{
+		{
+			name:         "matching host and name",
+			subnet:       makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			expectedHost: "node1",
+		},
+		{
+			name:         "mismatched host, not fixed",
+			subnet:       makeHostSubnet("node1", "node2", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			expectEvent:  true,
+			expectedHost: "node2",
+		},
+		{
+			name:          "mismatched host, fixed",
+			subnet:        makeHostSubnet("node1", "node2", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			fix:           true,
+			expectEvent:   true,
+			expectedHost:  "node1",
+			expectUpdated: true,
+		},
+		{
+			name:         "mismatched host on subnet not backed by node",
+			subnet:       makeHostSubnet("f5", "other", "192.168.1.1", "10.128.0.0/23", ""),
+			fix:          true,
+			expectedHost: "other",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			master, recorder := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{tc.subnet})
+			master.fixHostSubnetHostMismatch = tc.fix
+
+			updated, err := master.reconcileHostSubnetHost(tc.subnet)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if updated != tc.expectUpdated {
+				t.Fatalf("expected updated=%v, got %v", tc.expectUpdated, updated)
+			}
+
+			events := drainEvents(recorder)
+			if tc.expectEvent {
+				if len(events) != 1 || !strings.Contains(events[0], "HostSubnetHostMismatch") {
+					t.Fatalf("expected a HostSubnetHostMismatch event, got %v", events)
+				}
+			} else if len(events) != 0 {
+				t.Fatalf("unexpected events: %v", events)
+			}
+
+			hs := getHostSubnet(t, master, tc.subnet.Name)
+			if hs.Host != tc.expectedHost {
+				t.Fatalf("expected host %q, got %q", tc.expectedHost, hs.Host)
+			}
+		})
+	}
+}
+
+func TestHandleAddOrUpdateSubnetHostMismatch(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	subnet := makeHostSubnet("node1", "node2", "192.168.1.1", "10.128.0.0/23", "uid1")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{subnet})
+	master.fixHostSubnetHostMismatch = true
+
+	master.handleAddOrUpdateSubnet(subnet, nil, watch.Added)
+
+	if hs := getHostSubnet(t, master, "node1"); hs.Host != "node1" {
+		t.Fatalf("expected host to be corrected, got %q", hs.Host)
+	}
+	if events := drainEvents(recorder); len(events) != 1 {
+		t.Fatalf("expected exactly one event, got %v", events)
+	}
+}
+
+func TestReconcileHostSubnetNodeUID(t *testing.T) {
+	tests := []struct {
+		name          string
+		node          *corev1.Node
+		annotation    string
+		expectDeleted bool
+		expectedUID   string
+	}{
+		{
+			name:        "empty-string UID is stamped",
+			node:        makeNode("node1", "uid1", "192.168.1.1"),
+			annotation:  "",
+			expectedUID: "uid1",
+		},
+		{
+			name:        "whitespace UID is stamped",
+			node:        makeNode("node1", "uid1", "192.168.1.1"),
+			annotation:  "  ",
+			expectedUID: "uid1",
+		},
+		{
+			name:        "valid UID is left alone",
+			node:        makeNode("node1", "uid1", "192.168.1.1"),
+			annotation:  "uid1",
+			expectedUID: "uid1",
+		},
+		{
+			name:        "empty-string UID without a node is treated as not node-backed",
+			annotation:  "",
+			expectedUID: "",
+		},
+		{
+			name:          "valid UID without a node is deleted",
+			annotation:    "uid1",
+			expectDeleted: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subnet := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "")
+			subnet.Annotations = map[string]string{osdnv1.NodeUIDAnnotation: tc.annotation}
+			var nodes []*corev1.Node
+			if tc.node != nil {
+				nodes = append(nodes, tc.node)
+			}
+			master, _ := newTestSubnetMaster(t, nodes, []*osdnv1.HostSubnet{subnet})
+
+			if err := master.reconcileHostSubnet(subnet); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			hs, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), subnet.Name, metav1.GetOptions{})
+			if tc.expectDeleted {
+				if err == nil {
+					t.Fatalf("expected HostSubnet to be deleted")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error getting HostSubnet: %v", err)
+			}
+			if uid := common.HostSubnetNodeUID(hs); uid != tc.expectedUID {
+				t.Fatalf("expected node UID %q, got %q", tc.expectedUID, uid)
+			}
+		})
+	}
+}
+
+func TestAddNodeSubnetAssignedEvent(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+	// The first event creates the HostSubnet; the repeated event and the status-only
+	// update are no-ops
+	master.handleAddOrUpdateNode(node, nil, watch.Added)
+	master.handleAddOrUpdateNode(node, nil, watch.Modified)
+	if err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	hs := getHostSubnet(t, master, "node1")
+	assigned := 0
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "SubnetAssigned") {
+			assigned++
+			// (No timestamp, so that repeated events can be aggregated)
+			expected := fmt.Sprintf("%s SubnetAssigned Assigned subnet %s to node node1 (host IP 192.168.1.1)", corev1.EventTypeNormal, hs.Subnet)
+			if event != expected {
+				t.Fatalf("expected event %q, got %q", expected, event)
+			}
+		}
+	}
+	if assigned != 1 {
+		t.Fatalf("expected exactly one SubnetAssigned event, got %d", assigned)
+	}
+}
+
+func TestSubnetMasterSummary(t *testing.T) {
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{
+		makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+		makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "uid2"),
+	})
+
+	summary := subnetMasterSummary(master.subnetAllocator.Stats(), 1, 2)
+	for _, field := range []string{
+		"10.128.0.0/14 (host bits 9, 2/512 allocated)",
+		"512 subnets total",
+		"2 allocated",
+		"510 free",
+		"1 orphaned HostSubnets",
+		"2 foreign HostSubnets",
+	} {
+		if !strings.Contains(summary, field) {
+			t.Fatalf("summary %q does not contain %q", summary, field)
+		}
+	}
+}
+
+func TestHandleAssignHostSubnetAnnotationRedelivery(t *testing.T) {
+	subnet := makeHostSubnet("f5", "f5", "192.168.1.1", "", "")
+	subnet.Annotations = map[string]string{osdnv1.AssignHostSubnetAnnotation: "true"}
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{subnet})
+	fakeClient := master.osdnClient.(*osdnfake.Clientset)
+
+	master.handleAddOrUpdateSubnet(subnet, nil, watch.Added)
+	master.handleAddOrUpdateSubnet(subnet, nil, watch.Added)
+
+	deletes, creates := 0, 0
+	for _, action := range fakeClient.Actions() {
+		switch action.GetVerb() {
+		case "delete":
+			deletes++
+		case "create":
+			creates++
+		}
+	}
+	if deletes != 1 || creates != 1 {
+		t.Fatalf("expected exactly one delete and one create, got %d and %d", deletes, creates)
+	}
+
+	hs := getHostSubnet(t, master, "f5")
+	if _, ok := hs.Annotations[osdnv1.AssignHostSubnetAnnotation]; ok || hs.Subnet == "" {
+		t.Fatalf("expected HostSubnet to be assigned a subnet, got %s", common.HostSubnetToString(hs))
+	}
+}
+
+func TestHandleAssignHostSubnetAnnotationRequestedSubnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		expected  string
+	}{
+		{
+			name:      "honored",
+			requested: "10.128.8.0/23",
+			expected:  "10.128.8.0/23",
+		},
+		{
+			name:      "unavailable, falls back",
+			requested: "10.128.0.0/23",
+			expected:  "10.129.0.0/23",
+		},
+		{
+			name:      "misaligned, ignored",
+			requested: "10.128.9.0/23",
+			expected:  "10.129.0.0/23",
+		},
+		{
+			name:      "out of range, ignored",
+			requested: "10.200.0.0/23",
+			expected:  "10.129.0.0/23",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			existing := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "")
+			subnet := makeHostSubnet("f5", "f5", "192.168.1.2", "", "")
+			subnet.Annotations = map[string]string{
+				osdnv1.AssignHostSubnetAnnotation: "true",
+				requestedSubnetAnnotation:         tc.requested,
+			}
+			master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{existing, subnet})
+
+			if err := master.handleAssignHostSubnetAnnotation(subnet); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hs := getHostSubnet(t, master, "f5"); hs.Subnet != tc.expected {
+				t.Fatalf("expected subnet %s, got %s", tc.expected, hs.Subnet)
+			}
+		})
+	}
+}
+
+func TestNodeIPReuse(t *testing.T) {
+	oldNode := makeNode("node1", "uid1", "192.168.1.1")
+	newNode := makeNode("node2", "uid2", "192.168.1.1")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{oldNode, newNode}, nil)
+
+	master.handleAddOrUpdateNode(oldNode, nil, watch.Added)
+	drainEvents(recorder)
+
+	// newNode reuses oldNode's IP after oldNode has been deleted, but before its
+	// deletion has been processed
+	if err := master.nodeInformer.Informer().GetIndexer().Delete(oldNode); err != nil {
+		t.Fatalf("unexpected error deleting node from informer: %v", err)
+	}
+	master.handleAddOrUpdateNode(newNode, nil, watch.Added)
+	reused := 0
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "NodeIPReused") {
+			reused++
+		}
+	}
+	if reused != 1 {
+		t.Fatalf("expected exactly one NodeIPReused event, got %d", reused)
+	}
+	if owner := master.nodeIPOwners["192.168.1.1"]; owner != newNode.UID {
+		t.Fatalf("expected IP to be owned by %s, got %s", newNode.UID, owner)
+	}
+
+	// Processing the old node's deletion must not drop the new node's claim
+	master.hostSubnetInformer.Informer().GetIndexer().Add(getHostSubnet(t, master, "node1"))
+	master.handleDeleteNode(oldNode)
+	if owner := master.nodeIPOwners["192.168.1.1"]; owner != newNode.UID {
+		t.Fatalf("expected IP to still be owned by %s, got %s", newNode.UID, owner)
+	}
+
+	// Further events for the new node are not flagged
+	master.handleAddOrUpdateNode(makeNode("node2", "uid2", "192.168.1.2"), nil, watch.Modified)
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "NodeIPReused") {
+			t.Fatalf("unexpected event %q", event)
+		}
+	}
+	if _, ok := master.nodeIPOwners["192.168.1.1"]; ok {
+		t.Fatalf("expected stale IP to be removed from index")
+	}
+}
+
+func TestNodeIPConflict(t *testing.T) {
+	node1 := makeNode("node1", "uid1", "192.168.1.1")
+	node2 := makeNode("node2", "uid2", "192.168.1.1")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node1, node2}, nil)
+
+	master.handleAddOrUpdateNode(node1, nil, watch.Added)
+	drainEvents(recorder)
+
+	// node2 reports the same IP as node1, which still exists
+	master.handleAddOrUpdateNode(node2, nil, watch.Added)
+	if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node2", metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected no HostSubnet to be created for node2")
+	}
+	if owner := master.nodeIPOwners["192.168.1.1"]; owner != node1.UID {
+		t.Fatalf("expected IP to still be owned by %s, got %s", node1.UID, owner)
+	}
+	conflicts := map[string]bool{}
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "NodeIPConflict") {
+			for _, name := range []string{"node1", "node2"} {
+				if strings.Contains(event, "in use by node "+name) {
+					conflicts[name] = true
+				}
+			}
+		}
+	}
+	if !conflicts["node1"] || !conflicts["node2"] {
+		t.Fatalf("expected NodeIPConflict events on both nodes, got %v", conflicts)
+	}
+
+	// node1 itself is not flagged
+	if err := master.addNode("node1", "uid1", "192.168.1.1", nil, ""); err != nil {
+		t.Fatalf("unexpected error re-adding node1: %v", err)
+	}
+}
+
+func TestAddNodeConcurrent(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, "")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	subnets, err := master.osdnClient.NetworkV1().HostSubnets().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error listing subnets: %v", err)
+	}
+	if len(subnets.Items) != 1 {
+		t.Fatalf("expected exactly one HostSubnet, got %d", len(subnets.Items))
+	}
+	if allocated := master.subnetAllocator.Stats().Allocated; allocated != 1 {
+		t.Fatalf("expected exactly one allocated subnet, got %d", allocated)
+	}
+}
+
+func makeRunningPod(namespace, name, nodeName string, hostNetwork bool) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: corev1.PodSpec{
+			NodeName:    nodeName,
+			HostNetwork: hostNetwork,
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestNodeIPChangeWithRunningPods(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		pods         []*corev1.Pod
+		requireDrain bool
+		expectWarn   bool
+		expectErr    bool
+	}{
+		{
+			name: "no pods",
+		},
+		{
+			name: "only host-network pods and pods on other nodes",
+			pods: []*corev1.Pod{
+				makeRunningPod("ns", "host", "node1", true),
+				makeRunningPod("ns", "other", "node2", false),
+			},
+		},
+		{
+			name:       "running pods",
+			pods:       []*corev1.Pod{makeRunningPod("ns", "pod", "node1", false)},
+			expectWarn: true,
+		},
+		{
+			name:         "running pods with drain required",
+			pods:         []*corev1.Pod{makeRunningPod("ns", "pod", "node1", false)},
+			requireDrain: true,
+			expectErr:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.2")
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+			master.requireDrainForNodeIPChange = tc.requireDrain
+			for _, pod := range tc.pods {
+				if _, err := master.kClient.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+					t.Fatalf("unexpected error creating pod: %v", err)
+				}
+			}
+
+			err := master.addNode(node.Name, string(node.UID), "192.168.1.2", nil, "")
+			if tc.expectErr && err == nil {
+				t.Fatalf("expected error, got none")
+			} else if !tc.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			expectedIP := "192.168.1.2"
+			if tc.expectErr {
+				expectedIP = "192.168.1.1"
+			}
+			if hostIP := getHostSubnet(t, master, "node1").HostIP; hostIP != expectedIP {
+				t.Fatalf("expected HostIP %s, got %s", expectedIP, hostIP)
+			}
+
+			warned := false
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "NodeIPChanged") {
+					if !strings.HasPrefix(event, corev1.EventTypeWarning) {
+						t.Fatalf("unexpected event %q", event)
+					}
+					warned = true
+				}
+			}
+			if warned != tc.expectWarn {
+				t.Fatalf("expected NodeIPChanged warning %v, got %v", tc.expectWarn, warned)
+			}
+		})
+	}
+}
+
+func TestDeferSubnetDeleteUntilPodsGone(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// whether the pod goes away (rather than the timeout passing) before the
+		// HostSubnet is deleted
+		podGone bool
+		// whether the deletion starts from reconciling the orphaned HostSubnet (after a
+		// missed node event) rather than from the node deletion
+		reconcile bool
+	}{
+		{name: "pods gone", podGone: true},
+		{name: "timeout", podGone: false},
+		{name: "orphan reconcile, pods gone", podGone: true, reconcile: true},
+		{name: "orphan reconcile, timeout", podGone: false, reconcile: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+			fakeClock := testingclock.NewFakeClock(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+			master.clock = fakeClock
+			master.deferSubnetDeleteTimeout = time.Minute
+			pod := makeRunningPod("ns", "pod", "node1", false)
+			if _, err := master.kClient.CoreV1().Pods("ns").Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("unexpected error creating pod: %v", err)
+			}
+			if err := master.nodeInformer.Informer().GetIndexer().Delete(node); err != nil {
+				t.Fatalf("unexpected error deleting node from informer: %v", err)
+			}
+			hasSubnet := func() bool {
+				_, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{})
+				return err == nil
+			}
+			waitForRetry := func() {
+				t.Helper()
+				err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+					return fakeClock.HasWaiters(), nil
+				})
+				if err != nil {
+					t.Fatalf("deletion was not requeued")
+				}
+			}
+
+			// The pod is still on the node, so deletion is deferred
+			if tc.reconcile {
+				if err := master.kClient.CoreV1().Nodes().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+					t.Fatalf("unexpected error deleting node: %v", err)
+				}
+				if action, err := master.reconcileHostSubnetAction(hs); err != nil || action != ReconcileSkipped {
+					t.Fatalf("expected reconcile to be skipped, got %v, %v", action, err)
+				}
+			} else if err := master.deleteNode("node1"); err != nil {
+				t.Fatalf("unexpected error deleting node: %v", err)
+			}
+			if !hasSubnet() {
+				t.Fatalf("HostSubnet deleted while pods remain")
+			}
+			waitForRetry()
+			fakeClock.Step(deferredSubnetDeleteRetryInterval)
+			waitForRetry()
+			if !hasSubnet() {
+				t.Fatalf("HostSubnet deleted on retry while pods remain")
+			}
+
+			if tc.podGone {
+				if err := master.kClient.CoreV1().Pods("ns").Delete(context.TODO(), "pod", metav1.DeleteOptions{}); err != nil {
+					t.Fatalf("unexpected error deleting pod: %v", err)
+				}
+				fakeClock.Step(deferredSubnetDeleteRetryInterval)
+			} else {
+				fakeClock.Step(master.deferSubnetDeleteTimeout)
+			}
+			err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				return !hasSubnet(), nil
+			})
+			if err != nil {
+				t.Fatalf("HostSubnet was not deleted")
+			}
+			master.nodeIPLock.Lock()
+			defer master.nodeIPLock.Unlock()
+			if len(master.deferredSubnetDeletes) != 0 {
+				t.Fatalf("unexpected deferred deletions %v", master.deferredSubnetDeletes)
+			}
+		})
+	}
+}
+
+func TestAddNodeAnnotationDecorator(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+	var decoratedNodes []string
+	master.annotationDecorator = func(node *corev1.Node, annotations map[string]string) {
+		if node != nil {
+			decoratedNodes = append(decoratedNodes, node.Name)
+			annotations["example.com/owner"] = "team-" + node.Name
+		} else {
+			decoratedNodes = append(decoratedNodes, "")
+			annotations["example.com/owner"] = "team-external"
+		}
+		annotations["example.com/cost-center"] = "1234"
+		annotations[osdnv1.NodeUIDAnnotation] = "bogus"
+	}
+
+	// Node-backed HostSubnet
+	if err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hs := getHostSubnet(t, master, "node1")
+	if hs.Annotations["example.com/owner"] != "team-node1" || hs.Annotations["example.com/cost-center"] != "1234" {
+		t.Fatalf("custom annotations not applied: %v", hs.Annotations)
+	}
+	if hs.Annotations[osdnv1.NodeUIDAnnotation] != "uid1" {
+		t.Fatalf("expected NodeUID annotation %q, got %q", "uid1", hs.Annotations[osdnv1.NodeUIDAnnotation])
+	}
+
+	// HostSubnet not backed by a node
+	if err := master.addNode("external", "", "192.168.1.100", map[string]string{osdnv1.AssignHostSubnetAnnotation: "true"}, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hs = getHostSubnet(t, master, "external")
+	if hs.Annotations["example.com/owner"] != "team-external" {
+		t.Fatalf("custom annotations not applied: %v", hs.Annotations)
+	}
+	if _, ok := hs.Annotations[osdnv1.NodeUIDAnnotation]; ok {
+		t.Fatalf("unexpected NodeUID annotation on HostSubnet not backed by a node: %v", hs.Annotations)
+	}
+
+	if !reflect.DeepEqual(decoratedNodes, []string{"node1", ""}) {
+		t.Fatalf("unexpected decorator calls: %v", decoratedNodes)
+	}
+}
+
+func TestReconcileHostSubnetMissingHost(t *testing.T) {
+	tests := []struct {
+		name         string
+		node         *corev1.Node
+		nodeUID      string
+		expectedHost string
+	}{
+		{
+			name:         "node-backed subnet",
+			node:         makeNode("node1", "uid1", "192.168.1.1"),
+			nodeUID:      "uid1",
+			expectedHost: "node1",
+		},
+		{
+			name:         "node-backed subnet without UID annotation",
+			node:         makeNode("node1", "uid1", "192.168.1.1"),
+			expectedHost: "node1",
+		},
+		{
+			name:         "subnet not backed by a node",
+			expectedHost: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subnet := makeHostSubnet("node1", "", "192.168.1.1", "10.128.0.0/23", tc.nodeUID)
+			var nodes []*corev1.Node
+			if tc.node != nil {
+				nodes = append(nodes, tc.node)
+			}
+			master, _ := newTestSubnetMaster(t, nodes, []*osdnv1.HostSubnet{subnet})
+
+			master.handleAddOrUpdateSubnet(subnet, nil, watch.Added)
+
+			if hs := getHostSubnet(t, master, "node1"); hs.Host != tc.expectedHost {
+				t.Fatalf("expected host %q, got %q", tc.expectedHost, hs.Host)
+			}
+		})
+	}
+}
+
+func TestAddNodeMaxHostSubnets(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		existing  int
+		expectErr bool
+	}{
+		{
+			name:     "no limit",
+			limit:    0,
+			existing: 2,
+		},
+		{
+			name:     "below limit",
+			limit:    3,
+			existing: 2,
+		},
+		{
+			name:      "at limit",
+			limit:     2,
+			existing:  2,
+			expectErr: true,
+		},
+		{
+			name:      "above limit",
+			limit:     1,
+			existing:  2,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var subnets []*osdnv1.HostSubnet
+			for i := 0; i < tc.existing; i++ {
+				name := fmt.Sprintf("existing%d", i)
+				subnets = append(subnets, makeHostSubnet(name, name, fmt.Sprintf("192.168.0.%d", i+1), fmt.Sprintf("10.128.%d.0/23", i*2), ""))
+			}
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, subnets)
+			master.maxHostSubnets = tc.limit
+
+			err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, "")
+			events := drainEvents(recorder)
+			if !tc.expectErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				getHostSubnet(t, master, "node1")
+				return
+			}
+
+			if _, ok := err.(*HostSubnetLimitError); !ok {
+				t.Fatalf("expected HostSubnetLimitError, got %v", err)
+			}
+			if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+				t.Fatalf("unexpectedly created HostSubnet")
+			}
+			if allocated := master.subnetAllocator.Stats().Allocated; allocated != uint64(tc.existing) {
+				t.Fatalf("expected %d allocated subnets, got %d", tc.existing, allocated)
+			}
+			if len(events) != 1 || !strings.Contains(events[0], "HostSubnetLimitReached") {
+				t.Fatalf("expected a HostSubnetLimitReached event, got %v", events)
+			}
+		})
+	}
+}
+
+func TestCheckHostSubnetLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		subnet      string
+		expectEvent bool
+	}{
+		{
+			name:   "correctly sized",
+			subnet: "10.128.2.0/23",
+		},
+		{
+			name:        "too small",
+			subnet:      "10.128.2.0/24",
+			expectEvent: true,
+		},
+		{
+			name:        "too large",
+			subnet:      "10.128.0.0/22",
+			expectEvent: true,
+		},
+		{
+			name:   "outside cluster network",
+			subnet: "10.200.0.0/24",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", tc.subnet, "uid1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+			master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+
+			events := drainEvents(recorder)
+			found := false
+			for _, event := range events {
+				if strings.Contains(event, "HostSubnetLengthMismatch") {
+					found = true
+				}
+			}
+			if found != tc.expectEvent {
+				t.Fatalf("expected HostSubnetLengthMismatch event %v, got events %v", tc.expectEvent, events)
+			}
+			// Not reported again on resync
+			master.handleAddOrUpdateSubnet(hs, hs, watch.Modified)
+			if events := drainEvents(recorder); len(events) != 0 {
+				t.Fatalf("unexpected events on resync: %v", events)
+			}
+
+			if ok := master.checkHostSubnetLength(hs); ok == tc.expectEvent {
+				t.Fatalf("expected checkHostSubnetLength to return %v", !tc.expectEvent)
+			}
+		})
+	}
+}
+
+func TestWarnHostSubnetLengthMismatches(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		subnets []string
+		expect  string
+	}{
+		{
+			name:    "matching length",
+			subnets: []string{"10.128.0.0/23", "10.128.2.0/23", "10.200.0.0/24"},
+		},
+		{
+			name:    "mismatched length",
+			subnets: []string{"10.128.2.0/24", "10.128.0.0/23", "10.128.1.0/24"},
+			expect:  "2 HostSubnets in cluster network 10.128.0.0/14 do not match its HostSubnetLength 9: node1 (10.128.2.0/24), node3 (10.128.1.0/24)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			master, recorder := newTestSubnetMaster(t, nil, nil)
+			var subnets []*osdnv1.HostSubnet
+			for i, subnet := range tc.subnets {
+				name := fmt.Sprintf("node%d", i+1)
+				subnets = append(subnets, makeHostSubnet(name, name, fmt.Sprintf("192.168.1.%d", i+1), subnet, ""))
+			}
+
+			master.warnHostSubnetLengthMismatches(subnets)
+			var warnings []string
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "HostSubnetLengthMigrationNeeded") {
+					warnings = append(warnings, event)
+				}
+			}
+			if tc.expect == "" && len(warnings) != 0 {
+				t.Fatalf("unexpected events %v", warnings)
+			} else if tc.expect != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], tc.expect)) {
+				t.Fatalf("expected one event containing %q, got %v", tc.expect, warnings)
+			}
+
+			// The initial Add events don't report the mismatches again
+			for _, hs := range subnets {
+				master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+			}
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "HostSubnetLength") {
+					t.Fatalf("unexpected event after startup %q", event)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileHostSubnetPaused(t *testing.T) {
+	subnet := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{subnet})
+
+	cn := &osdnv1.ClusterNetwork{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        osdnv1.ClusterNetworkDefault,
+			Annotations: map[string]string{reconcilePausedAnnotation: ""},
+		},
+	}
+	cnIndexer := master.clusterNetworkInformer.Informer().GetIndexer()
+	if err := cnIndexer.Add(cn); err != nil {
+		t.Fatalf("unexpected error adding ClusterNetwork to informer: %v", err)
+	}
+
+	// The subnet has no node, but deletion is skipped while paused
+	if err := master.reconcileHostSubnet(subnet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	getHostSubnet(t, master, "node1")
+
+	// Every kind of change is skipped, and counted as such
+	node2 := makeNode("node2", "uid2", "192.168.1.2")
+	if err := master.nodeInformer.Informer().GetIndexer().Add(node2); err != nil {
+		t.Fatalf("unexpected error adding node to informer: %v", err)
+	}
+	unstamped := makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "")
+	unfilled := makeHostSubnet("node2", "", "192.168.1.2", "10.128.2.0/23", "uid2")
+	for _, hs := range []*osdnv1.HostSubnet{subnet, unstamped, unfilled} {
+		if action, err := master.reconcileHostSubnetAction(hs); err != nil || action != ReconcileSkipped {
+			t.Fatalf("expected reconciling %s to be skipped, got %v, %v", common.HostSubnetToString(hs), action, err)
+		}
+	}
+
+	// So are the fixes made by the HostSubnet event handler (which would fail here if
+	// attempted, since these HostSubnets don't exist)
+	master.fixHostSubnetHostMismatch = true
+	mismatched := makeHostSubnet("node3", "node4", "192.168.1.3", "10.128.4.0/23", "uid3")
+	if fixed, err := master.reconcileHostSubnetHost(mismatched); err != nil || fixed {
+		t.Fatalf("expected host fix to be skipped, got %v, %v", fixed, err)
+	}
+	repeated := makeHostSubnet("node3", "node3", "192.168.1.3", "10.128.4.0/23", "uid3")
+	repeated.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.100", "192.168.1.100"}
+	if deduped, err := master.dedupeEgressIPs(repeated); err != nil || deduped {
+		t.Fatalf("expected egress IP dedupe to be skipped, got %v, %v", deduped, err)
+	}
+
+	// Once unpaused, reconciliation resumes
+	cn = cn.DeepCopy()
+	cn.Annotations = nil
+	if err := cnIndexer.Update(cn); err != nil {
+		t.Fatalf("unexpected error updating ClusterNetwork in informer: %v", err)
+	}
+	if err := master.reconcileHostSubnet(subnet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected HostSubnet to be deleted after unpausing")
+	}
+}
+
+func TestAddNodeSubnetRangeLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		fill     bool
+		fallback bool
+		expected string
+	}{
+		{
+			name:     "unlabeled node uses any range",
+			expected: "10.128.0.0/23",
+		},
+		{
+			name:     "labeled node uses its range",
+			labels:   map[string]string{"example.com/pool": "gpu"},
+			expected: "10.132.0.0/23",
+		},
+		{
+			name:     "unknown label value uses any range",
+			labels:   map[string]string{"example.com/pool": "other"},
+			expected: "10.128.0.0/23",
+		},
+		{
+			name:   "full range without fallback",
+			labels: map[string]string{"example.com/pool": "gpu"},
+			fill:   true,
+		},
+		{
+			name:     "full range with fallback",
+			labels:   map[string]string{"example.com/pool": "gpu"},
+			fill:     true,
+			fallback: true,
+			expected: "10.128.0.0/23",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			node.Labels = tc.labels
+			master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+			master.subnetRangeLabel = "example.com/pool"
+			master.subnetRangesByLabel = map[string]string{"gpu": "10.132.0.0/23"}
+			master.subnetRangeFallback = tc.fallback
+			// A range with room for a single subnet
+			if err := master.subnetAllocator.AddNetworkRange("10.132.0.0/23", 9); err != nil {
+				t.Fatalf("unexpected error adding network range: %v", err)
+			}
+			if tc.fill {
+				if err := master.subnetAllocator.MarkAllocatedNetwork("10.132.0.0/23"); err != nil {
+					t.Fatalf("unexpected error filling range: %v", err)
+				}
+			}
+
+			err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, "")
+			if tc.expected == "" {
+				if err == nil {
+					t.Fatalf("expected error, got subnet %s", getHostSubnet(t, master, "node1").Subnet)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if subnet := getHostSubnet(t, master, "node1").Subnet; subnet != tc.expected {
+				t.Fatalf("expected subnet %s, got %s", tc.expected, subnet)
+			}
+		})
+	}
+}
+
+func TestReconcileHostSubnetMissingHostIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		nodeIP         string
+		expectedHostIP string
+		expectEvent    bool
+	}{
+		{
+			name:           "resolvable node IP",
+			nodeIP:         "192.168.1.1",
+			expectedHostIP: "192.168.1.1",
+		},
+		{
+			name:        "unresolvable node IP",
+			nodeIP:      "",
+			expectEvent: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", tc.nodeIP)
+			subnet := makeHostSubnet("node1", "node1", "", "10.128.0.0/23", "uid1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{subnet})
+
+			master.handleAddOrUpdateSubnet(subnet, nil, watch.Added)
+
+			if hs := getHostSubnet(t, master, "node1"); hs.HostIP != tc.expectedHostIP {
+				t.Fatalf("expected host IP %q, got %q", tc.expectedHostIP, hs.HostIP)
+			}
+			events := drainEvents(recorder)
+			found := false
+			for _, event := range events {
+				if strings.Contains(event, "HostSubnetHostIPUnresolved") {
+					found = true
+				}
+			}
+			if found != tc.expectEvent {
+				t.Fatalf("expected HostSubnetHostIPUnresolved event %v, got events %v", tc.expectEvent, events)
+			}
+		})
+	}
+}
+
+func TestAddNodeIPProber(t *testing.T) {
+	tests := []struct {
+		name        string
+		reachable   bool
+		block       bool
+		expectErr   bool
+		expectEvent bool
+	}{
+		{
+			name:      "reachable",
+			reachable: true,
+		},
+		{
+			name:        "unreachable, warn",
+			expectEvent: true,
+		},
+		{
+			name:        "unreachable, block",
+			block:       true,
+			expectErr:   true,
+			expectEvent: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+			var probed []string
+			master.nodeIPProber = func(nodeIP string) error {
+				probed = append(probed, nodeIP)
+				if !tc.reachable {
+					return fmt.Errorf("no route to host")
+				}
+				return nil
+			}
+			master.blockUnreachableNodeIPs = tc.block
+
+			err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, "")
+			if !reflect.DeepEqual(probed, []string{"192.168.1.1"}) {
+				t.Fatalf("unexpected probes %v", probed)
+			}
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+					t.Fatalf("unexpectedly created HostSubnet")
+				}
+				if allocated := master.subnetAllocator.Stats().Allocated; allocated != 0 {
+					t.Fatalf("expected no allocated subnets, got %d", allocated)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				getHostSubnet(t, master, "node1")
+			}
+
+			events := drainEvents(recorder)
+			found := false
+			for _, event := range events {
+				if strings.Contains(event, "NodeIPUnreachable") {
+					found = true
+				}
+			}
+			if found != tc.expectEvent {
+				t.Fatalf("expected NodeIPUnreachable event %v, got events %v", tc.expectEvent, events)
+			}
+		})
+	}
+}
+
+func TestNodeIPIsLocal(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		hostIPs     []net.IP
+		expectEvent bool
+	}{
+		{
+			name:    "present",
+			hostIPs: []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("192.168.1.1")},
+		},
+		{
+			name:        "absent",
+			hostIPs:     []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("192.168.1.2")},
+			expectEvent: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+			master.localHostIPs = func() ([]net.IP, error) {
+				return tc.hostIPs, nil
+			}
+
+			// A non-local node IP is only reported, not refused
+			if err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			getHostSubnet(t, master, "node1")
+
+			events := drainEvents(recorder)
+			found := false
+			for _, event := range events {
+				if strings.Contains(event, "NodeIPNotLocal") {
+					found = true
+				}
+			}
+			if found != tc.expectEvent {
+				t.Fatalf("expected NodeIPNotLocal event %v, got events %v", tc.expectEvent, events)
+			}
+		})
+	}
+}
+
+func TestClearNetworkUnavailableCondition(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		reason        string
+		disabled      bool
+		extraReasons  []string
+		expectCleared bool
+	}{
+		{
+			name:          "GCE condition",
+			reason:        "NoRouteCreated",
+			expectCleared: true,
+		},
+		{
+			name:     "disabled",
+			reason:   "NoRouteCreated",
+			disabled: true,
+		},
+		{
+			name:   "other provider's condition",
+			reason: "NetworkNotReady",
+		},
+		{
+			name:          "other provider's condition, configured",
+			reason:        "NetworkNotReady",
+			extraReasons:  []string{"NetworkNotReady"},
+			expectCleared: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			node.Status.Conditions = []corev1.NodeCondition{{
+				Type:   corev1.NodeNetworkUnavailable,
+				Status: corev1.ConditionTrue,
+				Reason: tc.reason,
+			}}
+			master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+			master.disableNetworkUnavailableClear = tc.disabled
+			master.networkUnavailableReasons = tc.extraReasons
+
+			master.clearInitialNodeNetworkUnavailableCondition(node)
+
+			updated, err := master.kClient.CoreV1().Nodes().Get(context.TODO(), node.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error getting node: %v", err)
+			}
+			condition := updated.Status.Conditions[0]
+			if cleared := condition.Status == corev1.ConditionFalse; cleared != tc.expectCleared {
+				t.Fatalf("expected cleared=%v, got condition %#v", tc.expectCleared, condition)
+			}
+			if tc.expectCleared && condition.Reason != "RouteCreated" {
+				t.Fatalf("unexpected condition reason %q", condition.Reason)
+			}
+		})
+	}
+}
+
+func TestReallocateNode(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		failUpdate  bool
+		expectErr   bool
+		expectRange string
+	}{
+		{
+			name:        "successful reallocation",
+			expectRange: "10.132.0.0/14",
+		},
+		{
+			name:        "failed update",
+			failUpdate:  true,
+			expectErr:   true,
+			expectRange: "10.128.0.0/14",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, recorder := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{hs})
+			if err := master.subnetAllocator.AddNetworkRange("10.132.0.0/14", 9); err != nil {
+				t.Fatalf("unexpected error adding network range: %v", err)
+			}
+			if tc.failUpdate {
+				master.osdnClient.(*osdnfake.Clientset).PrependReactor("update", "hostsubnets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, fmt.Errorf("update failed")
+				})
+			}
+
+			err := master.ReallocateNode("node1", "10.132.0.0/14")
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+
+			updated := getHostSubnet(t, master, "node1")
+			if cn, err := master.subnetAllocator.RangeForSubnet(updated.Subnet); err != nil || cn.ClusterCIDR.String() != tc.expectRange {
+				t.Fatalf("expected subnet in %s, got %s", tc.expectRange, updated.Subnet)
+			}
+			// Exactly one subnet remains allocated: either the new one or the old one
+			if allocated := master.subnetAllocator.Stats().Allocated; allocated != 1 {
+				t.Fatalf("expected 1 allocated subnet, got %d", allocated)
+			}
+			if !tc.expectErr {
+				if err := master.subnetAllocator.MarkAllocatedNetwork("10.128.0.0/23"); err != nil {
+					t.Fatalf("expected old subnet to be released: %v", err)
+				}
+				events := drainEvents(recorder)
+				if len(events) != 1 || !strings.Contains(events[0], "SubnetReallocated") {
+					t.Fatalf("unexpected events %v", events)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateRange(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		newRange string
+		// If set, all of newRange's remaining subnets are taken by someone else when
+		// the first HostSubnet is moved
+		exhaustMidway bool
+
+		expectErr        bool
+		expectMigrated   []string
+		expectRolledBack []string
+		expectSkipped    []string
+		expectRange      string
+	}{
+		{
+			name:           "successful migration",
+			newRange:       "10.132.0.0/14",
+			expectMigrated: []string{"node1", "node2", "node3"},
+			expectRange:    "10.132.0.0/14",
+		},
+		{
+			name:          "not enough room",
+			newRange:      "10.136.0.0/22",
+			expectErr:     true,
+			expectSkipped: []string{"node1", "node2", "node3"},
+			expectRange:   "10.128.0.0/14",
+		},
+		{
+			name:             "room runs out midway",
+			newRange:         "10.132.0.0/14",
+			exhaustMidway:    true,
+			expectErr:        true,
+			expectRolledBack: []string{"node1"},
+			expectSkipped:    []string{"node2", "node3"},
+			expectRange:      "10.128.0.0/14",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subnets := []*osdnv1.HostSubnet{
+				makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+				makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "uid2"),
+				makeHostSubnet("node3", "node3", "192.168.1.3", "10.128.4.0/23", "uid3"),
+			}
+			master, _ := newTestSubnetMaster(t, nil, subnets)
+			if err := master.subnetAllocator.AddNetworkRange("10.132.0.0/14", 9); err != nil {
+				t.Fatalf("unexpected error adding network range: %v", err)
+			}
+			if err := master.subnetAllocator.AddNetworkRange("10.136.0.0/22", 9); err != nil {
+				t.Fatalf("unexpected error adding network range: %v", err)
+			}
+			if tc.exhaustMidway {
+				exhausted := false
+				master.osdnClient.(*osdnfake.Clientset).PrependReactor("update", "hostsubnets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+					for !exhausted {
+						if _, err := master.subnetAllocator.AllocateNetworkFromRange(tc.newRange); err != nil {
+							exhausted = true
+						}
+					}
+					return false, nil, nil
+				})
+			}
+
+			result, err := master.MigrateRange("10.128.0.0/14", tc.newRange)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !reflect.DeepEqual(result.Migrated, tc.expectMigrated) ||
+				!reflect.DeepEqual(result.RolledBack, tc.expectRolledBack) ||
+				!reflect.DeepEqual(result.Skipped, tc.expectSkipped) ||
+				len(result.Failed) != 0 {
+				t.Fatalf("unexpected result %+v", result)
+			}
+
+			for _, hs := range subnets {
+				updated := getHostSubnet(t, master, hs.Name)
+				if cn, err := master.subnetAllocator.RangeForSubnet(updated.Subnet); err != nil || cn.ClusterCIDR.String() != tc.expectRange {
+					t.Fatalf("expected %s to be in %s, got %s", hs.Name, tc.expectRange, updated.Subnet)
+				}
+				if tc.expectRange == "10.128.0.0/14" && updated.Subnet != hs.Subnet {
+					t.Fatalf("expected %s to keep or get back its subnet %s, got %s", hs.Name, hs.Subnet, updated.Subnet)
+				}
+			}
+			for _, rs := range master.subnetAllocator.Stats().Ranges {
+				if rs.Network == "10.128.0.0/14" {
+					expected := uint64(0)
+					if tc.expectRange == rs.Network {
+						expected = 3
+					}
+					if rs.Allocated != expected {
+						t.Fatalf("expected %d subnets allocated in %s, got %d", expected, rs.Network, rs.Allocated)
+					}
+				}
+			}
+		})
+	}
+
+	master, _ := newTestSubnetMaster(t, nil, nil)
+	if _, err := master.MigrateRange("10.128.0.0/14", "10.132.0.0/14"); err == nil {
+		t.Fatalf("expected error migrating to an unknown range")
+	}
+}
+
+func TestAddNodeHostSubnetLengthOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		annotation   string
+		expectSubnet string
+		expectEvent  bool
+	}{
+		{
+			name:         "no override",
+			expectSubnet: "10.128.0.0/23",
+		},
+		{
+			name:         "larger subnet",
+			annotation:   "10",
+			expectSubnet: "10.131.252.0/22",
+		},
+		{
+			name:         "default size",
+			annotation:   "9",
+			expectSubnet: "10.128.0.0/23",
+		},
+		{
+			name:        "smaller than cluster network allows",
+			annotation:  "8",
+			expectEvent: true,
+		},
+		{
+			name:        "larger than cluster network",
+			annotation:  "19",
+			expectEvent: true,
+		},
+		{
+			name:        "invalid",
+			annotation:  "big",
+			expectEvent: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node1", "uid1", "192.168.1.1")
+			if tc.annotation != "" {
+				node.Annotations = map[string]string{hostSubnetLengthAnnotation: tc.annotation}
+			}
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+			err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, "")
+			if (err != nil) != tc.expectEvent {
+				t.Fatalf("unexpected error value %v", err)
+			}
+			found := false
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "InvalidHostSubnetLength") {
+					found = true
+				}
+			}
+			if found != tc.expectEvent {
+				t.Fatalf("expected InvalidHostSubnetLength event %v, got %v", tc.expectEvent, found)
+			}
+			if tc.expectEvent {
+				if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+					t.Fatalf("expected no HostSubnet to be created")
+				}
+				return
+			}
+
+			hs := getHostSubnet(t, master, "node1")
+			if hs.Subnet != tc.expectSubnet {
+				t.Fatalf("expected subnet %s, got %s", tc.expectSubnet, hs.Subnet)
+			}
+			if hs.Annotations[hostSubnetLengthAnnotation] != tc.annotation {
+				t.Fatalf("expected recorded length %q, got %q", tc.annotation, hs.Annotations[hostSubnetLengthAnnotation])
+			}
+			if !master.checkHostSubnetLength(hs) {
+				t.Fatalf("unexpected HostSubnet length mismatch")
+			}
+		})
+	}
+}
+
+func TestStartSubnetMasterHandlerRegistration(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+	if err := master.startSubnetMaster(); err != nil {
+		t.Fatalf("unexpected error starting subnet master: %v", err)
+	}
+	if master.nodeHandlerRegistration == nil || master.hostSubnetHandlerRegistration == nil {
+		t.Fatalf("expected event handler registrations to be retained")
+	}
+	if err := master.Stop(); err != nil {
+		t.Fatalf("unexpected error stopping subnet master: %v", err)
+	}
+	if master.nodeHandlerRegistration != nil || master.hostSubnetHandlerRegistration != nil {
+		t.Fatalf("expected event handler registrations to be removed")
+	}
+
+	// Registering handlers on a stopped informer fails, which fails startup
+	stopCh := make(chan struct{})
+	go master.nodeInformer.Informer().Run(stopCh)
+	close(stopCh)
+	err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return master.nodeInformer.Informer().IsStopped(), nil
+	})
+	if err != nil {
+		t.Fatalf("node informer did not stop")
+	}
+	if err := master.startSubnetMaster(); err == nil || !strings.Contains(err.Error(), "could not watch nodes") {
+		t.Fatalf("expected startup to fail registering node handler, got %v", err)
+	}
+}
+
+func TestSubnetSelfHeal(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fakeClock := testingclock.NewFakeClock(start)
+	master.clock = fakeClock
+	master.subnetSelfHealInterval = time.Minute
+
+	if err := master.startSubnetMaster(); err != nil {
+		t.Fatalf("unexpected error starting subnet master: %v", err)
+	}
+	defer master.Stop()
+	// Wait for the initial pass to finish, after which the loop waits for the clock
+	err := utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return fakeClock.HasWaiters(), nil
+	})
+	if err != nil {
+		t.Fatalf("self-heal loop did not start")
+	}
+	hasSubnet := func() bool {
+		_, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{})
+		return err == nil
+	}
+
+	// Delete the HostSubnet without the master seeing the event; it isn't recreated
+	// until the interval passes
+	if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error deleting HostSubnet: %v", err)
+	}
+	fakeClock.Step(time.Minute - time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if hasSubnet() {
+		t.Fatalf("HostSubnet recreated before the self-heal interval passed")
+	}
+	fakeClock.Step(time.Second)
+	err = utilwait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return hasSubnet(), nil
+	})
+	if err != nil {
+		t.Fatalf("HostSubnet was not recreated")
+	}
+	recreated := getHostSubnet(t, master, "node1")
+	if recreated.HostIP != "192.168.1.1" || common.HostSubnetNodeUID(recreated) != "uid1" {
+		t.Fatalf("unexpected recreated HostSubnet %s", common.HostSubnetToString(recreated))
+	}
+	assigned := false
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "SubnetAssigned") {
+			assigned = true
+		}
+	}
+	if !assigned {
+		t.Fatalf("expected SubnetAssigned event")
+	}
+
+	// Nothing is recreated once the loop is stopped
+	if err := master.Stop(); err != nil {
+		t.Fatalf("unexpected error stopping subnet master: %v", err)
+	}
+	if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error deleting HostSubnet: %v", err)
+	}
+	fakeClock.Step(time.Minute)
+	time.Sleep(100 * time.Millisecond)
+	if hasSubnet() {
+		t.Fatalf("HostSubnet unexpectedly recreated after stopping")
+	}
+}
+
+func TestSubnetsLow(t *testing.T) {
+	var nodes []*corev1.Node
+	for i := 1; i <= 4; i++ {
+		nodes = append(nodes, makeNode(fmt.Sprintf("node%d", i), fmt.Sprintf("uid%d", i), fmt.Sprintf("192.168.1.%d", i)))
+	}
+	master, recorder := newTestSubnetMaster(t, nodes, nil)
+	// The range has 512 subnets
+	master.subnetLowThreshold = 510
+
+	countLowEvents := func() int {
+		count := 0
+		for _, event := range drainEvents(recorder) {
+			if strings.Contains(event, "SubnetsLow") {
+				count++
+			}
+		}
+		return count
+	}
+	addNodes := func(nodes ...*corev1.Node) {
+		for _, node := range nodes {
+			if err := master.addNode(node.Name, string(node.UID), common.GetNodeInternalIP(node), nil, ""); err != nil {
+				t.Fatalf("unexpected error adding node %s: %v", node.Name, err)
+			}
+		}
+	}
+
+	addNodes(nodes[0], nodes[1])
+	if count := countLowEvents(); count != 0 {
+		t.Fatalf("expected no SubnetsLow events above threshold, got %d", count)
+	}
+	addNodes(nodes[2])
+	if count := countLowEvents(); count != 1 {
+		t.Fatalf("expected 1 SubnetsLow event on crossing threshold, got %d", count)
+	}
+	addNodes(nodes[3])
+	if count := countLowEvents(); count != 0 {
+		t.Fatalf("expected no further SubnetsLow events below threshold, got %d", count)
+	}
+
+	// Freeing subnets re-arms the warning
+	for _, node := range nodes[2:] {
+		master.handleDeleteSubnet(getHostSubnet(t, master, node.Name))
+		if err := master.osdnClient.NetworkV1().HostSubnets().Delete(context.TODO(), node.Name, metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("unexpected error deleting HostSubnet: %v", err)
+		}
+	}
+	if count := countLowEvents(); count != 0 {
+		t.Fatalf("expected no SubnetsLow events above threshold, got %d", count)
+	}
+	addNodes(nodes[2])
+	if count := countLowEvents(); count != 1 {
+		t.Fatalf("expected 1 SubnetsLow event on crossing threshold again, got %d", count)
+	}
+
+	// Percentage thresholds work the same way
+	master, recorder = newTestSubnetMaster(t, nodes, nil)
+	master.subnetLowThresholdPercent = 100
+	addNodes(nodes[0], nodes[1])
+	if count := countLowEvents(); count != 1 {
+		t.Fatalf("expected 1 SubnetsLow event with percentage threshold, got %d", count)
+	}
+}
+
+func TestDedupeEgressIPs(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	hs.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.100", "192.168.1.101", "192.168.1.100", " 192.168.1.101"}
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+
+	master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+	updated := getHostSubnet(t, master, "node1")
+	expected := []osdnv1.HostSubnetEgressIP{"192.168.1.100", "192.168.1.101"}
+	if !reflect.DeepEqual(updated.EgressIPs, expected) {
+		t.Fatalf("expected egress IPs %v, got %v", expected, updated.EgressIPs)
+	}
+
+	// The event for the corrected object changes nothing further
+	osdnClient := master.osdnClient.(*osdnfake.Clientset)
+	osdnClient.ClearActions()
+	if deduped, err := master.dedupeEgressIPs(updated); err != nil || deduped {
+		t.Fatalf("expected no change, got deduped=%v, err=%v", deduped, err)
+	}
+	if actions := osdnClient.Actions(); len(actions) != 0 {
+		t.Fatalf("unexpected actions %v", actions)
+	}
+}
+
+func TestEgressIPsOnLocalSubnets(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	hs.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.100", "192.168.2.100"}
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+
+	// Off by default
+	master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "EgressIPNotOnLocalSubnet") {
+			t.Fatalf("unexpected event %q", event)
+		}
+	}
+
+	master.nodeInterfaceNetworks = func(nodeName string) ([]*net.IPNet, error) {
+		if nodeName != "node1" {
+			return nil, fmt.Errorf("unexpected node %q", nodeName)
+		}
+		_, ipNet, _ := net.ParseCIDR("192.168.1.0/24")
+		return []*net.IPNet{ipNet}, nil
+	}
+	master.handleAddOrUpdateSubnet(hs, nil, watch.Added)
+	var warnings []string
+	for _, event := range drainEvents(recorder) {
+		if strings.Contains(event, "EgressIPNotOnLocalSubnet") {
+			warnings = append(warnings, event)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "192.168.2.100") {
+		t.Fatalf("expected one warning about 192.168.2.100, got %v", warnings)
+	}
+}
+
+func TestSetEgressIPs(t *testing.T) {
+	hs1 := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	hs1.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.100"}
+	hs2 := makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "uid2")
+	master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{hs1, hs2})
+
+	for _, tc := range []struct {
+		name      string
+		ips       []string
+		expectErr string
+		expected  []osdnv1.HostSubnetEgressIP
+	}{
+		{
+			name:     "valid",
+			ips:      []string{"192.168.1.101", " 192.168.1.102"},
+			expected: []osdnv1.HostSubnetEgressIP{"192.168.1.101", "192.168.1.102"},
+		},
+		{
+			name:      "assigned to another node",
+			ips:       []string{"192.168.1.103", "192.168.1.100"},
+			expectErr: "already assigned to node node1",
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101", "192.168.1.102"},
+		},
+		{
+			name:      "in cluster network",
+			ips:       []string{"10.129.0.5"},
+			expectErr: "inside cluster network",
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101", "192.168.1.102"},
+		},
+		{
+			name:      "repeated",
+			ips:       []string{"192.168.1.103", "192.168.1.103"},
+			expectErr: "repeated",
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101", "192.168.1.102"},
+		},
+		{
+			name:     "cleared",
+			ips:      []string{},
+			expected: []osdnv1.HostSubnetEgressIP{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := master.SetEgressIPs("node2", tc.ips)
+			if tc.expectErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectErr)) {
+				t.Fatalf("expected error containing %q, got %v", tc.expectErr, err)
+			}
+			hs := getHostSubnet(t, master, "node2")
+			if !reflect.DeepEqual(hs.EgressIPs, tc.expected) {
+				t.Fatalf("expected egress IPs %v, got %v", tc.expected, hs.EgressIPs)
+			}
+		})
+	}
+
+	if err := master.SetEgressIPs("node3", nil); err == nil {
+		t.Fatalf("expected error for node without HostSubnet")
+	}
+}
+
+func TestRejectDuplicateEgressIPs(t *testing.T) {
+	node1 := makeNode("node1", "uid1", "192.168.1.1")
+	node2 := makeNode("node2", "uid2", "192.168.1.2")
+	hs1 := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	hs1.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.100"}
+	hs2 := makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "uid2")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node1, node2}, []*osdnv1.HostSubnet{hs1, hs2})
+
+	for _, tc := range []struct {
+		name      string
+		egressIPs []osdnv1.HostSubnetEgressIP
+		expected  []osdnv1.HostSubnetEgressIP
+	}{
+		{
+			name:      "unique egress IP",
+			egressIPs: []osdnv1.HostSubnetEgressIP{"192.168.1.101"},
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101"},
+		},
+		{
+			name:      "duplicate egress IP",
+			egressIPs: []osdnv1.HostSubnetEgressIP{"192.168.1.101", "192.168.1.100"},
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101"},
+		},
+		{
+			name:      "duplicate egress IP in another form",
+			egressIPs: []osdnv1.HostSubnetEgressIP{"192.168.1.101", "::ffff:192.168.1.100"},
+			expected:  []osdnv1.HostSubnetEgressIP{"192.168.1.101"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			old := getHostSubnet(t, master, "node2")
+			updated := old.DeepCopy()
+			updated.EgressIPs = tc.egressIPs
+			updated, err := master.osdnClient.NetworkV1().HostSubnets().Update(context.TODO(), updated, metav1.UpdateOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error updating HostSubnet: %v", err)
+			}
+			drainEvents(recorder)
+
+			master.handleAddOrUpdateSubnet(updated, old, watch.Modified)
+
+			hs := getHostSubnet(t, master, "node2")
+			if !reflect.DeepEqual(hs.EgressIPs, tc.expected) {
+				t.Fatalf("expected egress IPs %v, got %v", tc.expected, hs.EgressIPs)
+			}
+			conflict := false
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "EgressIPConflict") && strings.Contains(event, "192.168.1.100") {
+					conflict = true
+				}
+			}
+			if conflict != (len(tc.expected) != len(tc.egressIPs)) {
+				t.Fatalf("unexpected EgressIPConflict event state %v", conflict)
+			}
+		})
+	}
+
+	// Duplicates are also rejected from new HostSubnets, but not from HostSubnets
+	// older than the one already holding the IP
+	for _, tc := range []struct {
+		name     string
+		expected []osdnv1.HostSubnetEgressIP
+	}{
+		{
+			name:     "node3",
+			expected: []osdnv1.HostSubnetEgressIP{"192.168.1.103"},
+		},
+		{
+			name:     "node0",
+			expected: []osdnv1.HostSubnetEgressIP{"192.168.1.103", "192.168.1.100"},
+		},
+	} {
+		hs := makeHostSubnet(tc.name, tc.name, "192.168.1.3", "", "")
+		hs.EgressIPs = []osdnv1.HostSubnetEgressIP{"192.168.1.103", "192.168.1.100"}
+		hs.Annotations = map[string]string{osdnv1.AssignHostSubnetAnnotation: "true"}
+		hs, err := master.osdnClient.NetworkV1().HostSubnets().Create(context.TODO(), hs, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error creating HostSubnet: %v", err)
+		}
+		if _, err := master.rejectDuplicateEgressIPs(hs, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		hs = getHostSubnet(t, master, tc.name)
+		if !reflect.DeepEqual(hs.EgressIPs, tc.expected) {
+			t.Fatalf("%s: expected egress IPs %v, got %v", tc.name, tc.expected, hs.EgressIPs)
+		}
+	}
+}
+
+func TestPreDeleteHook(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		hookErr   error
+		expectErr bool
+	}{
+		{
+			name: "hook allows deletion",
+		},
+		{
+			name:      "hook blocks deletion",
+			hookErr:   fmt.Errorf("route cleanup failed"),
+			expectErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, recorder := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{hs})
+			var hooked []string
+			master.preDeleteHook = func(hs *osdnv1.HostSubnet) error {
+				hooked = append(hooked, hs.Subnet)
+				return tc.hookErr
+			}
+
+			err := master.deleteNode("node1")
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !reflect.DeepEqual(hooked, []string{"10.128.0.0/23"}) {
+				t.Fatalf("expected hook to be called once for 10.128.0.0/23, got %v", hooked)
+			}
+			_, getErr := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{})
+			if deleted := getErr != nil; deleted == tc.expectErr {
+				t.Fatalf("expected HostSubnet deleted=%v", !tc.expectErr)
+			}
+			blocked := false
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "HostSubnetDeleteBlocked") {
+					blocked = true
+				}
+			}
+			if blocked != tc.expectErr {
+				t.Fatalf("unexpected HostSubnetDeleteBlocked event state %v", blocked)
+			}
+
+			if tc.expectErr {
+				// Once the hook succeeds, reconciling the orphaned HostSubnet deletes it
+				master.preDeleteHook = func(hs *osdnv1.HostSubnet) error { return nil }
+				if err := master.reconcileHostSubnet(hs); err != nil {
+					t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+				}
+				if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+					t.Fatalf("expected HostSubnet to be deleted on reconcile")
+				}
+			}
+		})
+	}
+}
+
+func TestPreDeleteHookOnAllDeletePaths(t *testing.T) {
+	annotated := makeHostSubnet("external1", "external1", "192.168.1.9", "", "")
+	annotated.Annotations = map[string]string{osdnv1.AssignHostSubnetAnnotation: "true"}
+	for _, tc := range []struct {
+		name   string
+		nodes  []*corev1.Node
+		subnet *osdnv1.HostSubnet
+		delete func(master *OsdnMaster, hs *osdnv1.HostSubnet) error
+	}{
+		{
+			name:   "node UID mismatch",
+			nodes:  []*corev1.Node{makeNode("node1", "uid2", "192.168.1.1")},
+			subnet: makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			delete: func(master *OsdnMaster, hs *osdnv1.HostSubnet) error {
+				return master.reconcileHostSubnet(hs)
+			},
+		},
+		{
+			name:   "subnet assignment",
+			subnet: annotated,
+			delete: func(master *OsdnMaster, hs *osdnv1.HostSubnet) error {
+				return master.handleAssignHostSubnetAnnotation(hs)
+			},
+		},
+		{
+			name:   "invalid subnet",
+			nodes:  []*corev1.Node{makeNode("node1", "uid1", "192.168.1.1")},
+			subnet: makeHostSubnet("node1", "node1-old", "192.168.1.1", "10.128.0.0/23", "uid1"),
+			delete: func(master *OsdnMaster, hs *osdnv1.HostSubnet) error {
+				return master.addNode("node1", "uid1", "192.168.1.1", nil, "")
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			master, _ := newTestSubnetMaster(t, tc.nodes, []*osdnv1.HostSubnet{tc.subnet})
+			hooked := 0
+			master.preDeleteHook = func(hs *osdnv1.HostSubnet) error {
+				hooked++
+				return fmt.Errorf("route cleanup failed")
+			}
+
+			if err := tc.delete(master, tc.subnet); err == nil {
+				t.Fatalf("expected error when the hook blocks deletion")
+			}
+			if hooked != 1 {
+				t.Fatalf("expected hook to be called once, got %d", hooked)
+			}
+			hs := getHostSubnet(t, master, tc.subnet.Name)
+			if hs.Subnet != tc.subnet.Subnet {
+				t.Fatalf("expected HostSubnet to be left alone, got %s", common.HostSubnetToString(hs))
+			}
+		})
+	}
+}
+
+func TestReconcileHostSubnetStaleNodeCache(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		cachedUID     string
+		liveUID       string
+		expectDeleted bool
+	}{
+		{
+			name:          "node recreated, cache stale",
+			cachedUID:     "uid1",
+			liveUID:       "uid2",
+			expectDeleted: false,
+		},
+		{
+			name:          "node recreated, cache current",
+			cachedUID:     "uid3",
+			liveUID:       "uid3",
+			expectDeleted: true,
+		},
+		{
+			name:          "node recreated, then deleted",
+			cachedUID:     "uid1",
+			expectDeleted: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The HostSubnet belongs to the node with UID uid2
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid2")
+			var nodes []*corev1.Node
+			if tc.liveUID != "" {
+				nodes = append(nodes, makeNode("node1", tc.liveUID, "192.168.1.1"))
+			}
+			master, _ := newTestSubnetMaster(t, nodes, []*osdnv1.HostSubnet{hs})
+			if err := master.nodeInformer.Informer().GetIndexer().Add(makeNode("node1", tc.cachedUID, "192.168.1.1")); err != nil {
+				t.Fatalf("unexpected error updating informer: %v", err)
+			}
+
+			if err := master.reconcileHostSubnet(hs); err != nil {
+				t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+			}
+			_, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{})
+			if deleted := err != nil; deleted != tc.expectDeleted {
+				t.Fatalf("expected HostSubnet deleted=%v, got %v", tc.expectDeleted, deleted)
+			}
+		})
+	}
+}
+
+func TestNodeMaintenance(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	node.Annotations = map[string]string{nodeMaintenanceAnnotation: ""}
+	hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{hs})
+	master.handleAddOrUpdateNode(node, nil, watch.Added)
+
+	// Simulate the node disappearing without a Delete event
+	removeNode := func() {
+		if err := master.nodeInformer.Informer().GetIndexer().Delete(node); err != nil {
+			t.Fatalf("unexpected error updating informer: %v", err)
+		}
+		if err := master.kClient.CoreV1().Nodes().Delete(context.TODO(), "node1", metav1.DeleteOptions{}); err != nil {
+			t.Fatalf("unexpected error deleting node: %v", err)
+		}
+	}
+	removeNode()
+	if err := master.reconcileHostSubnet(hs); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	getHostSubnet(t, master, "node1")
+
+	// A late Delete event doesn't remove it either
+	master.handleDeleteNode(node)
+	getHostSubnet(t, master, "node1")
+
+	// Once the node returns without the annotation, normal handling resumes
+	node = makeNode("node1", "uid1", "192.168.1.1")
+	if _, err := master.kClient.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unexpected error creating node: %v", err)
+	}
+	if err := master.nodeInformer.Informer().GetIndexer().Add(node); err != nil {
+		t.Fatalf("unexpected error updating informer: %v", err)
+	}
+	master.handleAddOrUpdateNode(node, nil, watch.Modified)
+	removeNode()
+	if err := master.reconcileHostSubnet(hs); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node1", metav1.GetOptions{}); err == nil {
+		t.Fatalf("expected HostSubnet to be deleted after maintenance ended")
+	}
+}
+
+func TestNodeSubnetAnnotation(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	node.Annotations = map[string]string{"example.com/other": "value"}
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+	master.annotateNodeSubnet = true
+	kClient := master.kClient.(*kfake.Clientset)
+
+	// syncNode returns the live node after copying it to the informer, and the number
+	// of node patches since the last call
+	syncNode := func() (*corev1.Node, int) {
+		t.Helper()
+		live, err := kClient.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error getting node: %v", err)
+		}
+		if err := master.nodeInformer.Informer().GetIndexer().Update(live); err != nil {
+			t.Fatalf("unexpected error updating informer: %v", err)
+		}
+		patches := 0
+		for _, action := range kClient.Actions() {
+			if action.GetVerb() == "patch" && action.GetResource().Resource == "nodes" {
+				patches++
+			}
+		}
+		kClient.ClearActions()
+		return live, patches
+	}
+	checkAnnotation := func(expected string) {
+		t.Helper()
+		live, _ := syncNode()
+		if value, ok := live.Annotations[nodeSubnetAnnotation]; expected == "" && ok {
+			t.Fatalf("expected no %s annotation, got %q", nodeSubnetAnnotation, value)
+		} else if value != expected {
+			t.Fatalf("expected %s annotation %q, got %q", nodeSubnetAnnotation, expected, value)
+		}
+		if live.Annotations["example.com/other"] != "value" {
+			t.Fatalf("other annotations were not preserved: %v", live.Annotations)
+		}
+	}
+
+	// Set on creation
+	master.handleAddOrUpdateNode(node, nil, watch.Added)
+	hs := getHostSubnet(t, master, "node1")
+	checkAnnotation(hs.Subnet)
+
+	// Not rewritten when already correct, even if another writer changes other
+	// annotations
+	live, _ := syncNode()
+	live.Annotations["example.com/another"] = "value"
+	if _, err := kClient.CoreV1().Nodes().Update(context.TODO(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating node: %v", err)
+	}
+	syncNode()
+	if err := master.addNode("node1", "uid1", "192.168.1.1", nil, ""); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	live, patches := syncNode()
+	if patches != 0 {
+		t.Fatalf("expected no node patches, got %d", patches)
+	}
+	if live.Annotations["example.com/another"] != "value" {
+		t.Fatalf("other annotations were not preserved: %v", live.Annotations)
+	}
+
+	// Kept in sync across a change of node IP
+	master.handleAddOrUpdateNode(makeNode("node1", "uid1", "192.168.1.2"), nil, watch.Modified)
+	checkAnnotation(hs.Subnet)
+
+	// Removed with the HostSubnet, and set again when the node gets a new subnet
+	if err := master.hostSubnetInformer.Informer().GetIndexer().Add(getHostSubnet(t, master, "node1")); err != nil {
+		t.Fatalf("unexpected error updating informer: %v", err)
+	}
+	if err := master.deleteNode("node1"); err != nil {
+		t.Fatalf("unexpected error deleting node: %v", err)
+	}
+	checkAnnotation("")
+	if err := master.addNode("node1", "uid1", "192.168.1.2", nil, "10.128.10.0/23"); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	checkAnnotation("10.128.10.0/23")
+
+	// Kept in sync when the node is moved to another range
+	if err := master.subnetAllocator.AddNetworkRange("10.132.0.0/14", 9); err != nil {
+		t.Fatalf("unexpected error adding network range: %v", err)
+	}
+	if err := master.ReallocateNode("node1", "10.132.0.0/14"); err != nil {
+		t.Fatalf("unexpected error reallocating node: %v", err)
+	}
+	hs = getHostSubnet(t, master, "node1")
+	if hs.Subnet == "10.128.10.0/23" {
+		t.Fatalf("expected node to be moved, still has %s", hs.Subnet)
+	}
+	checkAnnotation(hs.Subnet)
+}
+
+func TestCheckHostNetworksOnStart(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		enabled          bool
+		hostNetworks     []string
+		expectedConflict []string
+	}{
+		{
+			name:         "disabled",
+			hostNetworks: []string{"10.128.4.0/24"},
+		},
+		{
+			name:         "no conflict",
+			enabled:      true,
+			hostNetworks: []string{"192.168.1.0/24"},
+		},
+		{
+			name:             "conflicts",
+			enabled:          true,
+			hostNetworks:     []string{"192.168.1.0/24", "10.128.4.0/24", "172.30.0.0/24"},
+			expectedConflict: []string{"10.128.4.0/24", "172.30.0.0/24"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			master, recorder := newTestSubnetMaster(t, nil, nil)
+			master.checkHostNetworksOnStart = tc.enabled
+			master.hostIPNetworks = func() ([]*net.IPNet, error) {
+				var ipNets []*net.IPNet
+				for _, cidr := range tc.hostNetworks {
+					ipNets = append(ipNets, mustParseCIDR(cidr))
+				}
+				return ipNets, nil
+			}
+
+			if err := master.startSubnetMaster(); err != nil {
+				t.Fatalf("unexpected error starting subnet master: %v", err)
+			}
+			defer master.Stop()
+
+			var conflicts []string
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "HostNetworkConflict") {
+					conflicts = append(conflicts, event)
+				}
+			}
+			if len(conflicts) != len(tc.expectedConflict) {
+				t.Fatalf("expected %d HostNetworkConflict events, got %v", len(tc.expectedConflict), conflicts)
+			}
+			for i, network := range tc.expectedConflict {
+				if !strings.Contains(conflicts[i], network) {
+					t.Fatalf("expected conflict with %s, got %q", network, conflicts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseNode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		node     string
+		uncached bool
+		expected []string
+	}{
+		{
+			name:     "single subnet",
+			node:     "node1",
+			expected: []string{"10.128.0.0/23"},
+		},
+		{
+			name:     "multiple subnets",
+			node:     "node2",
+			expected: []string{"10.128.2.0/23", "10.128.4.0/23"},
+		},
+		{
+			name:     "subnet not yet in informer cache",
+			node:     "node1",
+			uncached: true,
+			expected: []string{"10.128.0.0/23"},
+		},
+		{
+			name: "no subnets",
+			node: "node3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subnets := []*osdnv1.HostSubnet{
+				makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1"),
+				makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.2.0/23", "uid2"),
+				makeHostSubnet("node2-extra", "node2", "192.168.1.2", "10.128.4.0/23", " uid2 "),
+				// Same Host, but not owned by node2's UID
+				makeHostSubnet("node2-other", "node2", "192.168.1.2", "10.128.6.0/23", ""),
+			}
+			master, _ := newTestSubnetMaster(t, nil, subnets)
+			if tc.uncached {
+				if err := master.hostSubnetInformer.Informer().GetIndexer().Delete(subnets[0]); err != nil {
+					t.Fatalf("unexpected error removing HostSubnet from informer: %v", err)
+				}
+			}
+			allocated := master.subnetAllocator.Stats().Allocated
+
+			released, err := master.ReleaseNode(tc.node)
+			if err != nil {
+				t.Fatalf("unexpected error releasing node: %v", err)
+			}
+			sort.Strings(released)
+			if !reflect.DeepEqual(released, tc.expected) {
+				t.Fatalf("expected %v to be released, got %v", tc.expected, released)
+			}
+
+			// Nothing is freed until the HostSubnets' deletions are observed
+			if stillAllocated := master.subnetAllocator.Stats().Allocated; stillAllocated != allocated {
+				t.Fatalf("expected %d subnets to remain allocated, got %d", allocated, stillAllocated)
+			}
+			for _, hs := range subnets {
+				_, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), hs.Name, metav1.GetOptions{})
+				if deleted := kerrs.IsNotFound(err); deleted {
+					master.handleDeleteSubnet(hs)
+				} else if err != nil {
+					t.Fatalf("unexpected error getting HostSubnet %s: %v", hs.Name, err)
+				}
+			}
+			if stillAllocated := master.subnetAllocator.Stats().Allocated; stillAllocated != allocated-uint64(len(tc.expected)) {
+				t.Fatalf("expected %d subnets to remain allocated, got %d", allocated-uint64(len(tc.expected)), stillAllocated)
+			}
+			for _, subnet := range tc.expected {
+				if err := master.subnetAllocator.MarkAllocatedNetwork(subnet); err != nil {
+					t.Fatalf("expected %s to be free: %v", subnet, err)
+				}
+			}
+			getHostSubnet(t, master, "node2-other")
+		})
+	}
+}
+
+func TestHostSubnetDeletePropagation(t *testing.T) {
+	foreground := metav1.DeletePropagationForeground
+	orphan := metav1.DeletePropagationOrphan
+	for _, tc := range []struct {
+		name   string
+		policy *metav1.DeletionPropagation
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:   "foreground",
+			policy: &foreground,
+		},
+		{
+			name:   "orphan",
+			policy: &orphan,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, _ := newTestSubnetMaster(t, nil, []*osdnv1.HostSubnet{hs})
+			master.hostSubnetDeletePropagation = tc.policy
+			osdnClient := master.osdnClient.(*osdnfake.Clientset)
+			osdnClient.ClearActions()
+
+			if err := master.deleteNode("node1"); err != nil {
+				t.Fatalf("unexpected error deleting node: %v", err)
+			}
+			var deletes []clienttesting.DeleteActionImpl
+			for _, action := range osdnClient.Actions() {
+				if action.GetVerb() == "delete" && action.GetResource().Resource == "hostsubnets" {
+					deletes = append(deletes, action.(clienttesting.DeleteActionImpl))
+				}
+			}
+			if len(deletes) != 1 {
+				t.Fatalf("expected 1 HostSubnet deletion, got %d", len(deletes))
+			}
+			if policy := deletes[0].GetDeleteOptions().PropagationPolicy; !reflect.DeepEqual(policy, tc.policy) {
+				t.Fatalf("expected propagation policy %v, got %v", tc.policy, policy)
+			}
+		})
+	}
+}
+
+func TestHostSubnetOverlap(t *testing.T) {
+	node1 := makeNode("node1", "uid1", "192.168.1.1")
+	node2 := makeNode("node2", "uid2", "192.168.1.2")
+	hs1 := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+	hs1.CreationTimestamp = metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	hs3 := makeHostSubnet("node3", "node3", "192.168.1.3", "10.128.4.0/23", "")
+	master, recorder := newTestSubnetMaster(t, []*corev1.Node{node1, node2}, []*osdnv1.HostSubnet{hs1, hs3})
+
+	overlapEvents := func() []string {
+		var events []string
+		for _, event := range drainEvents(recorder) {
+			if strings.Contains(event, "HostSubnetOverlap") {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+
+	if err := master.reconcileHostSubnet(hs1); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	if events := overlapEvents(); len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// A HostSubnet created later, with a subnet inside node1's
+	hs2 := makeHostSubnet("node2", "node2", "192.168.1.2", "10.128.1.0/24", "uid2")
+	hs2.CreationTimestamp = metav1.NewTime(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err := master.hostSubnetInformer.Informer().GetIndexer().Add(hs2); err != nil {
+		t.Fatalf("unexpected error adding subnet to informer: %v", err)
+	}
+	master.indexHostSubnet(hs2)
+
+	// Reconciling either one flags the newer one, node2, but only once
+	for i, hs := range []*osdnv1.HostSubnet{hs2, hs1, hs2} {
+		if err := master.reconcileHostSubnet(hs); err != nil {
+			t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+		}
+		events := overlapEvents()
+		if i > 0 {
+			if len(events) != 0 {
+				t.Fatalf("reconciling %s: unexpected repeated events %v", hs.Name, events)
+			}
+		} else if len(events) != 1 || !strings.Contains(events[0], "10.128.1.0/24 overlaps subnet 10.128.0.0/23 of older HostSubnet node1") {
+			t.Fatalf("reconciling %s: expected one overlap event for node2, got %v", hs.Name, events)
+		}
+	}
+
+	// Once node2 is deleted, the overlap is forgotten, and reported again if it recurs
+	master.unindexHostSubnet(hs2)
+	if err := master.reconcileHostSubnet(hs1); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	if events := overlapEvents(); len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	master.indexHostSubnet(hs2)
+	if err := master.reconcileHostSubnet(hs1); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	if events := overlapEvents(); len(events) != 1 {
+		t.Fatalf("expected the overlap to be reported again, got %v", events)
+	}
+
+	// The non-overlapping HostSubnet isn't flagged
+	if err := master.reconcileHostSubnet(hs3); err != nil {
+		t.Fatalf("unexpected error reconciling HostSubnet: %v", err)
+	}
+	if events := overlapEvents(); len(events) != 0 {
+		t.Fatalf("unexpected events %v", events)
+	}
+}
+
+func TestNodeIPInHostSubnet(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		nodeIP      string
+		expectError bool
+	}{
+		{
+			name:   "safe IP",
+			nodeIP: "192.168.1.2",
+		},
+		{
+			name:        "IP inside another node's subnet",
+			nodeIP:      "10.0.0.5",
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// A HostSubnet from an older configuration, outside the cluster network
+			legacy := makeHostSubnet("node1", "node1", "192.168.1.1", "10.0.0.0/23", "uid1")
+			node := makeNode("node2", "uid2", tc.nodeIP)
+			master, recorder := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+			if err := master.hostSubnetInformer.Informer().GetIndexer().Add(legacy); err != nil {
+				t.Fatalf("unexpected error adding subnet to informer: %v", err)
+			}
+
+			err := master.addNode("node2", "uid2", tc.nodeIP, nil, "")
+			if tc.expectError != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectError, err)
+			}
+			_, getErr := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node2", metav1.GetOptions{})
+			if created := getErr == nil; created == tc.expectError {
+				t.Fatalf("expected HostSubnet created=%v, got %v", !tc.expectError, created)
+			}
+			found := false
+			for _, event := range drainEvents(recorder) {
+				if strings.Contains(event, "NodeIPInHostSubnet") && strings.Contains(event, "10.0.0.0/23") {
+					found = true
+				}
+			}
+			if found != tc.expectError {
+				t.Fatalf("expected NodeIPInHostSubnet event %v, got %v", tc.expectError, found)
+			}
+
+			// The conflict is reported once, not on every retry
+			if err := master.addNode("node2", "uid2", tc.nodeIP, nil, ""); tc.expectError != (err != nil) {
+				t.Fatalf("expected error %v on retry, got %v", tc.expectError, err)
+			}
+			if events := drainEvents(recorder); len(events) != 0 {
+				t.Fatalf("unexpected events on retry: %v", events)
+			}
+		})
+	}
+}
+
+func TestSubnetOwnerTracking(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, nil)
+
+	master.handleAddOrUpdateNode(node, nil, watch.Added)
+	hs := getHostSubnet(t, master, "node1")
+	if sn := master.subnetAllocator.GetSubnetForNodeUID("uid1"); sn != hs.Subnet {
+		t.Fatalf("expected subnet %s for uid1, got %q", hs.Subnet, sn)
+	}
+
+	master.handleDeleteSubnet(hs)
+	if sn := master.subnetAllocator.GetSubnetForNodeUID("uid1"); sn != "" {
+		t.Fatalf("expected no subnet for uid1 after release, got %s", sn)
+	}
+}
+
+type fakeExternalIPAM struct {
+	subnet string
+	err    error
+	nodes  []string
+}
+
+func (ipam *fakeExternalIPAM) AllocateForNode(node *corev1.Node) (string, error) {
+	ipam.nodes = append(ipam.nodes, node.Name)
+	return ipam.subnet, ipam.err
+}
+
+func TestExternalIPAM(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		ipam      *fakeExternalIPAM
+		allocated string
+		released  bool
+		wantErr   string
+	}{
+		{
+			name: "allocated",
+			ipam: &fakeExternalIPAM{subnet: "10.128.10.0/23"},
+		},
+		{
+			name:    "IPAM error",
+			ipam:    &fakeExternalIPAM{err: fmt.Errorf("out of addresses")},
+			wantErr: "out of addresses",
+		},
+		{
+			// e.g. by another node's in-progress addNode
+			name:      "already allocated",
+			ipam:      &fakeExternalIPAM{subnet: "10.128.2.0/23"},
+			allocated: "10.128.2.0/23",
+			wantErr:   "already allocated",
+		},
+		{
+			// e.g. node1's subnet was released early, but its HostSubnet is still there
+			name:     "owned by another HostSubnet",
+			ipam:     &fakeExternalIPAM{subnet: "10.128.0.0/23"},
+			released: true,
+			wantErr:  "overlaps HostSubnet",
+		},
+		{
+			name:    "outside cluster network",
+			ipam:    &fakeExternalIPAM{subnet: "10.0.0.0/23"},
+			wantErr: "invalid subnet",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			node := makeNode("node2", "uid2", "192.168.1.2")
+			existing := makeHostSubnet("node1", "node1", "192.168.1.1", "10.128.0.0/23", "uid1")
+			master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{existing})
+			master.externalIPAM = tc.ipam
+			if tc.allocated != "" {
+				if err := master.subnetAllocator.MarkAllocatedNetwork(tc.allocated); err != nil {
+					t.Fatalf("unexpected error marking subnet allocated: %v", err)
+				}
+			}
+			if tc.released {
+				if err := master.subnetAllocator.ReleaseNetwork(existing.Subnet); err != nil {
+					t.Fatalf("unexpected error releasing subnet: %v", err)
+				}
+			}
+			allocated := master.subnetAllocator.Stats().Allocated
+
+			err := master.addNode("node2", "uid2", "192.168.1.2", nil, "")
+			if !reflect.DeepEqual(tc.ipam.nodes, []string{"node2"}) {
+				t.Fatalf("expected external IPAM to be called for node2, got %v", tc.ipam.nodes)
+			}
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+				}
+				if _, err := master.osdnClient.NetworkV1().HostSubnets().Get(context.TODO(), "node2", metav1.GetOptions{}); err == nil {
+					t.Fatalf("unexpected HostSubnet for node2")
+				}
+				if now := master.subnetAllocator.Stats().Allocated; now != allocated {
+					t.Fatalf("expected %d allocated subnets, got %d", allocated, now)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error adding node: %v", err)
+			}
+			hs := getHostSubnet(t, master, "node2")
+			if hs.Subnet != tc.ipam.subnet {
+				t.Fatalf("expected subnet %s, got %s", tc.ipam.subnet, hs.Subnet)
+			}
+			// The local allocator records the subnet
+			if now := master.subnetAllocator.Stats().Allocated; now != allocated+1 {
+				t.Fatalf("expected %d allocated subnets, got %d", allocated+1, now)
+			}
+			if sn := master.subnetAllocator.GetSubnetForNodeUID("uid2"); sn != tc.ipam.subnet {
+				t.Fatalf("expected allocator to record %s for uid2, got %q", tc.ipam.subnet, sn)
+			}
+		})
+	}
+}
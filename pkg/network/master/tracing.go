@@ -0,0 +1,38 @@
+package master
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/openshift/sdn/pkg/network/master"
+
+// subnetKey is the span attribute holding the subnet a span's operation acted on
+const subnetKey = attribute.Key("openshift.sdn.subnet")
+
+func nodeNameAttr(nodeName string) attribute.KeyValue {
+	return semconv.K8SNodeNameKey.String(nodeName)
+}
+
+// startSpan starts a tracing span (as a child of any span in ctx) using
+// master.tracerProvider. If no tracer provider is configured, the span is a no-op.
+func (master *OsdnMaster) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, oteltrace.Span) {
+	tp := master.tracerProvider
+	if tp == nil {
+		tp = oteltrace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName).Start(ctx, name, oteltrace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, if non-nil, and ends it
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
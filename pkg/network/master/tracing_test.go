@@ -0,0 +1,94 @@
+package master
+
+import (
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	osdnfake "github.com/openshift/client-go/network/clientset/versioned/fake"
+)
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	attrs := map[attribute.Key]string{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestSubnetTracing(t *testing.T) {
+	node := makeNode("node1", "uid1", "192.168.1.1")
+	stale := makeHostSubnet("node2", "node2", "192.168.1.2", "10.129.0.0/23", "uid2")
+	master, _ := newTestSubnetMaster(t, []*corev1.Node{node}, []*osdnv1.HostSubnet{stale})
+
+	recorder := tracetest.NewSpanRecorder()
+	master.tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	if err := master.addNode(node.Name, string(node.UID), "192.168.1.1", nil, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := master.reconcileHostSubnet(stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	master.osdnClient.(*osdnfake.Clientset).PrependReactor("delete", "hostsubnets", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("delete failed")
+	})
+	if err := master.deleteNode("node1"); err == nil {
+		t.Fatalf("unexpected success deleting node with failing HostSubnet deletion")
+	}
+
+	hs := getHostSubnet(t, master, "node1")
+	expected := []struct {
+		name  string
+		attrs map[attribute.Key]string
+		err   bool
+	}{
+		{
+			name:  "AllocateNetwork",
+			attrs: map[attribute.Key]string{"k8s.node.name": "node1", subnetKey: hs.Subnet},
+		},
+		{
+			name:  "addNode",
+			attrs: map[attribute.Key]string{"k8s.node.name": "node1", subnetKey: hs.Subnet},
+		},
+		{
+			name:  "reconcileHostSubnet",
+			attrs: map[attribute.Key]string{"k8s.node.name": "node2", subnetKey: "10.129.0.0/23"},
+		},
+		{
+			name:  "deleteNode",
+			attrs: map[attribute.Key]string{"k8s.node.name": "node1"},
+			err:   true,
+		},
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans, got %d", len(expected), len(spans))
+	}
+	for i, span := range spans {
+		if span.Name() != expected[i].name {
+			t.Fatalf("expected span %d to be %q, got %q", i, expected[i].name, span.Name())
+		}
+		attrs := spanAttributes(span)
+		for key, value := range expected[i].attrs {
+			if attrs[key] != value {
+				t.Fatalf("expected span %q to have %s=%q, got %q", span.Name(), key, value, attrs[key])
+			}
+		}
+		if isErr := span.Status().Code == codes.Error; isErr != expected[i].err {
+			t.Fatalf("expected span %q error status %v, got %v", span.Name(), expected[i].err, isErr)
+		}
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Fatalf("expected AllocateNetwork span to be a child of addNode span")
+	}
+}
@@ -1,41 +1,156 @@
 package util
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	osdnv1 "github.com/openshift/api/network/v1"
+	"github.com/openshift/sdn/pkg/network/common"
+	"github.com/openshift/sdn/pkg/network/master/metrics"
 )
 
 var ErrSubnetAllocatorFull = fmt.Errorf("no subnets available.")
 
+// recordLockWait records contended waits for a SubnetAllocator's lock; replaced in tests
+var recordLockWait = metrics.RecordSubnetAllocatorLockWait
+
 type SubnetAllocator struct {
 	sync.Mutex
 
 	ranges []*subnetAllocatorRange
+	// Incremented on every change to the allocator's state
+	generation uint64
+	// Used to time waits for the lock. Set only at construction (see WithClock), since
+	// it is read before taking the lock.
+	clock clock.PassiveClock
+	// If set, the first subnet of every range is never allocated
+	reserveFirstSubnet bool
+	// The UID of the node owning each allocated subnet (as recorded by SetNetworkOwner),
+	// and the reverse
+	owners         map[string]string
+	ownedByNodeUID map[string]string
 }
 
-func NewSubnetAllocator() *SubnetAllocator {
-	return &SubnetAllocator{}
+// SubnetAllocatorOption configures a SubnetAllocator created by NewSubnetAllocator
+type SubnetAllocatorOption func(sna *SubnetAllocator)
+
+// ReserveFirstSubnet makes the allocator reserve the first subnet of every range it is
+// given, for topologies that dedicate it to infrastructure, as though every range were
+// added with an offset of at least 1
+func ReserveFirstSubnet() SubnetAllocatorOption {
+	return func(sna *SubnetAllocator) {
+		sna.reserveFirstSubnet = true
+	}
 }
 
-func (sna *SubnetAllocator) AddNetworkRange(network string, hostBits uint32) error {
+// WithClock makes the allocator use clk rather than the real clock
+func WithClock(clk clock.PassiveClock) SubnetAllocatorOption {
+	return func(sna *SubnetAllocator) {
+		sna.clock = clk
+	}
+}
+
+func NewSubnetAllocator(opts ...SubnetAllocatorOption) *SubnetAllocator {
+	sna := &SubnetAllocator{clock: clock.RealClock{}}
+	for _, opt := range opts {
+		opt(sna)
+	}
+	return sna
+}
+
+// lock acquires sna's mutex, recording metrics about the wait if another goroutine holds
+// it. (The uncontended case doesn't touch the metrics.)
+func (sna *SubnetAllocator) lock() {
+	if sna.TryLock() {
+		return
+	}
+	start := sna.clock.Now()
 	sna.Lock()
+	recordLockWait(sna.clock.Since(start))
+}
+
+func (sna *SubnetAllocator) AddNetworkRange(network string, hostBits uint32) error {
+	return sna.AddNetworkRangeWithOffset(network, hostBits, 0)
+}
+
+// AddNetworkRangeWithOffset adds a range like AddNetworkRange, but never allocates the
+// first offset subnets of the range (in allocation order), so that they can be managed
+// externally. The skipped subnets can still be marked as allocated.
+func (sna *SubnetAllocator) AddNetworkRangeWithOffset(network string, hostBits uint32, offset uint32) error {
+	sna.lock()
 	defer sna.Unlock()
 
 	_, ipnet, err := net.ParseCIDR(network)
 	if err != nil {
 		return err
 	}
+	if err := common.ValidateHostSubnetLength(ipnet, hostBits); err != nil {
+		if !errors.Is(err, common.ErrNonStandardIPv6HostSubnetLength) {
+			return err
+		}
+		klog.Warningf("Network range %s: %v", network, err)
+	}
 	snr, err := newSubnetAllocatorRange(ipnet, hostBits)
 	if err != nil {
 		return err
 	}
+	if sna.reserveFirstSubnet && offset == 0 {
+		offset = 1
+	}
+	if offset >= snr.numSubnets() {
+		return fmt.Errorf("allocation offset %d leaves no subnets to allocate in network range %s", offset, network)
+	}
+	snr.offset = offset
+	snr.next = offset
 	sna.ranges = append(sna.ranges, snr)
+	sna.generation++
 	return nil
 }
 
+// Ranges returns a copy of the ranges sna allocates from
+func (sna *SubnetAllocator) Ranges() []common.ParsedClusterNetworkEntry {
+	sna.lock()
+	defer sna.Unlock()
+
+	ranges := make([]common.ParsedClusterNetworkEntry, 0, len(sna.ranges))
+	for _, snr := range sna.ranges {
+		ranges = append(ranges, snr.entry())
+	}
+	return ranges
+}
+
+// RangeForSubnet returns the range containing subnet's network address, regardless of
+// whether subnet is actually a valid subnet of that range.
+func (sna *SubnetAllocator) RangeForSubnet(subnet string) (*common.ParsedClusterNetworkEntry, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	for _, snr := range sna.ranges {
+		if snr.network.Contains(ipnet.IP) {
+			entry := snr.entry()
+			return &entry, nil
+		}
+	}
+	return nil, fmt.Errorf("network %s does not belong to any known range", subnet)
+}
+
 func (sna *SubnetAllocator) MarkAllocatedNetwork(subnet string) error {
-	sna.Lock()
+	sna.lock()
 	defer sna.Unlock()
 
 	_, ipnet, err := net.ParseCIDR(subnet)
@@ -44,17 +159,224 @@ func (sna *SubnetAllocator) MarkAllocatedNetwork(subnet string) error {
 	}
 	for _, snr := range sna.ranges {
 		if snr.markAllocatedNetwork(ipnet) {
+			sna.generation++
 			return nil
 		}
 	}
 	return fmt.Errorf("network %s does not belong to any known range", subnet)
 }
 
+// ImportResult describes the outcome of ImportAllocatedNetworks
+type ImportResult struct {
+	// Subnets that were marked as allocated
+	Marked []string
+	// Subnets that were already allocated
+	Duplicate []string
+	// Subnets that partially overlap an already-allocated subnet
+	Overlap []string
+	// Subnets that are not in any range
+	OutOfRange []string
+	// Lines that are not valid subnets of their range
+	Invalid []error
+}
+
+// ImportAllocatedNetworks reads a newline-delimited list of subnets (ignoring blank lines
+// and lines starting with "#") and marks them as allocated. Lines that can't be imported
+// are reported in the result rather than as an error; an error is only returned if r
+// can't be read.
+func (sna *SubnetAllocator) ImportAllocatedNetworks(r io.Reader) (*ImportResult, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	result := &ImportResult{}
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ip, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			result.Invalid = append(result.Invalid, fmt.Errorf("line %d: %v", lineNum, err))
+			continue
+		}
+		var snr *subnetAllocatorRange
+		for _, rng := range sna.ranges {
+			if rng.network.Contains(ipnet.IP) {
+				snr = rng
+				break
+			}
+		}
+		if snr == nil {
+			result.OutOfRange = append(result.OutOfRange, line)
+			continue
+		}
+		if err := snr.validateSubnet(ip, ipnet); err != nil {
+			result.Invalid = append(result.Invalid, fmt.Errorf("line %d: network %s is invalid: %v", lineNum, line, err))
+			continue
+		}
+		if snr.allocMap[ipnet.String()] {
+			result.Duplicate = append(result.Duplicate, line)
+			continue
+		}
+		if sna.overlapsAllocated(ipnet) {
+			result.Overlap = append(result.Overlap, line)
+			continue
+		}
+		snr.markAllocatedNetwork(ipnet)
+		sna.generation++
+		result.Marked = append(result.Marked, ipnet.String())
+	}
+	return result, scanner.Err()
+}
+
+// overlapsAllocated returns whether ipnet overlaps any allocated subnet
+func (sna *SubnetAllocator) overlapsAllocated(ipnet *net.IPNet) bool {
+	for _, snr := range sna.ranges {
+		if snr.overlapsAllocated(ipnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeSubnet returns the canonical form of subnet, or an error if subnet is not in
+// any range, or is not a correctly-sized and -aligned subnet of its range.
+func (sna *SubnetAllocator) NormalizeSubnet(subnet string) (string, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	ip, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	for _, snr := range sna.ranges {
+		if snr.network.Contains(ipnet.IP) {
+			if err := snr.validateSubnet(ip, ipnet); err != nil {
+				return "", fmt.Errorf("network %s is invalid: %v", subnet, err)
+			}
+			return ipnet.String(), nil
+		}
+	}
+	return "", fmt.Errorf("network %s does not belong to any known range", subnet)
+}
+
 func (sna *SubnetAllocator) AllocateNetwork() (string, error) {
-	sna.Lock()
+	sna.lock()
 	defer sna.Unlock()
 
+	return sna.countAllocation(allocateNetworkFromRanges(sna.ranges))
+}
+
+// countAllocation increments sna's generation if an allocation succeeded, and passes
+// through its results
+func (sna *SubnetAllocator) countAllocation(subnet string, err error) (string, error) {
+	if err == nil {
+		sna.generation++
+	}
+	return subnet, err
+}
+
+// SetRangePriority sets the priority of the range network. When allocating, ranges are
+// tried in order of decreasing priority, and then in the order they were added. (The
+// default priority is 0.)
+func (sna *SubnetAllocator) SetRangePriority(network string, priority int) error {
+	sna.lock()
+	defer sna.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		return err
+	}
 	for _, snr := range sna.ranges {
+		if snr.network.String() == ipnet.String() {
+			snr.priority = priority
+			sna.generation++
+			return nil
+		}
+	}
+	return fmt.Errorf("network %s is not a known range", network)
+}
+
+// FindReusableSubnet returns the lowest subnet that was allocated and then released, which
+// AllocateNetwork would reuse before allocating a subnet that has never been used. It
+// returns false if there is no such subnet.
+func (sna *SubnetAllocator) FindReusableSubnet() (string, bool) {
+	sna.lock()
+	defer sna.Unlock()
+
+	for _, snr := range rangesByPriority(sna.ranges) {
+		if sn := snr.findReusableSubnet(); sn != nil {
+			return sn.String(), true
+		}
+	}
+	return "", false
+}
+
+// AllocateNetworkFromRange allocates a subnet from the range rangeCIDR only. It returns
+// ErrSubnetAllocatorFull if that range is full.
+func (sna *SubnetAllocator) AllocateNetworkFromRange(rangeCIDR string) (string, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(rangeCIDR)
+	if err != nil {
+		return "", err
+	}
+	for _, snr := range sna.ranges {
+		if snr.network.String() == ipnet.String() {
+			return sna.countAllocation(allocateNetworkFromRanges([]*subnetAllocatorRange{snr}))
+		}
+	}
+	return "", fmt.Errorf("network %s is not a known range", rangeCIDR)
+}
+
+// AllocateNetworkWithLength allocates a subnet with hostBits host bits, which may be more
+// than (but not fewer than) the HostSubnetLength of the range it is allocated from.
+// Ranges that can't hold a subnet of that size are skipped, and an error is returned if
+// no range can. Larger-than-normal subnets are allocated from the end of their range, to
+// keep them away from the subnets that AllocateNetwork allocates.
+func (sna *SubnetAllocator) AllocateNetworkWithLength(hostBits uint32) (string, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	allowed := false
+	for _, snr := range rangesByPriority(sna.ranges) {
+		if hostBits < snr.hostBits || hostBits > snr.hostBits+snr.subnetBits {
+			continue
+		}
+		allowed = true
+		var sn *net.IPNet
+		if hostBits == snr.hostBits {
+			sn = snr.allocateNetwork()
+		} else {
+			sn = snr.allocateWideNetwork(hostBits)
+		}
+		if sn != nil {
+			sna.generation++
+			return sn.String(), nil
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("no network range allows subnets with %d host bits", hostBits)
+	}
+	return "", ErrSubnetAllocatorFull
+}
+
+// rangesByPriority returns a copy of ranges, sorted by decreasing priority
+func rangesByPriority(ranges []*subnetAllocatorRange) []*subnetAllocatorRange {
+	ranges = append([]*subnetAllocatorRange{}, ranges...)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].priority > ranges[j].priority
+	})
+	return ranges
+}
+
+// allocateNetworkFromRanges allocates from the first of ranges with a free subnet, trying
+// higher-priority ranges first
+func allocateNetworkFromRanges(ranges []*subnetAllocatorRange) (string, error) {
+	for _, snr := range rangesByPriority(ranges) {
 		sn := snr.allocateNetwork()
 		if sn != nil {
 			return sn.String(), nil
@@ -63,8 +385,71 @@ func (sna *SubnetAllocator) AllocateNetwork() (string, error) {
 	return "", ErrSubnetAllocatorFull
 }
 
+// SimulateAllocations returns the subnets that count successive calls to AllocateNetwork
+// would return, without actually allocating anything. If the allocator would run out of
+// subnets first, it returns the subnets that could be allocated and exhausted=true.
+func (sna *SubnetAllocator) SimulateAllocations(count int) (subnets []string, exhausted bool) {
+	sna.lock()
+	defer sna.Unlock()
+
+	ranges := make([]*subnetAllocatorRange, 0, len(sna.ranges))
+	for _, snr := range sna.ranges {
+		ranges = append(ranges, snr.clone())
+	}
+	subnets = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		sn, err := allocateNetworkFromRanges(ranges)
+		if err != nil {
+			return subnets, true
+		}
+		subnets = append(subnets, sn)
+	}
+	return subnets, false
+}
+
+// PeekNextSubnets returns the subnets that the next n calls to AllocateNetwork would
+// return (fewer, if the allocator would run out first), without allocating anything.
+func (sna *SubnetAllocator) PeekNextSubnets(n int) []string {
+	subnets, _ := sna.SimulateAllocations(n)
+	return subnets
+}
+
+// AllocateNetworkPreferring allocates preferred if it is available (not allocated, and not
+// inside an allocated wide subnet or the range's reserved subnets), or else any other
+// available subnet. It returns an error without allocating anything if preferred is not
+// a valid subnet of one of sna's ranges.
+func (sna *SubnetAllocator) AllocateNetworkPreferring(preferred string) (string, error) {
+	sna.lock()
+	defer sna.Unlock()
+
+	ip, ipnet, err := net.ParseCIDR(preferred)
+	if err != nil {
+		return "", err
+	}
+	var prefRange *subnetAllocatorRange
+	for _, snr := range sna.ranges {
+		if snr.network.Contains(ipnet.IP) {
+			prefRange = snr
+			break
+		}
+	}
+	if prefRange == nil {
+		return "", fmt.Errorf("network %s does not belong to any known range", preferred)
+	}
+	if err := prefRange.validateSubnet(ip, ipnet); err != nil {
+		return "", fmt.Errorf("network %s is invalid: %v", preferred, err)
+	}
+	if !prefRange.allocMap[ipnet.String()] && !prefRange.coveredByWide(ipnet) && !prefRange.overlapsReserved(ipnet) {
+		prefRange.allocMap[ipnet.String()] = true
+		sna.generation++
+		return ipnet.String(), nil
+	}
+
+	return sna.countAllocation(allocateNetworkFromRanges(sna.ranges))
+}
+
 func (sna *SubnetAllocator) ReleaseNetwork(subnet string) error {
-	sna.Lock()
+	sna.lock()
 	defer sna.Unlock()
 
 	_, ipnet, err := net.ParseCIDR(subnet)
@@ -73,12 +458,479 @@ func (sna *SubnetAllocator) ReleaseNetwork(subnet string) error {
 	}
 	for _, snr := range sna.ranges {
 		if snr.releaseNetwork(ipnet) {
+			sna.generation++
+			sna.clearNetworkOwner(ipnet.String())
 			return nil
 		}
 	}
 	return fmt.Errorf("network %s does not belong to any known range", subnet)
 }
 
+// SetNetworkOwner records that subnet, which must be allocated, belongs to the node with
+// UID nodeUID, replacing any previous owner of subnet and any previous subnet of nodeUID.
+// The record is dropped when subnet is released.
+func (sna *SubnetAllocator) SetNetworkOwner(subnet, nodeUID string) error {
+	sna.lock()
+	defer sna.Unlock()
+
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	key := ipnet.String()
+	allocated := false
+	for _, snr := range sna.ranges {
+		if _, ok := snr.wide[key]; ok || snr.allocMap[key] {
+			allocated = true
+			break
+		}
+	}
+	if !allocated {
+		return fmt.Errorf("network %s is not allocated", subnet)
+	}
+
+	if sna.owners == nil {
+		sna.owners = make(map[string]string)
+		sna.ownedByNodeUID = make(map[string]string)
+	}
+	sna.clearNetworkOwner(key)
+	if old, ok := sna.ownedByNodeUID[nodeUID]; ok {
+		sna.clearNetworkOwner(old)
+	}
+	sna.owners[key] = nodeUID
+	sna.ownedByNodeUID[nodeUID] = key
+	return nil
+}
+
+// clearNetworkOwner forgets the owner of subnet (in canonical form), if any
+func (sna *SubnetAllocator) clearNetworkOwner(subnet string) {
+	if nodeUID, ok := sna.owners[subnet]; ok {
+		delete(sna.owners, subnet)
+		delete(sna.ownedByNodeUID, nodeUID)
+	}
+}
+
+// GetSubnetForNodeUID returns the subnet owned by the node with UID nodeUID (see
+// SetNetworkOwner), or "" if none
+func (sna *SubnetAllocator) GetSubnetForNodeUID(nodeUID string) string {
+	sna.lock()
+	defer sna.Unlock()
+
+	return sna.ownedByNodeUID[nodeUID]
+}
+
+// SubnetAllocatorRangeState is the exported state of one range of a SubnetAllocator (see
+// ExportState)
+type SubnetAllocatorRangeState struct {
+	Network  string `json:"network"`
+	HostBits uint32 `json:"hostBits"`
+	// The number of subnets at the start of the range that are reserved
+	Offset   uint32 `json:"offset,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// The index of the next subnet to try allocating
+	Next uint32 `json:"next"`
+	// Allocated subnets of the normal size, previously-allocated subnets that have
+	// been released, and allocated subnets larger than the normal size, all sorted
+	Allocated []string `json:"allocated,omitempty"`
+	Released  []string `json:"released,omitempty"`
+	Wide      []string `json:"wide,omitempty"`
+}
+
+// SubnetAllocatorState is a serializable snapshot of a SubnetAllocator, which can be
+// loaded into another allocator with ImportState (eg, by a newly-elected leader, to
+// avoid relisting every HostSubnet before it can start allocating)
+type SubnetAllocatorState struct {
+	Ranges []SubnetAllocatorRangeState `json:"ranges"`
+	// The UID of the node owning each allocated subnet (see SetNetworkOwner)
+	Owners     map[string]string `json:"owners,omitempty"`
+	Generation uint64            `json:"generation"`
+}
+
+// ExportState returns a snapshot of sna's state
+func (sna *SubnetAllocator) ExportState() *SubnetAllocatorState {
+	sna.lock()
+	defer sna.Unlock()
+
+	state := &SubnetAllocatorState{
+		Ranges:     make([]SubnetAllocatorRangeState, 0, len(sna.ranges)),
+		Generation: sna.generation,
+	}
+	for _, snr := range sna.ranges {
+		rs := SubnetAllocatorRangeState{
+			Network:  snr.network.String(),
+			HostBits: snr.hostBits,
+			Offset:   snr.offset,
+			Priority: snr.priority,
+			Next:     snr.next,
+		}
+		for subnet, allocated := range snr.allocMap {
+			if allocated {
+				rs.Allocated = append(rs.Allocated, subnet)
+			} else {
+				rs.Released = append(rs.Released, subnet)
+			}
+		}
+		for subnet := range snr.wide {
+			rs.Wide = append(rs.Wide, subnet)
+		}
+		sort.Strings(rs.Allocated)
+		sort.Strings(rs.Released)
+		sort.Strings(rs.Wide)
+		state.Ranges = append(state.Ranges, rs)
+	}
+	if len(sna.owners) > 0 {
+		state.Owners = make(map[string]string, len(sna.owners))
+		for subnet, nodeUID := range sna.owners {
+			state.Owners[subnet] = nodeUID
+		}
+	}
+	return state
+}
+
+// ImportState replaces sna's ranges, allocations, owners, and generation with those in
+// state (as returned by ExportState). If state is invalid, an error is returned and sna is
+// left unchanged.
+func (sna *SubnetAllocator) ImportState(state *SubnetAllocatorState) error {
+	ranges := make([]*subnetAllocatorRange, 0, len(state.Ranges))
+	for _, rs := range state.Ranges {
+		snr, err := rangeFromState(rs)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, snr)
+	}
+
+	owners := make(map[string]string, len(state.Owners))
+	ownedByNodeUID := make(map[string]string, len(state.Owners))
+	for subnet, nodeUID := range state.Owners {
+		allocated := false
+		for _, snr := range ranges {
+			if _, ok := snr.wide[subnet]; ok || snr.allocMap[subnet] {
+				allocated = true
+				break
+			}
+		}
+		if !allocated {
+			return fmt.Errorf("owned network %s is not allocated", subnet)
+		}
+		if other, ok := ownedByNodeUID[nodeUID]; ok {
+			return fmt.Errorf("node UID %s owns both %s and %s", nodeUID, other, subnet)
+		}
+		owners[subnet] = nodeUID
+		ownedByNodeUID[nodeUID] = subnet
+	}
+
+	sna.lock()
+	defer sna.Unlock()
+	sna.ranges = ranges
+	sna.owners = owners
+	sna.ownedByNodeUID = ownedByNodeUID
+	sna.generation = state.Generation
+	return nil
+}
+
+// rangeFromState returns a subnetAllocatorRange with the state in rs
+func rangeFromState(rs SubnetAllocatorRangeState) (*subnetAllocatorRange, error) {
+	_, ipnet, err := net.ParseCIDR(rs.Network)
+	if err != nil {
+		return nil, err
+	}
+	snr, err := newSubnetAllocatorRange(ipnet, rs.HostBits)
+	if err != nil {
+		return nil, fmt.Errorf("network range %s: %v", rs.Network, err)
+	}
+	if rs.Offset >= snr.numSubnets() {
+		return nil, fmt.Errorf("allocation offset %d leaves no subnets to allocate in network range %s", rs.Offset, rs.Network)
+	}
+	snr.offset = rs.Offset
+	snr.priority = rs.Priority
+	snr.next = rs.Next
+
+	parse := func(subnet string) (*net.IPNet, error) {
+		ip, network, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if !snr.network.Contains(network.IP) {
+			return nil, fmt.Errorf("network %s is not in range %s", subnet, rs.Network)
+		}
+		if !ip.Equal(network.IP) {
+			return nil, fmt.Errorf("network %s is not aligned to a subnet boundary", subnet)
+		}
+		return network, nil
+	}
+	for _, subnet := range rs.Allocated {
+		network, err := parse(subnet)
+		if err != nil {
+			return nil, err
+		}
+		snr.allocMap[network.String()] = true
+	}
+	for _, subnet := range rs.Released {
+		network, err := parse(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if snr.allocMap[network.String()] {
+			return nil, fmt.Errorf("network %s is both allocated and released", subnet)
+		}
+		snr.allocMap[network.String()] = false
+	}
+	for _, subnet := range rs.Wide {
+		network, err := parse(subnet)
+		if err != nil {
+			return nil, err
+		}
+		if !snr.isWide(network) {
+			return nil, fmt.Errorf("network %s is not larger than the subnets of range %s", subnet, rs.Network)
+		}
+		snr.wide[network.String()] = network
+	}
+	return snr, nil
+}
+
+// EnumerateRangeSubnets returns the first limit subnets that a network range rangeCIDR
+// with hostSubnetLength host bits yields, in the order that SubnetAllocator allocates them
+// (or all of them, if there are fewer than limit). limit must be positive, since IPv6
+// ranges can yield millions of subnets.
+func EnumerateRangeSubnets(rangeCIDR string, hostSubnetLength uint32, limit int) ([]string, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	_, ipnet, err := net.ParseCIDR(rangeCIDR)
+	if err != nil {
+		return nil, err
+	}
+	if err := common.ValidateHostSubnetLength(ipnet, hostSubnetLength); err != nil && !errors.Is(err, common.ErrNonStandardIPv6HostSubnetLength) {
+		return nil, err
+	}
+	snr, err := newSubnetAllocatorRange(ipnet, hostSubnetLength)
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []string
+	for n := uint32(0); n < snr.numSubnets() && len(subnets) < limit; n++ {
+		if sn := snr.subnetForIndex(n); sn != nil {
+			subnets = append(subnets, sn.String())
+		}
+	}
+	return subnets, nil
+}
+
+// SubnetMismatch describes a HostSubnet whose subnet overlaps, but is not the same as, a
+// subnet allocated in the SubnetAllocator
+type SubnetMismatch struct {
+	HostSubnet string
+	Subnet     string
+	Allocated  string
+}
+
+// UnallocatedHostSubnet describes a HostSubnet whose subnet is in one of the
+// SubnetAllocator's ranges but is not allocated
+type UnallocatedHostSubnet struct {
+	HostSubnet string
+	Subnet     string
+}
+
+// AllocatorDiff describes the differences between a SubnetAllocator's state and the
+// HostSubnets in the API. (HostSubnets outside of the allocator's ranges are ignored.)
+type AllocatorDiff struct {
+	// Subnets that are allocated but not used by any HostSubnet
+	MissingFromAPI []string
+	// HostSubnets whose subnets are not allocated
+	NotAllocated []UnallocatedHostSubnet
+	// HostSubnets whose subnets overlap differently-sized or -aligned allocated subnets
+	Mismatched []SubnetMismatch
+}
+
+// Empty returns whether diff contains no differences
+func (diff *AllocatorDiff) Empty() bool {
+	return len(diff.MissingFromAPI) == 0 && len(diff.NotAllocated) == 0 && len(diff.Mismatched) == 0
+}
+
+// VerifyAgainstHostSubnets compares sna's allocated subnets with subnets and returns the
+// differences
+func (sna *SubnetAllocator) VerifyAgainstHostSubnets(subnets []*osdnv1.HostSubnet) *AllocatorDiff {
+	sna.lock()
+	defer sna.Unlock()
+
+	allocated := map[string]*net.IPNet{}
+	for _, snr := range sna.ranges {
+		for subnet, isAllocated := range snr.allocMap {
+			if _, ipnet, err := net.ParseCIDR(subnet); err == nil && isAllocated {
+				allocated[subnet] = ipnet
+			}
+		}
+		for subnet, ipnet := range snr.wide {
+			allocated[subnet] = ipnet
+		}
+	}
+
+	diff := &AllocatorDiff{}
+	used := map[string]bool{}
+	for _, hs := range subnets {
+		_, ipnet, err := net.ParseCIDR(hs.Subnet)
+		if err != nil || !sna.inRange(ipnet) {
+			continue
+		}
+		if _, ok := allocated[ipnet.String()]; ok {
+			used[ipnet.String()] = true
+			continue
+		}
+		overlapping := false
+		for subnet, other := range allocated {
+			if other.Contains(ipnet.IP) || ipnet.Contains(other.IP) {
+				overlapping = true
+				used[subnet] = true
+				diff.Mismatched = append(diff.Mismatched, SubnetMismatch{HostSubnet: hs.Name, Subnet: hs.Subnet, Allocated: subnet})
+			}
+		}
+		if !overlapping {
+			diff.NotAllocated = append(diff.NotAllocated, UnallocatedHostSubnet{HostSubnet: hs.Name, Subnet: hs.Subnet})
+		}
+	}
+	for subnet := range allocated {
+		if !used[subnet] {
+			diff.MissingFromAPI = append(diff.MissingFromAPI, subnet)
+		}
+	}
+
+	sort.Strings(diff.MissingFromAPI)
+	sort.Slice(diff.NotAllocated, func(i, j int) bool {
+		return diff.NotAllocated[i].HostSubnet < diff.NotAllocated[j].HostSubnet
+	})
+	sort.Slice(diff.Mismatched, func(i, j int) bool {
+		if diff.Mismatched[i].HostSubnet != diff.Mismatched[j].HostSubnet {
+			return diff.Mismatched[i].HostSubnet < diff.Mismatched[j].HostSubnet
+		}
+		return diff.Mismatched[i].Allocated < diff.Mismatched[j].Allocated
+	})
+	return diff
+}
+
+// inRange returns whether ipnet's network address is in one of sna's ranges
+func (sna *SubnetAllocator) inRange(ipnet *net.IPNet) bool {
+	for _, snr := range sna.ranges {
+		if snr.network.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubnetAllocatorRangeStats describes the allocation state of a single range
+type SubnetAllocatorRangeStats struct {
+	Network   string
+	HostBits  uint32
+	Total     uint64
+	Allocated uint64
+	Free      uint64
+}
+
+// SubnetAllocatorStats describes the allocation state of a SubnetAllocator. (For very
+// large ranges, or ranges with an allocation offset, Total only counts the subnets that
+// the allocator will actually use.)
+type SubnetAllocatorStats struct {
+	Ranges    []SubnetAllocatorRangeStats
+	Total     uint64
+	Allocated uint64
+	Free      uint64
+	// Generation is incremented on every change to the allocator's state, so callers
+	// can detect whether the allocator has changed since they last looked at it.
+	Generation uint64
+}
+
+func (sna *SubnetAllocator) Stats() SubnetAllocatorStats {
+	sna.lock()
+	defer sna.Unlock()
+
+	stats := SubnetAllocatorStats{Generation: sna.generation}
+	for _, snr := range sna.ranges {
+		rs := snr.stats()
+		stats.Ranges = append(stats.Ranges, rs)
+		stats.Total += rs.Total
+		stats.Allocated += rs.Allocated
+		stats.Free += rs.Free
+	}
+	return stats
+}
+
+// UtilizationPercent returns the percentage of the range's subnets that are allocated.
+// For very large (e.g. IPv6) ranges this is relative to the capped Total, so it reflects
+// how close the allocator is to running out rather than how much of the address space is
+// in use.
+func (rs SubnetAllocatorRangeStats) UtilizationPercent() float64 {
+	return utilizationPercent(rs.Allocated, rs.Total)
+}
+
+// UtilizationPercent returns the percentage of subnets across all ranges that are
+// allocated. As with SubnetAllocatorRangeStats.UtilizationPercent, very large ranges
+// only contribute their capped Total.
+func (stats SubnetAllocatorStats) UtilizationPercent() float64 {
+	return utilizationPercent(stats.Allocated, stats.Total)
+}
+
+func utilizationPercent(allocated, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	if allocated >= total {
+		return 100
+	}
+	return float64(allocated) * 100 / float64(total)
+}
+
+// AllocationBalance describes how evenly allocated subnets are spread across the ranges
+// of a SubnetAllocator
+type AllocationBalance struct {
+	// The UtilizationPercent of each range, in the order of the stats' Ranges
+	RangeUtilization []float64
+	// The Shannon entropy of the distribution of allocated subnets across ranges,
+	// normalized to between 0 (every allocated subnet is in one range) and 1 (allocated
+	// subnets are spread evenly across all ranges). It is 1 if there are fewer than 2
+	// ranges or nothing is allocated.
+	Entropy float64
+}
+
+// ComputeAllocationBalance returns the AllocationBalance of stats, for deciding whether
+// allocations are skewed enough towards some ranges to warrant a fairness policy
+func ComputeAllocationBalance(stats SubnetAllocatorStats) AllocationBalance {
+	balance := AllocationBalance{
+		RangeUtilization: make([]float64, 0, len(stats.Ranges)),
+		Entropy:          1,
+	}
+	var allocated uint64
+	for _, rs := range stats.Ranges {
+		balance.RangeUtilization = append(balance.RangeUtilization, rs.UtilizationPercent())
+		allocated += rs.Allocated
+	}
+	if len(stats.Ranges) < 2 || allocated == 0 {
+		return balance
+	}
+
+	var entropy float64
+	for _, rs := range stats.Ranges {
+		if rs.Allocated == 0 {
+			continue
+		}
+		p := float64(rs.Allocated) / float64(allocated)
+		entropy -= p * math.Log(p)
+	}
+	balance.Entropy = entropy / math.Log(float64(len(stats.Ranges)))
+	return balance
+}
+
+// CheckNodeHeadroom compares the free subnets in stats to the number of additional nodes
+// the cluster may grow by, and returns an error if the subnet pool would be exhausted
+// before the cluster reaches that size.
+func CheckNodeHeadroom(stats SubnetAllocatorStats, nodeHeadroom uint64) error {
+	if stats.Free < nodeHeadroom {
+		return fmt.Errorf("only %d subnets are free, but the cluster may add up to %d more nodes", stats.Free, nodeHeadroom)
+	}
+	return nil
+}
+
 // subnetAllocatorRange handles allocating subnets out of a single CIDR
 type subnetAllocatorRange struct {
 	network    *net.IPNet
@@ -86,6 +938,13 @@ type subnetAllocatorRange struct {
 	subnetBits uint32
 	next       uint32
 	allocMap   map[string]bool
+	// Allocated subnets that are larger than hostBits (see AllocateNetworkWithLength)
+	wide map[string]*net.IPNet
+
+	// The number of subnets at the start of the range that are never allocated
+	offset uint32
+	// Ranges with higher priority are allocated from first
+	priority int
 
 	// IPv4-only address-alignment hackery; see below
 	leftShift  uint32
@@ -109,6 +968,7 @@ func newSubnetAllocatorRange(network *net.IPNet, hostBits uint32) (*subnetAlloca
 		subnetBits: subnetBits,
 		next:       0,
 		allocMap:   make(map[string]bool),
+		wide:       make(map[string]*net.IPNet),
 	}
 
 	// In the simple case, the subnet part of the 32-bit IP address is just the subnet
@@ -142,65 +1002,264 @@ func newSubnetAllocatorRange(network *net.IPNet, hostBits uint32) (*subnetAlloca
 	return snr, nil
 }
 
+// entry returns a copy of snr's network and host bits
+func (snr *subnetAllocatorRange) entry() common.ParsedClusterNetworkEntry {
+	return common.ParsedClusterNetworkEntry{
+		ClusterCIDR: &net.IPNet{
+			IP:   append(net.IP{}, snr.network.IP...),
+			Mask: append(net.IPMask{}, snr.network.Mask...),
+		},
+		HostSubnetLength: snr.hostBits,
+	}
+}
+
+// clone returns a copy of snr whose allocation state is independent of snr's
+func (snr *subnetAllocatorRange) clone() *subnetAllocatorRange {
+	c := *snr
+	c.allocMap = make(map[string]bool, len(snr.allocMap))
+	for k, v := range snr.allocMap {
+		c.allocMap[k] = v
+	}
+	c.wide = make(map[string]*net.IPNet, len(snr.wide))
+	for k, v := range snr.wide {
+		c.wide[k] = v
+	}
+	return &c
+}
+
 // markAllocatedNetwork marks network as being in use, if it is part of snr's range.
 // It returns whether the network was in snr's range.
 func (snr *subnetAllocatorRange) markAllocatedNetwork(network *net.IPNet) bool {
-	str := network.String()
-	if snr.network.Contains(network.IP) {
-		snr.allocMap[str] = true
+	if !snr.network.Contains(network.IP) {
+		return false
+	}
+	if snr.isWide(network) {
+		snr.wide[network.String()] = network
+	} else {
+		snr.allocMap[network.String()] = true
 	}
-	return snr.allocMap[str]
+	return true
 }
 
-// allocateNetwork returns a new subnet, or nil if the range is full
-func (snr *subnetAllocatorRange) allocateNetwork() *net.IPNet {
-	netMaskSize, addrLen := snr.network.Mask.Size()
-	numSubnets := uint32(1) << snr.subnetBits
+// isWide returns whether network is larger than snr's subnets
+func (snr *subnetAllocatorRange) isWide(network *net.IPNet) bool {
+	ones, addrLen := network.Mask.Size()
+	return ones < addrLen-int(snr.hostBits)
+}
+
+// overlapsAllocated returns whether ipnet overlaps any subnet allocated from snr
+func (snr *subnetAllocatorRange) overlapsAllocated(ipnet *net.IPNet) bool {
+	for subnet, allocated := range snr.allocMap {
+		if !allocated {
+			continue
+		}
+		_, other, err := net.ParseCIDR(subnet)
+		if err == nil && (other.Contains(ipnet.IP) || ipnet.Contains(other.IP)) {
+			return true
+		}
+	}
+	for _, other := range snr.wide {
+		if other.Contains(ipnet.IP) || ipnet.Contains(other.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSubnet checks that network (parsed from a CIDR string whose address was ip) has
+// the prefix length of snr's subnets, and that ip is the network address.
+func (snr *subnetAllocatorRange) validateSubnet(ip net.IP, network *net.IPNet) error {
+	ones, addrLen := network.Mask.Size()
+	if expected := addrLen - int(snr.hostBits); ones != expected {
+		return fmt.Errorf("prefix length %d does not match the /%d subnets of range %s", ones, expected, snr.network.String())
+	}
+	if !ip.Equal(network.IP) {
+		return fmt.Errorf("address %s is not aligned to a subnet boundary", ip.String())
+	}
+	return nil
+}
+
+// numSubnets returns the number of subnets in snr that the allocator will use
+func (snr *subnetAllocatorRange) numSubnets() uint32 {
 	if snr.subnetBits > 24 {
-		// We need to make sure that the uint32 math below won't overflow. If
-		// snr.subnetBits > 32 then numSubnets has already overflowed, but also if
-		// numSubnets is between 1<<24 and 1<<32 then "base << (snr.hostBits % 8)"
-		// below could overflow if snr.hostBits%8 is non-0. So we cap numSubnets
-		// at 1<<24. "16M subnets ought to be enough for anybody."
-		numSubnets = 1 << 24
+		// We need to make sure that the uint32 math in allocateNetwork won't
+		// overflow. If snr.subnetBits > 32 then 1<<subnetBits would overflow, but
+		// also if numSubnets is between 1<<24 and 1<<32 then "base <<
+		// (snr.hostBits % 8)" could overflow if snr.hostBits%8 is non-0. So we cap
+		// numSubnets at 1<<24. "16M subnets ought to be enough for anybody."
+		return 1 << 24
 	}
+	return uint32(1) << snr.subnetBits
+}
 
-	var i uint32
-	for i = 0; i < numSubnets; i++ {
-		n := (i + snr.next) % numSubnets
-		base := n
-		if snr.leftShift != 0 {
-			base = ((base << snr.leftShift) & snr.leftMask) | ((base >> snr.rightShift) & snr.rightMask)
-		} else if addrLen == 128 && snr.subnetBits >= 16 {
-			// Skip the 0 subnet (and other subnets with all 0s in the low word)
-			// since the extra 0 word will get compressed out and make the address
-			// look different from addresses on other subnets.
-			if (base & 0xFFFF) == 0 {
-				continue
-			}
+func (snr *subnetAllocatorRange) stats() SubnetAllocatorRangeStats {
+	rs := SubnetAllocatorRangeStats{
+		Network:  snr.network.String(),
+		HostBits: snr.hostBits,
+		Total:    uint64(snr.numSubnets() - snr.offset),
+	}
+	for _, allocated := range snr.allocMap {
+		if allocated {
+			rs.Allocated++
 		}
-
-		genIP := append([]byte{}, []byte(snr.network.IP)...)
-		subnetBits := base << (snr.hostBits % 8)
-		b := (uint32(addrLen) - snr.hostBits - 1) / 8
-		for subnetBits != 0 {
-			genIP[b] |= byte(subnetBits)
-			subnetBits >>= 8
-			b--
+	}
+	for _, network := range snr.wide {
+		// Count the normal-sized subnets that network covers
+		ones, addrLen := network.Mask.Size()
+		extraBits := addrLen - int(snr.hostBits) - ones
+		if extraBits > 24 {
+			extraBits = 24
 		}
+		rs.Allocated += uint64(1) << extraBits
+	}
+	if rs.Allocated < rs.Total {
+		rs.Free = rs.Total - rs.Allocated
+	}
+	return rs
+}
+
+// allocateNetwork returns a new subnet, or nil if the range is full. Previously-released
+// subnets are reused (lowest first) before any new subnets are allocated, to keep the
+// allocated subnets compact.
+func (snr *subnetAllocatorRange) allocateNetwork() *net.IPNet {
+	if sn := snr.findReusableSubnet(); sn != nil {
+		snr.allocMap[sn.String()] = true
+		return sn
+	}
+
+	numSubnets := snr.numSubnets()
+	usableSubnets := numSubnets - snr.offset
+	if snr.next < snr.offset {
+		snr.next = snr.offset
+	}
 
-		genSubnet := &net.IPNet{IP: genIP, Mask: net.CIDRMask(int(snr.subnetBits)+netMaskSize, addrLen)}
-		if !snr.allocMap[genSubnet.String()] {
-			snr.allocMap[genSubnet.String()] = true
+	var i uint32
+	for i = 0; i < usableSubnets; i++ {
+		n := snr.offset + (i+snr.next-snr.offset)%usableSubnets
+		if genSubnet := snr.allocateIndex(n); genSubnet != nil {
 			snr.next = n + 1
 			return genSubnet
 		}
 	}
 
-	snr.next = 0
+	snr.next = snr.offset
+	return nil
+}
+
+// allocateIndex allocates and returns the nth subnet of snr in allocation order, or
+// returns nil if it is not available
+func (snr *subnetAllocatorRange) allocateIndex(n uint32) *net.IPNet {
+	genSubnet := snr.subnetForIndex(n)
+	if genSubnet == nil || snr.coveredByWide(genSubnet) || snr.allocMap[genSubnet.String()] {
+		return nil
+	}
+	snr.allocMap[genSubnet.String()] = true
+	return genSubnet
+}
+
+// findReusableSubnet returns the lowest subnet of snr that was allocated and then
+// released, and which can be allocated again, or nil if there is none
+func (snr *subnetAllocatorRange) findReusableSubnet() *net.IPNet {
+	var lowest *net.IPNet
+	for subnet, allocated := range snr.allocMap {
+		if allocated {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+		if ones, addrLen := ipnet.Mask.Size(); ones != addrLen-int(snr.hostBits) {
+			continue
+		}
+		if snr.coveredByWide(ipnet) || snr.overlapsReserved(ipnet) {
+			continue
+		}
+		if lowest == nil || bytes.Compare(ipnet.IP, lowest.IP) < 0 {
+			lowest = ipnet
+		}
+	}
+	return lowest
+}
+
+// subnetForIndex returns the nth subnet of snr in allocation order, or nil if that
+// subnet is never allocated
+func (snr *subnetAllocatorRange) subnetForIndex(n uint32) *net.IPNet {
+	netMaskSize, addrLen := snr.network.Mask.Size()
+	base := n
+	if snr.leftShift != 0 {
+		base = ((base << snr.leftShift) & snr.leftMask) | ((base >> snr.rightShift) & snr.rightMask)
+	} else if addrLen == 128 && snr.subnetBits >= 16 {
+		// Skip the 0 subnet (and other subnets with all 0s in the low word)
+		// since the extra 0 word will get compressed out and make the address
+		// look different from addresses on other subnets.
+		if (base & 0xFFFF) == 0 {
+			return nil
+		}
+	}
+
+	genIP := append([]byte{}, []byte(snr.network.IP)...)
+	subnetBits := base << (snr.hostBits % 8)
+	b := (uint32(addrLen) - snr.hostBits - 1) / 8
+	for subnetBits != 0 {
+		genIP[b] |= byte(subnetBits)
+		subnetBits >>= 8
+		b--
+	}
+
+	return &net.IPNet{IP: genIP, Mask: net.CIDRMask(int(snr.subnetBits)+netMaskSize, addrLen)}
+}
+
+// coveredByWide returns whether network is inside a wide subnet allocated from snr
+func (snr *subnetAllocatorRange) coveredByWide(network *net.IPNet) bool {
+	for _, wide := range snr.wide {
+		if wide.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateWideNetwork returns a new subnet with hostBits host bits (which must be more
+// than snr.hostBits), or nil if there is no free space for one. Subnets are allocated
+// from the end of the range, and never include subnets reserved by snr.offset.
+func (snr *subnetAllocatorRange) allocateWideNetwork(hostBits uint32) *net.IPNet {
+	_, addrLen := snr.network.Mask.Size()
+	blockBits := snr.hostBits + snr.subnetBits - hostBits
+	if blockBits > 24 {
+		// As in numSubnets
+		blockBits = 24
+	}
+
+	for i := uint32(1) << blockBits; i > 0; i-- {
+		genIP := append([]byte{}, []byte(snr.network.IP)...)
+		for bit := uint32(0); (i-1)>>bit != 0; bit++ {
+			if ((i-1)>>bit)&1 != 0 {
+				pos := hostBits + bit
+				genIP[uint32(addrLen)/8-1-pos/8] |= 1 << (pos % 8)
+			}
+		}
+		genSubnet := &net.IPNet{IP: genIP, Mask: net.CIDRMask(addrLen-int(hostBits), addrLen)}
+		if snr.overlapsAllocated(genSubnet) || snr.overlapsReserved(genSubnet) {
+			continue
+		}
+		snr.wide[genSubnet.String()] = genSubnet
+		return genSubnet
+	}
 	return nil
 }
 
+// overlapsReserved returns whether network contains any of the subnets reserved by
+// snr.offset
+func (snr *subnetAllocatorRange) overlapsReserved(network *net.IPNet) bool {
+	for n := uint32(0); n < snr.offset; n++ {
+		if sn := snr.subnetForIndex(n); sn != nil && network.Contains(sn.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 // releaseNetwork marks network as being not in use, if it is part of snr's range.
 // It returns whether the network was in snr's range.
 func (snr *subnetAllocatorRange) releaseNetwork(network *net.IPNet) bool {
@@ -208,6 +1267,10 @@ func (snr *subnetAllocatorRange) releaseNetwork(network *net.IPNet) bool {
 		return false
 	}
 
-	snr.allocMap[network.String()] = false
+	if _, ok := snr.wide[network.String()]; ok {
+		delete(snr.wide, network.String())
+	} else {
+		snr.allocMap[network.String()] = false
+	}
 	return true
 }
@@ -1,9 +1,20 @@
 package util
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testingclock "k8s.io/utils/clock/testing"
+
+	osdnv1 "github.com/openshift/api/network/v1"
 )
 
 func newSubnetAllocator(clusterCIDR string, hostBits uint32) (*SubnetAllocator, error) {
@@ -404,3 +415,1206 @@ func TestMultipleSubnets(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNormalizeSubnet(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	err = sna.AddNetworkRange("fd01::/48", 64)
+	if err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+
+	tests := []struct {
+		subnet   string
+		expected string
+		err      string
+	}{
+		{subnet: "10.1.2.0/24", expected: "10.1.2.0/24"},
+		{subnet: "fd01:0:0:0001:0::/64", expected: "fd01:0:0:1::/64"},
+		{subnet: "10.1.2.5/24", err: "not aligned"},
+		{subnet: "10.1.2.0/23", err: "prefix length 23"},
+		{subnet: "fd01:0:0:1::/60", err: "prefix length 60"},
+		{subnet: "10.2.0.0/24", err: "does not belong to any known range"},
+		{subnet: "bob", err: "invalid CIDR"},
+	}
+	for _, test := range tests {
+		sn, err := sna.NormalizeSubnet(test.subnet)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%s: expected error matching %q, got %q / %v", test.subnet, test.err, sn, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.subnet, err)
+		} else if sn != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.subnet, test.expected, sn)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 14)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	err = sna.AddNetworkRange("fd01::/48", 64)
+	if err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := sna.AllocateNetwork(); err != nil {
+			t.Fatal("Failed to allocate network: ", err)
+		}
+	}
+	if err := sna.ReleaseNetwork("10.1.64.0/18"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+
+	stats := sna.Stats()
+	expected := SubnetAllocatorStats{
+		Ranges: []SubnetAllocatorRangeStats{
+			{Network: "10.1.0.0/16", HostBits: 14, Total: 4, Allocated: 2, Free: 2},
+			{Network: "fd01::/48", HostBits: 64, Total: 65536, Allocated: 0, Free: 65536},
+		},
+		Total:      65540,
+		Allocated:  2,
+		Free:       65538,
+		Generation: 6,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, stats)
+	}
+}
+
+func TestComputeAllocationBalance(t *testing.T) {
+	rangeStats := func(allocated ...uint64) SubnetAllocatorStats {
+		var stats SubnetAllocatorStats
+		for i, a := range allocated {
+			stats.Ranges = append(stats.Ranges, SubnetAllocatorRangeStats{
+				Network:   fmt.Sprintf("10.%d.0.0/16", i),
+				HostBits:  8,
+				Total:     256,
+				Allocated: a,
+				Free:      256 - a,
+			})
+		}
+		return stats
+	}
+
+	balanced := ComputeAllocationBalance(rangeStats(64, 64, 64, 64))
+	if !reflect.DeepEqual(balanced.RangeUtilization, []float64{25, 25, 25, 25}) {
+		t.Fatalf("unexpected utilization %v", balanced.RangeUtilization)
+	}
+	if math.Abs(balanced.Entropy-1) > 1e-9 {
+		t.Fatalf("expected entropy 1 for balanced allocation, got %v", balanced.Entropy)
+	}
+
+	skewed := ComputeAllocationBalance(rangeStats(250, 4, 1, 1))
+	if !reflect.DeepEqual(skewed.RangeUtilization, []float64{250 * 100.0 / 256, 4 * 100.0 / 256, 100.0 / 256, 100.0 / 256}) {
+		t.Fatalf("unexpected utilization %v", skewed.RangeUtilization)
+	}
+	if skewed.Entropy >= balanced.Entropy || skewed.Entropy > 0.2 {
+		t.Fatalf("expected low entropy for skewed allocation, got %v", skewed.Entropy)
+	}
+
+	if entropy := ComputeAllocationBalance(rangeStats(10, 0)).Entropy; entropy != 0 {
+		t.Fatalf("expected entropy 0 with everything in one range, got %v", entropy)
+	}
+	for _, stats := range []SubnetAllocatorStats{rangeStats(), rangeStats(10), rangeStats(0, 0)} {
+		if entropy := ComputeAllocationBalance(stats).Entropy; entropy != 1 {
+			t.Fatalf("expected entropy 1 for %v, got %v", stats, entropy)
+		}
+	}
+}
+
+func TestUtilizationPercent(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 14)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	err = sna.AddNetworkRange("fd01::/32", 64)
+	if err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+
+	checkUtilization := func(expectedV4, expectedV6, expectedOverall float64) {
+		t.Helper()
+		stats := sna.Stats()
+		if pct := stats.Ranges[0].UtilizationPercent(); pct != expectedV4 {
+			t.Fatalf("expected IPv4 utilization %v, got %v", expectedV4, pct)
+		}
+		if pct := stats.Ranges[1].UtilizationPercent(); pct != expectedV6 {
+			t.Fatalf("expected IPv6 utilization %v, got %v", expectedV6, pct)
+		}
+		if pct := stats.UtilizationPercent(); pct != expectedOverall {
+			t.Fatalf("expected overall utilization %v, got %v", expectedOverall, pct)
+		}
+	}
+
+	// The IPv6 range has 2^32 subnets, but only 2^24 are counted
+	checkUtilization(0, 0, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := sna.AllocateNetwork(); err != nil {
+			t.Fatal("Failed to allocate network: ", err)
+		}
+	}
+	checkUtilization(75, 0, float64(3)*100/float64(4+1<<24))
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	checkUtilization(100, float64(100)/float64(1<<24), float64(5)*100/float64(4+1<<24))
+	if err := sna.ReleaseNetwork("10.1.64.0/18"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	checkUtilization(75, float64(100)/float64(1<<24), float64(4)*100/float64(4+1<<24))
+
+	if pct := (SubnetAllocatorStats{}).UtilizationPercent(); pct != 0 {
+		t.Fatalf("expected no utilization with no ranges, got %v", pct)
+	}
+}
+
+func TestAllocateNetworkPreferring(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	sn, err := sna.AllocateNetworkPreferring("10.1.5.0/24")
+	if err != nil || sn != "10.1.5.0/24" {
+		t.Fatalf("expected to allocate preferred network, got %q / %v", sn, err)
+	}
+	sn, err = sna.AllocateNetworkPreferring("10.1.5.0/24")
+	if err != nil || sn != "10.1.0.0/24" {
+		t.Fatalf("expected to fall back to 10.1.0.0/24, got %q / %v", sn, err)
+	}
+	for _, invalid := range []string{"10.1.5.1/24", "10.1.6.0/23", "10.2.0.0/24"} {
+		if sn, err = sna.AllocateNetworkPreferring(invalid); err == nil {
+			t.Fatalf("unexpectedly allocated %q for invalid network %s", sn, invalid)
+		}
+	}
+	if err := allocateExpected(sna, -1, "10.1.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A subnet inside an allocated wide subnet is not available
+	wide, err := sna.AllocateNetworkWithLength(10)
+	if err != nil || wide != "10.1.252.0/22" {
+		t.Fatalf("expected to allocate 10.1.252.0/22, got %q / %v", wide, err)
+	}
+	sn, err = sna.AllocateNetworkPreferring("10.1.253.0/24")
+	if err != nil || sn != "10.1.2.0/24" {
+		t.Fatalf("expected to fall back to 10.1.2.0/24, got %q / %v", sn, err)
+	}
+
+	// Nor is a reserved subnet
+	sna = NewSubnetAllocator()
+	if err := sna.AddNetworkRangeWithOffset("10.1.0.0/16", 8, 2); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	sn, err = sna.AllocateNetworkPreferring("10.1.1.0/24")
+	if err != nil || sn != "10.1.2.0/24" {
+		t.Fatalf("expected to fall back to 10.1.2.0/24, got %q / %v", sn, err)
+	}
+}
+
+func TestAddNetworkRangeHostSubnetLength(t *testing.T) {
+	if _, err := newSubnetAllocator("10.1.0.0/16", 1); err == nil {
+		t.Fatal("Unexpectedly succeeded in initializing subnet allocator with 1 host bit")
+	}
+	// Non-/64 IPv6 subnets are unusual but allowed
+	if _, err := newSubnetAllocator("fd01::/48", 68); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+}
+
+func TestCheckNodeHeadroom(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 14)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	stats := sna.Stats()
+
+	// node-limited: 3 free subnets is enough for 2 more nodes
+	if err := CheckNodeHeadroom(stats, 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CheckNodeHeadroom(stats, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// pool-limited: 3 free subnets is not enough for 5 more nodes
+	if err := CheckNodeHeadroom(stats, 5); err == nil || !strings.Contains(err.Error(), "only 3 subnets are free") {
+		t.Fatalf("expected pool exhaustion error, got %v", err)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	err = sna.AddNetworkRange("fd01::/48", 64)
+	if err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+
+	ranges := sna.Ranges()
+	if len(ranges) != 2 ||
+		ranges[0].ClusterCIDR.String() != "10.1.0.0/16" || ranges[0].HostSubnetLength != 8 ||
+		ranges[1].ClusterCIDR.String() != "fd01::/48" || ranges[1].HostSubnetLength != 64 {
+		t.Fatalf("unexpected ranges %v", ranges)
+	}
+
+	// Modifying the returned ranges must not affect the allocator
+	ranges[0].ClusterCIDR.IP[1] = 2
+	if err := allocateExpected(sna, -1, "10.1.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateSubnetWithOffset(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRangeWithOffset("10.1.0.0/16", 8, 256); err == nil {
+		t.Fatal("Unexpectedly succeeded in adding range with offset covering the whole range")
+	}
+	if err := sna.AddNetworkRangeWithOffset("10.1.0.0/16", 8, 4); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	// Subnets below the offset can still be marked as allocated
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to mark network below offset allocated: ", err)
+	}
+
+	for n := 4; n < 256; n++ {
+		if err := allocateExpected(sna, n, fmt.Sprintf("10.1.%d.0/24", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, 256); err != nil {
+		t.Fatal(err)
+	}
+
+	// Released subnets get reused, but allocation never wraps below the offset
+	if err := sna.ReleaseNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := sna.ReleaseNetwork("10.1.10.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := allocateExpected(sna, -1, "10.1.10.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocateNotExpected(sna, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if total := sna.Stats().Total; total != 252 {
+		t.Fatalf("expected 252 usable subnets, got %d", total)
+	}
+}
+
+func TestReserveFirstSubnet(t *testing.T) {
+	sna := NewSubnetAllocator(ReserveFirstSubnet())
+	if err := sna.AddNetworkRange("10.1.0.0/22", 8); err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/22", 8); err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+	// A larger explicit offset is kept
+	if err := sna.AddNetworkRangeWithOffset("10.3.0.0/22", 8, 2); err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+
+	for n, expected := range []string{
+		"10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24",
+		"10.2.1.0/24", "10.2.2.0/24", "10.2.3.0/24",
+		"10.3.2.0/24", "10.3.3.0/24",
+	} {
+		if err := allocateExpected(sna, n, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reserved subnet can still be marked allocated, and is still never allocated
+	// after being released
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to mark reserved network allocated: ", err)
+	}
+	if err := sna.ReleaseNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := allocateNotExpected(sna, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranges with a single subnet can't be added, since it would be reserved
+	if err := sna.AddNetworkRange("10.4.0.0/24", 8); err == nil {
+		t.Fatal("Unexpectedly succeeded in adding range with only a reserved subnet")
+	}
+}
+
+func TestSimulateAllocations(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRange("10.1.0.0/22", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/23", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.1.0/24"); err != nil {
+		t.Fatal("Failed to mark network allocated: ", err)
+	}
+	before := sna.Stats()
+
+	subnets, exhausted := sna.SimulateAllocations(3)
+	if exhausted {
+		t.Fatal("Unexpected exhaustion simulating 3 allocations")
+	}
+	if !reflect.DeepEqual(subnets, []string{"10.1.0.0/24", "10.1.2.0/24", "10.1.3.0/24"}) {
+		t.Fatalf("Unexpected simulated subnets %v", subnets)
+	}
+
+	subnets, exhausted = sna.SimulateAllocations(10)
+	if !exhausted {
+		t.Fatal("Expected exhaustion simulating 10 allocations")
+	}
+	if len(subnets) != 5 {
+		t.Fatalf("Expected 5 simulated subnets before exhaustion, got %v", subnets)
+	}
+
+	// The real allocator is untouched...
+	if after := sna.Stats(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("Simulation changed allocator state: before %+v, after %+v", before, after)
+	}
+	// ...and allocates what the simulation predicted
+	for i, expected := range subnets {
+		if err := allocateExpected(sna, i, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, len(subnets)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeekNextSubnets(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRange("10.1.0.0/22", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/23", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.SetRangePriority("10.2.0.0/23", 1); err != nil {
+		t.Fatal("Failed to set range priority: ", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sna.AllocateNetwork(); err != nil {
+			t.Fatal("Failed to allocate network: ", err)
+		}
+	}
+	// Released subnets are reused first
+	if err := sna.ReleaseNetwork("10.2.0.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+
+	if peeked := sna.PeekNextSubnets(0); len(peeked) != 0 {
+		t.Fatalf("Expected no subnets, got %v", peeked)
+	}
+	peeked := sna.PeekNextSubnets(3)
+	if !reflect.DeepEqual(peeked, []string{"10.2.0.0/24", "10.1.1.0/24", "10.1.2.0/24"}) {
+		t.Fatalf("Unexpected peeked subnets %v", peeked)
+	}
+	// Peeking again gives the same answer
+	if again := sna.PeekNextSubnets(3); !reflect.DeepEqual(again, peeked) {
+		t.Fatalf("Peeking again gave %v, expected %v", again, peeked)
+	}
+	// Peeking past exhaustion returns only what can be allocated
+	all := sna.PeekNextSubnets(10)
+	if len(all) != 4 || !reflect.DeepEqual(all[:3], peeked) {
+		t.Fatalf("Unexpected peeked subnets %v", all)
+	}
+	for i, expected := range all {
+		if err := allocateExpected(sna, i, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, len(all)); err != nil {
+		t.Fatal(err)
+	}
+	if peeked := sna.PeekNextSubnets(1); len(peeked) != 0 {
+		t.Fatalf("Expected no subnets from a full allocator, got %v", peeked)
+	}
+}
+
+func TestNetworkOwners(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid1"); sn != "" {
+		t.Fatalf("Expected no subnet for unknown node, got %s", sn)
+	}
+
+	sn1, err := sna.AllocateNetwork()
+	if err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	sn2, err := sna.AllocateNetwork()
+	if err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	if err := sna.SetNetworkOwner(sn1, "uid1"); err != nil {
+		t.Fatal("Failed to set network owner: ", err)
+	}
+	if err := sna.SetNetworkOwner(sn2, "uid2"); err != nil {
+		t.Fatal("Failed to set network owner: ", err)
+	}
+	if err := sna.SetNetworkOwner("10.1.200.0/24", "uid3"); err == nil {
+		t.Fatal("Unexpectedly set the owner of an unallocated network")
+	}
+	if sn := sna.GetSubnetForNodeUID("uid1"); sn != sn1 {
+		t.Fatalf("Expected %s for uid1, got %q", sn1, sn)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid2"); sn != sn2 {
+		t.Fatalf("Expected %s for uid2, got %q", sn2, sn)
+	}
+
+	// Releasing a subnet forgets its owner, and the owner is not carried over when the
+	// subnet is reused
+	if err := sna.ReleaseNetwork(sn1); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid1"); sn != "" {
+		t.Fatalf("Expected no subnet for uid1 after release, got %s", sn)
+	}
+	if err := sna.MarkAllocatedNetwork(sn1); err != nil {
+		t.Fatal("Failed to mark network allocated: ", err)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid1"); sn != "" {
+		t.Fatalf("Expected no subnet for uid1 after reuse, got %s", sn)
+	}
+
+	// Moving a node to a new subnet replaces its old one
+	if err := sna.SetNetworkOwner(sn1, "uid2"); err != nil {
+		t.Fatal("Failed to set network owner: ", err)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid2"); sn != sn1 {
+		t.Fatalf("Expected %s for uid2, got %q", sn1, sn)
+	}
+	if err := sna.ReleaseNetwork(sn2); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if sn := sna.GetSubnetForNodeUID("uid2"); sn != sn1 {
+		t.Fatalf("Expected %s for uid2 after releasing its old subnet, got %q", sn1, sn)
+	}
+}
+
+func TestRangeForSubnet(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRange("10.128.0.0/14", 9); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.AddNetworkRange("10.132.0.0/16", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, tc := range []struct {
+		subnet   string
+		expected string
+		hostBits uint32
+	}{
+		{"10.128.0.0/23", "10.128.0.0/14", 9},
+		{"10.129.4.0/24", "10.128.0.0/14", 9},
+		{"10.132.1.0/24", "10.132.0.0/16", 8},
+		{"10.132.1.0/22", "10.132.0.0/16", 8},
+		{"10.133.0.0/24", "", 0},
+		{"not-a-cidr", "", 0},
+	} {
+		rng, err := sna.RangeForSubnet(tc.subnet)
+		if tc.expected == "" {
+			if err == nil {
+				t.Fatalf("Unexpectedly found range %s for %s", rng.ClusterCIDR, tc.subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", tc.subnet, err)
+		}
+		if rng.ClusterCIDR.String() != tc.expected || rng.HostSubnetLength != tc.hostBits {
+			t.Fatalf("Expected range %s/%d for %s, got %s/%d", tc.expected, tc.hostBits, tc.subnet, rng.ClusterCIDR, rng.HostSubnetLength)
+		}
+	}
+}
+
+func TestAllocateNetworkFromRange(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRange("10.1.0.0/23", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/23", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	for _, expected := range []string{"10.2.0.0/24", "10.2.1.0/24"} {
+		sn, err := sna.AllocateNetworkFromRange("10.2.0.0/23")
+		if err != nil {
+			t.Fatalf("Unexpected error allocating from range: %v", err)
+		}
+		if sn != expected {
+			t.Fatalf("Expected %s, got %s", expected, sn)
+		}
+	}
+	if sn, err := sna.AllocateNetworkFromRange("10.2.0.0/23"); err != ErrSubnetAllocatorFull {
+		t.Fatalf("Expected ErrSubnetAllocatorFull, got %q, %v", sn, err)
+	}
+	if sn, err := sna.AllocateNetworkFromRange("10.3.0.0/23"); err == nil || err == ErrSubnetAllocatorFull {
+		t.Fatalf("Expected unknown range error, got %q, %v", sn, err)
+	}
+
+	// The other range is untouched
+	if err := allocateExpected(sna, -1, "10.1.0.0/24"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordLockWaits replaces recordLockWait for the duration of the test, and returns a
+// function returning the waits recorded so far
+func recordLockWaits(t *testing.T) func() []time.Duration {
+	var lock sync.Mutex
+	var waits []time.Duration
+	orig := recordLockWait
+	recordLockWait = func(wait time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		waits = append(waits, wait)
+	}
+	t.Cleanup(func() { recordLockWait = orig })
+	return func() []time.Duration {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]time.Duration(nil), waits...)
+	}
+}
+
+func TestSubnetAllocatorLockContentionMetrics(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	waits := recordLockWaits(t)
+
+	// Uncontended calls don't record anything
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	if w := waits(); len(w) != 0 {
+		t.Fatalf("Uncontended allocation recorded waits %v", w)
+	}
+
+	// Hold the lock while another goroutine tries to allocate
+	const holdTime = 50 * time.Millisecond
+	sna.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := sna.AllocateNetwork(); err != nil {
+			t.Error("Failed to allocate network: ", err)
+		}
+	}()
+	time.Sleep(holdTime)
+	sna.Unlock()
+	<-done
+
+	w := waits()
+	if len(w) != 1 {
+		t.Fatalf("Expected 1 recorded wait, got %v", w)
+	}
+	// The goroutine may not have started waiting immediately, so allow some slack
+	if w[0] < holdTime/2 {
+		t.Fatalf("Expected recorded wait of about %v, got %v", holdTime, w[0])
+	}
+}
+
+// notifyingClock is a fake clock that signals nowCalled on each call to Now
+type notifyingClock struct {
+	*testingclock.FakePassiveClock
+	nowCalled chan struct{}
+}
+
+func (c *notifyingClock) Now() time.Time {
+	c.nowCalled <- struct{}{}
+	return c.FakePassiveClock.Now()
+}
+
+func TestSubnetAllocatorLockWaitClock(t *testing.T) {
+	clk := &notifyingClock{
+		FakePassiveClock: testingclock.NewFakePassiveClock(time.Now()),
+		nowCalled:        make(chan struct{}, 1),
+	}
+	sna := NewSubnetAllocator(WithClock(clk))
+	if err := sna.AddNetworkRange("10.1.0.0/16", 8); err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	waits := recordLockWaits(t)
+
+	// Advance the clock by exactly holdTime while another goroutine waits for the lock
+	const holdTime = 3 * time.Second
+	sna.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := sna.AllocateNetwork(); err != nil {
+			t.Error("Failed to allocate network: ", err)
+		}
+	}()
+	<-clk.nowCalled
+	clk.SetTime(clk.FakePassiveClock.Now().Add(holdTime))
+	sna.Unlock()
+	<-done
+
+	if w := waits(); len(w) != 1 || w[0] != holdTime {
+		t.Fatalf("Expected a recorded wait of %v, got %v", holdTime, w)
+	}
+}
+
+func TestImportAllocatedNetworks(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	// Subnet of a different size, as if marked from a stale HostSubnet
+	if err := sna.MarkAllocatedNetwork("10.1.8.0/22"); err != nil {
+		t.Fatal("Failed to mark network allocated: ", err)
+	}
+
+	input := `# allocated subnets
+10.1.0.0/24
+  10.1.1.0/24
+
+10.1.0.0/24
+10.1.9.0/24
+10.2.0.0/24
+10.1.2.0/23
+10.1.3.1/24
+not-a-cidr
+`
+	result, err := sna.ImportAllocatedNetworks(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(result.Marked, []string{"10.1.0.0/24", "10.1.1.0/24"}) {
+		t.Fatalf("Unexpected marked subnets %v", result.Marked)
+	}
+	if !reflect.DeepEqual(result.Duplicate, []string{"10.1.0.0/24"}) {
+		t.Fatalf("Unexpected duplicate subnets %v", result.Duplicate)
+	}
+	if !reflect.DeepEqual(result.Overlap, []string{"10.1.9.0/24"}) {
+		t.Fatalf("Unexpected overlapping subnets %v", result.Overlap)
+	}
+	if !reflect.DeepEqual(result.OutOfRange, []string{"10.2.0.0/24"}) {
+		t.Fatalf("Unexpected out-of-range subnets %v", result.OutOfRange)
+	}
+	if len(result.Invalid) != 3 {
+		t.Fatalf("Expected 3 invalid lines, got %v", result.Invalid)
+	}
+	for i, lineNum := range []string{"line 8:", "line 9:", "line 10:"} {
+		if !strings.HasPrefix(result.Invalid[i].Error(), lineNum) {
+			t.Fatalf("Expected error for %s, got %v", lineNum, result.Invalid[i])
+		}
+	}
+
+	// Imported subnets are really allocated
+	if err := allocateExpected(sna, -1, "10.1.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	// (The /22 counts as the 4 /24s it covers)
+	if allocated := sna.Stats().Allocated; allocated != 7 {
+		t.Fatalf("Expected 7 allocated subnets, got %d", allocated)
+	}
+}
+
+func TestRangePriority(t *testing.T) {
+	sna := NewSubnetAllocator()
+	for _, network := range []string{"10.1.0.0/23", "10.2.0.0/23", "10.3.0.0/23"} {
+		if err := sna.AddNetworkRange(network, 8); err != nil {
+			t.Fatal("Failed to initialize subnet allocator: ", err)
+		}
+	}
+	if err := sna.SetRangePriority("10.3.0.0/23", 10); err != nil {
+		t.Fatal("Failed to set range priority: ", err)
+	}
+	if err := sna.SetRangePriority("10.2.0.0/23", 5); err != nil {
+		t.Fatal("Failed to set range priority: ", err)
+	}
+	if err := sna.SetRangePriority("10.4.0.0/23", 5); err == nil {
+		t.Fatal("Unexpectedly succeeded setting priority of unknown range")
+	}
+
+	// Ranges are drained in priority order, not the order they were added
+	for i, expected := range []string{"10.3.0.0/24", "10.3.1.0/24", "10.2.0.0/24", "10.2.1.0/24", "10.1.0.0/24", "10.1.1.0/24"} {
+		if err := allocateExpected(sna, i, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// A released subnet in a high-priority range is reused first
+	if err := sna.ReleaseNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := sna.ReleaseNetwork("10.3.1.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := allocateExpected(sna, -1, "10.3.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stats still report ranges in the order they were added
+	stats := sna.Stats()
+	if stats.Ranges[0].Network != "10.1.0.0/23" || stats.Ranges[2].Network != "10.3.0.0/23" {
+		t.Fatalf("Unexpected range order in stats %+v", stats.Ranges)
+	}
+}
+
+func TestAllocateNetworkWithLength(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/20", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+
+	// Wide subnets come from the end of the range
+	for _, tc := range []struct {
+		hostBits uint32
+		expected string
+	}{
+		{10, "10.1.12.0/22"},
+		{9, "10.1.10.0/23"},
+		{8, "10.1.0.0/24"},
+		{10, "10.1.4.0/22"},
+	} {
+		sn, err := sna.AllocateNetworkWithLength(tc.hostBits)
+		if err != nil {
+			t.Fatalf("Failed to allocate /%d: %v", 32-tc.hostBits, err)
+		}
+		if sn != tc.expected {
+			t.Fatalf("Expected %s, got %s", tc.expected, sn)
+		}
+	}
+
+	// Normal allocations skip the space used by wide subnets
+	for i, expected := range []string{"10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24", "10.1.8.0/24", "10.1.9.0/24"} {
+		if err := allocateExpected(sna, i, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := allocateNotExpected(sna, 5); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sna.Stats(); stats.Allocated != 16 || stats.Free != 0 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// Out-of-bounds lengths are rejected
+	for _, hostBits := range []uint32{7, 13} {
+		if _, err := sna.AllocateNetworkWithLength(hostBits); err == nil || err == ErrSubnetAllocatorFull {
+			t.Fatalf("Expected bounds error allocating %d host bits, got %v", hostBits, err)
+		}
+	}
+	if _, err := sna.AllocateNetworkWithLength(9); err != ErrSubnetAllocatorFull {
+		t.Fatalf("Expected full allocator, got %v", err)
+	}
+
+	// Released wide subnets can be reused, either whole or by normal allocations
+	if err := sna.ReleaseNetwork("10.1.4.0/22"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := sna.ReleaseNetwork("10.1.10.0/23"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if sn, err := sna.AllocateNetworkWithLength(10); err != nil || sn != "10.1.4.0/22" {
+		t.Fatalf("Expected 10.1.4.0/22, got %s, %v", sn, err)
+	}
+	if err := allocateExpected(sna, -1, "10.1.10.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Marking a wide subnet allocated blocks the subnets it covers
+	sna, err = newSubnetAllocator("10.1.0.0/22", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/23"); err != nil {
+		t.Fatal("Failed to mark network allocated: ", err)
+	}
+	if err := allocateExpected(sna, -1, "10.1.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAgainstHostSubnets(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for _, subnet := range []string{"10.1.0.0/24", "10.1.1.0/24", "10.1.4.0/24", "10.1.8.0/22"} {
+		if err := sna.MarkAllocatedNetwork(subnet); err != nil {
+			t.Fatal("Failed to mark network allocated: ", err)
+		}
+	}
+
+	makeHostSubnet := func(name, subnet string) *osdnv1.HostSubnet {
+		return &osdnv1.HostSubnet{ObjectMeta: metav1.ObjectMeta{Name: name}, Subnet: subnet}
+	}
+	matching := []*osdnv1.HostSubnet{
+		makeHostSubnet("node0", "10.1.0.0/24"),
+		makeHostSubnet("node1", "10.1.1.0/24"),
+		makeHostSubnet("node4", "10.1.4.0/24"),
+		makeHostSubnet("wide", "10.1.8.0/22"),
+		makeHostSubnet("foreign", "10.2.0.0/24"),
+		makeHostSubnet("assign", ""),
+	}
+	if diff := sna.VerifyAgainstHostSubnets(matching); !diff.Empty() {
+		t.Fatalf("Unexpected differences %+v", diff)
+	}
+
+	diff := sna.VerifyAgainstHostSubnets([]*osdnv1.HostSubnet{
+		makeHostSubnet("node0", "10.1.0.0/24"),
+		makeHostSubnet("node2", "10.1.2.0/24"),
+		makeHostSubnet("node4", "10.1.4.0/23"),
+		makeHostSubnet("node9", "10.1.9.0/24"),
+		makeHostSubnet("foreign", "10.2.0.0/24"),
+	})
+	expected := &AllocatorDiff{
+		MissingFromAPI: []string{"10.1.1.0/24"},
+		NotAllocated:   []UnallocatedHostSubnet{{HostSubnet: "node2", Subnet: "10.1.2.0/24"}},
+		Mismatched: []SubnetMismatch{
+			{HostSubnet: "node4", Subnet: "10.1.4.0/23", Allocated: "10.1.4.0/24"},
+			{HostSubnet: "node9", Subnet: "10.1.9.0/24", Allocated: "10.1.8.0/22"},
+		},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, diff)
+	}
+}
+
+func TestFindReusableSubnet(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/21", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	if sn, ok := sna.FindReusableSubnet(); ok {
+		t.Fatalf("Unexpected reusable subnet %s", sn)
+	}
+	for i := 0; i < 6; i++ {
+		if err := allocateExpected(sna, i, fmt.Sprintf("10.1.%d.0/24", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Freed subnets are reused, lowest first, before the range grows
+	for _, subnet := range []string{"10.1.4.0/24", "10.1.2.0/24"} {
+		if err := sna.ReleaseNetwork(subnet); err != nil {
+			t.Fatal("Failed to release network: ", err)
+		}
+	}
+	if sn, ok := sna.FindReusableSubnet(); !ok || sn != "10.1.2.0/24" {
+		t.Fatalf("Expected reusable subnet 10.1.2.0/24, got %q", sn)
+	}
+	for i, expected := range []string{"10.1.2.0/24", "10.1.4.0/24", "10.1.6.0/24", "10.1.7.0/24"} {
+		if err := allocateExpected(sna, i, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sn, ok := sna.FindReusableSubnet(); ok {
+		t.Fatalf("Unexpected reusable subnet %s", sn)
+	}
+	if sn, err := sna.AllocateNetwork(); err != ErrSubnetAllocatorFull {
+		t.Fatalf("Expected range to be full, got %q / %v", sn, err)
+	}
+
+	// A single released subnet is handed straight back out
+	if err := sna.ReleaseNetwork("10.1.3.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := allocateExpected(sna, 0, "10.1.3.0/24"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateNetworkReusesReleasedSubnet(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := allocateExpected(sna, i, fmt.Sprintf("10.1.%d.0/24", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sna.ReleaseNetwork("10.1.1.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	if err := allocateExpected(sna, 3, "10.1.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if err := allocateExpected(sna, 4, "10.1.3.0/24"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	sna, err := newSubnetAllocator("10.1.0.0/16", 8)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	gen := sna.Stats().Generation
+	checkGeneration := func(desc string, changed bool) {
+		t.Helper()
+		newGen := sna.Stats().Generation
+		if changed && newGen != gen+1 {
+			t.Fatalf("%s: expected generation %d, got %d", desc, gen+1, newGen)
+		} else if !changed && newGen != gen {
+			t.Fatalf("%s: expected generation to stay %d, got %d", desc, gen, newGen)
+		}
+		gen = newGen
+	}
+
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	checkGeneration("AllocateNetwork", true)
+	if err := sna.MarkAllocatedNetwork("10.1.5.0/24"); err != nil {
+		t.Fatal("Failed to mark network: ", err)
+	}
+	checkGeneration("MarkAllocatedNetwork", true)
+	if _, err := sna.AllocateNetworkPreferring("10.1.7.0/24"); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	checkGeneration("AllocateNetworkPreferring", true)
+	if err := sna.ReleaseNetwork("10.1.5.0/24"); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+	checkGeneration("ReleaseNetwork", true)
+
+	// Failures and read-only operations don't change the generation
+	if err := sna.ReleaseNetwork("10.2.0.0/24"); err == nil {
+		t.Fatal("Unexpectedly released network outside of range")
+	}
+	checkGeneration("failed ReleaseNetwork", false)
+	if err := sna.MarkAllocatedNetwork("10.2.0.0/24"); err == nil {
+		t.Fatal("Unexpectedly marked network outside of range")
+	}
+	checkGeneration("failed MarkAllocatedNetwork", false)
+	sna.SimulateAllocations(3)
+	checkGeneration("SimulateAllocations", false)
+	sna.FindReusableSubnet()
+	checkGeneration("FindReusableSubnet", false)
+
+	// A plan computed at one generation is stale once the allocator changes
+	planGen := sna.Stats().Generation
+	plan, _ := sna.SimulateAllocations(1)
+	if _, err := sna.AllocateNetwork(); err != nil {
+		t.Fatal("Failed to allocate network: ", err)
+	}
+	if sna.Stats().Generation == planGen {
+		t.Fatalf("Expected plan %v to be detected as stale", plan)
+	}
+}
+
+func TestEnumerateRangeSubnets(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rangeStr string
+		hostBits uint32
+		limit    int
+		expected []string
+		err      string
+	}{
+		{
+			name:     "small IPv4 range",
+			rangeStr: "10.1.0.0/22",
+			hostBits: 8,
+			limit:    10,
+			expected: []string{"10.1.0.0/24", "10.1.1.0/24", "10.1.2.0/24", "10.1.3.0/24"},
+		},
+		{
+			name:     "IPv4 range in rotated order",
+			rangeStr: "10.1.0.0/23",
+			hostBits: 7,
+			limit:    10,
+			expected: []string{"10.1.0.0/25", "10.1.1.0/25", "10.1.0.128/25", "10.1.1.128/25"},
+		},
+		{
+			name:     "limited IPv4 range",
+			rangeStr: "10.128.0.0/14",
+			hostBits: 9,
+			limit:    2,
+			expected: []string{"10.128.0.0/23", "10.129.0.0/23"},
+		},
+		{
+			name:     "limited IPv6 range",
+			rangeStr: "fd01::/48",
+			hostBits: 64,
+			limit:    3,
+			expected: []string{"fd01:0:0:1::/64", "fd01:0:0:2::/64", "fd01:0:0:3::/64"},
+		},
+		{
+			name:     "invalid limit",
+			rangeStr: "10.1.0.0/22",
+			hostBits: 8,
+			err:      "limit must be positive",
+		},
+		{
+			name:     "invalid host bits",
+			rangeStr: "10.1.0.0/22",
+			hostBits: 12,
+			limit:    10,
+			err:      "too large",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subnets, err := EnumerateRangeSubnets(tc.rangeStr, tc.hostBits, tc.limit)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error matching %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(subnets, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, subnets)
+			}
+		})
+	}
+
+	// Enumeration matches allocation order
+	subnets, err := EnumerateRangeSubnets("10.1.0.0/23", 7, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sna, err := newSubnetAllocator("10.1.0.0/23", 7)
+	if err != nil {
+		t.Fatal("Failed to initialize subnet allocator: ", err)
+	}
+	for n, expected := range subnets {
+		if err := allocateExpected(sna, n, expected); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	sna := NewSubnetAllocator()
+	if err := sna.AddNetworkRangeWithOffset("10.1.0.0/16", 8, 2); err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+	if err := sna.AddNetworkRange("10.2.0.0/16", 8); err != nil {
+		t.Fatal("Failed to add network range: ", err)
+	}
+	if err := sna.SetRangePriority("10.2.0.0/16", 1); err != nil {
+		t.Fatal("Failed to set range priority: ", err)
+	}
+	var subnets []string
+	for i := 0; i < 4; i++ {
+		sn, err := sna.AllocateNetwork()
+		if err != nil {
+			t.Fatal("Failed to allocate network: ", err)
+		}
+		subnets = append(subnets, sn)
+	}
+	wide, err := sna.AllocateNetworkWithLength(10)
+	if err != nil {
+		t.Fatal("Failed to allocate wide network: ", err)
+	}
+	if err := sna.MarkAllocatedNetwork("10.1.0.0/24"); err != nil {
+		t.Fatal("Failed to mark network: ", err)
+	}
+	if err := sna.SetNetworkOwner(subnets[0], "uid0"); err != nil {
+		t.Fatal("Failed to set network owner: ", err)
+	}
+	if err := sna.SetNetworkOwner(wide, "uid-wide"); err != nil {
+		t.Fatal("Failed to set network owner: ", err)
+	}
+	if err := sna.ReleaseNetwork(subnets[1]); err != nil {
+		t.Fatal("Failed to release network: ", err)
+	}
+
+	state := sna.ExportState()
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal("Failed to marshal state: ", err)
+	}
+	var decoded SubnetAllocatorState
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal("Failed to unmarshal state: ", err)
+	}
+
+	imported := NewSubnetAllocator()
+	if err := imported.ImportState(&decoded); err != nil {
+		t.Fatal("Failed to import state: ", err)
+	}
+	if !reflect.DeepEqual(imported.ExportState(), state) {
+		t.Fatalf("Imported state differs:\nexpected %#v\ngot %#v", state, imported.ExportState())
+	}
+	if !reflect.DeepEqual(imported.Stats(), sna.Stats()) {
+		t.Fatalf("Imported stats differ:\nexpected %#v\ngot %#v", sna.Stats(), imported.Stats())
+	}
+	for _, uid := range []string{"uid0", "uid1", "uid-wide"} {
+		if a, b := sna.GetSubnetForNodeUID(uid), imported.GetSubnetForNodeUID(uid); a != b {
+			t.Fatalf("Subnet for %s differs: expected %q, got %q", uid, a, b)
+		}
+	}
+
+	// Both allocators make the same allocations from here on, starting with the
+	// released subnet
+	for i := 0; i < 10; i++ {
+		a, errA := sna.AllocateNetwork()
+		b, errB := imported.AllocateNetwork()
+		if a != b || (errA == nil) != (errB == nil) {
+			t.Fatalf("Allocation %d differs: expected %q (%v), got %q (%v)", i, a, errA, b, errB)
+		}
+		if i == 0 && a != subnets[1] {
+			t.Fatalf("Expected released subnet %s to be reused, got %s", subnets[1], a)
+		}
+	}
+	for _, sn := range []string{"10.1.1.0/24", "10.1.0.0/24", wide} {
+		if a, b := sna.ReleaseNetwork(sn), imported.ReleaseNetwork(sn); (a == nil) != (b == nil) {
+			t.Fatalf("Release of %s differs: expected %v, got %v", sn, a, b)
+		}
+	}
+	if !reflect.DeepEqual(imported.ExportState(), sna.ExportState()) {
+		t.Fatalf("States diverged:\nexpected %#v\ngot %#v", sna.ExportState(), imported.ExportState())
+	}
+
+	// Invalid states are rejected without changing the allocator
+	for _, bad := range []*SubnetAllocatorState{
+		{Ranges: []SubnetAllocatorRangeState{{Network: "10.3.0.0/16", HostBits: 8, Allocated: []string{"10.4.0.0/24"}}}},
+		{Ranges: []SubnetAllocatorRangeState{{Network: "10.3.0.0/16", HostBits: 8, Allocated: []string{"10.3.0.1/24"}}}},
+		{Ranges: []SubnetAllocatorRangeState{{Network: "10.3.0.0/16", HostBits: 8, Offset: 256}}},
+		{Ranges: []SubnetAllocatorRangeState{{Network: "10.3.0.0/16", HostBits: 8}}, Owners: map[string]string{"10.3.0.0/24": "uid"}},
+	} {
+		if err := imported.ImportState(bad); err == nil {
+			t.Fatalf("Unexpectedly imported invalid state %#v", bad)
+		}
+	}
+	if !reflect.DeepEqual(imported.ExportState(), sna.ExportState()) {
+		t.Fatalf("Failed import changed the allocator's state")
+	}
+}
@@ -296,6 +296,24 @@ func (node *OsdnNode) validateMTU() error {
 	return nil
 }
 
+// checkLocalSubnetAgainstHostNetworks warns if the node's HostSubnet overlaps the network
+// of one of its interfaces
+func (node *OsdnNode) checkLocalSubnetAgainstHostNetworks() {
+	hostIPNets, _, err := common.GetHostIPNetworks([]string{Tun0})
+	if err != nil {
+		klog.Warningf("Could not check local subnet against host networks: %v", err)
+		return
+	}
+	overlaps, err := common.HostSubnetHostNetworkOverlaps(node.localSubnetCIDR, hostIPNets)
+	if err != nil {
+		klog.Warningf("Could not check local subnet against host networks: %v", err)
+		return
+	}
+	for _, ipNet := range overlaps {
+		klog.Warningf("Local subnet %s overlaps host network %s; local routing will not work correctly", node.localSubnetCIDR, ipNet.String())
+	}
+}
+
 func (node *OsdnNode) Start() error {
 	klog.V(2).Infof("Starting openshift-sdn network plugin")
 
@@ -304,6 +322,7 @@ func (node *OsdnNode) Start() error {
 	if err != nil {
 		return err
 	}
+	node.checkLocalSubnetAgainstHostNetworks()
 
 	for _, cn := range node.networkInfo.ClusterNetworks {
 		node.clusterCIDRs = append(node.clusterCIDRs, cn.ClusterCIDR.String())